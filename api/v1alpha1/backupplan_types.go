@@ -24,6 +24,16 @@ import (
 
 const BackupPlanKind = "BackupPlan"
 
+const (
+	// DestinationReadyCondition is true if the preflight check of the current
+	// configuration of the plan found all destinations ready to store backups
+	DestinationReadyCondition = "DestinationReady"
+
+	PreflightPendingReason   = "PreflightPending"
+	PreflightSucceededReason = "PreflightSucceeded"
+	PreflightFailedReason    = "PreflightFailed"
+)
+
 // BackupPlanSpec defines the desired state of BackupPlan
 type BackupPlanSpec struct {
 	// Schedule in cron format
@@ -34,13 +44,23 @@ type BackupPlanSpec struct {
 	ActiveDeadlineSeconds int64 `json:"activeDeadlineSeconds"`
 
 	// +kubebuilder:validation:Minimum=1
-	// Number of backups to keep
-	Retention int64 `json:"retention"`
+	// +optional
+	// Number of backups to keep. Ignored if retentionPolicy is set, one of
+	// both is required.
+	Retention int64 `json:"retention,omitempty"`
+
+	// +optional
+	// Policy deciding which backups are kept, requires a keep rule or maxAge
+	RetentionPolicy *RetentionPolicy `json:"retentionPolicy,omitempty"`
 
 	// +optional
 	// Environments for the CronJob
 	Env []corev1.EnvVar `json:"env,omitempty"`
 
+	// +optional
+	// Service account the worker runs as, e.g. to authenticate with IRSA
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
 	// +optional
 	// Setup for metrics
 	Pushgateway *Pushgateway `json:"pushgateway,omitempty"`
@@ -50,6 +70,29 @@ type BackupPlanSpec struct {
 	// will be tried.
 	Destination *Destination `json:"destination,omitempty"`
 
+	// +optional
+	// Destinations the backup is copied to in addition to destination. The
+	// backup is only created once and streamed to all destinations at once.
+	Destinations []Destination `json:"destinations,omitempty"`
+
+	// +optional
+	// Compress backups before they are streamed to the destinations. If unset
+	// the backup is stored as created by the tool, e.g. mongodump with gzip.
+	Compression *Compression `json:"compression,omitempty"`
+
+	// +optional
+	// Encrypt backups before they are streamed to the destinations
+	Encryption *Encryption `json:"encryption,omitempty"`
+
+	// +optional
+	// Restore tests of the latest backup
+	Verification *Verification `json:"verification,omitempty"`
+
+	// +optional
+	// Labels added to the metadata and manifest of every backup. Keys must be
+	// valid HTTP header names and are lower cased by S3.
+	Labels map[string]string `json:"labels,omitempty"`
+
 	// +optional
 	// Volumes to  bind to the pod
 	Volumes []corev1.Volume `json:"volumes,omitempty"`
@@ -59,10 +102,36 @@ type BackupPlanSpec struct {
 	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
 }
 
+// GetDestinations returns destination followed by all destinations
+func (s *BackupPlanSpec) GetDestinations() []Destination {
+	var dsts []Destination
+	if s.Destination != nil {
+		dsts = append(dsts, *s.Destination)
+	}
+	return append(dsts, s.Destinations...)
+}
+
 // BackupPlanStatus defines the observed state of BackupPlan
 type BackupPlanStatus struct {
 	CronJob *corev1.ObjectReference `json:"cronJob,omitempty"`
 	Secret  *corev1.ObjectReference `json:"secret,omitempty"`
+	// +optional
+	Verification *VerificationStatus `json:"verification,omitempty"`
+	// +optional
+	Preflight *PreflightStatus `json:"preflight,omitempty"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PreflightStatus references the latest Job checking the destinations
+type PreflightStatus struct {
+	// +optional
+	Job *corev1.ObjectReference `json:"job,omitempty"`
+	// +optional
+	// Hash of the configuration of the worker the Job checked
+	ConfigHash string `json:"configHash,omitempty"`
 }
 
 // +kubebuilder:object:generate:=false
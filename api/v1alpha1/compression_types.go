@@ -0,0 +1,33 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Compression configures compression of backups before they are encrypted and
+// stored
+type Compression struct {
+	// +kubebuilder:validation:Enum=none;gzip;zstd;lz4
+	// Codec used to compress backups
+	Codec string `json:"codec"`
+	// +optional
+	// Level of the codec, the default level of the codec is used if unset.
+	// Ranges from 1 to 9 for gzip and lz4 and from 1 to 22 for zstd.
+	Level int `json:"level,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// Number of blocks compressed in parallel
+	Concurrency int `json:"concurrency,omitempty"`
+}
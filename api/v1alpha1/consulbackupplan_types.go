@@ -78,7 +78,12 @@ func (p *ConsulBackupPlan) GetCmd() string {
 }
 
 func (p *ConsulBackupPlan) GetSecretData() ([]byte, error) {
+	// The kind lets the worker choose the source
 	reduced := ConsulBackupPlan{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       ConsulBackupPlanKind,
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: p.Namespace,
 			Name:      p.Name,
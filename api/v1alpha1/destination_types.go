@@ -16,10 +16,64 @@ limitations under the License.
 
 package v1alpha1
 
+import (
+	"path"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VolumeDestinationMountPath is the directory the volumes of volume
+// destinations are mounted to in the worker
+const VolumeDestinationMountPath = "/var/backup"
+
+// TLSMountPath is the directory Secrets and ConfigMaps referenced by the TLS
+// options of destinations are mounted to in the worker
+const TLSMountPath = "/etc/backup/tls"
+
+// SpoolMountPath is the directory the emptyDir volume, uploads of S3
+// destinations with upload retries are spooled to, is mounted to in the worker
+const SpoolMountPath = "/var/spool/backup"
+
+// Destination configures where backups are stored. Exactly one of s3, sftp,
+// volume and plugin has to be set, destinations with several are rejected by
+// the preflight of the worker.
 type Destination struct {
+	// +optional
+	// Name of the destination used in logs and metrics
+	Name string `json:"name,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	// Number of backups to keep in this destination. Defaults to the
+	// retention of the plan. Ignored if retentionPolicy is set.
+	Retention *int64 `json:"retention,omitempty"`
+
+	// +optional
+	// Policy deciding which backups are kept in this destination. Defaults to
+	// the retention policy of the plan.
+	RetentionPolicy *RetentionPolicy `json:"retentionPolicy,omitempty"`
+
+	// +optional
+	// Failures of optional destinations are reported, but do not fail the
+	// backup as long as another destination succeeded.
+	Optional bool `json:"optional,omitempty"`
+
 	// +optional
 	// Configuration for S3 as backup target
 	S3 *S3 `json:"s3,omitempty"`
+
+	// +optional
+	// Configuration for SFTP as backup target
+	SFTP *SFTP `json:"sftp,omitempty"`
+
+	// +optional
+	// Configuration for a PersistentVolumeClaim as backup target
+	Volume *Volume `json:"volume,omitempty"`
+
+	// +optional
+	// Configuration for a destination type provided by a plugin
+	Plugin *Plugin `json:"plugin,omitempty"`
 }
 
 type S3 struct {
@@ -28,15 +82,199 @@ type S3 struct {
 	// +optional
 	Bucket string `json:"bucket,omitempty"`
 	// +optional
+	// Create the bucket if it does not exist. Otherwise a missing bucket is
+	// reported by the preflight check of the destinations.
+	CreateBucket bool `json:"createBucket,omitempty"`
+	// +optional
 	UseSSL bool `json:"useSSL,omitempty"`
 	// +optional
 	AccessKeyID string `json:"accessKeyID,omitempty"`
 	// +optional
 	SecretAccessKey string `json:"secretAccessKey,omitempty"`
 	// +optional
+	// Region of the bucket, defaults to us-east-1
+	Region string `json:"region,omitempty"`
+	// +optional
+	// Authenticate with the default AWS credential chain instead of
+	// accessKeyID and secretAccessKey: environment, web identity token (e.g.
+	// IRSA with serviceAccountName of the plan), shared config and EC2/ECS
+	// metadata
+	CredentialChain bool `json:"credentialChain,omitempty"`
+	// +optional
+	// ARN of a role assumed with the credentials
+	RoleARN string `json:"roleARN,omitempty"`
+	// +optional
+	// External ID passed when assuming the role
+	ExternalID string `json:"externalID,omitempty"`
+	// +optional
+	// Skip the verification of the certificate of the endpoint. Prefer
+	// caBundle for endpoints with a private CA.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// +optional
+	// PEM encoded CA certificates trusted in addition to the system roots
+	CABundle string `json:"caBundle,omitempty"`
+	// +optional
+	// Key of a Secret or ConfigMap with PEM encoded CA certificates trusted
+	// in addition to the system roots and caBundle
+	CABundleRef *KeyRef `json:"caBundleRef,omitempty"`
+	// +optional
+	// Name of a Secret of type kubernetes.io/tls in the namespace of the plan
+	// with the client certificate and key used for mutual TLS
+	ClientCertificateSecret string `json:"clientCertificateSecret,omitempty"`
+	// +optional
+	// Name the certificate of the endpoint is verified against. Defaults to
+	// the host of the endpoint.
+	ServerName string `json:"serverName,omitempty"`
+	// +optional
 	EncryptionKey string `json:"encryptionKey,omitempty"`
 	// +optional
 	EncryptionAlgorithm string `json:"encryptionAlgorithm,omitempty"`
 	// +optional
 	PartSize int64 `json:"partSize,omitempty"`
+	// +optional
+	// Go template of the prefix backups are stored below. The namespace and
+	// name of the plan are available as .Namespace and .Name. Defaults to
+	// "{{ .Namespace }}/{{ .Name }}/".
+	PrefixTemplate string `json:"prefixTemplate,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Enum=v1;v2
+	// Layout of the objects below the prefix. In v1 backups are stored
+	// directly below the prefix, in v2 every run is stored in a directory of
+	// its own. Defaults to v1, existing backups can be migrated with the
+	// migrate-layout command of the worker after switching to v2.
+	Layout string `json:"layout,omitempty"`
+	// +optional
+	// Lock stored backups against deletion and modification. The bucket must
+	// have object lock enabled.
+	ObjectLock *ObjectLock `json:"objectLock,omitempty"`
+	// +optional
+	// Storage class of stored backups, e.g. STANDARD_IA or GLACIER_IR
+	StorageClass string `json:"storageClass,omitempty"`
+	// +optional
+	// Tags of stored backups in addition to the tags
+	// backup.finleap.cloud/namespace, backup.finleap.cloud/plan and
+	// backup.finleap.cloud/source, e.g. for lifecycle rules and cost allocation
+	Tags map[string]string `json:"tags,omitempty"`
+	// +optional
+	// User metadata of stored backups
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Enum=AES256;"aws:kms"
+	// Server side encryption with keys managed by S3 (AES256) or KMS
+	// (aws:kms). Cannot be combined with encryptionKey.
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+	// +optional
+	// ID or ARN of the KMS key used for aws:kms, defaults to the AWS managed key
+	KMSKeyID string `json:"kmsKeyID,omitempty"`
+	// +optional
+	// Retries of failed requests and uploads with exponential backoff
+	Retry *S3Retry `json:"retry,omitempty"`
+}
+
+// S3Retry configures retries of failed requests and uploads. The delay before
+// a retry doubles with every retry up to maxDelay, a random jitter of up to
+// half of it spreads the retries of concurrent uploads.
+type S3Retry struct {
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Retries of every request, e.g. the upload of a part. Defaults to 3.
+	PartRetries *int `json:"partRetries,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Retries of whole uploads. Backups are spooled to a temporary file in the
+	// worker first, so failed uploads continue after the last completed part
+	// instead of repeating the backup. The worker needs ephemeral storage for
+	// the largest backup.
+	UploadRetries int `json:"uploadRetries,omitempty"`
+	// +optional
+	// Size limit of the emptyDir volume backups are spooled to, which should
+	// fit the largest backup. Unlimited by default.
+	SpoolSizeLimit *resource.Quantity `json:"spoolSizeLimit,omitempty"`
+	// +optional
+	// Delay before the first retry. Defaults to 100ms.
+	MinDelay *metav1.Duration `json:"minDelay,omitempty"`
+	// +optional
+	// Upper bound of the delay before a retry. Defaults to 30s.
+	MaxDelay *metav1.Duration `json:"maxDelay,omitempty"`
+}
+
+type ObjectLock struct {
+	// +optional
+	// +kubebuilder:validation:Enum=GOVERNANCE;COMPLIANCE
+	// Retention mode of stored backups
+	Mode string `json:"mode,omitempty"`
+	// +optional
+	// Duration backups are retained after they are stored. Defaults to the
+	// duration the retention policy keeps backups at least, i.e. its minAge or
+	// the period of its finest rule, e.g. 7 days for keepDaily 7.
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// +optional
+	// Place a legal hold on stored backups, which has to be removed manually
+	LegalHold bool `json:"legalHold,omitempty"`
+}
+
+// KeyRef references a key of a Secret or a ConfigMap in the namespace of the
+// plan
+type KeyRef struct {
+	// +optional
+	// Name of the Secret
+	SecretName string `json:"secretName,omitempty"`
+	// +optional
+	// Name of the ConfigMap, if secretName is not set
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// Key within the Secret or ConfigMap
+	Key string `json:"key"`
+}
+
+// MountPath returns the directory the Secret or ConfigMap is mounted to in the
+// worker
+func (r *KeyRef) MountPath() string {
+	if r.SecretName != "" {
+		return SecretMountPath(r.SecretName)
+	}
+	return path.Join(TLSMountPath, "configmap", r.ConfigMapName)
+}
+
+// Path returns the path of the key in the worker
+func (r *KeyRef) Path() string {
+	return path.Join(r.MountPath(), r.Key)
+}
+
+// SecretMountPath returns the directory the Secret is mounted to in the worker
+func SecretMountPath(name string) string {
+	return path.Join(TLSMountPath, "secret", name)
+}
+
+type SFTP struct {
+	// Address of the SFTP server as host:port
+	Host string `json:"host"`
+	// +optional
+	User string `json:"user,omitempty"`
+	// +optional
+	// PEM encoded private key used for authentication. Falls back to the
+	// environment variable SFTP_PRIVATE_KEY, which should be populated from
+	// a Secret.
+	PrivateKey string `json:"privateKey,omitempty"`
+	// +optional
+	// Pinned host key(s) of the server in authorized_keys format. Falls back
+	// to the environment variable SFTP_HOST_KEY.
+	HostKey string `json:"hostKey,omitempty"`
+	// +optional
+	// Remote directory to store the backups in. Each plan uses the
+	// sub-directory <namespace>/<name>.
+	Directory string `json:"directory,omitempty"`
+}
+
+type Volume struct {
+	// Name of the PersistentVolumeClaim in the namespace of the plan
+	ClaimName string `json:"claimName"`
+	// +optional
+	// Directory within the volume to store the backups in. Each plan uses the
+	// sub-directory <namespace>/<name>.
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// MountPath returns the path the claim is mounted to in the worker
+func (v *Volume) MountPath() string {
+	return path.Join(VolumeDestinationMountPath, v.ClaimName)
 }
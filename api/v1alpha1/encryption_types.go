@@ -0,0 +1,48 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Encryption configures client-side encryption of backups with AES-256-GCM
+type Encryption struct {
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=255
+	// ID of the key. It is recorded with every backup to select the matching
+	// key on restore, which allows to rotate keys.
+	KeyID string `json:"keyID"`
+	// +optional
+	// Base64 encoded 256 bit key. Falls back to the environment variable
+	// BACKUP_ENCRYPTION_KEY, which should be populated from a Secret.
+	Key string `json:"key,omitempty"`
+	// +optional
+	// Keys backups were encrypted with before the key was rotated. They are
+	// only used to decrypt backups on restore and verification.
+	PreviousKeys []DecryptionKey `json:"previousKeys,omitempty"`
+}
+
+// DecryptionKey is a previous key, which is only used for decryption
+type DecryptionKey struct {
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=255
+	// ID of the key as recorded with the backups encrypted with it
+	KeyID string `json:"keyID"`
+	// +optional
+	// Base64 encoded 256 bit key. Falls back to the environment variable
+	// BACKUP_DECRYPTION_KEY_<KEYID>, the ID in upper case with all characters
+	// except letters and digits replaced by underscores, which should be
+	// populated from a Secret.
+	Key string `json:"key,omitempty"`
+}
@@ -70,7 +70,12 @@ func (p *MongoDBBackupPlan) GetCmd() string {
 }
 
 func (p *MongoDBBackupPlan) GetSecretData() ([]byte, error) {
+	// The kind lets the worker choose the source
 	reduced := MongoDBBackupPlan{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       MongoDBBackupPlanKind,
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: p.Namespace,
 			Name:      p.Name,
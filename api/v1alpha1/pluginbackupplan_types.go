@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const PluginBackupPlanKind = "PluginBackupPlan"
+const PluginBackupPlanWorkerCommand = "plugin"
+
+// PluginMountPath is the directory the worker discovers plugin binaries in.
+// Plugins are provided with the volumes and volumeMounts of the plan.
+const PluginMountPath = "/etc/backup/plugins"
+
+// Plugin selects a source or destination type provided by a plugin
+type Plugin struct {
+	// Name of the plugin binary in the plugin directory of the worker
+	Name string `json:"name"`
+
+	// +optional
+	// Type provided by the plugin. Defaults to the only source or
+	// destination type of the plugin.
+	Type string `json:"type,omitempty"`
+
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// Configuration passed to the plugin as is
+	Config *runtime.RawExtension `json:"config,omitempty"`
+}
+
+// PluginBackupPlanSpec defines the desired state of PluginBackupPlan
+type PluginBackupPlanSpec struct {
+	BackupPlanSpec `json:",inline"`
+
+	// Source type of a plugin creating the backups
+	Plugin Plugin `json:"plugin"`
+}
+
+// +kubebuilder:object:root=true
+
+// PluginBackupPlan is the Schema for the pluginbackupplans API
+type PluginBackupPlan struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PluginBackupPlanSpec `json:"spec,omitempty"`
+	Status BackupPlanStatus     `json:"status,omitempty"`
+}
+
+func (p *PluginBackupPlan) GetTypeMeta() *metav1.TypeMeta {
+	return &p.TypeMeta
+}
+
+func (p *PluginBackupPlan) GetObjectMeta() *metav1.ObjectMeta {
+	return &p.ObjectMeta
+}
+
+func (p *PluginBackupPlan) GetSpec() *BackupPlanSpec {
+	return &p.Spec.BackupPlanSpec
+}
+
+func (p *PluginBackupPlan) GetStatus() *BackupPlanStatus {
+	return &p.Status
+}
+
+func (p *PluginBackupPlan) GetKind() string {
+	return PluginBackupPlanKind
+}
+
+func (p *PluginBackupPlan) GetCmd() string {
+	return PluginBackupPlanWorkerCommand
+}
+
+func (p *PluginBackupPlan) GetSecretData() ([]byte, error) {
+	// The kind lets the worker choose the source
+	reduced := PluginBackupPlan{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       PluginBackupPlanKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: p.Namespace,
+			Name:      p.Name,
+		},
+		Spec: p.Spec,
+	}
+	return json.Marshal(&reduced)
+}
+
+func (p *PluginBackupPlan) New() BackupPlan {
+	return &PluginBackupPlan{}
+}
+
+// +kubebuilder:object:root=true
+
+// PluginBackupPlanList contains a list of PluginBackupPlan
+type PluginBackupPlanList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PluginBackupPlan `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PluginBackupPlan{}, &PluginBackupPlanList{})
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+// RetentionPolicy configures which backups are kept based on their timestamps.
+// For every rule the newest backup per hour, day, week, month or year is kept
+// for the given number of periods. A backup is kept if any rule keeps it.
+type RetentionPolicy struct {
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of newest backups to keep
+	KeepLast int `json:"keepLast,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of hours to keep the newest backup of
+	KeepHourly int `json:"keepHourly,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of days to keep the newest backup of
+	KeepDaily int `json:"keepDaily,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of weeks to keep the newest backup of
+	KeepWeekly int `json:"keepWeekly,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of months to keep the newest backup of
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of years to keep the newest backup of
+	KeepYearly int `json:"keepYearly,omitempty"`
+	// +optional
+	// Backups younger than this are always kept, e.g. 24h
+	MinAge *metav1.Duration `json:"minAge,omitempty"`
+	// +optional
+	// Backups older than this are always removed, e.g. 8760h
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// +optional
+	// Only log which backups would be removed
+	DryRun bool `json:"dryRun,omitempty"`
+	// +optional
+	// Also prune backups without manifest, e.g. stored by previous versions.
+	// They count towards the rules like all other backups.
+	PruneLegacy bool `json:"pruneLegacy,omitempty"`
+}
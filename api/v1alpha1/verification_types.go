@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	VerificationSucceeded = "Succeeded"
+	VerificationFailed    = "Failed"
+)
+
+// Verification configures restore tests of the latest backup into a scratch
+// instance, which runs as sidecar of the worker
+type Verification struct {
+	// +optional
+	// Schedule in cron format. If unset the latest backup is restored after
+	// every successful backup.
+	Schedule string `json:"schedule,omitempty"`
+
+	// Image of the scratch instance, e.g. mongo:4.4 or consul:1.12
+	Image string `json:"image"`
+
+	// +optional
+	// Shell command starting the scratch instance listening on localhost.
+	// Defaults to mongod or a consul agent in dev mode.
+	Command string `json:"command,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// Defaults to the activeDeadlineSeconds of the plan
+	ActiveDeadlineSeconds int64 `json:"activeDeadlineSeconds,omitempty"`
+
+	// +optional
+	// Checks run against the restored instance. If none are given, the
+	// restored instance must not be empty.
+	Checks []VerificationCheck `json:"checks,omitempty"`
+
+	// +optional
+	// Restore backups without manifest, e.g. stored by previous versions,
+	// without verifying their checksum. They are rejected otherwise.
+	AllowUnverified bool `json:"allowUnverified,omitempty"`
+}
+
+// VerificationCheck counts documents or keys of the restored instance
+type VerificationCheck struct {
+	// Name of the check used in metrics
+	Name string `json:"name"`
+
+	// +optional
+	// MongoDB database to count documents in. All databases are counted if
+	// unset.
+	Database string `json:"database,omitempty"`
+
+	// +optional
+	// MongoDB collection to count documents in. All collections of the
+	// database are counted if unset.
+	Collection string `json:"collection,omitempty"`
+
+	// +optional
+	// MongoDB query filter as extended JSON, e.g. {"active": true}. Requires
+	// database and collection.
+	Filter string `json:"filter,omitempty"`
+
+	// +optional
+	// Consul key prefix to count keys of
+	Prefix string `json:"prefix,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Minimum number of documents or keys. Defaults to 1.
+	MinCount *int64 `json:"minCount,omitempty"`
+}
+
+// VerificationStatus describes the latest restore test
+type VerificationStatus struct {
+	// +optional
+	CronJob *corev1.ObjectReference `json:"cronJob,omitempty"`
+	// +optional
+	// Latest verification Job
+	Job *corev1.ObjectReference `json:"job,omitempty"`
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// +optional
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// +optional
+	// Result of the latest completed verification, either Succeeded or Failed
+	LastResult string `json:"lastResult,omitempty"`
+}
@@ -98,6 +98,16 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "ConsulBackupPlan")
 		os.Exit(1)
 	}
+	if err = (&controllers.BackupPlanReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("PluginBackupPlan"),
+		Scheme:      mgr.GetScheme(),
+		WorkerImage: workerImage,
+		Type:        &backupv1alpha1.PluginBackupPlan{},
+	}).SetupWithManager(mgr, "pluginbackupplan"); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PluginBackupPlan")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
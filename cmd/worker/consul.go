@@ -17,18 +17,9 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"time"
 
 	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
-	"github.com/finleap-connect/backup-operator/pkg/backup/consul"
-	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
-	"github.com/finleap-connect/backup-operator/pkg/logger"
-	"github.com/finleap-connect/backup-operator/pkg/metrics"
-	"github.com/finleap-connect/backup-operator/pkg/util"
 	"github.com/spf13/cobra"
 )
 
@@ -36,76 +27,10 @@ var consulCmd = &cobra.Command{
 	Use:   "consul [flags] config",
 	Short: "Backups consul using specified config",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		log := logger.WithName("worker")
-		// Load configuration
 		if len(args) != 1 {
 			return fmt.Errorf("config path expected as one and only argument")
 		}
-		file, err := os.Open(args[0])
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		raw, err := ioutil.ReadAll(file)
-		if err != nil {
-			return err
-		}
-		var plan backupv1alpha1.ConsulBackupPlan
-		err = json.Unmarshal([]byte(os.ExpandEnv(string(raw))), &plan)
-		if err != nil {
-			return err
-		}
-		// Setup metrics publisher
-		mps := plan.Spec.Pushgateway
-		mpc := metrics.DefaultConfig().
-			WithApp("consul").
-			WithURL(util.FallbackToEnv(mps.URL, "PUSHGATEWAY_URL")).
-			WithUsername(util.FallbackToEnv(mps.Username, "PUSHGATEWAY_USERNAME")).
-			WithPassword(util.FallbackToEnv(mps.Password, "PUSHGATEWAY_PASSWORD"))
-		var mp metrics.MetricsPublisher
-		if err := mpc.Validate(); err != nil {
-			log.Error(err, "invalid metrics configuration falling back to NewNopMetricsPublisher")
-			mp = metrics.NewNopMetricsPublisher()
-		} else {
-			mp = metrics.NewMetricsPublisher(mpc)
-		}
-		defer func() {
-			mp.StopTimer()
-			mp.PublishMetrics()
-		}()
-		// Backup
-		name := fmt.Sprintf("backup-%s.tgz", time.Now().Format("20060102150405"))
-		src, err := consul.NewConsulSource(plan.Spec.Address, util.FallbackToEnv(plan.Spec.Username, "CONSUL_HTTP_USERNAME"), util.FallbackToEnv(plan.Spec.Password, "CONSUL_HTTP_PASSWORD"), name)
-		if err != nil {
-			return err
-		}
-		prefix := fmt.Sprintf("%s/%s", plan.ObjectMeta.Namespace, plan.ObjectMeta.Name)
-		s3c := plan.Spec.Destination.S3
-		conf := &s3.S3DestinationConf{
-			Endpoint:            s3c.Endpoint,
-			AccessKey:           util.FallbackToEnv(s3c.AccessKeyID, "S3_ACCESS_KEY_ID"),
-			SecretKey:           util.FallbackToEnv(s3c.SecretAccessKey, "S3_SECRET_ACCESS_KEY"),
-			EncryptionKey:       util.NilIfEmpty(util.FallbackToEnv(s3c.EncryptionKey, "S3_ENCRYPTION_KEY")),
-			EncryptionAlgorithm: util.FallbackToEnv(s3c.EncryptionAlgorithm, "S3_ENCRYPTION_ALGORITHM"),
-			DisableSSL:          !s3c.UseSSL,
-			Bucket:              s3c.Bucket,
-			Prefix:              prefix,
-		}
-		dst, err := s3.NewS3Destination(conf)
-		if err != nil {
-			return err
-		}
-		written, err := src.Stream(dst)
-		if err != nil {
-			return err
-		}
-		mp.SetBackupSizeInBytes(written)
-		err = dst.EnsureRetention(int(plan.Spec.Retention))
-		if err != nil {
-			return err
-		}
-		mp.SetSuccessfulRun()
-		return nil
+		return runPlan(cmd.Context(), backupv1alpha1.ConsulBackupPlanWorkerCommand, args[0])
 	},
 }
 
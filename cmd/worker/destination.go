@@ -0,0 +1,514 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup/sftp"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/finleap-connect/backup-operator/pkg/metrics"
+	"github.com/finleap-connect/backup-operator/pkg/util"
+)
+
+// newDestination creates a destination storing the backup in all
+// destinations configured in the plan
+func newDestination(plan backupv1alpha1.BackupPlan, mp metrics.MetricsPublisher) (*backup.FanOutDestination, error) {
+	log := logger.WithName("worker")
+	var targets []backup.FanOutTarget
+	for i, dstc := range plan.GetSpec().GetDestinations() {
+		target := backup.FanOutTarget{
+			Name:     dstc.Name,
+			Optional: dstc.Optional,
+		}
+		if dstc.Retention != nil || dstc.RetentionPolicy != nil {
+			policy := destinationRetentionPolicy(dstc, plan.GetSpec())
+			target.Retention = &policy
+		}
+		dst, kind, err := newSingleDestination(dstc, plan.GetObjectMeta(), plan.GetSpec(), planTags(plan))
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("%s-%d", kind, i)
+		}
+		if err != nil {
+			if !dstc.Optional {
+				return nil, fmt.Errorf("failed to setup destination %s: %w", target.Name, err)
+			}
+			log.Error(err, "failed to setup optional destination", "destination", target.Name)
+			mp.SetDestinationResult(target.Name, 0, false)
+			continue
+		}
+		target.Destination = dst
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no destination configured")
+	}
+	return backup.NewFanOutDestination(targets...), nil
+}
+
+// retentionPolicy returns the policy if set and falls back to keeping the
+// newest retention backups otherwise. Only backups named by the worker are
+// considered.
+func retentionPolicy(retention int64, policy *backupv1alpha1.RetentionPolicy) backup.RetentionPolicy {
+	if policy == nil {
+		p := backup.KeepLast(int(retention))
+		p.Pattern = backup.IDPattern
+		return p
+	}
+	p := backup.RetentionPolicy{
+		KeepLast:    policy.KeepLast,
+		KeepHourly:  policy.KeepHourly,
+		KeepDaily:   policy.KeepDaily,
+		KeepWeekly:  policy.KeepWeekly,
+		KeepMonthly: policy.KeepMonthly,
+		KeepYearly:  policy.KeepYearly,
+		DryRun:      policy.DryRun,
+		PruneLegacy: policy.PruneLegacy,
+		Pattern:     backup.IDPattern,
+	}
+	if policy.MinAge != nil {
+		p.MinAge = policy.MinAge.Duration
+	}
+	if policy.MaxAge != nil {
+		p.MaxAge = policy.MaxAge.Duration
+	}
+	return p
+}
+
+// destinationRetentionPolicy returns the retention policy of dst, which
+// defaults to the one of the plan
+func destinationRetentionPolicy(dst backupv1alpha1.Destination, spec *backupv1alpha1.BackupPlanSpec) backup.RetentionPolicy {
+	switch {
+	case dst.RetentionPolicy != nil:
+		return retentionPolicy(0, dst.RetentionPolicy)
+	case dst.Retention != nil:
+		return retentionPolicy(*dst.Retention, nil)
+	}
+	return retentionPolicy(spec.Retention, spec.RetentionPolicy)
+}
+
+// validateRetention rejects plans, which would keep all backups forever as
+// neither the plan nor a destination overriding it limits them
+func validateRetention(spec *backupv1alpha1.BackupPlanSpec) error {
+	if err := retentionPolicy(spec.Retention, spec.RetentionPolicy).Validate(); err != nil {
+		return fmt.Errorf("retention or retentionPolicy of plan required: %w", err)
+	}
+	for i, dst := range spec.GetDestinations() {
+		if dst.Retention == nil && dst.RetentionPolicy == nil {
+			continue
+		}
+		if err := destinationRetentionPolicy(dst, spec).Validate(); err != nil {
+			return fmt.Errorf("invalid retention of destination %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// withStages wraps dst to compress and encrypt backups as configured and to
+// store a manifest next to them. Backups are compressed first, as encrypted
+// data does not compress, and the manifest describes the stored data.
+func withStages(plan backupv1alpha1.BackupPlan, info backup.ManifestInfo, dst backup.Destination) (backup.Destination, error) {
+	spec := plan.GetSpec()
+	info.Plan = planPrefix(plan.GetObjectMeta())
+	info.Tools["worker"] = util.ModuleVersion("")
+	info.Labels = spec.Labels
+	dst = backup.NewManifestDestination(dst, info)
+	if spec.Encryption != nil {
+		key, err := encryptionKey(spec.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		dst = backup.NewEncryptingDestination(dst, key)
+	}
+	if spec.Compression != nil {
+		return backup.NewCompressingDestination(dst, backup.CompressionConf{
+			Codec:       spec.Compression.Codec,
+			Level:       spec.Compression.Level,
+			Concurrency: spec.Compression.Concurrency,
+		})
+	}
+	return dst, nil
+}
+
+// encryptionKey returns the key backups are encrypted with
+func encryptionKey(enc *backupv1alpha1.Encryption) (backup.EncryptionKey, error) {
+	return backup.ParseEncryptionKey(enc.KeyID, util.FallbackToEnv(enc.Key, "BACKUP_ENCRYPTION_KEY"))
+}
+
+// decryptionKeys returns the current key followed by all previous keys, which
+// are used to decrypt backups. No keys are returned without encryption.
+func decryptionKeys(enc *backupv1alpha1.Encryption) ([]backup.EncryptionKey, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	key, err := encryptionKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	keys := []backup.EncryptionKey{key}
+	for _, prev := range enc.PreviousKeys {
+		key, err := backup.ParseEncryptionKey(prev.KeyID, util.FallbackToEnv(prev.Key, decryptionKeyEnv(prev.KeyID)))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// decryptionKeyEnv returns the environment variable the previous key with the
+// given ID falls back to
+func decryptionKeyEnv(keyID string) string {
+	return "BACKUP_DECRYPTION_KEY_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, keyID)
+}
+
+// planPrefix returns the prefix of all backups of the plan
+func planPrefix(meta *metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+}
+
+// planTags returns the tags added to all objects stored by the plan
+func planTags(plan backupv1alpha1.BackupPlan) map[string]string {
+	return map[string]string{
+		"backup.finleap.cloud/namespace": plan.GetObjectMeta().Namespace,
+		"backup.finleap.cloud/plan":      plan.GetObjectMeta().Name,
+		"backup.finleap.cloud/source":    plan.GetCmd(),
+	}
+}
+
+// s3Layout returns the layout of the destination, which defaults to v1 so
+// existing backups stay visible until they are migrated
+func s3Layout(s3c *backupv1alpha1.S3) s3.Layout {
+	if s3c.Layout == "" {
+		return s3.LayoutV1
+	}
+	return s3.Layout(s3c.Layout)
+}
+
+// s3ObjectLock returns the object lock configuration of the destination. The
+// duration defaults to the one derived from the retention policy.
+func s3ObjectLock(lock *backupv1alpha1.ObjectLock, policy backup.RetentionPolicy) (*s3.ObjectLockConf, error) {
+	if lock == nil {
+		return nil, nil
+	}
+	conf := &s3.ObjectLockConf{Mode: lock.Mode, LegalHold: lock.LegalHold}
+	if lock.Duration != nil {
+		conf.Duration = lock.Duration.Duration
+	} else {
+		conf.Duration = policy.LockDuration()
+	}
+	if conf.Mode != "" && conf.Duration <= 0 {
+		return nil, fmt.Errorf("object lock duration cannot be derived from a retention by count, please set it explicitly")
+	}
+	return conf, nil
+}
+
+// s3Retry returns the retry policies of requests and uploads and the
+// directory uploads are spooled to, so they can be resumed
+func s3Retry(r *backupv1alpha1.S3Retry) (partRetry, retry *s3.RetryPolicy, spoolDir string) {
+	if r == nil {
+		return nil, nil, ""
+	}
+	policy := s3.RetryPolicy{MaxRetries: s3.DefaultRetries}
+	if r.MinDelay != nil {
+		policy.MinDelay = r.MinDelay.Duration
+	}
+	if r.MaxDelay != nil {
+		policy.MaxDelay = r.MaxDelay.Duration
+	}
+	if r.PartRetries != nil {
+		policy.MaxRetries = *r.PartRetries
+	}
+	if r.UploadRetries > 0 {
+		upload := policy
+		upload.MaxRetries = r.UploadRetries
+		retry, spoolDir = &upload, spoolPath()
+	}
+	return &policy, retry, spoolDir
+}
+
+// spoolPath returns the volume the operator mounts for spooled uploads or,
+// outside of a cronjob, the temporary directory
+func spoolPath() string {
+	if info, err := os.Stat(backupv1alpha1.SpoolMountPath); err == nil && info.IsDir() {
+		return backupv1alpha1.SpoolMountPath
+	}
+	return os.TempDir()
+}
+
+// s3TLS returns the CA bundle and the client certificate of the destination.
+// Referenced Secrets and ConfigMaps are read from the volumes mounted by the
+// operator.
+func s3TLS(s3c *backupv1alpha1.S3) (caBundle, cert, key string, err error) {
+	caBundle = s3c.CABundle
+	if ref := s3c.CABundleRef; ref != nil {
+		data, err := ioutil.ReadFile(ref.Path())
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		caBundle += "\n" + string(data)
+	}
+	if name := s3c.ClientCertificateSecret; name != "" {
+		dir := backupv1alpha1.SecretMountPath(name)
+		certData, err := ioutil.ReadFile(filepath.Join(dir, corev1.TLSCertKey))
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		keyData, err := ioutil.ReadFile(filepath.Join(dir, corev1.TLSPrivateKeyKey))
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to read client key: %w", err)
+		}
+		cert, key = string(certData), string(keyData)
+	}
+	return caBundle, cert, key, nil
+}
+
+// newSingleDestination creates the destination of the registered type
+// configured in dst, objects are stored with the given tags if supported
+func newSingleDestination(dst backupv1alpha1.Destination, meta *metav1.ObjectMeta, spec *backupv1alpha1.BackupPlanSpec, tags map[string]string) (backup.Destination, string, error) {
+	kind, conf, err := destinationConfig(dst)
+	if err != nil {
+		return nil, kind, err
+	}
+	d, err := backup.DefaultRegistry.NewDestination(kind, conf, backup.DestinationOptions{
+		Namespace: meta.Namespace,
+		Name:      meta.Name,
+		Tags:      tags,
+		Retention: destinationRetentionPolicy(dst, spec),
+	})
+	return d, kind, err
+}
+
+// newSingleSource creates a source streaming the object with the given id as
+// stored in the destination of the registered type configured in dst
+func newSingleSource(dst backupv1alpha1.Destination, meta *metav1.ObjectMeta, id string) (backup.Source, string, error) {
+	kind, conf, err := destinationConfig(dst)
+	if err != nil {
+		return nil, kind, err
+	}
+	src, err := backup.DefaultRegistry.NewDestinationSource(kind, conf, backup.DestinationOptions{
+		Namespace: meta.Namespace,
+		Name:      meta.Name,
+	}, id)
+	return src, kind, err
+}
+
+// destinationConfig returns the registered type configured in dst and its
+// configuration. Exactly one type has to be configured.
+func destinationConfig(dst backupv1alpha1.Destination) (string, json.RawMessage, error) {
+	raw, err := json.Marshal(&dst)
+	if err != nil {
+		return "unknown", nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "unknown", nil, err
+	}
+	var kinds []string
+	for _, kind := range backup.DefaultRegistry.Destinations() {
+		if _, ok := fields[kind]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	switch len(kinds) {
+	case 0:
+		return "unknown", nil, fmt.Errorf("destination type missing")
+	case 1:
+		return kinds[0], fields[kinds[0]], nil
+	}
+	return "unknown", nil, fmt.Errorf("only one destination type may be set, got %s", strings.Join(kinds, ", "))
+}
+
+func init() {
+	backup.RegisterDestination(backup.DestinationType{
+		Name:      "s3",
+		NewConfig: func() interface{} { return &backupv1alpha1.S3{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			return newS3Destination(conf.(*backupv1alpha1.S3), opts)
+		},
+		NewSource: func(conf interface{}, opts backup.DestinationOptions, id string) (backup.Source, error) {
+			return newS3Source(conf.(*backupv1alpha1.S3), opts, id)
+		},
+	})
+	backup.RegisterDestination(backup.DestinationType{
+		Name:      "sftp",
+		NewConfig: func() interface{} { return &backupv1alpha1.SFTP{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			return sftp.NewSFTPDestination(&sftp.SFTPDestinationConf{
+				SFTPConf: sftpConf(conf.(*backupv1alpha1.SFTP)),
+				Prefix:   path.Join(opts.Namespace, opts.Name),
+			})
+		},
+		NewSource: func(conf interface{}, opts backup.DestinationOptions, id string) (backup.Source, error) {
+			return sftp.NewSFTPSource(&sftp.SFTPSourceConf{
+				SFTPConf: sftpConf(conf.(*backupv1alpha1.SFTP)),
+				Key:      path.Join(opts.Namespace, opts.Name, id),
+			})
+		},
+	})
+	backup.RegisterDestination(backup.DestinationType{
+		Name:      "volume",
+		NewConfig: func() interface{} { return &backupv1alpha1.Volume{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			v := conf.(*backupv1alpha1.Volume)
+			return fs.NewDirDestination(filepath.Join(v.MountPath(), v.SubPath, opts.Namespace, opts.Name))
+		},
+		NewSource: func(conf interface{}, opts backup.DestinationOptions, id string) (backup.Source, error) {
+			v := conf.(*backupv1alpha1.Volume)
+			return fs.NewFileSource(filepath.Join(v.MountPath(), v.SubPath, opts.Namespace, opts.Name, id))
+		},
+	})
+	backup.RegisterDestination(backup.DestinationType{
+		Name:      "plugin",
+		NewConfig: func() interface{} { return &backupv1alpha1.Plugin{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			return newPluginDestination(conf.(*backupv1alpha1.Plugin), opts)
+		},
+	})
+}
+
+// sftpConf returns the connection settings of a SFTP destination
+func sftpConf(sftpc *backupv1alpha1.SFTP) sftp.SFTPConf {
+	return sftp.SFTPConf{
+		Host:       sftpc.Host,
+		User:       sftpc.User,
+		PrivateKey: util.FallbackToEnv(sftpc.PrivateKey, "SFTP_PRIVATE_KEY"),
+		HostKey:    util.FallbackToEnv(sftpc.HostKey, "SFTP_HOST_KEY"),
+		Directory:  sftpc.Directory,
+	}
+}
+
+// s3Prefix returns the prefix of all backups of the plan in the S3 destination
+func s3Prefix(s3c *backupv1alpha1.S3, opts backup.DestinationOptions) (string, error) {
+	tmpl := s3c.PrefixTemplate
+	if tmpl == "" {
+		tmpl = s3.DefaultPrefixTemplate
+	}
+	return s3.RenderPrefix(tmpl, s3.PrefixData{Namespace: opts.Namespace, Name: opts.Name})
+}
+
+// newS3Destination creates a S3 destination, objects are stored below the
+// prefix rendered for the plan
+func newS3Destination(s3c *backupv1alpha1.S3, opts backup.DestinationOptions) (*s3.S3Destination, error) {
+	prefix, err := s3Prefix(s3c, opts)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := s3ObjectLock(s3c.ObjectLock, opts.Retention)
+	if err != nil {
+		return nil, err
+	}
+	caBundle, cert, key, err := s3TLS(s3c)
+	if err != nil {
+		return nil, err
+	}
+	partRetry, retry, spoolDir := s3Retry(s3c.Retry)
+	allTags := map[string]string{}
+	for _, t := range []map[string]string{opts.Tags, s3c.Tags} {
+		for k, v := range t {
+			allTags[k] = v
+		}
+	}
+	return s3.NewS3Destination(&s3.S3DestinationConf{
+		Endpoint:             s3c.Endpoint,
+		AccessKey:            util.FallbackToEnv(s3c.AccessKeyID, "S3_ACCESS_KEY_ID"),
+		SecretKey:            util.FallbackToEnv(s3c.SecretAccessKey, "S3_SECRET_ACCESS_KEY"),
+		EncryptionKey:        util.NilIfEmpty(util.FallbackToEnv(s3c.EncryptionKey, "S3_ENCRYPTION_KEY")),
+		EncryptionAlgorithm:  util.FallbackToEnv(s3c.EncryptionAlgorithm, "S3_ENCRYPTION_ALGORITHM"),
+		DisableSSL:           !s3c.UseSSL,
+		InsecureSkipVerify:   s3c.InsecureSkipVerify,
+		CABundle:             caBundle,
+		ClientCertificate:    cert,
+		ClientKey:            key,
+		ServerName:           s3c.ServerName,
+		Region:               s3c.Region,
+		CredentialChain:      s3c.CredentialChain,
+		RoleARN:              s3c.RoleARN,
+		ExternalID:           s3c.ExternalID,
+		Bucket:               s3c.Bucket,
+		CreateBucket:         s3c.CreateBucket,
+		Prefix:               prefix,
+		PartSize:             util.DefaultIfZeroValueInt64(s3c.PartSize, s3manager.MinUploadPartSize),
+		Layout:               s3Layout(s3c),
+		ObjectLock:           lock,
+		StorageClass:         s3c.StorageClass,
+		Tags:                 allTags,
+		Metadata:             s3c.Metadata,
+		ServerSideEncryption: s3c.ServerSideEncryption,
+		SSEKMSKeyID:          s3c.KMSKeyID,
+		PartRetry:            partRetry,
+		Retry:                retry,
+		SpoolDir:             spoolDir,
+	})
+}
+
+// newS3Source creates a source streaming the object with the given id below
+// the prefix rendered for the plan as stored, it is verified by the caller
+func newS3Source(s3c *backupv1alpha1.S3, opts backup.DestinationOptions, id string) (*s3.S3Source, error) {
+	prefix, err := s3Prefix(s3c, opts)
+	if err != nil {
+		return nil, err
+	}
+	caBundle, cert, key, err := s3TLS(s3c)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewS3Source(&s3.S3SourceConf{
+		Endpoint:            s3c.Endpoint,
+		AccessKey:           util.FallbackToEnv(s3c.AccessKeyID, "S3_ACCESS_KEY_ID"),
+		SecretKey:           util.FallbackToEnv(s3c.SecretAccessKey, "S3_SECRET_ACCESS_KEY"),
+		EncryptionKey:       util.NilIfEmpty(util.FallbackToEnv(s3c.EncryptionKey, "S3_ENCRYPTION_KEY")),
+		EncryptionAlgorithm: util.FallbackToEnv(s3c.EncryptionAlgorithm, "S3_ENCRYPTION_ALGORITHM"),
+		DisableSSL:          !s3c.UseSSL,
+		InsecureSkipVerify:  s3c.InsecureSkipVerify,
+		CABundle:            caBundle,
+		ClientCertificate:   cert,
+		ClientKey:           key,
+		ServerName:          s3c.ServerName,
+		Region:              s3c.Region,
+		CredentialChain:     s3c.CredentialChain,
+		RoleARN:             s3c.RoleARN,
+		ExternalID:          s3c.ExternalID,
+		Bucket:              s3c.Bucket,
+		Key:                 path.Join(prefix, id),
+		Raw:                 true,
+		// Verified against the manifest by the worker
+		AllowUnverified: true,
+	})
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Destination", func() {
+	It("should keep layout v1 unless v2 is configured", func() {
+		Expect(s3Layout(&backupv1alpha1.S3{})).To(Equal(s3.LayoutV1))
+		Expect(s3Layout(&backupv1alpha1.S3{Layout: "v2"})).To(Equal(s3.LayoutV2))
+	})
+	It("should spool uploads only with upload retries", func() {
+		_, retry, spoolDir := s3Retry(&backupv1alpha1.S3Retry{})
+		Expect(retry).To(BeNil())
+		Expect(spoolDir).To(BeEmpty())
+		_, retry, spoolDir = s3Retry(&backupv1alpha1.S3Retry{UploadRetries: 3})
+		Expect(retry.MaxRetries).To(Equal(3))
+		Expect(spoolDir).To(Equal(spoolPath()))
+	})
+	It("should reject plans keeping all backups", func() {
+		Expect(validateRetention(&backupv1alpha1.BackupPlanSpec{})).ToNot(Succeed())
+		Expect(validateRetention(&backupv1alpha1.BackupPlanSpec{Retention: 3})).To(Succeed())
+		Expect(validateRetention(&backupv1alpha1.BackupPlanSpec{
+			RetentionPolicy: &backupv1alpha1.RetentionPolicy{KeepDaily: 7},
+		})).To(Succeed())
+		Expect(validateRetention(&backupv1alpha1.BackupPlanSpec{
+			RetentionPolicy: &backupv1alpha1.RetentionPolicy{DryRun: true},
+		})).ToNot(Succeed())
+		Expect(validateRetention(&backupv1alpha1.BackupPlanSpec{
+			Retention: 3,
+			Destinations: []backupv1alpha1.Destination{
+				{RetentionPolicy: &backupv1alpha1.RetentionPolicy{}},
+			},
+		})).ToNot(Succeed())
+	})
+	It("should reject destinations setting several types", func() {
+		kind, _, err := destinationConfig(backupv1alpha1.Destination{S3: &backupv1alpha1.S3{Bucket: "backups"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kind).To(Equal("s3"))
+		_, _, err = destinationConfig(backupv1alpha1.Destination{})
+		Expect(err).To(MatchError("destination type missing"))
+		_, _, err = newSingleDestination(backupv1alpha1.Destination{
+			S3:     &backupv1alpha1.S3{Bucket: "backups"},
+			Volume: &backupv1alpha1.Volume{ClaimName: "backups"},
+		}, &metav1.ObjectMeta{Namespace: "namespace", Name: "plan"}, &backupv1alpha1.BackupPlanSpec{Retention: 3}, nil)
+		Expect(err).To(MatchError("only one destination type may be set, got s3, volume"))
+	})
+	It("should restore backups encrypted before the key was rotated", func() {
+		keyA := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+		keyB := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+		stored, _ := mem.NewBufferDestination()
+		key, err := encryptionKey(&backupv1alpha1.Encryption{KeyID: "a", Key: keyA})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backup.NewEncryptingDestination(stored, key).Store(context.Background(), backup.Object{ID: "backup", Data: bytes.NewBufferString("testcontent")})
+		Expect(err).ToNot(HaveOccurred())
+
+		// Rotate from key A to key B
+		keys, err := decryptionKeys(&backupv1alpha1.Encryption{
+			KeyID:        "b",
+			Key:          keyB,
+			PreviousKeys: []backupv1alpha1.DecryptionKey{{KeyID: "a", Key: keyA}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		restored, _ := mem.NewBufferDestination()
+		_, err = backup.NewDecryptingDestination(restored, keys...).Store(context.Background(), backup.Object{
+			ID:   "backup" + backup.EncryptionExtension,
+			Data: bytes.NewReader(stored.Data["backup"+backup.EncryptionExtension]),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(restored.Data["backup"])).To(Equal("testcontent"))
+
+		// Without the previous key the backup cannot be restored
+		keys, err = decryptionKeys(&backupv1alpha1.Encryption{KeyID: "b", Key: keyB})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backup.NewDecryptingDestination(restored, keys...).Store(context.Background(), backup.Object{
+			ID:   "backup" + backup.EncryptionExtension,
+			Data: bytes.NewReader(stored.Data["backup"+backup.EncryptionExtension]),
+		})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should read previous keys from the environment", func() {
+		current := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+		previous := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+		Expect(decryptionKeyEnv("key-2020.01")).To(Equal("BACKUP_DECRYPTION_KEY_KEY_2020_01"))
+		os.Setenv("BACKUP_DECRYPTION_KEY_KEY_2020_01", previous)
+		defer os.Unsetenv("BACKUP_DECRYPTION_KEY_KEY_2020_01")
+
+		keys, err := decryptionKeys(&backupv1alpha1.Encryption{
+			KeyID:        "key-2021",
+			Key:          current,
+			PreviousKeys: []backupv1alpha1.DecryptionKey{{KeyID: "key-2020.01"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keys).To(HaveLen(2))
+		Expect(keys[0].ID).To(Equal("key-2021"))
+		Expect(keys[1].ID).To(Equal("key-2020.01"))
+		Expect(keys[1].Key).To(Equal(bytes.Repeat([]byte{2}, 32)))
+
+		_, err = decryptionKeys(&backupv1alpha1.Encryption{
+			KeyID:        "key-2021",
+			Key:          current,
+			PreviousKeys: []backupv1alpha1.DecryptionKey{{KeyID: "missing"}},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+var migrateLayoutOpts struct {
+	dryRun bool
+}
+
+var migrateLayoutCmd = &cobra.Command{
+	Use:   "migrate-layout [flags] config",
+	Short: "Moves backups stored in layout v1 into the layout of the S3 destinations of the specified config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := logger.WithName("worker")
+		if len(args) != 1 {
+			return fmt.Errorf("config path expected as one and only argument")
+		}
+		var plan commonPlan
+		if err := loadPlan(args[0], &plan); err != nil {
+			return err
+		}
+		// Backups in layout v1 were always stored below the plan prefix
+		from := planPrefix(&plan.ObjectMeta)
+		var failed []string
+		for i, dstc := range plan.Spec.GetDestinations() {
+			name := dstc.Name
+			if name == "" {
+				name = fmt.Sprintf("s3-%d", i)
+			}
+			if dstc.S3 == nil || s3Layout(dstc.S3) != s3.LayoutV2 {
+				continue
+			}
+			dst, _, err := newSingleDestination(dstc, &plan.ObjectMeta, &plan.Spec, nil)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			migrated, err := dst.(*s3.S3Destination).Migrate(cmd.Context(), from, migrateLayoutOpts.dryRun)
+			if err != nil {
+				log.Error(err, "migration failed", "destination", name, "migrated", len(migrated))
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			log.Info("migration successful", "destination", name, "migrated", len(migrated), "dryRun", migrateLayoutOpts.dryRun)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("migration failed: %s", strings.Join(failed, "; "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	flags := migrateLayoutCmd.Flags()
+	flags.BoolVar(&migrateLayoutOpts.dryRun, "dry-run", false, "Only log the backups, which would be migrated")
+	rootCmd.AddCommand(migrateLayoutCmd)
+}
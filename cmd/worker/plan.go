@@ -0,0 +1,73 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/finleap-connect/backup-operator/pkg/metrics"
+	"github.com/finleap-connect/backup-operator/pkg/util"
+)
+
+// loadPlan reads the plan from the given file after evaluating environment
+// variables in it
+func loadPlan(fp string, plan interface{}) error {
+	raw, err := readPlan(fp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, plan)
+}
+
+// readPlan returns the content of the given file after evaluating environment
+// variables in it
+func readPlan(fp string) ([]byte, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	raw, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(os.ExpandEnv(string(raw))), nil
+}
+
+// newMetricsPublisher returns a publisher for the pushgateway or a nop
+// publisher, if the pushgateway is not configured
+func newMetricsPublisher(app string, mps *backupv1alpha1.Pushgateway) metrics.MetricsPublisher {
+	log := logger.WithName("worker")
+	if mps == nil {
+		mps = &backupv1alpha1.Pushgateway{}
+	}
+	mpc := metrics.DefaultConfig().
+		WithApp(app).
+		WithURL(util.FallbackToEnv(mps.URL, "PUSHGATEWAY_URL")).
+		WithUsername(util.FallbackToEnv(mps.Username, "PUSHGATEWAY_USERNAME")).
+		WithPassword(util.FallbackToEnv(mps.Password, "PUSHGATEWAY_PASSWORD"))
+	if err := mpc.Validate(); err != nil {
+		log.Error(err, "invalid metrics configuration falling back to NewNopMetricsPublisher")
+		return metrics.NewNopMetricsPublisher()
+	}
+	log.Info("using pushgateway for metrics", "url", mpc.URL)
+	return metrics.NewMetricsPublisher(mpc)
+}
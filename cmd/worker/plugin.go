@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/plugin"
+	"github.com/spf13/cobra"
+)
+
+var pluginDir string
+
+var pluginCmd = &cobra.Command{
+	Use:   "plugin [flags] config",
+	Short: "Backups the source of a plugin using specified config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("config path expected as one and only argument")
+		}
+		return runPlan(cmd.Context(), backupv1alpha1.PluginBackupPlanWorkerCommand, args[0])
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&pluginDir, "plugin-dir", backupv1alpha1.PluginMountPath, "Directory plugins are discovered in")
+	rootCmd.AddCommand(pluginCmd)
+}
+
+// pluginSource stops the plugin once the backup is done
+type pluginSource struct {
+	backup.Source
+	client *plugin.Client
+}
+
+func (s *pluginSource) Close() error {
+	return s.client.Close()
+}
+
+// pluginDestination stops the plugin once the destination is closed
+type pluginDestination struct {
+	*plugin.Destination
+	client *plugin.Client
+}
+
+func (d *pluginDestination) Close() error {
+	return d.client.Close()
+}
+
+// newPluginSource starts the plugin and creates its source
+func newPluginSource(p *backupv1alpha1.Plugin, opts backup.SourceOptions) (backup.Source, error) {
+	client, err := startPlugin(p.Name)
+	if err != nil {
+		return nil, err
+	}
+	src, err := func() (backup.Source, error) {
+		t, err := pluginType(p, "source", client.Info.Sources)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewSource(t, pluginConfig(p), opts)
+	}()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &pluginSource{Source: src, client: client}, nil
+}
+
+// newPluginDestination starts the plugin and creates its destination
+func newPluginDestination(p *backupv1alpha1.Plugin, opts backup.DestinationOptions) (backup.Destination, error) {
+	client, err := startPlugin(p.Name)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := func() (*plugin.Destination, error) {
+		t, err := pluginType(p, "destination", client.Info.Destinations)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewDestination(t, pluginConfig(p), opts)
+	}()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &pluginDestination{Destination: dst, client: client}, nil
+}
+
+// startPlugin starts the named plugin of the plugin directory
+func startPlugin(name string) (*plugin.Client, error) {
+	path, err := plugin.Lookup(pluginDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return plugin.Open(context.Background(), path)
+}
+
+// pluginType returns the selected type of the plugin, which defaults to the
+// only type of the kind provided by the plugin
+func pluginType(p *backupv1alpha1.Plugin, kind string, types []string) (string, error) {
+	if p.Type != "" {
+		return p.Type, nil
+	}
+	if len(types) != 1 {
+		return "", fmt.Errorf("plugin %s provides %d %s types, the type has to be set", p.Name, len(types), kind)
+	}
+	return types[0], nil
+}
+
+// pluginConfig returns the configuration passed to the plugin
+func pluginConfig(p *backupv1alpha1.Plugin) []byte {
+	if p.Config == nil || len(p.Config.Raw) == 0 {
+		return []byte("{}")
+	}
+	return p.Config.Raw
+}
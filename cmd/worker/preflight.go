@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+var preflightOpts struct {
+	messageFile string
+}
+
+var preflightCmd = &cobra.Command{
+	Use:   "preflight [flags] config",
+	Short: "Checks all destinations of the specified config are reachable and backups can be stored, listed and removed",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := logger.WithName("worker")
+		if len(args) != 1 {
+			return fmt.Errorf("config path expected as one and only argument")
+		}
+		var plan commonPlan
+		if err := loadPlan(args[0], &plan); err != nil {
+			return err
+		}
+		var failed []string
+		if err := validateRetention(&plan.Spec); err != nil {
+			log.Error(err, "preflight failed")
+			failed = append(failed, err.Error())
+		}
+		for i, dstc := range plan.Spec.GetDestinations() {
+			dst, kind, err := newSingleDestination(dstc, &plan.ObjectMeta, &plan.Spec, nil)
+			name := dstc.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", kind, i)
+			}
+			if err == nil {
+				if c, ok := dst.(io.Closer); ok {
+					defer c.Close()
+				}
+				if p, ok := dst.(backup.PreflightChecker); ok {
+					err = p.Preflight(cmd.Context())
+				}
+			}
+			if err != nil {
+				log.Error(err, "preflight failed", "destination", name)
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			log.Info("preflight successful", "destination", name)
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		message := strings.Join(failed, "; ")
+		// The operator reports the message in the DestinationReady condition
+		if preflightOpts.messageFile != "" {
+			if err := ioutil.WriteFile(preflightOpts.messageFile, []byte(message), 0644); err != nil {
+				log.Error(err, "failed to write message file")
+			}
+		}
+		return fmt.Errorf("preflight failed: %s", message)
+	},
+}
+
+func init() {
+	flags := preflightCmd.Flags()
+	flags.StringVar(&preflightOpts.messageFile, "message-file", "", "File the failures are written to, e.g. the termination log of the container")
+	rootCmd.AddCommand(preflightCmd)
+}
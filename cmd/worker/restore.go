@@ -0,0 +1,335 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOptions "go.mongodb.org/mongo-driver/mongo/options"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/consul"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mongodb"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+var defaultScratchAddresses = map[string]string{
+	backupv1alpha1.MongoDBBackupPlanWorkerCommand: "mongodb://127.0.0.1:27017",
+	backupv1alpha1.ConsulBackupPlanWorkerCommand:  "127.0.0.1:8500",
+}
+
+var restoreTestOpts struct {
+	address  string
+	doneFile string
+	timeout  time.Duration
+}
+
+var restoreTestCmd = &cobra.Command{
+	Use:   "restore-test [flags] type config",
+	Short: "Restores the latest backup of the specified config into a scratch instance and checks it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := logger.WithName("worker")
+		if len(args) != 2 {
+			return fmt.Errorf("type and config path expected as arguments")
+		}
+		kind := args[0]
+		if _, ok := defaultScratchAddresses[kind]; !ok {
+			return fmt.Errorf("unknown type %s", kind)
+		}
+		// Let the scratch instance terminate, once the test is finished
+		if restoreTestOpts.doneFile != "" {
+			defer func() {
+				if err := os.WriteFile(restoreTestOpts.doneFile, []byte{}, 0644); err != nil {
+					log.Error(err, "failed to signal completion", "file", restoreTestOpts.doneFile)
+				}
+			}()
+		}
+		var plan commonPlan
+		if err := loadPlan(args[1], &plan); err != nil {
+			return err
+		}
+		if plan.Spec.Verification == nil {
+			return fmt.Errorf("verification is not configured")
+		}
+		address := restoreTestOpts.address
+		if address == "" {
+			address = defaultScratchAddresses[kind]
+		}
+		// Setup metrics publisher
+		mp := newMetricsPublisher(kind+"-verification", plan.Spec.Pushgateway)
+		defer func() {
+			mp.StopTimer()
+			mp.PublishMetrics()
+		}()
+		mp.StartTimer()
+
+		keys, err := decryptionKeys(plan.Spec.Encryption)
+		if err != nil {
+			return err
+		}
+		dstc, id, err := latestBackup(cmd.Context(), &plan)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), restoreTestOpts.timeout)
+		defer cancel()
+		var counter func(check backupv1alpha1.VerificationCheck) (int64, error)
+		var out backup.Destination
+		switch kind {
+		case backupv1alpha1.MongoDBBackupPlanWorkerCommand:
+			client, err := waitForMongoDB(ctx, address)
+			if err != nil {
+				return err
+			}
+			defer client.Disconnect(context.Background())
+			counter = func(check backupv1alpha1.VerificationCheck) (int64, error) {
+				return countMongoDB(ctx, client, check)
+			}
+			out, err = mongodb.NewMongoDBDestination(address)
+			if err != nil {
+				return err
+			}
+		case backupv1alpha1.ConsulBackupPlanWorkerCommand:
+			client, err := waitForConsul(ctx, address)
+			if err != nil {
+				return err
+			}
+			counter = func(check backupv1alpha1.VerificationCheck) (int64, error) {
+				return countConsul(client, check)
+			}
+			out, err = consul.NewConsulDestination(address, "", "")
+			if err != nil {
+				return err
+			}
+		}
+		log.Info("restoring backup", "backup", id)
+		if err := restoreBackup(cmd.Context(), dstc, &plan.ObjectMeta, id, keys, plan.Spec.Verification.AllowUnverified, out); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", id, err)
+		}
+		// Run checks against the restored instance
+		checks := plan.Spec.Verification.Checks
+		if len(checks) == 0 {
+			checks = []backupv1alpha1.VerificationCheck{{Name: "total"}}
+		}
+		var failed []string
+		for _, check := range checks {
+			minCount := int64(1)
+			if check.MinCount != nil {
+				minCount = *check.MinCount
+			}
+			count, err := counter(check)
+			successful := err == nil && count >= minCount
+			mp.SetVerificationResult(check.Name, count, successful)
+			if err != nil {
+				log.Error(err, "check failed", "check", check.Name)
+				failed = append(failed, fmt.Sprintf("%s: %v", check.Name, err))
+			} else if !successful {
+				log.Info("check failed", "check", check.Name, "count", count, "minCount", minCount)
+				failed = append(failed, fmt.Sprintf("%s: found %d, expected at least %d", check.Name, count, minCount))
+			} else {
+				log.Info("check successful", "check", check.Name, "count", count)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("restore test of %s failed: %s", id, strings.Join(failed, "; "))
+		}
+		mp.SetSuccessfulRun()
+		return nil
+	},
+}
+
+func init() {
+	flags := restoreTestCmd.Flags()
+	flags.StringVar(&restoreTestOpts.address, "address", "", "Address of the scratch instance, defaults to localhost")
+	flags.StringVar(&restoreTestOpts.doneFile, "done-file", "", "File created once the test is finished")
+	flags.DurationVar(&restoreTestOpts.timeout, "timeout", 10*time.Minute, "Timeout for the scratch instance to become ready and the checks")
+	rootCmd.AddCommand(restoreTestCmd)
+}
+
+// latestBackup returns the latest backup of the first destination, which
+// contains any and supports reading it back
+func latestBackup(ctx context.Context, plan *commonPlan) (backupv1alpha1.Destination, string, error) {
+	log := logger.WithName("worker")
+	for _, dstc := range plan.Spec.GetDestinations() {
+		if kind, _, err := destinationConfig(dstc); err == nil {
+			if t, err := backup.DefaultRegistry.Destination(kind); err == nil && t.NewSource == nil {
+				log.Info("destination does not support reading backups", "destination", dstc.Name, "type", kind)
+				continue
+			}
+		}
+		dst, kind, err := newSingleDestination(dstc, &plan.ObjectMeta, &plan.Spec, nil)
+		if err != nil {
+			log.Error(err, "failed to setup destination", "destination", dstc.Name)
+			continue
+		}
+		if c, ok := dst.(io.Closer); ok {
+			defer c.Close()
+		}
+		lister, ok := dst.(backup.Lister)
+		if !ok {
+			log.Info("destination does not support listing backups", "destination", dstc.Name, "type", kind)
+			continue
+		}
+		ids, err := lister.List(ctx)
+		if err != nil {
+			log.Error(err, "failed to list backups", "destination", dstc.Name)
+			continue
+		}
+		if len(ids) > 0 {
+			return dstc, ids[0], nil
+		}
+	}
+	return backupv1alpha1.Destination{}, "", fmt.Errorf("no backup found")
+}
+
+// restoreBackup restores the backup stored in dst into out. The backup is
+// verified against its manifest, decrypted and decompressed on the way.
+// Backups without manifest are only restored, if unverified backups are
+// allowed.
+func restoreBackup(ctx context.Context, dst backupv1alpha1.Destination, meta *metav1.ObjectMeta, id string, keys []backup.EncryptionKey, allowUnverified bool, out backup.Destination) error {
+	out = backup.NewDecompressingDestination(out)
+	if len(keys) > 0 {
+		out = backup.NewDecryptingDestination(out, keys...)
+	}
+	buf, _ := mem.NewBufferDestination()
+	_, err := streamFromDestination(ctx, dst, meta, backup.ManifestID(id), buf)
+	switch {
+	case err == nil:
+	case backup.IsNotFound(err) && allowUnverified:
+		logger.WithName("worker").Info("no manifest found, skipping checksum verification", "backup", id)
+	case backup.IsNotFound(err):
+		return fmt.Errorf("%w: %s has no manifest", backup.ErrNoChecksum, id)
+	default:
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	for _, data := range buf.Data {
+		manifest, err := backup.ParseManifest(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		out = backup.NewVerifyingDestination(out, manifest.SHA256)
+	}
+	_, err = streamFromDestination(ctx, dst, meta, id, out)
+	return err
+}
+
+func waitForMongoDB(ctx context.Context, uri string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, mongoOptions.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if err = client.Ping(ctx, nil); err == nil {
+			return client, nil
+		}
+		select {
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("scratch instance not ready: %w", err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func countMongoDB(ctx context.Context, client *mongo.Client, check backupv1alpha1.VerificationCheck) (int64, error) {
+	filter := bson.D{}
+	if check.Filter != "" {
+		if check.Database == "" || check.Collection == "" {
+			return 0, fmt.Errorf("filter requires database and collection")
+		}
+		if err := bson.UnmarshalExtJSON([]byte(check.Filter), false, &filter); err != nil {
+			return 0, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	databases := []string{check.Database}
+	if check.Database == "" {
+		names, err := client.ListDatabaseNames(ctx, bson.D{})
+		if err != nil {
+			return 0, err
+		}
+		databases = nil
+		for _, name := range names {
+			if name != "admin" && name != "config" && name != "local" {
+				databases = append(databases, name)
+			}
+		}
+	}
+	var count int64
+	for _, database := range databases {
+		db := client.Database(database)
+		collections := []string{check.Collection}
+		if check.Collection == "" {
+			var err error
+			if collections, err = db.ListCollectionNames(ctx, bson.D{}); err != nil {
+				return 0, err
+			}
+		}
+		for _, collection := range collections {
+			n, err := db.Collection(collection).CountDocuments(ctx, filter)
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+	}
+	return count, nil
+}
+
+func waitForConsul(ctx context.Context, address string) (*consulApi.Client, error) {
+	conf := consulApi.DefaultConfig()
+	conf.Address = address
+	client, err := consulApi.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// Snapshots can only be restored once a leader is elected
+		leader, err := client.Status().Leader()
+		if err == nil && leader != "" {
+			return client, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no leader elected")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("scratch instance not ready: %w", err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func countConsul(client *consulApi.Client, check backupv1alpha1.VerificationCheck) (int64, error) {
+	keys, _, err := client.KV().Keys(check.Prefix, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(keys)), nil
+}
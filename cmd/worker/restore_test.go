@@ -0,0 +1,132 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Restore", func() {
+	var (
+		server *testutil.S3Server
+		dstc   backupv1alpha1.Destination
+		dst    *s3.S3Destination
+		meta   = &metav1.ObjectMeta{Namespace: "namespace", Name: "plan"}
+	)
+	BeforeEach(func() {
+		var err error
+		server, err = testutil.NewS3Server()
+		Expect(err).ToNot(HaveOccurred())
+		dstc = backupv1alpha1.Destination{S3: &backupv1alpha1.S3{
+			Endpoint:        server.Endpoint,
+			Bucket:          "backups",
+			AccessKeyID:     server.AccessKeyID,
+			SecretAccessKey: server.SecretAccessKey,
+		}}
+		dst, err = s3.NewS3Destination(&s3.S3DestinationConf{
+			Endpoint:     server.Endpoint,
+			AccessKey:    server.AccessKeyID,
+			SecretKey:    server.SecretAccessKey,
+			DisableSSL:   true,
+			Bucket:       "backups",
+			CreateBucket: true,
+			Prefix:       "namespace/plan",
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(server.Close()).To(Succeed())
+	})
+	It("should verify backups against their manifest", func() {
+		id := "backup-20200101000000"
+		_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+		Expect(err).ToNot(HaveOccurred())
+		out, _ := mem.NewBufferDestination()
+		Expect(restoreBackup(context.Background(), dstc, meta, id, nil, false, out)).To(Succeed())
+		Expect(out.Data).To(HaveLen(1))
+	})
+	It("should restore and verify backups encrypted with a previous key", func() {
+		previous := backup.EncryptionKey{ID: "previous", Key: bytes.Repeat([]byte{1}, 32)}
+		current := backup.EncryptionKey{ID: "current", Key: bytes.Repeat([]byte{2}, 32)}
+		id := "backup-20200101000000"
+		stored := backup.NewEncryptingDestination(backup.NewManifestDestination(dst, backup.ManifestInfo{}), previous)
+		_, err := stored.Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+		Expect(err).ToNot(HaveOccurred())
+
+		id += backup.EncryptionExtension
+
+		out, _ := mem.NewBufferDestination()
+		Expect(restoreBackup(context.Background(), dstc, meta, id, []backup.EncryptionKey{current, previous}, false, out)).To(Succeed())
+		Expect(out.Data).To(HaveLen(1))
+		_, _, err = verifyBackup(context.Background(), dstc, meta, id, []backup.EncryptionKey{current, previous})
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = verifyBackup(context.Background(), dstc, meta, id, []backup.EncryptionKey{current})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should only restore backups without manifest if allowed", func() {
+		id := "backup-20200101000000"
+		_, err := dst.Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+		Expect(err).ToNot(HaveOccurred())
+		out, _ := mem.NewBufferDestination()
+		err = restoreBackup(context.Background(), dstc, meta, id, nil, false, out)
+		Expect(errors.Is(err, backup.ErrNoChecksum)).To(BeTrue())
+		Expect(out.Data).To(BeEmpty())
+
+		Expect(restoreBackup(context.Background(), dstc, meta, id, nil, true, out)).To(Succeed())
+		Expect(out.Data).To(HaveLen(1))
+	})
+	It("should fail if the manifest cannot be read", func() {
+		id := "backup-20200101000000"
+		_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+		Expect(err).ToNot(HaveOccurred())
+		server.Fail = func(r *http.Request) bool {
+			return strings.HasSuffix(r.URL.Path, backup.ManifestExtension)
+		}
+		out, _ := mem.NewBufferDestination()
+		err = restoreBackup(context.Background(), dstc, meta, id, nil, true, out)
+		Expect(err).To(MatchError(ContainSubstring("failed to read manifest")))
+		Expect(out.Data).To(BeEmpty())
+	})
+	It("should skip destinations not supporting reading backups", func() {
+		id := "backup-20200101000000"
+		_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+		Expect(err).ToNot(HaveOccurred())
+		plan := &commonPlan{ObjectMeta: *meta, Spec: backupv1alpha1.BackupPlanSpec{Destinations: []backupv1alpha1.Destination{
+			{Name: "plugin", Plugin: &backupv1alpha1.Plugin{Name: "missing"}},
+			dstc,
+		}}}
+		latest, latestID, err := latestBackup(context.Background(), plan)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(latest).To(Equal(dstc))
+		Expect(latestID).To(Equal(id))
+	})
+})
@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/finleap-connect/backup-operator/pkg/logger"
 	"github.com/spf13/cobra"
@@ -36,7 +39,12 @@ func init() {
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	// Stop running backups gracefully, e.g. once activeDeadlineSeconds is
+	// exceeded and the pod is terminated
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		log := logger.WithName("root-cmd")
 		log.Error(err, "command failed")
 		os.Exit(1)
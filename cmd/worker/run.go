@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] config",
+	Short: "Backups the source of the plan depending on its kind",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("config path expected as one and only argument")
+		}
+		return runPlan(cmd.Context(), "", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+}
+
+// runPlan backups the plan in the given file with the registered source type.
+// The type is derived from the kind of the plan if empty.
+func runPlan(ctx context.Context, sourceType string, fp string) error {
+	raw, err := readPlan(fp)
+	if err != nil {
+		return err
+	}
+	if sourceType == "" {
+		if sourceType, err = sourceTypeOf(raw); err != nil {
+			return err
+		}
+	}
+	t, err := backup.DefaultRegistry.Source(sourceType)
+	if err != nil {
+		return err
+	}
+	conf := t.NewConfig()
+	if err := json.Unmarshal(raw, conf); err != nil {
+		return err
+	}
+	plan, ok := conf.(backupv1alpha1.BackupPlan)
+	if !ok {
+		return fmt.Errorf("configuration of source %s is no backup plan", t.Name)
+	}
+	return runBackup(ctx, t, plan)
+}
+
+// sourceTypeOf returns the name of the source type, which backups plans of
+// the kind of the given plan
+func sourceTypeOf(raw []byte) (string, error) {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return "", err
+	}
+	if meta.Kind == "" {
+		return "", fmt.Errorf("plan has no kind")
+	}
+	for _, name := range backup.DefaultRegistry.Sources() {
+		t, _ := backup.DefaultRegistry.Source(name)
+		if plan, ok := t.NewConfig().(backupv1alpha1.BackupPlan); ok && plan.GetKind() == meta.Kind {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w of plan: %s", backup.ErrUnknownType, meta.Kind)
+}
+
+// runBackup streams a backup from the source created for the plan to all of
+// its destinations and ensures the retention afterwards
+func runBackup(ctx context.Context, t backup.SourceType, plan backupv1alpha1.BackupPlan) error {
+	spec := plan.GetSpec()
+	if err := validateRetention(spec); err != nil {
+		return err
+	}
+	// Setup metrics publisher
+	mp := newMetricsPublisher(t.Name, spec.Pushgateway)
+	defer func() {
+		mp.StopTimer()
+		mp.PublishMetrics()
+	}()
+	// Backup
+	mp.StartTimer()
+	now := time.Now()
+	src, err := t.New(plan, backup.SourceOptions{
+		Time:       now,
+		Compressed: spec.Compression != nil,
+	})
+	if err != nil {
+		return err
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	dst, err := newDestination(plan, mp)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	tools := make(map[string]string, len(t.Tools)+1)
+	for k, v := range t.Tools {
+		tools[k] = v
+	}
+	sdst, err := withStages(plan, backup.ManifestInfo{
+		Source: t.Name,
+		Tools:  tools,
+	}, dst)
+	if err != nil {
+		return err
+	}
+	written, err := streamBackup(ctx, src, sdst, s3.NewRunID(now))
+	for _, res := range dst.Results() {
+		mp.SetDestinationResult(res.Name, res.Written, res.Err == nil)
+	}
+	if err != nil {
+		return err
+	}
+	mp.SetBackupSizeInBytes(written)
+	err = dst.EnsureRetention(ctx, retentionPolicy(spec.Retention, spec.RetentionPolicy))
+	if err != nil {
+		return err
+	}
+	mp.SetSuccessfulRun()
+	return nil
+}
+
+// streamBackup streams src into a session of dst in the directory run, so the
+// objects of the run are only marked as complete once all of them are stored.
+// If any destination does not support sessions, src is streamed into dst
+// directly.
+func streamBackup(ctx context.Context, src backup.Source, dst backup.Destination, run string) (int64, error) {
+	written, err := backup.StreamSession(ctx, src, dst, run)
+	if errors.Is(err, backup.ErrNoSessions) {
+		return src.Stream(ctx, dst)
+	}
+	return written, err
+}
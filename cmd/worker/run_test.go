@@ -0,0 +1,63 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// plainDestination hides the sessions of the wrapped destination
+type plainDestination struct {
+	backup.Destination
+}
+
+var _ = Describe("Run", func() {
+	It("should store backups in a session of the run", func() {
+		dir, err := ioutil.TempDir("", "worker")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		fdst, err := fs.NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		dst := backup.NewFanOutDestination(backup.FanOutTarget{Name: "fs", Destination: fdst})
+		src, _ := mem.NewBufferSource("backup-20200101000000.tgz", []byte("testcontent"))
+		_, err = streamBackup(context.Background(), src, backup.NewManifestDestination(dst, backup.ManifestInfo{}), "run")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "run", "backup-20200101000000.tgz")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "run", backup.CompletionMarker)).To(BeAnExistingFile())
+
+		policy := backup.KeepLast(1)
+		policy.Pattern = backup.IDPattern
+		Expect(dst.EnsureRetention(context.Background(), policy)).To(Succeed())
+	})
+	It("should store backups directly without sessions", func() {
+		mdst, _ := mem.NewBufferDestination()
+		src, _ := mem.NewBufferSource("backup-20200101000000.tgz", []byte("testcontent"))
+		_, err := streamBackup(context.Background(), src, plainDestination{mdst}, "run")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mdst.Data).To(HaveKey("backup-20200101000000.tgz"))
+	})
+})
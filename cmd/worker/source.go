@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/consul"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mongodb"
+	"github.com/finleap-connect/backup-operator/pkg/util"
+)
+
+func init() {
+	backup.RegisterSource(backup.SourceType{
+		Name:      backupv1alpha1.MongoDBBackupPlanWorkerCommand,
+		Tools:     map[string]string{"mongodump": util.ModuleVersion("github.com/mongodb/mongo-tools")},
+		NewConfig: func() interface{} { return &backupv1alpha1.MongoDBBackupPlan{} },
+		New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+			plan := conf.(*backupv1alpha1.MongoDBBackupPlan)
+			// Let mongodump compress the archive unless compression is configured
+			gzip := !opts.Compressed
+			ext := ".archive"
+			if gzip {
+				ext = ".tgz"
+			}
+			return mongodb.NewMongoDBSource(plan.Spec.URI, "", backup.NewID(opts.Time, ext), gzip)
+		},
+	})
+	backup.RegisterSource(backup.SourceType{
+		Name:      backupv1alpha1.ConsulBackupPlanWorkerCommand,
+		Tools:     map[string]string{"consul-api": util.ModuleVersion("github.com/hashicorp/consul/api")},
+		NewConfig: func() interface{} { return &backupv1alpha1.ConsulBackupPlan{} },
+		New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+			plan := conf.(*backupv1alpha1.ConsulBackupPlan)
+			return consul.NewConsulSource(plan.Spec.Address,
+				util.FallbackToEnv(plan.Spec.Username, "CONSUL_HTTP_USERNAME"),
+				util.FallbackToEnv(plan.Spec.Password, "CONSUL_HTTP_PASSWORD"),
+				backup.NewID(opts.Time, ".tgz"))
+		},
+	})
+	backup.RegisterSource(backup.SourceType{
+		Name:      backupv1alpha1.PluginBackupPlanWorkerCommand,
+		NewConfig: func() interface{} { return &backupv1alpha1.PluginBackupPlan{} },
+		New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+			return newPluginSource(&conf.(*backupv1alpha1.PluginBackupPlan).Spec.Plugin, opts)
+		},
+	})
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+// commonPlan contains the parts shared by all plans
+type commonPlan struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              backupv1alpha1.BackupPlanSpec `json:"spec,omitempty"`
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [flags] config backup",
+	Short: "Verifies the checksum of a backup in all destinations of the specified config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := logger.WithName("worker")
+		if len(args) != 2 {
+			return fmt.Errorf("config path and backup name expected as arguments")
+		}
+		var plan commonPlan
+		if err := loadPlan(args[0], &plan); err != nil {
+			return err
+		}
+		keys, err := decryptionKeys(plan.Spec.Encryption)
+		if err != nil {
+			return err
+		}
+		var failed []string
+		for i, dstc := range plan.Spec.GetDestinations() {
+			manifest, kind, err := verifyBackup(cmd.Context(), dstc, &plan.ObjectMeta, args[1], keys)
+			name := dstc.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", kind, i)
+			}
+			if err != nil {
+				log.Error(err, "verification failed", "destination", name, "backup", args[1])
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			log.Info("verification successful", "destination", name, "backup", args[1], "sha256", manifest.SHA256, "size", manifest.Size)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("verification failed: %s", strings.Join(failed, "; "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifyBackup checks the backup stored in dst against its manifest. If keys
+// are given, encrypted backups must be decryptable with one of them.
+func verifyBackup(ctx context.Context, dst backupv1alpha1.Destination, meta *metav1.ObjectMeta, id string, keys []backup.EncryptionKey) (*backup.Manifest, string, error) {
+	buf, _ := mem.NewBufferDestination()
+	if kind, err := streamFromDestination(ctx, dst, meta, backup.ManifestID(id), buf); err != nil {
+		return nil, kind, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest *backup.Manifest
+	for _, data := range buf.Data {
+		var err error
+		if manifest, err = backup.ParseManifest(bytes.NewReader(data)); err != nil {
+			return nil, "", err
+		}
+	}
+	if manifest == nil {
+		return nil, "", fmt.Errorf("manifest of %s is empty", id)
+	}
+	counter := &discardDestination{keys: keys}
+	kind, err := streamFromDestination(ctx, dst, meta, id, backup.NewVerifyingDestination(counter, manifest.SHA256))
+	if err != nil {
+		return nil, kind, err
+	}
+	if counter.written != manifest.Size {
+		return nil, kind, fmt.Errorf("size mismatch: expected %d, got %d", manifest.Size, counter.written)
+	}
+	return manifest, kind, nil
+}
+
+// streamFromDestination streams the object with the given id as stored in
+// the destination into out
+func streamFromDestination(ctx context.Context, dst backupv1alpha1.Destination, meta *metav1.ObjectMeta, id string, out backup.Destination) (string, error) {
+	src, kind, err := newSingleSource(dst, meta, id)
+	if err != nil {
+		return kind, err
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	_, err = src.Stream(ctx, out)
+	return kind, err
+}
+
+// discardDestination reads objects without storing them. Encrypted objects
+// are decrypted, if keys are given, to check they can be restored.
+type discardDestination struct {
+	keys    []backup.EncryptionKey
+	written int64
+}
+
+func (d *discardDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	if len(d.keys) == 0 {
+		n, err := io.Copy(io.Discard, obj.Data)
+		d.written += n
+		return n, err
+	}
+	r := &countingReader{r: obj.Data}
+	obj.Data = r
+	_, err := backup.NewDecryptingDestination(&discardDestination{}, d.keys...).Store(ctx, obj)
+	d.written += r.n
+	return r.n, err
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verify", func() {
+	It("should read the object with the given key from S3", func() {
+		server, err := testutil.NewS3Server()
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+		s3c := &backupv1alpha1.S3{
+			Endpoint:        server.Endpoint,
+			Bucket:          "backups",
+			AccessKeyID:     server.AccessKeyID,
+			SecretAccessKey: server.SecretAccessKey,
+		}
+		dst, err := s3.NewS3Destination(&s3.S3DestinationConf{
+			Endpoint:     server.Endpoint,
+			AccessKey:    server.AccessKeyID,
+			SecretKey:    server.SecretAccessKey,
+			DisableSSL:   true,
+			Bucket:       "backups",
+			CreateBucket: true,
+			Prefix:       "namespace/plan",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		for _, id := range []string{"backup-20200101000000", "backup-20200102000000"} {
+			_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString(id)})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		src, kind, err := newSingleSource(backupv1alpha1.Destination{S3: s3c}, &metav1.ObjectMeta{Namespace: "namespace", Name: "plan"}, "backup-20200102000000")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kind).To(Equal("s3"))
+		out, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.Data).To(HaveKeyWithValue("namespace/plan/backup-20200102000000", []byte("backup-20200102000000")))
+	})
+	It("should refuse to read from destinations not supporting it", func() {
+		_, kind, err := newSingleSource(backupv1alpha1.Destination{Plugin: &backupv1alpha1.Plugin{Name: "tar"}}, &metav1.ObjectMeta{Namespace: "namespace", Name: "plan"}, "backup-20200102000000")
+		Expect(kind).To(Equal("plugin"))
+		Expect(errors.Is(err, backup.ErrNotReadable)).To(BeTrue())
+	})
+})
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command tar-plugin is an example of a backup plugin. It provides the source
+// type tar, which backups a directory mounted into the worker as tar archive,
+// and the destination type dir, which stores backups in a directory.
+//
+// Plugins are discovered by the worker in the plugin directory, which is
+// /etc/backup/plugins by default, and are started for the backups of plans
+// referencing them. See config/samples/backup_v1alpha1_pluginbackupplan.yaml.
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/plugin"
+)
+
+// TarConfig is the configuration of the tar source
+type TarConfig struct {
+	// Directory to backup
+	Path string `json:"path"`
+}
+
+// DirConfig is the configuration of the dir destination
+type DirConfig struct {
+	// Directory to store the backups of all plans in. Each plan uses the
+	// sub-directory <namespace>/<name>.
+	Path string `json:"path"`
+}
+
+func main() {
+	registry := backup.NewRegistry()
+	registry.RegisterSource(backup.SourceType{
+		Name:      "tar",
+		NewConfig: func() interface{} { return &TarConfig{} },
+		New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+			c := conf.(*TarConfig)
+			if c.Path == "" {
+				return nil, fmt.Errorf("path of the directory to backup is required")
+			}
+			return &tarSource{dir: c.Path, id: backup.NewID(opts.Time, ".tar")}, nil
+		},
+	})
+	registry.RegisterDestination(backup.DestinationType{
+		Name:      "dir",
+		NewConfig: func() interface{} { return &DirConfig{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			c := conf.(*DirConfig)
+			if c.Path == "" {
+				return nil, fmt.Errorf("path of the directory to store backups in is required")
+			}
+			return fs.NewDirDestination(filepath.Join(c.Path, opts.Namespace, opts.Name))
+		},
+	})
+	if err := plugin.Serve(registry); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type tarSource struct {
+	dir string
+	id  string
+}
+
+func (s *tarSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	obj := backup.Object{ID: s.id}
+	obj.Metadata = obj.WithMetadata(backup.MetadataContentType, "application/x-tar")
+	return backup.Pipe(ctx, dst, obj, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return addFile(tw, s.dir, path, info)
+		})
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+}
+
+// addFile adds the file at path to the archive, names are relative to dir
+func addFile(tw *tar.Writer, dir, path string, info os.FileInfo) error {
+	name, err := filepath.Rel(dir, path)
+	if err != nil || name == "." {
+		return err
+	}
+	if info.Mode()&os.ModeSocket != 0 {
+		// Sockets cannot be archived
+		return nil
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	MetadataCompression = "backup-compression"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLz4  = "lz4"
+
+	// Block size used by parallel gzip compression
+	gzipBlockSize = 1 << 20
+)
+
+var compressionExtensions = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+	CompressionLz4:  ".lz4",
+}
+
+type CompressionConf struct {
+	Codec       string
+	Level       int // Codec specific, the default of the codec is used if zero
+	Concurrency int // Number of blocks compressed in parallel, one if zero
+}
+
+// CompressionExtension returns the file extension used for codec
+func CompressionExtension(codec string) string {
+	return compressionExtensions[codec]
+}
+
+// NewCompressingDestination compresses all objects with the configured codec
+// before they are passed to dst. The codec is recorded in the metadata and the
+// extension of the object.
+func NewCompressingDestination(dst Destination, conf CompressionConf) (Destination, error) {
+	if conf.Codec == "" || conf.Codec == CompressionNone {
+		return dst, nil
+	}
+	if _, ok := compressionExtensions[conf.Codec]; !ok {
+		return nil, fmt.Errorf("unknown compression codec %s", conf.Codec)
+	}
+	if conf.Concurrency < 1 {
+		conf.Concurrency = 1
+	}
+	// Check the configuration early instead of failing on the first store
+	w, err := newCompressingWriter(io.Discard, conf)
+	if err != nil {
+		return nil, err
+	}
+	w.Close()
+	return &compressingDestination{
+		dst:  dst,
+		conf: conf,
+	}, nil
+}
+
+type compressingDestination struct {
+	dst  Destination
+	conf CompressionConf
+}
+
+// Begin starts a session of the wrapped destination, which compresses all
+// objects of the session
+func (c *compressingDestination) Begin(ctx context.Context, run string) (Session, error) {
+	return beginStage(ctx, c.dst, run, func(dst Destination) Destination {
+		return &compressingDestination{dst: dst, conf: c.conf}
+	})
+}
+
+func (c *compressingDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := newCompressingWriter(pw, c.conf)
+		if err == nil {
+			_, err = io.Copy(w, obj.Data)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	metadata := obj.WithMetadata(MetadataCompression, c.conf.Codec)
+	delete(metadata, MetadataSize) // The size is not known in advance anymore
+	written, err := c.dst.Store(ctx, Object{
+		ID:       obj.ID + CompressionExtension(c.conf.Codec),
+		Data:     pr,
+		Metadata: metadata,
+	})
+	pr.CloseWithError(io.ErrClosedPipe) // unblock compression if dst stopped reading
+	<-done
+	return written, err
+}
+
+func newCompressingWriter(w io.Writer, conf CompressionConf) (io.WriteCloser, error) {
+	switch conf.Codec {
+	case CompressionGzip:
+		level := conf.Level
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		gw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := gw.SetConcurrency(gzipBlockSize, conf.Concurrency); err != nil {
+			return nil, err
+		}
+		return gw, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(conf.Concurrency)}
+		if conf.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(conf.Level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionLz4:
+		if conf.Level < 0 || conf.Level > 9 {
+			return nil, fmt.Errorf("lz4 compression level must be between 1 and 9")
+		}
+		lw := lz4.NewWriter(w)
+		opts := []lz4.Option{lz4.ConcurrencyOption(conf.Concurrency)}
+		if conf.Level != 0 {
+			opts = append(opts, lz4.CompressionLevelOption(lz4.CompressionLevel(1<<(8+conf.Level))))
+		}
+		if err := lw.Apply(opts...); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %s", conf.Codec)
+}
+
+// NewDecompressingDestination decompresses objects compressed by a
+// compressing destination before they are passed to dst. The codec is taken
+// from the metadata or the extension of the object, other objects are passed
+// through unchanged.
+func NewDecompressingDestination(dst Destination) Destination {
+	return &decompressingDestination{
+		dst: dst,
+	}
+}
+
+type decompressingDestination struct {
+	dst Destination
+}
+
+func (d *decompressingDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	codec := obj.Metadata[MetadataCompression]
+	if codec == "" {
+		for c, ext := range compressionExtensions {
+			if strings.HasSuffix(obj.ID, ext) {
+				codec = c
+				break
+			}
+		}
+	}
+	if codec == "" || codec == CompressionNone {
+		return d.dst.Store(ctx, obj)
+	}
+	r, err := newDecompressingReader(obj.Data, codec)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	metadata := obj.WithMetadata()
+	delete(metadata, MetadataCompression)
+	delete(metadata, MetadataSize)
+	return d.dst.Store(ctx, Object{
+		ID:       strings.TrimSuffix(obj.ID, CompressionExtension(codec)),
+		Data:     r,
+		Metadata: metadata,
+	})
+}
+
+func newDecompressingReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		return pgzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionLz4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %s", codec)
+}
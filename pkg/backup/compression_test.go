@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	data := bytes.Repeat([]byte("temporarycontent"), 1<<16)
+
+	DescribeTable("should compress and decompress with",
+		func(conf backup.CompressionConf) {
+			buf, _ := mem.NewBufferDestination()
+			mdst := &metadataDestination{BufferDestination: buf}
+			dst, err := backup.NewCompressingDestination(mdst, conf)
+			Expect(err).ToNot(HaveOccurred())
+			src, _ := mem.NewBufferSource("backup.archive", data)
+			_, err = src.Stream(context.Background(), dst)
+			Expect(err).ToNot(HaveOccurred())
+			id := "backup.archive" + backup.CompressionExtension(conf.Codec)
+			Expect(buf.Data).To(HaveKey(id))
+			Expect(len(buf.Data[id])).To(BeNumerically("<", len(data)/10))
+			Expect(mdst.metadata).To(HaveKeyWithValue(backup.MetadataCompression, conf.Codec))
+
+			out, _ := mem.NewBufferDestination()
+			src, _ = mem.NewBufferSource(id, buf.Data[id])
+			_, err = src.Stream(context.Background(), backup.NewDecompressingDestination(out))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.Data["backup.archive"]).To(Equal(data))
+		},
+		Entry("gzip", backup.CompressionConf{Codec: backup.CompressionGzip}),
+		Entry("gzip in parallel", backup.CompressionConf{Codec: backup.CompressionGzip, Level: 9, Concurrency: 4}),
+		Entry("zstd", backup.CompressionConf{Codec: backup.CompressionZstd}),
+		Entry("zstd in parallel", backup.CompressionConf{Codec: backup.CompressionZstd, Level: 19, Concurrency: 4}),
+		Entry("lz4", backup.CompressionConf{Codec: backup.CompressionLz4}),
+		Entry("lz4 in parallel", backup.CompressionConf{Codec: backup.CompressionLz4, Level: 9, Concurrency: 4}),
+	)
+	It("should not compress without codec", func() {
+		buf, _ := mem.NewBufferDestination()
+		dst, err := backup.NewCompressingDestination(buf, backup.CompressionConf{Codec: backup.CompressionNone})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst).To(BeIdenticalTo(buf))
+	})
+	It("should reject unknown codecs", func() {
+		buf, _ := mem.NewBufferDestination()
+		_, err := backup.NewCompressingDestination(buf, backup.CompressionConf{Codec: "rar"})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should pass through uncompressed objects", func() {
+		out, _ := mem.NewBufferDestination()
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewDecompressingDestination(out))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.Data["backup.tgz"]).To(Equal(data))
+	})
+	It("should decompress encrypted objects after decryption", func() {
+		key := newEncryptionKey("key-1", 1)
+		buf, _ := mem.NewBufferDestination()
+		dst, err := backup.NewCompressingDestination(backup.NewEncryptingDestination(buf, key), backup.CompressionConf{Codec: backup.CompressionZstd})
+		Expect(err).ToNot(HaveOccurred())
+		src, _ := mem.NewBufferSource("backup.archive", data)
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		id := "backup.archive.zst" + backup.EncryptionExtension
+		Expect(buf.Data).To(HaveKey(id))
+
+		out, _ := mem.NewBufferDestination()
+		src, _ = mem.NewBufferSource(id, buf.Data[id])
+		_, err = src.Stream(context.Background(), backup.NewDecryptingDestination(backup.NewDecompressingDestination(out), key))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.Data["backup.archive"]).To(Equal(data))
+	})
+})
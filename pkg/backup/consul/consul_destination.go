@@ -17,6 +17,8 @@ limitations under the License.
 package consul
 
 import (
+	"context"
+
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/logger"
 
@@ -48,11 +50,11 @@ func NewConsulDestination(uri, username, password string) (backup.Destination, e
 	}, nil
 }
 
-func (s *consulDestination) Store(obj backup.Object) (int64, error) {
+func (s *consulDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
 	log := s.log
 
 	log.Info("restore starting")
-	err := s.Client.Snapshot().Restore(&consulApi.WriteOptions{}, obj.Data)
+	err := s.Client.Snapshot().Restore((&consulApi.WriteOptions{}).WithContext(ctx), obj.Data)
 	if err != nil {
 		log.Error(err, "Failed to write snapshot to consul")
 		return 0, err
@@ -17,6 +17,13 @@ limitations under the License.
 package consul
 
 import (
+	"bytes"
+	"context"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -29,7 +36,54 @@ var _ = Describe("ConsulDestination", func() {
 		dst, err := NewConsulDestination(dstURI, "", "")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(dst).ToNot(BeNil())
-		_, err = src.Stream(dst)
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		value, ok := dstServer.Get("service/config")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal([]byte("testcontent")))
+	})
+	It("should reject corrupted snapshots", func() {
+		dst, err := NewConsulDestination(dstURI, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Store(context.Background(), backup.Object{ID: "test.snap", Data: bytes.NewBufferString("corrupted")})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should restore snapshots backed up to S3", func() {
+		server, err := testutil.NewS3Server()
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+		conf := s3.S3DestinationConf{
+			Endpoint:     server.Endpoint,
+			AccessKey:    server.AccessKeyID,
+			SecretKey:    server.SecretAccessKey,
+			DisableSSL:   true,
+			Bucket:       "backups",
+			CreateBucket: true,
+			Prefix:       "ns/consul/",
+		}
+		s3dst, err := s3.NewS3Destination(&conf)
+		Expect(err).ToNot(HaveOccurred())
+		src, err := NewConsulSource(srcURI, "", "", "test.snap")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), backup.NewManifestDestination(s3dst, backup.ManifestInfo{Source: "consul"}))
+		Expect(err).ToNot(HaveOccurred())
+
+		restored, err := testutil.NewConsulServer()
+		Expect(err).ToNot(HaveOccurred())
+		defer restored.Close()
+		s3src, err := s3.NewS3Source(&s3.S3SourceConf{
+			Endpoint:   conf.Endpoint,
+			AccessKey:  conf.AccessKey,
+			SecretKey:  conf.SecretKey,
+			DisableSSL: true,
+			Bucket:     conf.Bucket,
+			Key:        conf.Prefix + "test.snap",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := NewConsulDestination(restored.Address, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s3src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
+		Expect(restored.Keys()).To(Equal(srcServer.Keys()))
 	})
 })
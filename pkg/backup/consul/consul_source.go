@@ -17,7 +17,7 @@ limitations under the License.
 package consul
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"time"
 
@@ -27,6 +27,10 @@ import (
 	consulApi "github.com/hashicorp/consul/api"
 )
 
+// SnapshotContentType is the content type of consul snapshots, which are
+// gzipped tar archives
+const SnapshotContentType = "application/gzip"
+
 type consulSource struct {
 	SnapName string
 	Client   *consulApi.Client
@@ -54,38 +58,37 @@ func NewConsulSource(uri, username, password, snapName string) (backup.Source, e
 	}, nil
 }
 
-func (s *consulSource) Stream(dst backup.Destination) (int64, error) {
+func (s *consulSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
 	log := s.log
 
-	reader, _, err := s.Client.Snapshot().Save(&consulApi.QueryOptions{})
+	reader, _, err := s.Client.Snapshot().Save((&consulApi.QueryOptions{}).WithContext(ctx))
 	if err != nil {
 		log.Error(err, "Could not get snapshot from consul")
 		return 0, err
 	}
 	defer reader.Close()
-	pr, pw := io.Pipe()
-
-	// start the backup in a separate routine
-	errc := make(chan error, 1)
-	defer close(errc)
-	go func() {
-		defer pw.Close()
+	info := backup.ObjectInfo{
+		ContentType:   SnapshotContentType,
+		Created:       time.Now(),
+		SourceType:    "consul",
+		SourceVersion: s.version(),
+	}
+	return backup.Pipe(ctx, dst, backup.Object{ID: s.SnapName, Metadata: info.Metadata()}, func(w io.Writer) error {
 		log.Info("starting dump")
-		numBytes, err := io.Copy(pw, reader)
-		if err != nil {
-			errc <- err
-		}
+		numBytes, err := io.Copy(w, reader)
 		log.Info("finished dump", "numBytes", numBytes)
-	}()
-	written, dsterr := dst.Store(backup.Object{
-		ID:   s.SnapName,
-		Data: pr,
+		return err
 	})
+}
 
-	select {
-	case srcerr := <-errc: // return src error if possible as well
-		return written, fmt.Errorf("dst error: %v; src error: %v", dsterr, srcerr)
-	case <-time.After(1 * time.Second):
-		return written, dsterr
+// version returns the version of the consul agent or an empty string if it
+// cannot be determined
+func (s *consulSource) version() string {
+	self, err := s.Client.Agent().Self()
+	if err != nil {
+		s.log.Error(err, "failed to determine consul version")
+		return ""
 	}
+	version, _ := self["Config"]["Version"].(string)
+	return version
 }
@@ -17,11 +17,14 @@ limitations under the License.
 package consul
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -38,7 +41,7 @@ var _ = Describe("ConsulSource", func() {
 		fp := filepath.Join(dir, "test.snap")
 		dst, err := fs.NewDirDestination(dir)
 		Expect(err).ToNot(HaveOccurred())
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(fp).Should(BeAnExistingFile())
@@ -46,4 +49,20 @@ var _ = Describe("ConsulSource", func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(fi.Size()).Should(BeNumerically(">", 0))
 	})
+	It("should authenticate with basic auth", func() {
+		server, err := testutil.NewConsulServer()
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+		server.Username, server.Password = "backup", "secret"
+		src, err := NewConsulSource(server.Address, "", "", "test.snap")
+		Expect(err).ToNot(HaveOccurred())
+		dst, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).To(HaveOccurred())
+		src, err = NewConsulSource(server.Address, "backup", "secret", "test.snap")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.Data).To(HaveKey("test.snap"))
+	})
 })
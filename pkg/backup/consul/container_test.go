@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consul
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/ory/dockertest/v3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Runs backup and restore against real Consul agents if enabled by
+// testutil.DockerEnv
+var _ = Describe("Consul container", func() {
+	var (
+		srcAddress string
+		dstAddress string
+	)
+	BeforeEach(func() {
+		testutil.SkipWithoutDocker()
+		if srcAddress != "" {
+			return
+		}
+		log := logger.WithName("consulsetup")
+		By("bootstrapping both consuls")
+		pool, err := dockertest.NewPool("")
+		Expect(err).ToNot(HaveOccurred())
+		run := func() string {
+			resource, err := pool.Run("consul", "1.7", nil)
+			Expect(err).ToNot(HaveOccurred())
+			teardown = append(teardown, func() error { return pool.Purge(resource) })
+			address := fmt.Sprintf("localhost:%s", resource.GetPort("8500/tcp"))
+			Expect(testutil.WaitForConsul(pool, address)).To(Succeed())
+			log.Info("consul ready", "address", address)
+			return address
+		}
+		srcAddress, dstAddress = run(), run()
+	})
+	kv := func(address string) *consulApi.KV {
+		conf := consulApi.DefaultConfig()
+		conf.Address = address
+		client, err := consulApi.NewClient(conf)
+		Expect(err).ToNot(HaveOccurred())
+		return client.KV()
+	}
+
+	It("should restore snapshots", func() {
+		_, err := kv(srcAddress).Put(&consulApi.KVPair{Key: "service/config", Value: []byte("testcontent")}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		src, err := NewConsulSource(srcAddress, "", "", "test.snap")
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := NewConsulDestination(dstAddress, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		pair, _, err := kv(dstAddress).Get("service/config", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pair).ToNot(BeNil())
+		Expect(pair.Value).To(Equal([]byte("testcontent")))
+	})
+})
@@ -17,23 +17,22 @@ limitations under the License.
 package consul
 
 import (
-	"fmt"
 	"testing"
 
-	"github.com/finleap-connect/backup-operator/pkg/logger"
 	"github.com/finleap-connect/backup-operator/pkg/testutil"
-	"github.com/ory/dockertest/v3"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var (
-	pool        *dockertest.Pool
-	srcResource *dockertest.Resource
-	dstResource *dockertest.Resource
-	srcURI      string
-	dstURI      string
+	srcServer *testutil.ConsulServer
+	dstServer *testutil.ConsulServer
+	srcURI    string
+	dstURI    string
+	// teardown is run after the suite, e.g. to remove containers started by
+	// specs
+	teardown []func() error
 )
 
 func TestService(t *testing.T) {
@@ -41,41 +40,24 @@ func TestService(t *testing.T) {
 	RunSpecs(t, "Consul")
 }
 
-var _ = BeforeSuite(func(done Done) {
+var _ = BeforeSuite(func() {
 	var err error
-	log := logger.WithName("consulsetup")
-
-	By("bootstrapping both consuls")
-	pool, err = dockertest.NewPool("")
-	Expect(err).ToNot(HaveOccurred())
-
-	log.Info("spawn src consul container")
-	srcResource, err = pool.Run("consul", "1.7", nil)
-	Expect(err).ToNot(HaveOccurred())
-	srcURI = fmt.Sprintf("localhost:%s", srcResource.GetPort("8500/tcp"))
-
-	log.Info("spawn dst consul container")
-	dstResource, err = pool.Run("consul", "1.7", nil)
-	Expect(err).ToNot(HaveOccurred())
-	dstURI = fmt.Sprintf("localhost:%s", dstResource.GetPort("8500/tcp"))
-
-	err = testutil.WaitForConsul(pool, srcURI)
+	By("starting both consuls")
+	srcServer, err = testutil.NewConsulServer()
 	Expect(err).ToNot(HaveOccurred())
-	log.Info("src consul ready")
+	srcURI = srcServer.Address
+	srcServer.Put("service/config", []byte("testcontent"))
 
-	err = testutil.WaitForConsul(pool, dstURI)
+	dstServer, err = testutil.NewConsulServer()
 	Expect(err).ToNot(HaveOccurred())
-	log.Info("dst consul ready")
-
-	close(done)
-}, 60)
+	dstURI = dstServer.Address
+})
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
-
-	var err error
-	err = pool.Purge(srcResource)
-	Expect(err).ToNot(HaveOccurred())
-	err = pool.Purge(dstResource)
-	Expect(err).ToNot(HaveOccurred())
+	Expect(srcServer.Close()).To(Succeed())
+	Expect(dstServer.Close()).To(Succeed())
+	for _, f := range teardown {
+		Expect(f()).To(Succeed())
+	}
 })
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// NewContextReader returns a reader failing with the error of ctx as soon as
+// it is done, so copying stops on cancellation. If r is an io.Seeker, so is
+// the returned reader, so destinations can still re-read the data.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	c := &contextReader{ctx: ctx, r: r}
+	if s, ok := r.(io.Seeker); ok {
+		return &contextReadSeeker{contextReader: c, s: s}
+	}
+	return c
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type contextReadSeeker struct {
+	*contextReader
+	s io.Seeker
+}
+
+func (c *contextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return c.s.Seek(offset, whence)
+}
+
+// OnCancel calls f in a separate goroutine as soon as ctx is done, unless the
+// returned function is called before. It is used to interrupt blocking
+// operations, which do not accept a context themselves.
+func OnCancel(ctx context.Context, f func()) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Both may be ready, stop takes precedence
+			select {
+			case <-done:
+			default:
+				f()
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
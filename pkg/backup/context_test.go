@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Context", func() {
+	It("should stop reading once cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := backup.NewContextReader(ctx, bytes.NewBufferString("testcontent"))
+		buf := make([]byte, 4)
+		n, err := r.Read(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(4))
+		cancel()
+		_, err = r.Read(buf)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+	It("should keep readers seekable", func() {
+		r := backup.NewContextReader(context.Background(), bytes.NewReader([]byte("testcontent")))
+		_, ok := r.(io.ReadSeeker)
+		Expect(ok).To(BeTrue())
+		_, ok = backup.NewContextReader(context.Background(), bytes.NewBufferString("testcontent")).(io.Seeker)
+		Expect(ok).To(BeFalse())
+	})
+	It("should call the function on cancellation only", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		called := make(chan struct{})
+		stop := backup.OnCancel(ctx, func() { close(called) })
+		cancel()
+		Eventually(called).Should(BeClosed())
+		stop()
+
+		ctx, cancel = context.WithCancel(context.Background())
+		called = make(chan struct{})
+		stop = backup.OnCancel(ctx, func() { close(called) })
+		stop()
+		stop() // Can be called multiple times
+		cancel()
+		Consistently(called, 100*time.Millisecond).ShouldNot(BeClosed())
+	})
+	It("should stop all destinations of a fan out on cancellation", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		dst, _ := mem.NewBufferDestination()
+		fanout := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: dst},
+			backup.FanOutTarget{Name: "b", Destination: discard{}},
+		)
+		go func() {
+			_, _ = pw.Write([]byte("testcontent"))
+			cancel()
+			// The source is blocked until the next write is read
+			_, _ = pw.Write([]byte("testcontent"))
+		}()
+		_, err := fanout.Store(ctx, backup.Object{ID: "backup.tgz", Data: pr})
+		Expect(err).To(MatchError(context.Canceled))
+		for _, res := range fanout.Results() {
+			Expect(res.Err).To(HaveOccurred())
+		}
+	})
+})
+
+type discard struct{}
+
+func (discard) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	return io.Copy(ioutil.Discard, obj.Data)
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+// DirFS is the file system a DirStore keeps its files in. Paths are slash
+// separated.
+type DirFS interface {
+	ReadDir(dir string) ([]os.FileInfo, error)
+	// Create creates or truncates the named file
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+	// Rename replaces newname, if it exists
+	Rename(oldname, newname string) error
+	// MkdirAll creates dir along with its parents
+	MkdirAll(dir string) error
+}
+
+// DirStore stores backups as files in a directory, sessions in sub
+// directories of their runs. It implements what volume and SFTP destinations
+// have in common.
+type DirStore struct {
+	FS  DirFS
+	Dir string
+	Run string // Directory of the last committed session
+	Log logger.Logger
+}
+
+func (d *DirStore) Store(ctx context.Context, obj Object) (int64, error) {
+	fp := path.Join(d.Dir, obj.ID)
+	if err := d.FS.MkdirAll(path.Dir(fp)); err != nil {
+		return 0, err
+	}
+	// Write into a hidden file first, so partial backups are never mistaken
+	// for complete ones and do not count towards the retention
+	tmp := path.Join(path.Dir(fp), fmt.Sprintf(".%s.%08x.part", path.Base(fp), rand.Uint32()))
+	file, err := d.FS.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, NewContextReader(ctx, obj.Data))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = d.FS.Rename(tmp, fp)
+	}
+	if err != nil {
+		_ = d.FS.Remove(tmp)
+		return written, err
+	}
+	return written, nil
+}
+
+// Begin starts a session storing objects in the sub directory run
+func (d *DirStore) Begin(ctx context.Context, run string) (Session, error) {
+	if err := ValidateRun(run); err != nil {
+		return nil, err
+	}
+	return &dirSession{
+		parent: d,
+		dst:    &DirStore{FS: d.FS, Dir: path.Join(d.Dir, run), Log: d.Log},
+		run:    run,
+	}, nil
+}
+
+type dirSession struct {
+	parent  *DirStore
+	dst     *DirStore
+	run     string
+	objects []string
+}
+
+func (s *dirSession) Store(ctx context.Context, obj Object) (int64, error) {
+	written, err := s.dst.Store(ctx, obj)
+	if err != nil {
+		return written, err
+	}
+	s.objects = append(s.objects, obj.ID)
+	return written, nil
+}
+
+func (s *dirSession) Commit(ctx context.Context) error {
+	marker, err := NewCompletion(s.run, s.objects)
+	if err != nil {
+		return err
+	}
+	if _, err := s.dst.Store(ctx, Object{ID: CompletionMarker, Data: bytes.NewReader(marker)}); err != nil {
+		return err
+	}
+	s.parent.Run = s.run
+	return nil
+}
+
+// Abort removes the run directory including partial files
+func (s *dirSession) Abort(ctx context.Context) error {
+	s.dst.Log.Info("aborting session", "dir", s.dst.Dir)
+	return s.dst.RemoveAll(s.dst.Dir)
+}
+
+// Retention returns policy with the backup it requires referenced in the
+// directory of the last committed session
+func (d *DirStore) Retention(policy RetentionPolicy) RetentionPolicy {
+	if d.Run != "" && policy.Require != "" {
+		policy.Require = path.Join(d.Run, policy.Require)
+	}
+	return policy
+}
+
+func (d *DirStore) Backups(_ context.Context) ([]StoredBackup, error) {
+	files, manifests, err := d.files()
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]StoredBackup, len(files))
+	for i, fi := range files {
+		backups[i] = StoredBackup{
+			ID:        fi.id,
+			Timestamp: fi.ModTime(),
+			Size:      fi.Size(),
+			Manifest:  manifests[ManifestID(fi.id)],
+		}
+	}
+	return backups, nil
+}
+
+func (d *DirStore) List(_ context.Context) ([]string, error) {
+	files, _, err := d.files()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(files))
+	for i, fi := range files {
+		ids[i] = fi.id
+	}
+	return ids, nil
+}
+
+// Remove removes the backup with its manifest and the directory of its run
+// once no backups are left in it
+func (d *DirStore) Remove(_ context.Context, id string) error {
+	fp := path.Join(d.Dir, id)
+	if err := d.FS.Remove(fp); err != nil {
+		return err
+	}
+	if err := d.FS.Remove(ManifestID(fp)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if run := path.Dir(id); run != "." {
+		return d.removeRun(run)
+	}
+	return nil
+}
+
+// removeRun removes the directory of a run once no backups are left in it
+func (d *DirStore) removeRun(run string) error {
+	dir := path.Join(d.Dir, run)
+	entries, err := d.FS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.Name() != CompletionMarker {
+			return nil
+		}
+	}
+	return d.RemoveAll(dir)
+}
+
+// RemoveAll removes dir and everything below it
+func (d *DirStore) RemoveAll(dir string) error {
+	entries, err := d.FS.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		fp := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			err = d.RemoveAll(fp)
+		} else {
+			err = d.FS.Remove(fp)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := d.FS.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// files returns all backups in the directory and in the directories of
+// committed runs, newest first, and the IDs of all manifests
+func (d *DirStore) files() (sortableFileInfoSlice, map[string]bool, error) {
+	entries, err := d.FS.ReadDir(d.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stored []storedFile
+	for _, fi := range entries {
+		switch {
+		case strings.HasPrefix(fi.Name(), "."):
+		case fi.IsDir():
+			run, err := d.runFiles(fi.Name())
+			if err != nil {
+				return nil, nil, err
+			}
+			stored = append(stored, run...)
+		case fi.Mode().IsRegular():
+			stored = append(stored, storedFile{FileInfo: fi, id: fi.Name()})
+		}
+	}
+	files := sortableFileInfoSlice{}
+	manifests := map[string]bool{}
+	for _, fi := range stored {
+		// Manifests are removed together with their backups
+		if IsManifest(fi.id) {
+			manifests[fi.id] = true
+			continue
+		}
+		files = append(files, fi)
+	}
+	sort.Sort(files)
+	return files, manifests, nil
+}
+
+// runFiles returns the files in the directory of a run, if it was committed.
+// Runs without completion marker are still in progress or failed.
+func (d *DirStore) runFiles(run string) ([]storedFile, error) {
+	entries, err := d.FS.ReadDir(path.Join(d.Dir, run))
+	if err != nil {
+		return nil, err
+	}
+	var files []storedFile
+	committed := false
+	for _, fi := range entries {
+		if fi.Name() == CompletionMarker {
+			committed = true
+		}
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			files = append(files, storedFile{FileInfo: fi, id: path.Join(run, fi.Name())})
+		}
+	}
+	if !committed {
+		return nil, nil
+	}
+	return files, nil
+}
+
+// storedFile is a file in the directory or in the directory of a run
+type storedFile struct {
+	os.FileInfo
+	id string // Path relative to the directory
+}
+
+type sortableFileInfoSlice []storedFile
+
+func (s sortableFileInfoSlice) Len() int {
+	return len(s)
+}
+
+func (s sortableFileInfoSlice) Less(i, j int) bool {
+	if s[i].ModTime().Equal(s[j].ModTime()) {
+		return s[i].id > s[j].id
+	}
+	return s[i].ModTime().After(s[j].ModTime())
+}
+
+func (s sortableFileInfoSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// localFS is the local file system, renames fail if failRename is set
+type localFS struct {
+	failRename bool
+}
+
+func (localFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (localFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (localFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (f localFS) Rename(oldname, newname string) error {
+	if f.failRename {
+		return errors.New("rename failed")
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (localFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+var _ = Describe("DirStore", func() {
+	var (
+		dir   string
+		store *backup.DirStore
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dirstore")
+		Expect(err).ToNot(HaveOccurred())
+		store = &backup.DirStore{FS: localFS{}, Dir: dir, Log: logger.WithName("dirstore")}
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should list backups of committed runs only and remove empty runs", func() {
+		ctx := context.Background()
+		_, err := store.Store(ctx, backup.Object{ID: "backup-20200101000000.tgz", Data: bytes.NewBufferString("legacy")})
+		Expect(err).ToNot(HaveOccurred())
+		session, err := store.Begin(ctx, "run-a")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = session.Store(ctx, backup.Object{ID: "backup-20200102000000.tgz", Data: bytes.NewBufferString("run")})
+		Expect(err).ToNot(HaveOccurred())
+		ids, err := store.List(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"backup-20200101000000.tgz"}))
+
+		Expect(session.Commit(ctx)).To(Succeed())
+		Expect(store.Run).To(Equal("run-a"))
+		Expect(store.Retention(backup.KeepLast(1)).Require).To(BeEmpty())
+		policy := backup.KeepLast(1)
+		policy.Require = "backup-20200102000000.tgz"
+		Expect(store.Retention(policy).Require).To(Equal("run-a/backup-20200102000000.tgz"))
+		ids, err = store.List(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(ConsistOf("backup-20200101000000.tgz", "run-a/backup-20200102000000.tgz"))
+
+		Expect(store.Remove(ctx, "run-a/backup-20200102000000.tgz")).To(Succeed())
+		Expect(filepath.Join(dir, "run-a")).ToNot(BeADirectory())
+	})
+	It("should remove aborted runs and partial files", func() {
+		ctx := context.Background()
+		session, err := store.Begin(ctx, "run-b")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = session.Store(ctx, backup.Object{ID: "nested/backup.tgz", Data: bytes.NewBufferString("run")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Abort(ctx)).To(Succeed())
+		Expect(filepath.Join(dir, "run-b")).ToNot(BeADirectory())
+		Expect(store.RemoveAll(filepath.Join(dir, "missing"))).To(Succeed())
+
+		store.FS = localFS{failRename: true}
+		_, err = store.Store(ctx, backup.Object{ID: "backup.tgz", Data: bytes.NewBufferString("partial")})
+		Expect(err).To(MatchError("rename failed"))
+		entries, err := ioutil.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+	It("should refuse invalid run directories", func() {
+		_, err := store.Begin(context.Background(), "../escape")
+		Expect(err).To(HaveOccurred())
+	})
+})
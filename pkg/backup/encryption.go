@@ -0,0 +1,365 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	MetadataEncryption      = "backup-encryption"
+	MetadataEncryptionKeyID = "backup-encryption-key-id"
+
+	EncryptionAlgorithm = "aes-256-gcm"
+	EncryptionExtension = ".enc"
+
+	encryptionChunkSize = 64 * 1024
+	encryptionMagic     = "BOENC1"
+)
+
+var errEncryptionTruncated = fmt.Errorf("encrypted stream is truncated")
+
+type EncryptionKey struct {
+	ID  string
+	Key []byte // 256 bit
+}
+
+// ParseEncryptionKey parses a base64 encoded 256 bit key
+func ParseEncryptionKey(id, encoded string) (EncryptionKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return EncryptionKey{}, fmt.Errorf("failed to decode key %s: %w", id, err)
+	}
+	if len(key) != 32 {
+		return EncryptionKey{}, fmt.Errorf("key %s must be 256 bit, but is %d bit", id, len(key)*8)
+	}
+	if id == "" || len(id) > 255 {
+		return EncryptionKey{}, fmt.Errorf("key id must be between 1 and 255 characters")
+	}
+	return EncryptionKey{ID: id, Key: key}, nil
+}
+
+// NewEncryptingDestination encrypts all objects with AES-256-GCM before they
+// are passed to dst. The stream is split into authenticated chunks, so it
+// never has to be held in memory.
+func NewEncryptingDestination(dst Destination, key EncryptionKey) Destination {
+	return &encryptingDestination{
+		dst: dst,
+		key: key,
+	}
+}
+
+type encryptingDestination struct {
+	dst Destination
+	key EncryptionKey
+}
+
+// Begin starts a session of the wrapped destination, which encrypts all
+// objects of the session
+func (e *encryptingDestination) Begin(ctx context.Context, run string) (Session, error) {
+	return beginStage(ctx, e.dst, run, func(dst Destination) Destination {
+		return &encryptingDestination{dst: dst, key: e.key}
+	})
+}
+
+func (e *encryptingDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := newEncryptingWriter(pw, e.key)
+		if err == nil {
+			_, err = io.Copy(w, obj.Data)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	metadata := obj.WithMetadata(
+		MetadataEncryption, EncryptionAlgorithm,
+		MetadataEncryptionKeyID, e.key.ID,
+	)
+	delete(metadata, MetadataSize) // Encryption adds headers and tags
+	written, err := e.dst.Store(ctx, Object{
+		ID:       obj.ID + EncryptionExtension,
+		Data:     pr,
+		Metadata: metadata,
+	})
+	pr.CloseWithError(io.ErrClosedPipe) // unblock encryption if dst stopped reading
+	<-done
+	return written, err
+}
+
+// NewDecryptingDestination decrypts objects encrypted by an encrypting
+// destination with the matching key before they are passed to dst. Objects
+// which are not encrypted are passed through unchanged.
+func NewDecryptingDestination(dst Destination, keys ...EncryptionKey) Destination {
+	return &decryptingDestination{
+		dst:  dst,
+		keys: keys,
+	}
+}
+
+type decryptingDestination struct {
+	dst  Destination
+	keys []EncryptionKey
+}
+
+func (d *decryptingDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	br := bufio.NewReader(obj.Data)
+	magic, err := br.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if string(magic) != encryptionMagic {
+		if obj.Metadata[MetadataEncryption] != "" {
+			return 0, fmt.Errorf("object %s is marked as encrypted, but has no encryption header", obj.ID)
+		}
+		obj.Data = br
+		return d.dst.Store(ctx, obj)
+	}
+	r, keyID, err := newDecryptingReader(br, d.keys)
+	if err != nil {
+		return 0, err
+	}
+	if expected, ok := obj.Metadata[MetadataEncryptionKeyID]; ok && expected != keyID {
+		return 0, fmt.Errorf("key id %s of object %s does not match key id %s of encryption header", expected, obj.ID, keyID)
+	}
+	metadata := obj.WithMetadata()
+	delete(metadata, MetadataEncryption)
+	delete(metadata, MetadataEncryptionKeyID)
+	delete(metadata, MetadataSize)
+	return d.dst.Store(ctx, Object{
+		ID:       strings.TrimSuffix(obj.ID, EncryptionExtension),
+		Data:     r,
+		Metadata: metadata,
+	})
+}
+
+// The encrypted stream consists of a header followed by chunks:
+//
+//	header: magic | uint16 length of key id | key id | 8 byte nonce prefix
+//	chunk:  uint32 length of sealed data | sealed data
+//
+// The nonce of each chunk is the nonce prefix followed by the uint32 counter
+// of the chunk. The header and a flag marking the final chunk are used as
+// additional data, so reordering, truncation and modification are detected.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncryptingWriter(w io.Writer, key EncryptionKey) (*encryptingWriter, error) {
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := bytes.NewBufferString(encryptionMagic)
+	_ = binary.Write(header, binary.BigEndian, uint16(len(key.ID)))
+	header.WriteString(key.ID)
+	header.Write(prefix)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header.Bytes(),
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		free := encryptionChunkSize - len(e.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		e.buf = append(e.buf, p[:free]...)
+		p = p[free:]
+		n += free
+		// Only seal full chunks once more data follows, the last chunk is
+		// sealed on Close
+		if len(e.buf) == encryptionChunkSize && len(p) > 0 {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(final bool) error {
+	if e.counter == ^uint32(0) {
+		return fmt.Errorf("too many chunks to encrypt")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, chunkAdditionalData(e.header, final))
+	e.counter++
+	e.buf = e.buf[:0]
+	if err := binary.Write(e.w, binary.BigEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptingReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	final   bool
+}
+
+func newDecryptingReader(r io.Reader, keys []EncryptionKey) (*decryptingReader, string, error) {
+	header := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", err
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, "", fmt.Errorf("invalid encryption header")
+	}
+	keyID := make([]byte, binary.BigEndian.Uint16(header[len(encryptionMagic):]))
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, "", err
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, "", err
+	}
+	var key *EncryptionKey
+	for i := range keys {
+		if keys[i].ID == string(keyID) {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, string(keyID), fmt.Errorf("no key with id %s available for decryption", keyID)
+	}
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return nil, key.ID, err
+	}
+	return &decryptingReader{
+		r:      r,
+		aead:   aead,
+		header: append(append(header, keyID...), prefix...),
+		prefix: prefix,
+	}, key.ID, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) open() error {
+	var size uint32
+	if err := binary.Read(d.r, binary.BigEndian, &size); err != nil {
+		if err == io.EOF {
+			return errEncryptionTruncated
+		}
+		return err
+	}
+	if size > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("invalid chunk size %d", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errEncryptionTruncated
+		}
+		return err
+	}
+	nonce := chunkNonce(d.prefix, d.counter)
+	d.counter++
+	// Try to open as intermediate chunk first and as final chunk otherwise
+	plain, err := d.aead.Open(sealed[:0:0], nonce, sealed, chunkAdditionalData(d.header, false))
+	if err != nil {
+		plain, err = d.aead.Open(sealed[:0:0], nonce, sealed, chunkAdditionalData(d.header, true))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt chunk %d: %w", d.counter-1, err)
+		}
+		d.final = true
+		// Nothing must follow the final chunk
+		if n, _ := d.r.Read(make([]byte, 1)); n > 0 {
+			return fmt.Errorf("unexpected data after final chunk")
+		}
+	}
+	d.buf = plain
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+func chunkAdditionalData(header []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(append([]byte{}, header...), flag)
+}
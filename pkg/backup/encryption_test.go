@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+func newEncryptionKey(id string, b byte) backup.EncryptionKey {
+	key, err := backup.ParseEncryptionKey(id, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)))
+	Expect(err).ToNot(HaveOccurred())
+	return key
+}
+
+// encrypt stores data encrypted with key and returns the stored object
+func encrypt(key backup.EncryptionKey, data []byte) []byte {
+	buf, _ := mem.NewBufferDestination()
+	src, _ := mem.NewBufferSource("backup.tgz", data)
+	_, err := src.Stream(context.Background(), backup.NewEncryptingDestination(buf, key))
+	Expect(err).ToNot(HaveOccurred())
+	Expect(buf.Data).To(HaveKey("backup.tgz" + backup.EncryptionExtension))
+	return buf.Data["backup.tgz"+backup.EncryptionExtension]
+}
+
+func decrypt(data []byte, keys ...backup.EncryptionKey) ([]byte, error) {
+	buf, _ := mem.NewBufferDestination()
+	src, _ := mem.NewBufferSource("backup.tgz"+backup.EncryptionExtension, data)
+	_, err := src.Stream(context.Background(), backup.NewDecryptingDestination(buf, keys...))
+	return buf.Data["backup.tgz"], err
+}
+
+// metadataDestination records the metadata of stored objects
+type metadataDestination struct {
+	*mem.BufferDestination
+	metadata map[string]string            // Of the object stored last
+	objects  map[string]map[string]string // Of all objects by ID
+}
+
+func (m *metadataDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	m.metadata = obj.Metadata
+	if m.objects == nil {
+		m.objects = map[string]map[string]string{}
+	}
+	m.objects[obj.ID] = obj.Metadata
+	return m.BufferDestination.Store(context.Background(), obj)
+}
+
+var _ = Describe("Encryption", func() {
+	key := newEncryptionKey("key-1", 1)
+
+	DescribeTable("should encrypt and decrypt data of size",
+		func(size int) {
+			data := bytes.Repeat([]byte("a"), size)
+			encrypted := encrypt(key, data)
+			Expect(bytes.Contains(encrypted, []byte("aaaaaaaaaaaaaaaa"))).To(BeFalse())
+			decrypted, err := decrypt(encrypted, newEncryptionKey("key-0", 0), key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decrypted).To(Equal(data))
+		},
+		Entry("empty", 0),
+		Entry("small", 16),
+		Entry("one chunk", 64*1024),
+		Entry("multiple chunks", 3*64*1024+5),
+	)
+	It("should record the key id in metadata", func() {
+		buf, _ := mem.NewBufferDestination()
+		dst := &metadataDestination{BufferDestination: buf}
+		_, err := backup.NewEncryptingDestination(dst, key).Store(context.Background(), backup.Object{
+			ID:       "backup.tgz",
+			Data:     bytes.NewBufferString("temporarycontent"),
+			Metadata: map[string]string{"foo": "bar"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.metadata).To(Equal(map[string]string{
+			"foo":                          "bar",
+			backup.MetadataEncryption:      backup.EncryptionAlgorithm,
+			backup.MetadataEncryptionKeyID: "key-1",
+		}))
+	})
+	It("should fail without matching key", func() {
+		_, err := decrypt(encrypt(key, []byte("temporarycontent")), newEncryptionKey("key-2", 1))
+		Expect(err).To(HaveOccurred())
+	})
+	It("should fail with wrong key", func() {
+		_, err := decrypt(encrypt(key, []byte("temporarycontent")), newEncryptionKey("key-1", 2))
+		Expect(err).To(HaveOccurred())
+	})
+	It("should detect modifications", func() {
+		encrypted := encrypt(key, []byte("temporarycontent"))
+		encrypted[len(encrypted)-1] ^= 1
+		_, err := decrypt(encrypted, key)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should detect truncation", func() {
+		encrypted := encrypt(key, bytes.Repeat([]byte("a"), 2*64*1024+1))
+		_, err := decrypt(encrypted[:len(encrypted)-40], key)
+		Expect(err).To(HaveOccurred())
+		_, err = decrypt(encrypted[:64*1024+16+4+len("BOENC1")+2+len("key-1")+8], key)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should pass through unencrypted data", func() {
+		data := []byte("temporarycontent")
+		buf, _ := mem.NewBufferDestination()
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewDecryptingDestination(buf, key))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.Data["backup.tgz"]).To(Equal(data))
+	})
+	It("should reject invalid keys", func() {
+		_, err := backup.ParseEncryptionKey("key", base64.StdEncoding.EncodeToString([]byte("short")))
+		Expect(err).To(HaveOccurred())
+		_, err = backup.ParseEncryptionKey("key", "not base64")
+		Expect(err).To(HaveOccurred())
+	})
+})
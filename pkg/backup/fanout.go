@@ -0,0 +1,437 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+// DefaultOptionalTimeout is the time optional targets may hold back the others
+var DefaultOptionalTimeout = 5 * time.Minute
+
+// ErrStalled is reported for optional targets, which were cancelled because
+// they held back the others for too long
+var ErrStalled = errors.New("optional destination held back the others")
+
+// fanOutBuffer is the number of chunks buffered per target
+const fanOutBuffer = 8
+
+type FanOutTarget struct {
+	Name        string
+	Destination Destination
+	Retention   *RetentionPolicy // Overrides the policy passed to EnsureRetention if set
+	Optional    bool             // Failures are only reported if at least one other target succeeded
+}
+
+type FanOutResult struct {
+	Name    string
+	Written int64
+	Err     error
+	ID      string // ID of the last backup stored, manifests are not recorded
+}
+
+func NewFanOutDestination(targets ...FanOutTarget) *FanOutDestination {
+	return &FanOutDestination{
+		Targets:         targets,
+		OptionalTimeout: DefaultOptionalTimeout,
+		results:         make([]FanOutResult, len(targets)),
+		log:             logger.WithName("fanoutdst"),
+	}
+}
+
+// FanOutDestination tees every object to all of its targets concurrently
+type FanOutDestination struct {
+	Targets         []FanOutTarget
+	OptionalTimeout time.Duration // Optional targets holding back the others for longer are cancelled
+	results         []FanOutResult
+	log             logger.Logger
+}
+
+func (f *FanOutDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	dsts := make([]Destination, len(f.Targets))
+	for i, t := range f.Targets {
+		dsts[i] = t.Destination
+	}
+	return f.store(ctx, obj, dsts)
+}
+
+// store tees obj to dsts, which belong to the targets with the same index
+func (f *FanOutDestination) store(ctx context.Context, obj Object, dsts []Destination) (int64, error) {
+	if len(f.Targets) == 0 {
+		return 0, fmt.Errorf("no destination to store %s in", obj.ID)
+	}
+	writers := make([]*fanOutWriter, len(f.Targets))
+	results := make([]FanOutResult, len(f.Targets))
+	var wg sync.WaitGroup
+	for i := range f.Targets {
+		// A manifest must not describe a backup, which the target failed to
+		// store
+		if IsManifest(obj.ID) && f.results[i].Err != nil {
+			results[i] = FanOutResult{Err: fmt.Errorf("skipped manifest as backup failed: %w", f.results[i].Err)}
+			continue
+		}
+		tctx, cancel := context.WithCancel(ctx)
+		pr, pw := io.Pipe()
+		w := &fanOutWriter{
+			pw:     pw,
+			chunks: make(chan []byte, fanOutBuffer),
+			done:   make(chan struct{}),
+			stored: make(chan struct{}),
+			cancel: cancel,
+		}
+		writers[i] = w
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w.run()
+		}()
+		go func(i int, w *fanOutWriter, pr *io.PipeReader) {
+			defer wg.Done()
+			defer close(w.stored)
+			defer cancel()
+			t := f.Targets[i]
+			f.log.Info("storing backup", "destination", t.Name, "id", obj.ID)
+			written, err := dsts[i].Store(tctx, Object{ID: obj.ID, Data: pr, Metadata: obj.Metadata})
+			// Unblock the writer, if the destination stopped reading early
+			pr.CloseWithError(io.ErrClosedPipe)
+			results[i] = FanOutResult{Name: t.Name, Written: written, Err: err}
+		}(i, w, pr)
+	}
+	srcerr := f.copy(NewContextReader(ctx, obj.Data), writers)
+	for _, w := range writers {
+		if w != nil {
+			w.srcerr = srcerr
+			close(w.chunks)
+		}
+	}
+	f.drain(writers)
+	wg.Wait()
+	var (
+		written int64
+		failed  []string
+		success bool
+	)
+	for i, res := range results {
+		t := f.Targets[i]
+		if res.Err == nil && srcerr != nil {
+			res.Err = fmt.Errorf("source failed: %w", srcerr)
+		}
+		if w := writers[i]; w != nil && w.stalled {
+			res.Err = fmt.Errorf("%w for %s", ErrStalled, f.OptionalTimeout)
+		}
+		// The writer stops if the destination stopped reading, which lost the
+		// rest of the data if it reported success nonetheless
+		if w := writers[i]; res.Err == nil && w != nil && w.stopped {
+			res.Err = fmt.Errorf("%w: destination returned before the end of the data", io.ErrShortWrite)
+		}
+		f.results[i].Name = t.Name
+		f.results[i].Written += res.Written
+		if f.results[i].Err == nil {
+			f.results[i].Err = res.Err
+		}
+		if res.Err != nil {
+			f.log.Error(res.Err, "failed to store backup", "destination", t.Name, "optional", t.Optional)
+			if !t.Optional {
+				failed = append(failed, fmt.Sprintf("%s: %v", t.Name, res.Err))
+			}
+			continue
+		}
+		success = true
+		if !IsManifest(obj.ID) {
+			f.results[i].ID = obj.ID
+		}
+		if res.Written > written {
+			written = res.Written
+		}
+	}
+	if srcerr != nil {
+		return written, srcerr
+	}
+	if len(failed) > 0 {
+		return written, fmt.Errorf("destinations failed: %s", strings.Join(failed, "; "))
+	}
+	if !success {
+		return written, fmt.Errorf("all destinations failed")
+	}
+	return written, nil
+}
+
+// Begin starts a session in every target, which must all support sessions.
+// Results are recorded as for Store.
+func (f *FanOutDestination) Begin(ctx context.Context, run string) (Session, error) {
+	session := &fanOutSession{f: f, sessions: make([]Session, 0, len(f.Targets))}
+	for _, t := range f.Targets {
+		sd, ok := t.Destination.(SessionDestination)
+		if !ok {
+			_ = session.Abort(context.Background())
+			return nil, fmt.Errorf("%s: %w", t.Name, ErrNoSessions)
+		}
+		s, err := sd.Begin(ctx, run)
+		if err != nil {
+			_ = session.Abort(context.Background())
+			return nil, fmt.Errorf("%s: %w", t.Name, err)
+		}
+		session.sessions = append(session.sessions, s)
+	}
+	return session, nil
+}
+
+type fanOutSession struct {
+	f        *FanOutDestination
+	sessions []Session
+}
+
+func (s *fanOutSession) Store(ctx context.Context, obj Object) (int64, error) {
+	dsts := make([]Destination, len(s.sessions))
+	for i, session := range s.sessions {
+		dsts[i] = session
+	}
+	return s.f.store(ctx, obj, dsts)
+}
+
+// Commit commits the sessions of all targets, which stored every object
+// successfully, and aborts the others
+func (s *fanOutSession) Commit(ctx context.Context) error {
+	var (
+		failed    []string
+		committed bool
+	)
+	for i, session := range s.sessions {
+		t := s.f.Targets[i]
+		res := &s.f.results[i]
+		if res.Err != nil {
+			if err := session.Abort(context.Background()); err != nil {
+				s.f.log.Error(err, "failed to abort session", "destination", t.Name)
+			}
+			if !t.Optional {
+				failed = append(failed, fmt.Sprintf("%s: %v", t.Name, res.Err))
+			}
+			continue
+		}
+		if err := session.Commit(ctx); err != nil {
+			s.f.log.Error(err, "failed to commit session", "destination", t.Name, "optional", t.Optional)
+			res.Err = err
+			if !t.Optional {
+				failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+			}
+			continue
+		}
+		committed = true
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("destinations failed: %s", strings.Join(failed, "; "))
+	}
+	if !committed {
+		return fmt.Errorf("all destinations failed")
+	}
+	return nil
+}
+
+func (s *fanOutSession) Abort(ctx context.Context) error {
+	var failed []string
+	for i, session := range s.sessions {
+		if err := session.Abort(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", s.f.Targets[i].Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("aborting sessions failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// fanOutWriter feeds the data to a single target from its own buffer, so a
+// slow target only holds back the others once its buffer is full
+type fanOutWriter struct {
+	pw      *io.PipeWriter
+	chunks  chan []byte
+	done    chan struct{} // Closed once the writer returned
+	stored  chan struct{} // Closed once the destination returned
+	cancel  context.CancelFunc
+	srcerr  error // Set before chunks is closed
+	stopped bool  // Set by the writer if the destination stopped reading
+	dropped bool  // Set by copy once no more chunks are sent
+	stalled bool  // Set if the target was cancelled for holding back the others
+}
+
+func (w *fanOutWriter) run() {
+	defer close(w.done)
+	for chunk := range w.chunks {
+		if _, err := w.pw.Write(chunk); err != nil {
+			w.stopped = true // error is reported by the destination
+			return
+		}
+	}
+	w.pw.CloseWithError(w.srcerr) // nil equals Close
+}
+
+// stall cancels the target of the writer
+func (w *fanOutWriter) stall() {
+	w.stalled = true
+	w.cancel()
+	w.pw.CloseWithError(ErrStalled)
+}
+
+// copy writes src to all writers and returns the error of src if any. Writers
+// of destinations which stopped reading are dropped, optional ones are
+// cancelled if they do not accept data within the timeout.
+func (f *FanOutDestination) copy(src io.Reader, writers []*fanOutWriter) error {
+	for {
+		// Chunks are shared by all writers and must not be reused
+		buf := make([]byte, 32*1024)
+		n, err := src.Read(buf)
+		if n > 0 {
+			active := false
+			for i, w := range writers {
+				if w == nil || w.dropped {
+					continue
+				}
+				if !f.send(w, f.Targets[i].Optional, buf[:n]) {
+					w.dropped = true
+					continue
+				}
+				active = true
+			}
+			if !active {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send queues chunk for w and reports whether it was accepted
+func (f *FanOutDestination) send(w *fanOutWriter, optional bool, chunk []byte) bool {
+	select {
+	case w.chunks <- chunk:
+		return true
+	case <-w.done:
+		return false
+	default:
+	}
+	var timeout <-chan time.Time
+	if optional {
+		timer := time.NewTimer(f.OptionalTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case w.chunks <- chunk:
+		return true
+	case <-w.done:
+		return false
+	case <-timeout:
+		w.stall()
+		return false
+	}
+}
+
+// drain waits for all destinations to store the data. Optional targets get the
+// timeout once the required ones are done.
+func (f *FanOutDestination) drain(writers []*fanOutWriter) {
+	for i, w := range writers {
+		if w != nil && !f.Targets[i].Optional {
+			<-w.stored
+		}
+	}
+	timer := time.NewTimer(f.OptionalTimeout)
+	defer timer.Stop()
+	expired := false
+	for i, w := range writers {
+		if w == nil || !f.Targets[i].Optional {
+			continue
+		}
+		if !expired {
+			select {
+			case <-w.stored:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case <-w.stored:
+		default:
+			w.stall()
+		}
+	}
+}
+
+// Results returns the accumulated results of all stores per target
+func (f *FanOutDestination) Results() []FanOutResult {
+	return append([]FanOutResult{}, f.results...)
+}
+
+// EnsureRetention ensures the retention for all targets, which stored their
+// backups successfully. Targets which failed are skipped to never remove
+// intact backups in favor of broken ones. The backup stored last is required
+// to be verifiable in every target before anything is removed.
+func (f *FanOutDestination) EnsureRetention(ctx context.Context, policy RetentionPolicy) error {
+	var failed []string
+	for i, t := range f.Targets {
+		rd, ok := t.Destination.(RetentionDestination)
+		if !ok {
+			continue
+		}
+		if f.results[i].Err != nil {
+			f.log.Info("skipping retention as backup failed", "destination", t.Name)
+			continue
+		}
+		retention := policy
+		if t.Retention != nil {
+			retention = *t.Retention
+		}
+		if retention.Require == "" {
+			retention.Require = f.results[i].ID
+		}
+		if err := rd.EnsureRetention(ctx, retention); err != nil {
+			f.log.Error(err, "failed to ensure retention", "destination", t.Name, "optional", t.Optional)
+			if !t.Optional {
+				failed = append(failed, fmt.Sprintf("%s: %v", t.Name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("retention failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (f *FanOutDestination) Close() error {
+	var err error
+	for _, t := range f.Targets {
+		if c, ok := t.Destination.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// failingDestination reads limit bytes and fails afterwards
+type failingDestination struct {
+	limit     int64
+	retention *backup.RetentionPolicy
+	ids       []string
+}
+
+func (f *failingDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	f.ids = append(f.ids, obj.ID)
+	n, _ := io.CopyN(ioutil.Discard, obj.Data, f.limit)
+	return n, fmt.Errorf("failed after %d bytes", n)
+}
+
+func (f *failingDestination) EnsureRetention(_ context.Context, policy backup.RetentionPolicy) error {
+	f.retention = &policy
+	return nil
+}
+
+// truncatingDestination reads limit bytes and reports success nonetheless
+type truncatingDestination struct {
+	limit int64
+}
+
+func (t *truncatingDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	n, err := io.CopyN(ioutil.Discard, obj.Data, t.limit)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// stallingDestination reads limit bytes and blocks until it is cancelled
+type stallingDestination struct {
+	limit int64
+}
+
+func (s *stallingDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	n, _ := io.CopyN(ioutil.Discard, obj.Data, s.limit)
+	<-ctx.Done()
+	return n, ctx.Err()
+}
+
+// retentionDestination records the retention it was asked for
+type retentionDestination struct {
+	*mem.BufferDestination
+	retention backup.RetentionPolicy
+}
+
+func (r *retentionDestination) EnsureRetention(_ context.Context, policy backup.RetentionPolicy) error {
+	r.retention = policy
+	return nil
+}
+
+var _ = Describe("FanOutDestination", func() {
+	data := bytes.Repeat([]byte("temporarycontent"), 1<<14)
+
+	It("should store object in all destinations", func() {
+		a, _ := mem.NewBufferDestination()
+		b, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: b},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		written, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(Equal(int64(len(data))))
+		Expect(a.Data["backup.tgz"]).To(Equal(data))
+		Expect(b.Data["backup.tgz"]).To(Equal(data))
+		for _, res := range dst.Results() {
+			Expect(res.Err).ToNot(HaveOccurred())
+			Expect(res.Written).To(Equal(int64(len(data))))
+		}
+	})
+	It("should fail if a required destination fails", func() {
+		a, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: &failingDestination{limit: 1024}},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), dst)
+		Expect(err).To(HaveOccurred())
+		Expect(a.Data["backup.tgz"]).To(Equal(data))
+		results := dst.Results()
+		Expect(results[0].Err).ToNot(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+	})
+	It("should succeed if only an optional destination fails", func() {
+		a, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: &failingDestination{limit: 1024}, Optional: true},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Data["backup.tgz"]).To(Equal(data))
+	})
+	It("should cancel optional destinations holding back the others", func() {
+		for _, limit := range []int64{1024, int64(len(data))} {
+			a, _ := mem.NewBufferDestination()
+			dst := backup.NewFanOutDestination(
+				backup.FanOutTarget{Name: "a", Destination: a},
+				backup.FanOutTarget{Name: "b", Destination: &stallingDestination{limit: limit}, Optional: true},
+			)
+			dst.OptionalTimeout = 100 * time.Millisecond
+			src, _ := mem.NewBufferSource("backup.tgz", data)
+			_, err := src.Stream(context.Background(), dst)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Data["backup.tgz"]).To(Equal(data))
+			Expect(errors.Is(dst.Results()[1].Err, backup.ErrStalled)).To(BeTrue())
+		}
+	})
+	It("should fail if all destinations fail", func() {
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: &failingDestination{limit: 0}, Optional: true},
+			backup.FanOutTarget{Name: "b", Destination: &failingDestination{limit: 1024}, Optional: true},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), dst)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should ensure retention per destination and skip failed ones", func() {
+		a := &retentionDestination{}
+		a.BufferDestination, _ = mem.NewBufferDestination()
+		b := &retentionDestination{}
+		b.BufferDestination, _ = mem.NewBufferDestination()
+		c := &failingDestination{limit: 1024}
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: b, Retention: &backup.RetentionPolicy{KeepDaily: 7}},
+			backup.FanOutTarget{Name: "c", Destination: c, Optional: true},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.EnsureRetention(context.Background(), backup.KeepLast(3))).To(Succeed())
+		Expect(a.retention).To(Equal(backup.RetentionPolicy{KeepLast: 3, Require: "backup.tgz"}))
+		Expect(b.retention).To(Equal(backup.RetentionPolicy{KeepDaily: 7, Require: "backup.tgz"}))
+		Expect(c.retention).To(BeNil())
+	})
+	It("should fail destinations returning before the end of the data", func() {
+		a, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: &truncatingDestination{limit: 1024}},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), dst)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(dst.Results()[1].Err, io.ErrShortWrite)).To(BeTrue())
+	})
+	It("should not store manifests of failed backups", func() {
+		a, _ := mem.NewBufferDestination()
+		b := &failingDestination{limit: 1024}
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: b, Optional: true},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewManifestDestination(dst, backup.ManifestInfo{}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Data).To(HaveKey(backup.ManifestID("backup.tgz")))
+		Expect(b.ids).To(Equal([]string{"backup.tgz"}))
+	})
+})
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package faults wraps sources and destinations to inject latency,
+// throttling, errors, short writes, hangs and corrupted bytes into the data
+// they stream, so the handling of misbehaving backends can be tested.
+package faults
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// ErrInjected is returned by reads failing because of an injected fault
+var ErrInjected = errors.New("injected fault")
+
+// Conf configures the faults injected into the data of every object. Random
+// decisions are made by a generator seeded with Seed and the ID of the object,
+// so the same faults are injected again when a run is repeated with the same
+// seed.
+type Conf struct {
+	Seed        int64
+	Latency     time.Duration // Upper bound of the random delay before every read
+	Throttle    int64         // Bytes per second the data is limited to, unlimited if 0
+	ShortReads  bool          // Reads return a random part of the requested bytes
+	ErrorRate   float64       // Probability of every read to fail with ErrInjected
+	FailAfter   int64         // Reads fail with ErrInjected after this many bytes, if set
+	HangRate    float64       // Probability of every read to block until the context is done
+	CorruptRate float64       // Probability of every read to flip a random bit of the data
+	// Destinations stop reading after this many bytes and report success like
+	// a backend silently losing data, if set. Ignored by sources.
+	ShortWriteAfter int64
+}
+
+// NewDestination injects the faults into the data of all objects read by dst.
+// If dst is a RetentionDestination, so is the returned destination, the
+// retention itself is passed through unchanged.
+func NewDestination(dst backup.Destination, conf Conf) backup.Destination {
+	d := &destination{dst: dst, conf: conf}
+	if rd, ok := dst.(backup.RetentionDestination); ok {
+		return &retentionDestination{destination: d, rd: rd}
+	}
+	return d
+}
+
+type destination struct {
+	dst  backup.Destination
+	conf Conf
+}
+
+func (d *destination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	data := NewReader(ctx, obj.Data, d.conf, obj.ID)
+	if d.conf.ShortWriteAfter > 0 {
+		data = io.LimitReader(data, d.conf.ShortWriteAfter)
+	}
+	return d.dst.Store(ctx, backup.Object{ID: obj.ID, Data: data, Metadata: obj.Metadata})
+}
+
+type retentionDestination struct {
+	*destination
+	rd backup.RetentionDestination
+}
+
+func (r *retentionDestination) EnsureRetention(ctx context.Context, policy backup.RetentionPolicy) error {
+	return r.rd.EnsureRetention(ctx, policy)
+}
+
+// NewSource injects the faults into the data of all objects streamed by src
+func NewSource(src backup.Source, conf Conf) backup.Source {
+	conf.ShortWriteAfter = 0
+	return &source{src: src, conf: conf}
+}
+
+type source struct {
+	src  backup.Source
+	conf Conf
+}
+
+func (s *source) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	return s.src.Stream(ctx, &destination{dst: dst, conf: s.conf})
+}
+
+// NewReader returns a reader injecting the faults into the data of r. id
+// selects the sequence of random decisions together with the seed. Delays and
+// hangs end as soon as ctx is done.
+func NewReader(ctx context.Context, r io.Reader, conf Conf, id string) io.Reader {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return &reader{
+		ctx:   ctx,
+		r:     r,
+		conf:  conf,
+		rand:  rand.New(rand.NewSource(conf.Seed ^ int64(h.Sum64()))),
+		start: time.Now(),
+	}
+}
+
+type reader struct {
+	ctx   context.Context
+	r     io.Reader
+	conf  Conf
+	rand  *rand.Rand
+	start time.Time
+	read  int64
+}
+
+func (f *reader) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return f.r.Read(p)
+	}
+	if f.conf.Latency > 0 {
+		if err := f.sleep(time.Duration(f.rand.Int63n(int64(f.conf.Latency)))); err != nil {
+			return 0, err
+		}
+	}
+	if f.conf.HangRate > 0 && f.rand.Float64() < f.conf.HangRate {
+		<-f.ctx.Done()
+		return 0, f.ctx.Err()
+	}
+	if f.conf.ErrorRate > 0 && f.rand.Float64() < f.conf.ErrorRate {
+		return 0, ErrInjected
+	}
+	if f.conf.FailAfter > 0 {
+		remaining := f.conf.FailAfter - f.read
+		if remaining <= 0 {
+			return 0, ErrInjected
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	if f.conf.ShortReads && len(p) > 1 {
+		p = p[:1+f.rand.Intn(len(p))]
+	}
+	// Read in chunks of a tenth of a second, so the rate is even
+	if chunk := f.conf.Throttle / 10; chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := f.r.Read(p)
+	if n > 0 && f.conf.CorruptRate > 0 && f.rand.Float64() < f.conf.CorruptRate {
+		p[f.rand.Intn(n)] ^= 1 << uint(f.rand.Intn(8))
+	}
+	f.read += int64(n)
+	if f.conf.Throttle > 0 {
+		due := f.start.Add(time.Duration(float64(f.read) / float64(f.conf.Throttle) * float64(time.Second)))
+		if serr := f.sleep(time.Until(due)); serr != nil {
+			return n, serr
+		}
+	}
+	return n, err
+}
+
+// sleep waits for d unless the context is done before
+func (f *reader) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
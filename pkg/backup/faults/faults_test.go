@@ -0,0 +1,235 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package faults_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/faults"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// retentionDestination records the retention it was asked for
+type retentionDestination struct {
+	*mem.BufferDestination
+	policies []backup.RetentionPolicy
+}
+
+func newRetentionDestination() *retentionDestination {
+	dst, _ := mem.NewBufferDestination()
+	return &retentionDestination{BufferDestination: dst}
+}
+
+func (r *retentionDestination) EnsureRetention(_ context.Context, policy backup.RetentionPolicy) error {
+	r.policies = append(r.policies, policy)
+	return nil
+}
+
+// runBackup stores src in dst like the worker does and only ensures the
+// retention if the backup succeeded
+func runBackup(ctx context.Context, src backup.Source, dst *backup.FanOutDestination, id string) error {
+	if _, err := src.Stream(ctx, backup.NewManifestDestination(dst, backup.ManifestInfo{})); err != nil {
+		return err
+	}
+	return dst.EnsureRetention(context.Background(), backup.RetentionPolicy{KeepLast: 1, Require: id})
+}
+
+func readAll(ctx context.Context, data []byte, conf faults.Conf) ([]byte, error) {
+	return ioutil.ReadAll(faults.NewReader(ctx, bytes.NewReader(data), conf, "backup.tgz"))
+}
+
+var _ = Describe("Faults", func() {
+	data := bytes.Repeat([]byte("temporarycontent"), 1<<14)
+
+	It("should inject the same faults for the same seed", func() {
+		conf := faults.Conf{Seed: 1, CorruptRate: 0.5, ShortReads: true}
+		a, err := readAll(context.Background(), data, conf)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := readAll(context.Background(), data, conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a).To(Equal(b))
+		Expect(a).ToNot(Equal(data))
+
+		conf.Seed = 2
+		c, err := readAll(context.Background(), data, conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c).ToNot(Equal(a))
+	})
+	It("should keep the data intact with latency and short reads", func() {
+		read, err := readAll(context.Background(), data, faults.Conf{Seed: 1, ShortReads: true, Latency: 10 * time.Microsecond})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(data))
+	})
+	It("should throttle the data", func() {
+		start := time.Now()
+		read, err := readAll(context.Background(), data, faults.Conf{Throttle: 1 << 20})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(data))
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+	It("should end hangs with the context", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := readAll(ctx, data, faults.Conf{HangRate: 1})
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+	It("should fail sources after the given number of bytes", func() {
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		dst, _ := mem.NewBufferDestination()
+		_, err := faults.NewSource(src, faults.Conf{FailAfter: 1024}).Stream(context.Background(), dst)
+		Expect(errors.Is(err, faults.ErrInjected)).To(BeTrue())
+		Expect(dst.Data).To(BeEmpty())
+	})
+	It("should pass retention through", func() {
+		dst := newRetentionDestination()
+		rd, ok := faults.NewDestination(dst, faults.Conf{}).(backup.RetentionDestination)
+		Expect(ok).To(BeTrue())
+		Expect(rd.EnsureRetention(context.Background(), backup.KeepLast(1))).To(Succeed())
+		Expect(dst.policies).To(HaveLen(1))
+	})
+	It("should detect corrupted backups on restore", func() {
+		intact, _ := mem.NewBufferDestination()
+		corrupt, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "intact", Destination: intact},
+			backup.FanOutTarget{Name: "corrupt", Destination: faults.NewDestination(corrupt, faults.Conf{Seed: 1, CorruptRate: 1})},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewManifestDestination(dst, backup.ManifestInfo{}))
+		Expect(err).ToNot(HaveOccurred())
+		manifest, err := backup.ParseManifest(bytes.NewReader(intact.Data[backup.ManifestID("backup.tgz")]))
+		Expect(err).ToNot(HaveOccurred())
+
+		restored, _ := mem.NewBufferDestination()
+		src, _ = mem.NewBufferSource("backup.tgz", corrupt.Data["backup.tgz"])
+		_, err = src.Stream(context.Background(), backup.NewVerifyingDestination(restored, manifest.SHA256))
+		Expect(errors.Is(err, backup.ErrChecksumMismatch)).To(BeTrue())
+		Expect(restored.Data).To(BeEmpty())
+	})
+	It("should report destinations silently losing data", func() {
+		dst, _ := mem.NewBufferDestination()
+		_, err := backup.Pipe(context.Background(), backup.NewManifestDestination(
+			faults.NewDestination(dst, faults.Conf{ShortWriteAfter: 1024}), backup.ManifestInfo{}),
+			backup.Object{ID: "backup.tgz"}, func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			})
+		Expect(errors.Is(err, io.ErrShortWrite)).To(BeTrue())
+		Expect(dst.Data).ToNot(HaveKey(backup.ManifestID("backup.tgz")))
+	})
+	It("should report fan-out targets silently losing data", func() {
+		healthy := newRetentionDestination()
+		lossy := newRetentionDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "healthy", Destination: healthy},
+			backup.FanOutTarget{Name: "lossy", Destination: faults.NewDestination(lossy, faults.Conf{ShortWriteAfter: 1024})},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		err := runBackup(context.Background(), src, dst, "backup.tgz")
+		Expect(err).To(MatchError(ContainSubstring(io.ErrShortWrite.Error())))
+		Expect(errors.Is(dst.Results()[1].Err, io.ErrShortWrite)).To(BeTrue())
+		Expect(healthy.policies).To(BeEmpty())
+		Expect(lossy.policies).To(BeEmpty())
+	})
+	It("should only run retention on optional targets, which succeeded", func() {
+		healthy := newRetentionDestination()
+		broken := newRetentionDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "healthy", Destination: healthy},
+			backup.FanOutTarget{Name: "broken", Destination: faults.NewDestination(broken, faults.Conf{FailAfter: 1024}), Optional: true},
+		)
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		Expect(runBackup(context.Background(), src, dst, "backup.tgz")).To(Succeed())
+		Expect(healthy.Data["backup.tgz"]).To(Equal(data))
+		Expect(healthy.policies).To(HaveLen(1))
+		Expect(broken.Data).To(BeEmpty())
+		Expect(broken.policies).To(BeEmpty())
+	})
+	It("should never run retention after a broken upload", func() {
+		failures := 0
+		for seed := int64(1); seed <= 20; seed++ {
+			conf := faults.Conf{Seed: seed, ErrorRate: 0.02, ShortReads: true, Latency: 10 * time.Microsecond}
+			a := newRetentionDestination()
+			b := newRetentionDestination()
+			dst := backup.NewFanOutDestination(
+				backup.FanOutTarget{Name: "a", Destination: faults.NewDestination(a, conf)},
+				backup.FanOutTarget{Name: "b", Destination: b},
+			)
+			src, _ := mem.NewBufferSource("backup.tgz", data)
+			err := runBackup(context.Background(), faults.NewSource(src, conf), dst, "backup.tgz")
+			if err != nil {
+				failures++
+				Expect(err).To(MatchError(ContainSubstring(faults.ErrInjected.Error())), fmt.Sprintf("seed %d", seed))
+				Expect(a.policies).To(BeEmpty(), fmt.Sprintf("seed %d", seed))
+				Expect(b.policies).To(BeEmpty(), fmt.Sprintf("seed %d", seed))
+				continue
+			}
+			for _, d := range []*retentionDestination{a, b} {
+				Expect(d.Data["backup.tgz"]).To(Equal(data), fmt.Sprintf("seed %d", seed))
+				Expect(d.policies).To(HaveLen(1), fmt.Sprintf("seed %d", seed))
+			}
+		}
+		Expect(failures).To(BeNumerically(">", 0))
+		Expect(failures).To(BeNumerically("<", 20))
+	})
+	It("should keep old backups in S3 after a broken upload", func() {
+		server, err := testutil.NewS3Server()
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+		s3dst, err := s3.NewS3Destination(&s3.S3DestinationConf{
+			Endpoint:     server.Endpoint,
+			AccessKey:    server.AccessKeyID,
+			SecretKey:    server.SecretAccessKey,
+			DisableSSL:   true,
+			Bucket:       "backups",
+			CreateBucket: true,
+			PartSize:     server.MinPartSize,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		dst := backup.NewFanOutDestination(backup.FanOutTarget{Name: "s3", Destination: s3dst})
+
+		old := backup.NewID(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "")
+		src, _ := mem.NewBufferSource(old, data)
+		Expect(runBackup(context.Background(), src, dst, old)).To(Succeed())
+
+		large := bytes.Repeat(data, 48) // multiple parts
+		id := backup.NewID(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "")
+		src, _ = mem.NewBufferSource(id, large)
+		err = runBackup(context.Background(), faults.NewSource(src, faults.Conf{FailAfter: int64(len(large) / 2)}), dst, id)
+		Expect(errors.Is(err, faults.ErrInjected)).To(BeTrue())
+		// Skipped for the failed target
+		Expect(dst.EnsureRetention(context.Background(), backup.RetentionPolicy{KeepLast: 1, Require: id})).To(Succeed())
+
+		keys := strings.Join(server.Keys("backups"), ",")
+		Expect(keys).To(ContainSubstring(old))
+		Expect(keys).ToNot(ContainSubstring(id))
+		Expect(server.Uploads("backups")).To(BeEmpty())
+	})
+})
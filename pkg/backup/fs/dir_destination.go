@@ -17,29 +17,83 @@ limitations under the License.
 package fs
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
 )
 
-func NewDirDestination(dir string) (backup.Destination, error) {
+func NewDirDestination(dir string) (backup.RetentionDestination, error) {
 	return &dirDestination{
-		dir: dir,
+		DirStore: &backup.DirStore{
+			FS:  osFS{},
+			Dir: filepath.ToSlash(dir),
+			Log: logger.WithName("dirdst"),
+		},
 	}, nil
 }
 
 type dirDestination struct {
-	dir string
+	*backup.DirStore
 }
 
-func (f *dirDestination) Store(obj backup.Object) (int64, error) {
-	fp := filepath.Join(f.dir, obj.ID)
-	file, err := os.Create(fp)
+// Preflight checks files can be written, listed and removed in the directory
+func (f *dirDestination) Preflight(_ context.Context) error {
+	dir := filepath.FromSlash(f.Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, ".preflight-")
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return err
+	}
+	return os.Remove(file.Name())
+}
+
+func (f *dirDestination) EnsureRetention(ctx context.Context, policy backup.RetentionPolicy) error {
+	// The backup of this run is stored in the directory of its session
+	return backup.ApplyRetention(ctx, f, f.Retention(policy), f.Log)
+}
+
+func (f *dirDestination) Manifest(_ context.Context, id string) (*backup.Manifest, error) {
+	file, err := os.Open(filepath.FromSlash(backup.ManifestID(path.Join(f.Dir, id))))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer file.Close()
-	return io.Copy(file, obj.Data)
+	return backup.ParseManifest(file)
+}
+
+// osFS is the local file system
+type osFS struct{}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.FromSlash(dir))
+}
+
+func (osFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.FromSlash(name))
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(filepath.FromSlash(name))
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(filepath.FromSlash(dir), 0755)
 }
@@ -18,13 +18,19 @@ package fs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -40,7 +46,7 @@ var _ = Describe("FileDestination", func() {
 		Expect(dst).ToNot(BeNil())
 		buf := bytes.NewBuffer(data)
 		Expect(buf).ToNot(BeNil())
-		written, err := dst.Store(backup.Object{ID: "tmpfile", Data: buf})
+		written, err := dst.Store(context.Background(), backup.Object{ID: "tmpfile", Data: buf})
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(fp).Should(BeAnExistingFile())
@@ -48,4 +54,167 @@ var _ = Describe("FileDestination", func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(res).Should(Equal(data))
 	})
+	It("should create missing directories", func() {
+		data := []byte("temporarycontent")
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(filepath.Join(dir, "ns", "name"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Store(context.Background(), backup.Object{ID: "tmpfile", Data: bytes.NewBuffer(data)})
+		Expect(err).ToNot(HaveOccurred())
+		res, err := ioutil.ReadFile(filepath.Join(dir, "ns", "name", "tmpfile"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).Should(Equal(data))
+	})
+	It("should not leave partial backups on cancellation", func() {
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = dst.Store(ctx, backup.Object{ID: "tmpfile", Data: bytes.NewBufferString("testcontent")})
+		Expect(err).To(MatchError(context.Canceled))
+		entries, err := ioutil.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+	It("should pass preflight checks", func() {
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(filepath.Join(dir, "ns", "name"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.(backup.PreflightChecker).Preflight(context.Background())).To(Succeed())
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "ns", "name"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+	It("should store sessions in run directories", func() {
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		src, _ := mem.NewBufferSource("backup.tgz", []byte("testcontent"))
+		_, err = backup.StreamSession(context.Background(), src, dst, "run-a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "run-a", "backup.tgz")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "run-a", backup.CompletionMarker)).To(BeAnExistingFile())
+
+		session, err := backup.Begin(context.Background(), dst, "run-b")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), session)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Abort(context.Background())).To(Succeed())
+		Expect(filepath.Join(dir, "run-b")).ToNot(BeADirectory())
+
+		// Runs are only listed once committed
+		session, err = backup.Begin(context.Background(), dst, "run-c")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), session)
+		Expect(err).ToNot(HaveOccurred())
+		ids, err := dst.(backup.Lister).List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"run-a/backup.tgz"}))
+	})
+	It("should apply the retention to the backups of runs", func() {
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		var ids []string
+		for i, run := range []string{"run-a", "run-b"} {
+			id := backup.NewID(now.Add(time.Duration(i)*time.Hour), ".tgz")
+			ids = append(ids, id)
+			src, _ := mem.NewBufferSource(id, []byte("testcontent"))
+			_, err := backup.StreamSession(context.Background(), src, backup.NewManifestDestination(dst, backup.ManifestInfo{}), run)
+			Expect(err).ToNot(HaveOccurred())
+			mtime := now.Add(time.Duration(i) * time.Hour)
+			Expect(os.Chtimes(filepath.Join(dir, run, id), mtime, mtime)).To(Succeed())
+		}
+		policy := backup.KeepLast(1)
+		policy.Pattern = backup.IDPattern
+		policy.Require = ids[1]
+		Expect(dst.EnsureRetention(context.Background(), policy)).To(Succeed())
+		Expect(filepath.Join(dir, "run-a")).ToNot(BeADirectory())
+		stored, err := dst.(backup.Lister).List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(Equal([]string{"run-b/" + ids[1]}))
+	})
+	It("should fail preflight checks for read-only directories", func() {
+		if os.Geteuid() == 0 {
+			Skip("permissions are not enforced for root")
+		}
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(os.Chmod(dir, 0555)).To(Succeed())
+		dst, err := NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.(backup.PreflightChecker).Preflight(context.Background())).ToNot(Succeed())
+	})
+	It("should list backups newest first", func() {
+		dir, err := ioutil.TempDir("", "fdst")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst, err := NewDirDestination(dir)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		for i, name := range []string{"backup-a.tgz", "backup-b.tgz", backup.ManifestID("backup-b.tgz")} {
+			_, err := dst.Store(context.Background(), backup.Object{ID: name, Data: bytes.NewBufferString("testcontent")})
+			Expect(err).ToNot(HaveOccurred())
+			mtime := now.Add(time.Duration(i) * time.Minute)
+			Expect(os.Chtimes(filepath.Join(dir, name), mtime, mtime)).To(Succeed())
+		}
+		ids, err := dst.(backup.Lister).List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"backup-b.tgz", "backup-a.tgz"}))
+	})
+	DescribeTable("ensure retention for values",
+		func(retention int, count int) {
+			dir, err := ioutil.TempDir("", "fdst")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			dst, err := NewDirDestination(dir)
+			Expect(err).ToNot(HaveOccurred())
+			expected := []string{}
+			now := time.Now()
+			for i := 0; i < count; i++ {
+				name := fmt.Sprintf("backup-%d.tgz", i)
+				_, err := dst.Store(context.Background(), backup.Object{ID: name, Data: bytes.NewBufferString("testcontent")})
+				Expect(err).ToNot(HaveOccurred())
+				mtime := now.Add(time.Duration(i) * time.Minute)
+				Expect(os.Chtimes(filepath.Join(dir, name), mtime, mtime)).To(Succeed())
+				// Every other backup has no manifest and is never removed
+				manifest := backup.ManifestID(name)
+				if i%2 == 0 {
+					Expect(ioutil.WriteFile(filepath.Join(dir, manifest), []byte("{}"), 0644)).To(Succeed())
+					Expect(os.Chtimes(filepath.Join(dir, manifest), mtime, mtime)).To(Succeed())
+				}
+				if i%2 == 1 {
+					expected = append(expected, name)
+				} else if i >= count-2*retention {
+					expected = append(expected, name, manifest)
+				}
+			}
+			Expect(dst.EnsureRetention(context.Background(), backup.KeepLast(retention))).To(Succeed())
+			entries, err := ioutil.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			found := []string{}
+			for _, fi := range entries {
+				found = append(found, fi.Name())
+			}
+			sort.Strings(expected)
+			sort.Strings(found)
+			Expect(found).To(Equal(expected))
+		},
+		Entry("3 out of 5", 3, 5),
+		Entry("4 out of 5", 4, 5),
+		Entry("5 out of 12", 5, 12),
+	)
 })
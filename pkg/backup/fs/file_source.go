@@ -17,6 +17,7 @@ limitations under the License.
 package fs
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 
@@ -33,14 +34,19 @@ type fileSource struct {
 	fp string
 }
 
-func (f *fileSource) Stream(dst backup.Destination) (int64, error) {
+func (f *fileSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
 	file, err := os.Open(f.fp)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
-	return dst.Store(backup.Object{
-		ID:   filepath.Base(f.fp),
-		Data: file,
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return dst.Store(ctx, backup.Object{
+		ID:       filepath.Base(f.fp),
+		Data:     backup.NewContextReader(ctx, file),
+		Metadata: backup.ObjectInfo{Size: info.Size()}.Metadata(),
 	})
 }
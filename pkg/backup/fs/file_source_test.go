@@ -17,6 +17,7 @@ limitations under the License.
 package fs
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -40,7 +41,7 @@ var _ = Describe("FileSource", func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(src).ToNot(BeNil())
 		dst, _ := mem.NewBufferDestination()
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(dst.Data["tmpfile"]).Should(Equal(data))
@@ -62,7 +63,7 @@ var _ = Describe("FileSource", func() {
 		dst, err := NewDirDestination(filepath.Dir(dfp))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(dst).ToNot(BeNil())
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(dfp).Should(BeAnExistingFile())
@@ -0,0 +1,254 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+const ManifestExtension = ".manifest.json"
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrNoChecksum is returned if a backup has no manifest containing its
+// checksum, so it cannot be verified
+var ErrNoChecksum = errors.New("no checksum available")
+
+// Manifest describes a stored backup and is stored as sidecar next to it
+type Manifest struct {
+	Object          string            `json:"object"`
+	Plan            string            `json:"plan,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Tools           map[string]string `json:"tools,omitempty"`
+	Size            int64             `json:"size"`
+	SHA256          string            `json:"sha256"`
+	Compression     string            `json:"compression,omitempty"`
+	EncryptionKeyID string            `json:"encryptionKeyID,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	SourceVersion   string            `json:"sourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Created         time.Time         `json:"created"`
+}
+
+// ManifestInfo is recorded in the manifest of every backup
+type ManifestInfo struct {
+	Plan   string            // Namespace and name of the plan
+	Source string            // Type of the source, e.g. mongodb
+	Tools  map[string]string // Versions of the tools used to create the backup
+	Labels map[string]string // Added to the labels of every backup
+}
+
+// ManifestID returns the ID of the manifest of the object with the given ID
+func ManifestID(id string) string {
+	return id + ManifestExtension
+}
+
+// IsManifest returns true if id is the ID of a manifest
+func IsManifest(id string) bool {
+	return strings.HasSuffix(id, ManifestExtension)
+}
+
+// ParseManifest reads a manifest as stored by a manifest destination
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.SHA256 == "" {
+		return nil, fmt.Errorf("manifest of %s has no checksum", manifest.Object)
+	}
+	return manifest, nil
+}
+
+// NewManifestDestination computes the SHA-256 of all objects while they are
+// stored in dst and stores a manifest next to each of them afterwards. The
+// manifest is the only record of the checksum, as it is known only once the
+// object has been stored. The creation time, source type and labels of info are added to the metadata
+// unless the object already has them.
+func NewManifestDestination(dst Destination, info ManifestInfo) Destination {
+	return &manifestDestination{
+		dst:  dst,
+		info: info,
+		log:  logger.WithName("manifestdst"),
+	}
+}
+
+type manifestDestination struct {
+	dst  Destination
+	info ManifestInfo
+	log  logger.Logger
+}
+
+// Begin starts a session of the wrapped destination, which stores manifests
+// next to all objects of the session
+func (m *manifestDestination) Begin(ctx context.Context, run string) (Session, error) {
+	return beginStage(ctx, m.dst, run, func(dst Destination) Destination {
+		return &manifestDestination{dst: dst, info: m.info, log: m.log}
+	})
+}
+
+func (m *manifestDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	obj.Metadata = m.metadata(obj)
+	info := obj.Info()
+	h := sha256.New()
+	counter := &countingWriter{}
+	written, err := m.dst.Store(ctx, Object{
+		ID:       obj.ID,
+		Data:     io.TeeReader(obj.Data, io.MultiWriter(h, counter)),
+		Metadata: obj.Metadata,
+	})
+	if err != nil {
+		return written, err
+	}
+	// A destination returning before the end of the data silently lost the
+	// rest of it, which must not be recorded as a complete backup
+	var next [1]byte
+	if n, err := io.ReadFull(obj.Data, next[:]); n > 0 {
+		return written, fmt.Errorf("%w: %s: destination returned after %d bytes before the end of the data", io.ErrShortWrite, obj.ID, counter.n)
+	} else if err != io.EOF {
+		return written, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	raw, err := json.MarshalIndent(&Manifest{
+		Object:          obj.ID,
+		Plan:            m.info.Plan,
+		Source:          info.SourceType,
+		Tools:           m.info.Tools,
+		Size:            counter.n,
+		SHA256:          digest,
+		Compression:     info.Compression,
+		EncryptionKeyID: info.EncryptionKeyID,
+		ContentType:     info.ContentType,
+		SourceVersion:   info.SourceVersion,
+		Labels:          info.Labels,
+		Created:         info.Created,
+	}, "", "  ")
+	if err != nil {
+		return written, err
+	}
+	if _, err := m.dst.Store(ctx, Object{
+		ID:   ManifestID(obj.ID),
+		Data: bytes.NewReader(raw),
+	}); err != nil {
+		return written, fmt.Errorf("failed to store manifest: %w", err)
+	}
+	m.log.Info("stored manifest", "id", obj.ID, "sha256", digest, "size", counter.n)
+	return written, nil
+}
+
+// NewVerifyingReader returns a reader, which fails with ErrChecksumMismatch
+// instead of io.EOF, if the SHA-256 of the data read does not match the given
+// hex encoded checksum. Consumers therefore never finish successfully on
+// corrupted data.
+func NewVerifyingReader(r io.Reader, checksum string) io.Reader {
+	return &verifyingReader{
+		r:        r,
+		h:        sha256.New(),
+		checksum: strings.ToLower(checksum),
+	}
+}
+
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	checksum string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(v.h.Sum(nil)); actual != v.checksum {
+			return n, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, v.checksum, actual)
+		}
+	}
+	return n, err
+}
+
+// NewVerifyingDestination verifies the checksum of objects while they are
+// stored in dst
+func NewVerifyingDestination(dst Destination, checksum string) Destination {
+	return &verifyingDestination{
+		dst:      dst,
+		checksum: checksum,
+	}
+}
+
+type verifyingDestination struct {
+	dst      Destination
+	checksum string
+}
+
+func (v *verifyingDestination) Store(ctx context.Context, obj Object) (int64, error) {
+	vr := NewVerifyingReader(obj.Data, v.checksum)
+	written, err := v.dst.Store(ctx, Object{
+		ID:       obj.ID,
+		Data:     vr,
+		Metadata: obj.Metadata,
+	})
+	if err != nil {
+		return written, err
+	}
+	// Make sure the checksum is verified, even if dst did not read until EOF
+	if _, err := io.Copy(io.Discard, vr); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// metadata returns the metadata of obj completed with the defaults of the
+// manifest info
+func (m *manifestDestination) metadata(obj Object) map[string]string {
+	info := obj.Info()
+	defaults := ObjectInfo{}
+	if info.Created.IsZero() {
+		defaults.Created = time.Now()
+	}
+	if info.SourceType == "" {
+		defaults.SourceType = m.info.Source
+	}
+	for k, v := range m.info.Labels {
+		if _, ok := info.Labels[k]; !ok {
+			if defaults.Labels == nil {
+				defaults.Labels = map[string]string{}
+			}
+			defaults.Labels[k] = v
+		}
+	}
+	return obj.WithInfo(defaults)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
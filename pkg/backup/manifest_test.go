@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manifest", func() {
+	data := bytes.Repeat([]byte("temporarycontent"), 1<<12)
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	It("should store manifest next to backup", func() {
+		buf, _ := mem.NewBufferDestination()
+		dst := &metadataDestination{BufferDestination: buf}
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewManifestDestination(dst, backup.ManifestInfo{
+			Plan:   "default/plan",
+			Source: "mongodb",
+			Tools:  map[string]string{"mongodump": "v1"},
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.Data["backup.tgz"]).To(Equal(data))
+		manifest, err := backup.ParseManifest(bytes.NewReader(buf.Data[backup.ManifestID("backup.tgz")]))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Object).To(Equal("backup.tgz"))
+		Expect(manifest.Plan).To(Equal("default/plan"))
+		Expect(manifest.Source).To(Equal("mongodb"))
+		Expect(manifest.Tools).To(HaveKeyWithValue("mongodump", "v1"))
+		Expect(manifest.Size).To(Equal(int64(len(data))))
+		Expect(manifest.SHA256).To(Equal(checksum))
+		// The manifest does not inherit the metadata of the backup
+		Expect(dst.objects[backup.ManifestID("backup.tgz")]).To(BeEmpty())
+	})
+	It("should record compression and encryption", func() {
+		buf, _ := mem.NewBufferDestination()
+		var dst backup.Destination = backup.NewManifestDestination(buf, backup.ManifestInfo{})
+		dst = backup.NewEncryptingDestination(dst, newEncryptionKey("key-1", 1))
+		dst, err := backup.NewCompressingDestination(dst, backup.CompressionConf{Codec: backup.CompressionGzip})
+		Expect(err).ToNot(HaveOccurred())
+		src, _ := mem.NewBufferSource("backup.archive", data)
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		manifest, err := backup.ParseManifest(bytes.NewReader(buf.Data[backup.ManifestID("backup.archive.gz.enc")]))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Compression).To(Equal(backup.CompressionGzip))
+		Expect(manifest.EncryptionKeyID).To(Equal("key-1"))
+		Expect(manifest.Size).To(Equal(int64(len(buf.Data["backup.archive.gz.enc"]))))
+	})
+	It("should verify checksums", func() {
+		_, err := ioutil.ReadAll(backup.NewVerifyingReader(bytes.NewReader(data), checksum))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ioutil.ReadAll(backup.NewVerifyingReader(bytes.NewReader(data[1:]), checksum))
+		Expect(errors.Is(err, backup.ErrChecksumMismatch)).To(BeTrue())
+	})
+	It("should fail to store corrupted data", func() {
+		buf, _ := mem.NewBufferDestination()
+		src, _ := mem.NewBufferSource("backup.tgz", append([]byte("x"), data...))
+		_, err := src.Stream(context.Background(), backup.NewVerifyingDestination(buf, checksum))
+		Expect(errors.Is(err, backup.ErrChecksumMismatch)).To(BeTrue())
+		src, _ = mem.NewBufferSource("backup.tgz", data)
+		_, err = src.Stream(context.Background(), backup.NewVerifyingDestination(buf, checksum))
+		Expect(err).ToNot(HaveOccurred())
+	})
+	It("should fail if the destination returns before the end of the data", func() {
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		_, err := src.Stream(context.Background(), backup.NewManifestDestination(&truncatingDestination{limit: 16}, backup.ManifestInfo{}))
+		Expect(errors.Is(err, io.ErrShortWrite)).To(BeTrue())
+	})
+})
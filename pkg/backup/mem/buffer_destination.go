@@ -17,7 +17,11 @@ limitations under the License.
 package mem
 
 import (
+	"context"
 	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 )
@@ -30,10 +34,65 @@ func NewBufferDestination() (*BufferDestination, error) {
 
 type BufferDestination struct {
 	Data map[string][]byte
+	mu   sync.Mutex
 }
 
-func (b *BufferDestination) Store(obj backup.Object) (int64, error) {
-	var err error
-	b.Data[obj.ID], err = ioutil.ReadAll(obj.Data)
-	return (int64)(len(b.Data[obj.ID])), err
+// Store keeps the data of obj once it is read completely, so failed objects
+// are never stored partially
+func (b *BufferDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	data, err := ioutil.ReadAll(backup.NewContextReader(ctx, obj.Data))
+	if err != nil {
+		return (int64)(len(data)), err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Data[obj.ID] = data
+	return (int64)(len(data)), nil
+}
+
+// Begin starts a session storing objects as <run>/<id>
+func (b *BufferDestination) Begin(ctx context.Context, run string) (backup.Session, error) {
+	if err := backup.ValidateRun(run); err != nil {
+		return nil, err
+	}
+	return &bufferSession{dst: b, run: run}, nil
+}
+
+type bufferSession struct {
+	dst     *BufferDestination
+	run     string
+	objects []string
+}
+
+func (s *bufferSession) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	id := obj.ID
+	obj.ID = path.Join(s.run, id)
+	written, err := s.dst.Store(ctx, obj)
+	if err != nil {
+		return written, err
+	}
+	s.objects = append(s.objects, id)
+	return written, nil
+}
+
+func (s *bufferSession) Commit(ctx context.Context) error {
+	marker, err := backup.NewCompletion(s.run, s.objects)
+	if err != nil {
+		return err
+	}
+	s.dst.mu.Lock()
+	defer s.dst.mu.Unlock()
+	s.dst.Data[path.Join(s.run, backup.CompletionMarker)] = marker
+	return nil
+}
+
+func (s *bufferSession) Abort(ctx context.Context) error {
+	s.dst.mu.Lock()
+	defer s.dst.mu.Unlock()
+	for id := range s.dst.Data {
+		if strings.HasPrefix(id, s.run+"/") {
+			delete(s.dst.Data, id)
+		}
+	}
+	return nil
 }
@@ -18,6 +18,7 @@ package mem
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 )
@@ -34,8 +35,8 @@ type BufferSource struct {
 	Data []byte
 }
 
-func (b *BufferSource) Stream(dst backup.Destination) (int64, error) {
-	return dst.Store(backup.Object{
+func (b *BufferSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	return dst.Store(ctx, backup.Object{
 		ID:   b.Name,
 		Data: bytes.NewReader(b.Data),
 	})
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MetadataSize          = "backup-size"
+	MetadataContentType   = "backup-content-type"
+	MetadataCreated       = "backup-created"
+	MetadataSourceType    = "backup-source-type"
+	MetadataSourceVersion = "backup-source-version"
+	MetadataLabelPrefix   = "backup-label-"
+)
+
+// ObjectInfo is the typed form of the metadata of an object. Destinations
+// persisting metadata store it with the keys above, so restores and other
+// tooling can rely on it instead of parsing object IDs.
+type ObjectInfo struct {
+	Size            int64  // Size of the data if known in advance, 0 otherwise
+	ContentType     string // MIME type of the data as produced by the source
+	Compression     string
+	Encryption      string
+	EncryptionKeyID string
+	Created         time.Time
+	SourceType      string            // e.g. mongodb
+	SourceVersion   string            // Version of the backed up system
+	Labels          map[string]string // Keys may be lower cased by destinations
+}
+
+// ParseObjectInfo returns the info contained in metadata. Invalid values are
+// ignored, as metadata may be modified outside of the operator.
+func ParseObjectInfo(metadata map[string]string) ObjectInfo {
+	info := ObjectInfo{
+		ContentType:     metadata[MetadataContentType],
+		Compression:     metadata[MetadataCompression],
+		Encryption:      metadata[MetadataEncryption],
+		EncryptionKeyID: metadata[MetadataEncryptionKeyID],
+		SourceType:      metadata[MetadataSourceType],
+		SourceVersion:   metadata[MetadataSourceVersion],
+	}
+	if size, err := strconv.ParseInt(metadata[MetadataSize], 10, 64); err == nil {
+		info.Size = size
+	}
+	if created, err := time.Parse(time.RFC3339, metadata[MetadataCreated]); err == nil {
+		info.Created = created
+	}
+	for k, v := range metadata {
+		if strings.HasPrefix(k, MetadataLabelPrefix) {
+			if info.Labels == nil {
+				info.Labels = map[string]string{}
+			}
+			info.Labels[strings.TrimPrefix(k, MetadataLabelPrefix)] = v
+		}
+	}
+	return info
+}
+
+// Metadata returns the info as metadata, omitting empty values
+func (i ObjectInfo) Metadata() map[string]string {
+	metadata := map[string]string{}
+	set := func(k, v string) {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	if i.Size > 0 {
+		set(MetadataSize, strconv.FormatInt(i.Size, 10))
+	}
+	set(MetadataContentType, i.ContentType)
+	set(MetadataCompression, i.Compression)
+	set(MetadataEncryption, i.Encryption)
+	set(MetadataEncryptionKeyID, i.EncryptionKeyID)
+	if !i.Created.IsZero() {
+		set(MetadataCreated, i.Created.UTC().Format(time.RFC3339))
+	}
+	set(MetadataSourceType, i.SourceType)
+	set(MetadataSourceVersion, i.SourceVersion)
+	for k, v := range i.Labels {
+		set(MetadataLabelPrefix+k, v)
+	}
+	return metadata
+}
+
+// Info returns the typed metadata of obj
+func (obj Object) Info() ObjectInfo {
+	return ParseObjectInfo(obj.Metadata)
+}
+
+// WithInfo returns a copy of the metadata of obj, in which all non-empty
+// values of info are set
+func (obj Object) WithInfo(info ObjectInfo) map[string]string {
+	metadata := obj.WithMetadata()
+	for k, v := range info.Metadata() {
+		metadata[k] = v
+	}
+	return metadata
+}
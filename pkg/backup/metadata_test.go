@@ -0,0 +1,105 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metadata", func() {
+	It("should convert object info to metadata and back", func() {
+		info := backup.ObjectInfo{
+			Size:            42,
+			ContentType:     "application/gzip",
+			Compression:     backup.CompressionZstd,
+			Encryption:      backup.EncryptionAlgorithm,
+			EncryptionKeyID: "key-1",
+			Created:         time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			SourceType:      "mongodb",
+			SourceVersion:   "4.4.0",
+			Labels:          map[string]string{"team": "platform"},
+		}
+		metadata := info.Metadata()
+		Expect(metadata).To(HaveKeyWithValue(backup.MetadataSize, "42"))
+		Expect(metadata).To(HaveKeyWithValue(backup.MetadataCreated, "2020-01-02T03:04:05Z"))
+		Expect(metadata).To(HaveKeyWithValue(backup.MetadataLabelPrefix+"team", "platform"))
+		Expect(backup.ParseObjectInfo(metadata)).To(Equal(info))
+	})
+	It("should omit empty values and ignore invalid ones", func() {
+		Expect(backup.ObjectInfo{}.Metadata()).To(BeEmpty())
+		info := backup.ParseObjectInfo(map[string]string{
+			backup.MetadataSize:    "unknown",
+			backup.MetadataCreated: "yesterday",
+		})
+		Expect(info.Size).To(BeZero())
+		Expect(info.Created.IsZero()).To(BeTrue())
+	})
+	It("should add defaults of the manifest info", func() {
+		buf, _ := mem.NewBufferDestination()
+		dst := &metadataDestination{BufferDestination: buf}
+		obj := backup.Object{
+			ID:   "backup.tgz",
+			Data: bytes.NewBufferString("testcontent"),
+			Metadata: backup.ObjectInfo{
+				ContentType:   "application/gzip",
+				SourceVersion: "4.4.0",
+				Labels:        map[string]string{"team": "platform"},
+			}.Metadata(),
+		}
+		_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{
+			Source: "mongodb",
+			Labels: map[string]string{"team": "default", "env": "prod"},
+		}).Store(context.Background(), obj)
+		Expect(err).ToNot(HaveOccurred())
+		info := backup.ParseObjectInfo(dst.objects["backup.tgz"])
+		Expect(info.SourceType).To(Equal("mongodb"))
+		Expect(info.Created).ToNot(BeZero())
+		Expect(info.Labels).To(Equal(map[string]string{"team": "platform", "env": "prod"}))
+
+		manifest, err := backup.ParseManifest(bytes.NewReader(buf.Data[backup.ManifestID("backup.tgz")]))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Source).To(Equal("mongodb"))
+		Expect(manifest.ContentType).To(Equal("application/gzip"))
+		Expect(manifest.SourceVersion).To(Equal("4.4.0"))
+		Expect(manifest.Labels).To(Equal(info.Labels))
+		Expect(manifest.Created).To(Equal(info.Created))
+	})
+	It("should drop the size hint when the data is transformed", func() {
+		buf, _ := mem.NewBufferDestination()
+		dst := &metadataDestination{BufferDestination: buf}
+		cdst, err := backup.NewCompressingDestination(dst, backup.CompressionConf{Codec: backup.CompressionGzip})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cdst.Store(context.Background(), backup.Object{
+			ID:       "backup.archive",
+			Data:     bytes.NewBufferString("testcontent"),
+			Metadata: backup.ObjectInfo{Size: 11, SourceType: "mongodb"}.Metadata(),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		info := backup.ParseObjectInfo(dst.metadata)
+		Expect(info.Size).To(BeZero())
+		Expect(info.SourceType).To(Equal("mongodb"))
+		Expect(info.Compression).To(Equal(backup.CompressionGzip))
+	})
+})
@@ -17,13 +17,19 @@ limitations under the License.
 package mongodb
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/logger"
 	"github.com/mongodb/mongo-tools/mongorestore"
 )
 
+var gzipMagic = []byte{0x1f, 0x8b}
+
 func NewMongoDBDestination(uri string) (backup.Destination, error) {
 	return &mongoDBDestination{
 		URI: uri,
@@ -37,12 +43,20 @@ type mongoDBDestination struct {
 	log     logger.Logger
 }
 
-func (m *mongoDBDestination) Store(obj backup.Object) (int64, error) {
+func (m *mongoDBDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
 	log := m.log
+	// Archives may be compressed by mongodump or stored uncompressed
+	data := bufio.NewReader(backup.NewContextReader(ctx, obj.Data))
+	magic, err := data.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
 	args := []string{
 		fmt.Sprintf("--uri=\"%s\"", m.URI),
 		"--archive",
-		"--gzip",
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		args = append(args, "--gzip")
 	}
 	opts, err := mongorestore.ParseOptions(args, "custom", "custom")
 	if err != nil {
@@ -53,7 +67,9 @@ func (m *mongoDBDestination) Store(obj backup.Object) (int64, error) {
 		return 0, err
 	}
 	defer m.restore.Close()
-	m.restore.InputReader = obj.Data
+	m.restore.InputReader = data
+	stop := backup.OnCancel(ctx, m.restore.HandleInterrupt)
+	defer stop()
 	// start the restoral
 	result := m.restore.Restore()
 	if result.Err != nil {
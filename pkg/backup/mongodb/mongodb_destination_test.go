@@ -17,6 +17,8 @@ limitations under the License.
 package mongodb
 
 import (
+	"context"
+
 	"github.com/finleap-connect/backup-operator/pkg/testutil"
 
 	. "github.com/onsi/ginkgo"
@@ -25,13 +27,23 @@ import (
 
 var _ = Describe("MongoDBSource", func() {
 	It("should dump to file", func() {
-		src, err := NewMongoDBSource(srcURI, "", "backup.tgz")
+		src, err := NewMongoDBSource(srcURI, "", "backup.tgz", true)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(src).ToNot(BeNil())
 		dst, err := NewMongoDBDestination(dstURI)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(dst).ToNot(BeNil())
-		_, err = src.Stream(dst)
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		err = testutil.FindTestData(dstURI)
+		Expect(err).ToNot(HaveOccurred())
+	})
+	It("should restore uncompressed archives", func() {
+		src, err := NewMongoDBSource(srcURI, "", "backup.archive", false)
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := NewMongoDBDestination(dstURI)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		err = testutil.FindTestData(dstURI)
 		Expect(err).ToNot(HaveOccurred())
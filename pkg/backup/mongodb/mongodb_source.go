@@ -17,6 +17,7 @@ limitations under the License.
 package mongodb
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"regexp"
@@ -33,24 +34,33 @@ var (
 	filter = regexp.MustCompile("[^a-zA-Z0-9]+")
 )
 
-func NewMongoDBSource(uri, database, archiveName string) (backup.Source, error) {
+// NewMongoDBSource creates a source dumping the database as archive. The
+// archive is compressed by mongodump if gzip is set.
+func NewMongoDBSource(uri, database, archiveName string, gzip bool) (backup.Source, error) {
 	return &mongoDBSource{
 		URI:         uri,
 		Database:    database,
 		ArchiveName: archiveName,
+		Gzip:        gzip,
 		log:         logger.WithName("mongosrc"),
 	}, nil
 }
 
+const (
+	ArchiveContentType = "application/octet-stream" // mongodump archives have no registered type
+	GzipContentType    = "application/gzip"
+)
+
 type mongoDBSource struct {
 	URI         string
 	Database    string // TODO: implement
 	ArchiveName string
+	Gzip        bool
 	dump        *mongodump.MongoDump
 	log         logger.Logger
 }
 
-func (m *mongoDBSource) Stream(dst backup.Destination) (int64, error) {
+func (m *mongoDBSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
 	log := m.log
 	opts := options.New("mongodump",
 		"custom",
@@ -66,7 +76,9 @@ func (m *mongoDBSource) Stream(dst backup.Destination) (int64, error) {
 	args := []string{
 		fmt.Sprintf("--uri=\"%s\"", m.URI),
 		"--archive",
-		"--gzip",
+	}
+	if m.Gzip {
+		args = append(args, "--gzip")
 	}
 	_, err := opts.ParseArgs(args)
 	if err != nil {
@@ -83,34 +95,35 @@ func (m *mongoDBSource) Stream(dst backup.Destination) (int64, error) {
 	if err = m.dump.Init(); err != nil {
 		return 0, err
 	}
-	pr, pw := io.Pipe()
-	m.dump.OutputWriter = pw
-	// start the backup in a separate routine
-	errc := make(chan error, 1)
-	defer close(errc)
-	go func() {
-		defer pw.Close()
-		log.Info("starting dump")
-		if err = m.dump.Dump(); err != nil {
-			errc <- err
+	// Stop the dump on cancellation
+	stop := backup.OnCancel(ctx, m.dump.HandleInterrupt)
+	defer stop()
+	if m.ArchiveName == "" {
+		ext := ".archive"
+		if m.Gzip {
+			ext = ".tgz"
 		}
-		log.Info("finished dump")
-	}()
+		m.ArchiveName = filter.ReplaceAllString(m.URI+m.Database, "") + ext
+	}
+	info := backup.ObjectInfo{
+		ContentType: ArchiveContentType,
+		Created:     time.Now(),
+		SourceType:  "mongodb",
+	}
+	if m.Gzip {
+		info.ContentType = GzipContentType
+	}
+	if info.SourceVersion, err = m.dump.SessionProvider.ServerVersion(); err != nil {
+		log.Error(err, "failed to determine server version")
+	}
 	// process output with destination implementation
 	log.Info("start storing dump")
-	if m.ArchiveName == "" {
-		m.ArchiveName = filter.ReplaceAllString(m.URI+m.Database, "") + ".tgz"
-	}
-	written, dsterr := dst.Store(backup.Object{
-		ID:   m.ArchiveName,
-		Data: pr,
+	return backup.Pipe(ctx, dst, backup.Object{ID: m.ArchiveName, Metadata: info.Metadata()}, func(w io.Writer) error {
+		m.dump.OutputWriter = w
+		log.Info("starting dump")
+		defer log.Info("finished dump")
+		return m.dump.Dump()
 	})
-	select {
-	case srcerr := <-errc: // return src error if possible as well
-		return written, fmt.Errorf("dst error: %v; src error: %v", dsterr, srcerr)
-	case <-time.After(1 * time.Second):
-		return written, dsterr
-	}
 }
 
 func (m *mongoDBSource) Close() error {
@@ -17,6 +17,7 @@ limitations under the License.
 package mongodb
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -29,7 +30,7 @@ import (
 
 var _ = Describe("MongoDBSource", func() {
 	It("should dump to file", func() {
-		src, err := NewMongoDBSource(srcURI, "", "dump.tgz")
+		src, err := NewMongoDBSource(srcURI, "", "dump.tgz", true)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(src).ToNot(BeNil())
 		dir, err := ioutil.TempDir("", "mongosrc")
@@ -38,7 +39,7 @@ var _ = Describe("MongoDBSource", func() {
 		fp := filepath.Join(dir, "dump.tgz")
 		dst, err := fs.NewDirDestination(dir)
 		Expect(err).ToNot(HaveOccurred())
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(fp).Should(BeAnExistingFile())
@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mongodb
+
+import (
+	"context"
+	"crypto/rand"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MongoDB with S3", func() {
+	var server *testutil.S3Server
+	BeforeEach(func() {
+		var err error
+		// SSE-C requires TLS
+		server, err = testutil.NewS3TLSServer()
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(server.Close()).To(Succeed())
+	})
+
+	roundTrip := func(encrypted bool) {
+		name := "backup.tgz"
+		bucket := "bucketc"
+		var encryptionKey *string
+		if encrypted {
+			key := make([]byte, 32)
+			_, err := rand.Read(key)
+			Expect(err).ToNot(HaveOccurred())
+			encryptionKey = new(string)
+			*encryptionKey = string(key)
+		}
+		src, err := NewMongoDBSource(srcURI, "", name, true)
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := s3.NewS3Destination(&s3.S3DestinationConf{
+			Endpoint:      server.Endpoint,
+			AccessKey:     server.AccessKeyID,
+			SecretKey:     server.SecretAccessKey,
+			CABundle:      server.CABundle,
+			EncryptionKey: encryptionKey,
+			Bucket:        bucket,
+			CreateBucket:  true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		written, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeNumerically(">", 100))
+		data, _, ok := server.Object(bucket, name)
+		Expect(ok).To(BeTrue())
+		Expect(data).To(HaveLen(int(written)))
+
+		s3src, err := s3.NewS3Source(&s3.S3SourceConf{
+			Endpoint:      server.Endpoint,
+			AccessKey:     server.AccessKeyID,
+			SecretKey:     server.SecretAccessKey,
+			CABundle:      server.CABundle,
+			EncryptionKey: encryptionKey,
+			Bucket:        bucket,
+			Key:           name,
+			// Stored without manifest
+			AllowUnverified: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		mdst, err := NewMongoDBDestination(dstURI)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s3src.Stream(context.Background(), mdst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(testutil.FindTestData(dstURI)).To(Succeed())
+	}
+	It("should stream from MongoDBSource to S3Destination and back", func() {
+		roundTrip(false)
+	})
+	It("should stream from MongoDBSource to encrypted S3Destination and back", func() {
+		roundTrip(true)
+	})
+})
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+
+	"google.golang.org/grpc/codes"
+)
+
+// msgStream is implemented by client and server streams
+type msgStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+// sendChunks sends the data read from r as chunks, the first chunk is sent
+// with the header of the object. A read error aborts the object.
+func sendChunks(stream msgStream, header *Chunk, r io.Reader) error {
+	buf := make([]byte, ChunkSize)
+	chunk := header
+	for {
+		n, err := io.ReadFull(r, buf)
+		chunk.Data = buf[:n]
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			chunk.EOF = true
+			err = nil
+		case err != nil:
+			chunk.Data = nil
+			chunk.Error = err.Error()
+		}
+		// Messages are encoded before SendMsg returns, buf can be reused
+		if serr := stream.SendMsg(chunk); serr != nil {
+			return serr
+		}
+		if chunk.EOF || err != nil {
+			return err
+		}
+		chunk = &Chunk{}
+	}
+}
+
+// chunkReader reads the data of an object from the chunks received. chunk is
+// the first chunk of the object, aborted objects are reported as errors of
+// the plugin.
+type chunkReader struct {
+	stream msgStream
+	chunk  Chunk
+	plugin string
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk.Data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		switch {
+		case r.chunk.Error != "":
+			r.err = &Error{Plugin: r.plugin, Code: codes.Unknown, Message: r.chunk.Error}
+		case r.chunk.EOF:
+			r.err = io.EOF
+		default:
+			var next Chunk
+			if err := r.stream.RecvMsg(&next); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				r.err = err
+				continue
+			}
+			r.chunk = next
+		}
+	}
+	n := copy(p, r.chunk.Data)
+	r.chunk.Data = r.chunk.Data[n:]
+	return n, nil
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// HandshakeTimeout limits how long a plugin may take to start serving
+var HandshakeTimeout = 30 * time.Second
+
+// StopTimeout limits how long a plugin may take to stop before it is killed
+var StopTimeout = 10 * time.Second
+
+// ErrUnsupported is matched by errors of plugins for methods a source or
+// destination does not support
+var ErrUnsupported = errors.New("unsupported by plugin")
+
+// Error is returned for errors reported by a plugin
+type Error struct {
+	Plugin  string
+	Code    codes.Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Plugin == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("plugin %s: %s", e.Plugin, e.Message)
+}
+
+// Is matches the errors of this and the backup package the code corresponds
+// to, e.g. backup.ErrUnknownType for unknown types
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case codes.NotFound:
+		return target == backup.ErrUnknownType
+	case codes.Unimplemented:
+		return target == ErrUnsupported
+	case codes.Canceled:
+		return target == context.Canceled
+	case codes.DeadlineExceeded:
+		return target == context.DeadlineExceeded
+	}
+	return false
+}
+
+// Client is connected to a plugin
+type Client struct {
+	Name string
+	Info InfoResponse
+
+	conn *grpc.ClientConn
+	cmd  *exec.Cmd
+	done chan struct{} // Closed once the process of the plugin exited
+	once sync.Once
+}
+
+// Open starts the plugin binary at path and connects to it. The plugin is
+// stopped by Close.
+func Open(ctx context.Context, path string) (*Client, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), MagicCookieKey+"="+MagicCookieValue)
+	cmd.Stdout = pw
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	stop := func() {
+		cmd.Process.Kill()
+		<-done
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		r := bufio.NewReader(pr)
+		line, _ := r.ReadString('\n')
+		lines <- line
+		// Further output of the plugin is passed through
+		io.Copy(os.Stderr, r)
+	}()
+	var line string
+	timer := time.NewTimer(HandshakeTimeout)
+	defer timer.Stop()
+	select {
+	case line = <-lines:
+	case <-ctx.Done():
+		stop()
+		return nil, ctx.Err()
+	case <-timer.C:
+		stop()
+		return nil, fmt.Errorf("plugin %s did not start within %s", path, HandshakeTimeout)
+	}
+	network, addr, err := parseHandshake(line)
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	c, err := Dial(ctx, network, addr)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	c.Name = filepath.Base(path)
+	c.cmd = cmd
+	c.done = done
+	return c, nil
+}
+
+// parseHandshake parses the line a plugin prints once it serves, e.g.
+// 1|unix|/tmp/plugin.sock
+func parseHandshake(line string) (network, addr string, err error) {
+	if line == "" {
+		return "", "", fmt.Errorf("exited before handshake")
+	}
+	parts := strings.SplitN(strings.TrimSpace(line), "|", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("invalid handshake %q", line)
+	}
+	if v, err := strconv.Atoi(parts[0]); err != nil || v != ProtocolVersion {
+		return "", "", fmt.Errorf("unsupported protocol version %s, expected %d", parts[0], ProtocolVersion)
+	}
+	return parts[1], parts[2], nil
+}
+
+// Dial connects to a plugin, which is served at the given address
+func Dial(ctx context.Context, network, addr string) (*Client, error) {
+	conn, err := grpc.DialContext(ctx, "passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{Name: addr, conn: conn}
+	if err := conn.Invoke(ctx, fullMethod(methodInfo), &Empty{}, &c.Info); err != nil {
+		conn.Close()
+		return nil, c.remoteError(ctx, err)
+	}
+	if c.Info.Protocol != ProtocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("plugin %s: unsupported protocol version %d, expected %d", c.Name, c.Info.Protocol, ProtocolVersion)
+	}
+	return c, nil
+}
+
+// Close disconnects from the plugin and stops it, if it was started by Open
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.conn.Close()
+		if c.cmd == nil {
+			return
+		}
+		c.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-c.done:
+		case <-time.After(StopTimeout):
+			c.cmd.Process.Kill()
+			<-c.done
+		}
+	})
+	return err
+}
+
+// NewSource returns a source of the given type provided by the plugin, the
+// configuration is passed to the plugin as is
+func (c *Client) NewSource(sourceType string, conf []byte, opts backup.SourceOptions) (backup.Source, error) {
+	if !contains(c.Info.Sources, sourceType) {
+		return nil, fmt.Errorf("plugin %s: %w of source: %s", c.Name, backup.ErrUnknownType, sourceType)
+	}
+	return &source{client: c, req: SourceRequest{
+		Type:       sourceType,
+		Config:     conf,
+		Time:       opts.Time,
+		Compressed: opts.Compressed,
+	}}, nil
+}
+
+// NewDestination returns a destination of the given type provided by the
+// plugin, the configuration is passed to the plugin as is
+func (c *Client) NewDestination(destinationType string, conf []byte, opts backup.DestinationOptions) (*Destination, error) {
+	if !contains(c.Info.Destinations, destinationType) {
+		return nil, fmt.Errorf("plugin %s: %w of destination: %s", c.Name, backup.ErrUnknownType, destinationType)
+	}
+	return &Destination{client: c, req: DestinationRequest{
+		Type:      destinationType,
+		Config:    conf,
+		Namespace: opts.Namespace,
+		Name:      opts.Name,
+		Tags:      opts.Tags,
+		Retention: newRetentionPolicy(opts.Retention),
+	}}, nil
+}
+
+// remoteError converts errors returned by gRPC calls
+func (c *Client) remoteError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	return &Error{Plugin: c.Name, Code: st.Code(), Message: st.Message()}
+}
+
+func fullMethod(method string) string {
+	return "/" + serviceName + "/" + method
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"io"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// Destination stores objects in a destination of a plugin
+type Destination struct {
+	client *Client
+	req    DestinationRequest
+}
+
+func (d *Destination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	// Cancelling the stream aborts the object in the plugin on failures
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := d.client.conn.NewStream(ctx, &serviceDesc.Streams[1], fullMethod(methodStore))
+	if err != nil {
+		return 0, d.client.remoteError(ctx, err)
+	}
+	err = stream.SendMsg(&StoreRequest{
+		Destination: d.req,
+		Object:      Chunk{ID: obj.ID, Metadata: obj.Metadata},
+	})
+	if err == nil {
+		err = sendChunks(stream, &Chunk{}, obj.Data)
+	}
+	// io.EOF is returned once the plugin failed, its error is received below
+	if err != nil && err != io.EOF {
+		return 0, d.client.remoteError(ctx, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return 0, d.client.remoteError(ctx, err)
+	}
+	var resp StoreResponse
+	if err := stream.RecvMsg(&resp); err != nil {
+		return 0, d.client.remoteError(ctx, err)
+	}
+	return resp.Written, nil
+}
+
+// List returns the IDs of all backups stored in the destination
+func (d *Destination) List(ctx context.Context) ([]string, error) {
+	var resp ListResponse
+	if err := d.client.conn.Invoke(ctx, fullMethod(methodList), &d.req, &resp); err != nil {
+		return nil, d.client.remoteError(ctx, err)
+	}
+	return resp.IDs, nil
+}
+
+// EnsureRetention removes all backups obsolete according to the policy
+func (d *Destination) EnsureRetention(ctx context.Context, policy backup.RetentionPolicy) error {
+	req := &RetentionRequest{Destination: d.req, Policy: newRetentionPolicy(policy)}
+	if err := d.client.conn.Invoke(ctx, fullMethod(methodEnsureRetention), req, &Empty{}); err != nil {
+		return d.client.remoteError(ctx, err)
+	}
+	return nil
+}
+
+// Preflight checks the destination of the plugin, if it supports checks
+func (d *Destination) Preflight(ctx context.Context) error {
+	if err := d.client.conn.Invoke(ctx, fullMethod(methodPreflight), &d.req, &Empty{}); err != nil {
+		return d.client.remoteError(ctx, err)
+	}
+	return nil
+}
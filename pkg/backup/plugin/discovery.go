@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Discover returns the paths of all plugins in dir by their names. Plugins
+// are executable files named like the plugin, hidden files are ignored, e.g.
+// the internal links of mounted ConfigMaps.
+func Discover(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	plugins := map[string]string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Follow symbolic links
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			plugins[entry.Name()] = path
+		}
+	}
+	return plugins, nil
+}
+
+// Lookup returns the path of the named plugin in dir
+func Lookup(dir, name string) (string, error) {
+	plugins, err := Discover(dir)
+	if err != nil {
+		return "", err
+	}
+	path, ok := plugins[name]
+	if !ok {
+		return "", fmt.Errorf("plugin %s not found in %s", name, dir)
+	}
+	return path, nil
+}
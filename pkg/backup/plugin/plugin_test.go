@@ -0,0 +1,287 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/plugin"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plugin", func() {
+	var (
+		dir    string
+		server *grpc.Server
+		client *plugin.Client
+	)
+	BeforeEach(func() {
+		dir = tempDir()
+		lis, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+		Expect(err).ToNot(HaveOccurred())
+		server = plugin.NewServer(newTestRegistry())
+		go server.Serve(lis) // nolint:errcheck
+		client, err = plugin.Dial(context.Background(), "unix", lis.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(client.Close()).To(Succeed())
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	newSource := func(conf testSourceConfig) backup.Source {
+		raw, err := json.Marshal(&conf)
+		Expect(err).ToNot(HaveOccurred())
+		src, err := client.NewSource("objects", raw, backup.SourceOptions{
+			Time:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Compressed: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return src
+	}
+	newDestination := func() *plugin.Destination {
+		raw, err := json.Marshal(&testDirConfig{Path: dir})
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := client.NewDestination("dir", raw, backup.DestinationOptions{
+			Namespace: "default",
+			Name:      "plan",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return dst
+	}
+
+	It("should describe the types provided", func() {
+		Expect(client.Info.Protocol).To(Equal(plugin.ProtocolVersion))
+		Expect(client.Info.Sources).To(Equal([]string{"objects"}))
+		Expect(client.Info.Destinations).To(Equal([]string{"dir"}))
+	})
+	It("should reject unknown types", func() {
+		_, err := client.NewSource("redis", nil, backup.SourceOptions{})
+		Expect(errors.Is(err, backup.ErrUnknownType)).To(BeTrue())
+		_, err = client.NewDestination("s3", nil, backup.DestinationOptions{})
+		Expect(errors.Is(err, backup.ErrUnknownType)).To(BeTrue())
+	})
+	It("should report invalid configuration", func() {
+		src, err := client.NewSource("objects", []byte(`{"objects": 1}`), backup.SourceOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), newRecordingDestination())
+		Expect(err).To(MatchError(ContainSubstring("invalid configuration of source objects")))
+	})
+
+	Context("source", func() {
+		It("should stream all objects with their metadata", func() {
+			src := newSource(testSourceConfig{Objects: []testObject{
+				{ID: "first.archive", Data: "first", Metadata: map[string]string{"backup-content-type": "application/x-archive"}},
+				{Data: "0123456789abcdef", Repeat: plugin.ChunkSize / 8},
+				{ID: "empty"},
+			}})
+			dst := newRecordingDestination()
+			written, err := src.Stream(context.Background(), dst)
+			Expect(err).ToNot(HaveOccurred())
+			large := strings.Repeat("0123456789abcdef", plugin.ChunkSize/8+1)
+			Expect(written).To(BeEquivalentTo(len("first") + len(large)))
+			Expect(string(dst.data["first.archive"])).To(Equal("first"))
+			Expect(dst.metadata["first.archive"]).To(Equal(map[string]string{
+				"backup-content-type": "application/x-archive",
+				"compressed":          "true",
+			}))
+			// Options are passed to the source
+			Expect(string(dst.data["backup-20200102030405"])).To(Equal(large))
+			Expect(dst.data).To(HaveKeyWithValue("empty", BeEmpty()))
+		})
+		It("should report failures of the source", func() {
+			src := newSource(testSourceConfig{Objects: []testObject{
+				{ID: "backup.tgz", Data: "partial", Fail: "dump failed"},
+			}})
+			dst := newRecordingDestination()
+			_, err := src.Stream(context.Background(), dst)
+			Expect(err).To(MatchError(ContainSubstring("dump failed")))
+			var serr *backup.StreamError
+			Expect(errors.As(err, &serr)).To(BeTrue())
+			Expect(serr.Source).To(HaveOccurred())
+			// Truncated objects are never stored as complete
+			Expect(dst.data).ToNot(HaveKey("backup.tgz"))
+		})
+		It("should report failures of the destination and stop the source", func() {
+			src := newSource(testSourceConfig{Objects: []testObject{
+				{ID: "first", Data: "0123456789abcdef", Repeat: plugin.ChunkSize},
+				{ID: "second", Data: "second"},
+			}})
+			dst := newRecordingDestination()
+			dst.failAt = 100
+			_, err := src.Stream(context.Background(), dst)
+			Expect(err).To(MatchError("destination failed: disk full"))
+			Expect(dst.data).To(BeEmpty())
+		})
+		It("should stop on cancellation", func() {
+			src := newSource(testSourceConfig{Objects: []testObject{
+				{ID: "backup.tgz", Data: "partial", Stall: true},
+			}})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				_, err := src.Stream(ctx, newRecordingDestination())
+				done <- err
+			}()
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			var err error
+			Eventually(done, 5*time.Second).Should(Receive(&err))
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+	})
+
+	Context("destination", func() {
+		It("should store objects", func() {
+			dst := newDestination()
+			data := strings.Repeat("0123456789abcdef", plugin.ChunkSize/8)
+			written, err := dst.Store(context.Background(), backup.Object{ID: "backup-20200102030405.tgz", Data: strings.NewReader(data)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(written).To(BeEquivalentTo(len(data)))
+			stored, err := ioutil.ReadFile(filepath.Join(dir, "default", "plan", "backup-20200102030405.tgz"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(stored)).To(Equal(data))
+		})
+		It("should not store objects, which cannot be read completely", func() {
+			dst := newDestination()
+			_, err := dst.Store(context.Background(), backup.Object{ID: "backup-20200101000000.tgz", Data: strings.NewReader("complete")})
+			Expect(err).ToNot(HaveOccurred())
+			data := &failingReader{errors.New("dump failed")}
+			_, err = dst.Store(context.Background(), backup.Object{ID: "backup-20200102030405.tgz", Data: data})
+			Expect(err).To(MatchError("dump failed"))
+			ids, err := dst.List(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(Equal([]string{"backup-20200101000000.tgz"}))
+		})
+		It("should list backups and ensure the retention", func() {
+			dst := newDestination()
+			Expect(dst.Preflight(context.Background())).To(Succeed())
+			for _, id := range []string{"backup-20200101000000.tgz", "backup-20200102000000.tgz", "backup-20200103000000.tgz"} {
+				_, err := dst.Store(context.Background(), backup.Object{ID: id, Data: strings.NewReader(id)})
+				Expect(err).ToNot(HaveOccurred())
+				// Only backups with manifests are pruned
+				_, err = dst.Store(context.Background(), backup.Object{ID: backup.ManifestID(id), Data: strings.NewReader("{}")})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			ids, err := dst.List(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(ConsistOf("backup-20200101000000.tgz", "backup-20200102000000.tgz", "backup-20200103000000.tgz"))
+			policy := backup.KeepLast(1)
+			policy.Pattern = backup.IDPattern
+			Expect(dst.EnsureRetention(context.Background(), policy)).To(Succeed())
+			ids, err = dst.List(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(ConsistOf("backup-20200103000000.tgz"))
+		})
+	})
+})
+
+var _ = Describe("Open", func() {
+	It("should start, use and stop plugins", func() {
+		os.Setenv(helperEnv, "1")
+		defer os.Unsetenv(helperEnv)
+		client, err := plugin.Open(context.Background(), os.Args[0])
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+		Expect(client.Name).To(Equal(filepath.Base(os.Args[0])))
+		Expect(client.Info.Sources).To(Equal([]string{"objects"}))
+		raw, _ := json.Marshal(&testSourceConfig{Objects: []testObject{{ID: "backup.tgz", Data: "testcontent"}}})
+		src, err := client.NewSource("objects", raw, backup.SourceOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		dst := newRecordingDestination()
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(dst.data["backup.tgz"])).To(Equal("testcontent"))
+		Expect(client.Close()).To(Succeed())
+	})
+	It("should fail for binaries, which are no plugins", func() {
+		_, err := plugin.Open(context.Background(), "/bin/true")
+		Expect(err).To(MatchError(ContainSubstring("exited before handshake")))
+	})
+	It("should refuse to serve when not started by the worker", func() {
+		Expect(plugin.Serve(newTestRegistry())).To(MatchError(ContainSubstring("started by the worker")))
+	})
+})
+
+var _ = Describe("Discover", func() {
+	It("should find executables", func() {
+		dir := tempDir()
+		defer os.RemoveAll(dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "redis"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "README"), []byte("plugins"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		Expect(os.Symlink(filepath.Join(dir, "redis"), filepath.Join(dir, "valkey"))).To(Succeed())
+		plugins, err := plugin.Discover(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plugins).To(Equal(map[string]string{
+			"redis":  filepath.Join(dir, "redis"),
+			"valkey": filepath.Join(dir, "valkey"),
+		}))
+		_, err = plugin.Lookup(dir, "postgres")
+		Expect(err).To(MatchError(ContainSubstring("plugin postgres not found")))
+	})
+})
+
+var _ = Describe("tar-plugin example", func() {
+	testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+		dir, err := ioutil.TempDir("", "conformance")
+		if err != nil {
+			return nil, err
+		}
+		client, err := plugin.Open(context.Background(), tarPlugin)
+		if err != nil {
+			return nil, err
+		}
+		raw, _ := json.Marshal(&testDirConfig{Path: dir})
+		dst, err := client.NewDestination("dir", raw, backup.DestinationOptions{Namespace: "namespace", Name: "plan"})
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		planDir := filepath.Join(dir, "namespace", "plan")
+		return &testutil.ConformanceTarget{
+			Destination: dst,
+			Source: func(id string) (backup.Source, error) {
+				return fs.NewFileSource(filepath.Join(planDir, id))
+			},
+			Leftovers: func() []string {
+				hidden, _ := filepath.Glob(filepath.Join(planDir, ".*"))
+				return hidden
+			},
+			Close: func() {
+				client.Close()
+				os.RemoveAll(dir)
+			},
+		}, nil
+	})
+})
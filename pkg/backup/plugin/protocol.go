@@ -0,0 +1,200 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// ProtocolVersion is increased on incompatible changes of the protocol
+const ProtocolVersion = 1
+
+// The worker sets the magic cookie in the environment of plugins it starts,
+// so plugin binaries run by accident explain themselves instead of serving
+const (
+	MagicCookieKey   = "BACKUP_PLUGIN_MAGIC_COOKIE"
+	MagicCookieValue = "6d1b2b4e-backup-operator-plugin"
+)
+
+// ChunkSize is the maximum size of the data of a single chunk
+const ChunkSize = 256 * 1024
+
+const serviceName = "backup.plugin.v1.Plugin"
+
+// Methods of the plugin service. Messages are encoded as JSON, so plugins can
+// be written in any language with a gRPC implementation.
+const (
+	// Info returns the protocol version and the types the plugin provides
+	methodInfo = "Info"
+	// Stream streams the backup of a source. The worker sends a
+	// SourceRequest, the plugin answers with the chunks of every object and
+	// waits for an Ack of the worker after each object.
+	methodStream = "Stream"
+	// Store stores an object in a destination. The worker sends a
+	// StoreRequest followed by the chunks of the object, the plugin answers
+	// with a StoreResponse.
+	methodStore = "Store"
+	// List lists the backups of a destination
+	methodList = "List"
+	// EnsureRetention removes the backups of a destination obsolete
+	// according to a policy
+	methodEnsureRetention = "EnsureRetention"
+	// Preflight checks whether backups can be stored in a destination
+	methodPreflight = "Preflight"
+)
+
+// Empty is sent by methods without parameters or results
+type Empty struct{}
+
+// InfoResponse describes the plugin
+type InfoResponse struct {
+	Protocol     int      `json:"protocol"`
+	Sources      []string `json:"sources,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// Chunk is a piece of an object. The first chunk of every object carries its
+// ID and metadata, the last one has EOF set. A chunk with an error aborts the
+// object, e.g. because the source failed while reading it.
+type Chunk struct {
+	ID       string            `json:"id,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Data     []byte            `json:"data,omitempty"`
+	EOF      bool              `json:"eof,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// SourceRequest creates the source streamed by the plugin
+type SourceRequest struct {
+	Type       string          `json:"type"`
+	Config     json.RawMessage `json:"config,omitempty"`
+	Time       time.Time       `json:"time"`
+	Compressed bool            `json:"compressed,omitempty"`
+}
+
+// Ack confirms an object was stored completely by the worker
+type Ack struct {
+	Written int64 `json:"written"`
+}
+
+// DestinationRequest creates the destination a method is applied to
+type DestinationRequest struct {
+	Type      string            `json:"type"`
+	Config    json.RawMessage   `json:"config,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Retention RetentionPolicy   `json:"retention"`
+}
+
+// StoreRequest starts storing an object, Object is its first chunk
+type StoreRequest struct {
+	Destination DestinationRequest `json:"destination"`
+	Object      Chunk              `json:"object"`
+}
+
+// StoreResponse returns the number of bytes stored
+type StoreResponse struct {
+	Written int64 `json:"written"`
+}
+
+// ListResponse returns the IDs of the backups of a destination
+type ListResponse struct {
+	IDs []string `json:"ids,omitempty"`
+}
+
+// RetentionRequest applies the policy to a destination
+type RetentionRequest struct {
+	Destination DestinationRequest `json:"destination"`
+	Policy      RetentionPolicy    `json:"policy"`
+}
+
+// RetentionPolicy is the wire format of backup.RetentionPolicy
+type RetentionPolicy struct {
+	KeepLast    int           `json:"keepLast,omitempty"`
+	KeepHourly  int           `json:"keepHourly,omitempty"`
+	KeepDaily   int           `json:"keepDaily,omitempty"`
+	KeepWeekly  int           `json:"keepWeekly,omitempty"`
+	KeepMonthly int           `json:"keepMonthly,omitempty"`
+	KeepYearly  int           `json:"keepYearly,omitempty"`
+	MinAge      time.Duration `json:"minAge,omitempty"`
+	MaxAge      time.Duration `json:"maxAge,omitempty"`
+	DryRun      bool          `json:"dryRun,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+	Require     string        `json:"require,omitempty"`
+}
+
+func newRetentionPolicy(p backup.RetentionPolicy) RetentionPolicy {
+	wire := RetentionPolicy{
+		KeepLast:    p.KeepLast,
+		KeepHourly:  p.KeepHourly,
+		KeepDaily:   p.KeepDaily,
+		KeepWeekly:  p.KeepWeekly,
+		KeepMonthly: p.KeepMonthly,
+		KeepYearly:  p.KeepYearly,
+		MinAge:      p.MinAge,
+		MaxAge:      p.MaxAge,
+		DryRun:      p.DryRun,
+		Require:     p.Require,
+	}
+	if p.Pattern != nil {
+		wire.Pattern = p.Pattern.String()
+	}
+	return wire
+}
+
+func (p RetentionPolicy) policy() (backup.RetentionPolicy, error) {
+	policy := backup.RetentionPolicy{
+		KeepLast:    p.KeepLast,
+		KeepHourly:  p.KeepHourly,
+		KeepDaily:   p.KeepDaily,
+		KeepWeekly:  p.KeepWeekly,
+		KeepMonthly: p.KeepMonthly,
+		KeepYearly:  p.KeepYearly,
+		MinAge:      p.MinAge,
+		MaxAge:      p.MaxAge,
+		DryRun:      p.DryRun,
+		Require:     p.Require,
+	}
+	if p.Pattern != "" {
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return policy, err
+		}
+		policy.Pattern = pattern
+	}
+	return policy, nil
+}
+
+// codec encodes messages as JSON instead of protocol buffers
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (codec) Name() string {
+	return "json"
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: methodInfo, Handler: infoHandler},
+		{MethodName: methodList, Handler: listHandler},
+		{MethodName: methodEnsureRetention, Handler: ensureRetentionHandler},
+		{MethodName: methodPreflight, Handler: preflightHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: methodStream, Handler: streamHandler, ServerStreams: true, ClientStreams: true},
+		{StreamName: methodStore, Handler: storeHandler, ClientStreams: true},
+	},
+}
+
+func infoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	if err := dec(&Empty{}); err != nil {
+		return nil, err
+	}
+	return srv.(*server).info(), nil
+}
+
+func listHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &DestinationRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return srv.(*server).list(ctx, req)
+}
+
+func ensureRetentionHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &RetentionRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return srv.(*server).ensureRetention(ctx, req)
+}
+
+func preflightHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &DestinationRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return srv.(*server).preflight(ctx, req)
+}
+
+func streamHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*server).stream(stream)
+}
+
+func storeHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*server).store(stream)
+}
+
+// NewServer returns a gRPC server providing the source and destination types
+// of the registry
+func NewServer(registry *backup.Registry) *grpc.Server {
+	s := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	s.RegisterService(&serviceDesc, &server{registry: registry})
+	return s
+}
+
+// Serve provides the source and destination types of the registry to the
+// worker, which started the plugin. It is called by the main function of
+// plugins and returns once the worker stops the plugin.
+func Serve(registry *backup.Registry) error {
+	if os.Getenv(MagicCookieKey) != MagicCookieValue {
+		return fmt.Errorf("this binary is a backup plugin, which is started by the worker")
+	}
+	dir, err := ioutil.TempDir("", "backup-plugin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "plugin.sock")
+	lis, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	s := NewServer(registry)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(lis)
+	}()
+	// The handshake tells the worker where to connect to
+	fmt.Fprintf(os.Stdout, "%d|unix|%s\n", ProtocolVersion, addr)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	select {
+	case err := <-errc:
+		return err
+	case <-sigc:
+		s.Stop()
+		return nil
+	}
+}
+
+type server struct {
+	registry *backup.Registry
+}
+
+func (s *server) info() *InfoResponse {
+	return &InfoResponse{
+		Protocol:     ProtocolVersion,
+		Sources:      s.registry.Sources(),
+		Destinations: s.registry.Destinations(),
+	}
+}
+
+func (s *server) stream(stream grpc.ServerStream) error {
+	var req SourceRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	src, err := s.registry.NewSource(req.Type, req.Config, backup.SourceOptions{
+		Time:       req.Time,
+		Compressed: req.Compressed,
+	})
+	if err != nil {
+		return statusError(err)
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	_, err = src.Stream(stream.Context(), &streamDestination{stream: stream})
+	return statusError(err)
+}
+
+// streamDestination sends the objects of a source to the worker
+type streamDestination struct {
+	stream grpc.ServerStream
+}
+
+func (d *streamDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	chunk := &Chunk{ID: obj.ID, Metadata: obj.Metadata}
+	if err := sendChunks(d.stream, chunk, obj.Data); err != nil {
+		return 0, err
+	}
+	var ack Ack
+	if err := d.stream.RecvMsg(&ack); err != nil {
+		return 0, err
+	}
+	return ack.Written, nil
+}
+
+func (s *server) store(stream grpc.ServerStream) error {
+	var req StoreRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	dst, err := s.destination(&req.Destination)
+	if err != nil {
+		return statusError(err)
+	}
+	if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+	written, err := dst.Store(stream.Context(), backup.Object{
+		ID:       req.Object.ID,
+		Metadata: req.Object.Metadata,
+		Data:     &chunkReader{stream: stream, chunk: req.Object},
+	})
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendMsg(&StoreResponse{Written: written})
+}
+
+func (s *server) list(ctx context.Context, req *DestinationRequest) (interface{}, error) {
+	dst, err := s.destination(req)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+	lister, ok := dst.(backup.Lister)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "destination %s cannot list backups", req.Type)
+	}
+	ids, err := lister.List(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &ListResponse{IDs: ids}, nil
+}
+
+func (s *server) ensureRetention(ctx context.Context, req *RetentionRequest) (interface{}, error) {
+	policy, err := req.Policy.policy()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	dst, err := s.destination(&req.Destination)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+	rdst, ok := dst.(backup.RetentionDestination)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "destination %s does not support retention", req.Destination.Type)
+	}
+	if err := rdst.EnsureRetention(ctx, policy); err != nil {
+		return nil, statusError(err)
+	}
+	return &Empty{}, nil
+}
+
+func (s *server) preflight(ctx context.Context, req *DestinationRequest) (interface{}, error) {
+	dst, err := s.destination(req)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+	if checker, ok := dst.(backup.PreflightChecker); ok {
+		if err := checker.Preflight(ctx); err != nil {
+			return nil, statusError(err)
+		}
+	}
+	return &Empty{}, nil
+}
+
+// destination creates the destination of the request
+func (s *server) destination(req *DestinationRequest) (backup.Destination, error) {
+	retention, err := req.Retention.policy()
+	if err != nil {
+		return nil, err
+	}
+	return s.registry.NewDestination(req.Type, req.Config, backup.DestinationOptions{
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Tags:      req.Tags,
+		Retention: retention,
+	})
+}
+
+// statusError converts errors returned by sources and destinations, so the
+// worker can tell unknown types and cancellations apart
+func statusError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, backup.ErrUnknownType):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
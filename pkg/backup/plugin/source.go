@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// source streams the objects of a source of a plugin
+type source struct {
+	client *Client
+	req    SourceRequest
+}
+
+func (s *source) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	// Cancelling the stream aborts the source of the plugin on failures
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.client.conn.NewStream(ctx, &serviceDesc.Streams[0], fullMethod(methodStream))
+	if err != nil {
+		return 0, s.client.remoteError(ctx, err)
+	}
+	if err := stream.SendMsg(&s.req); err != nil {
+		return 0, s.client.remoteError(ctx, err)
+	}
+	var total int64
+	for {
+		var header Chunk
+		if err := stream.RecvMsg(&header); err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, s.client.remoteError(ctx, err)
+		}
+		if header.ID == "" {
+			return total, fmt.Errorf("plugin %s: object without ID", s.client.Name)
+		}
+		data := &chunkReader{stream: stream, chunk: header, plugin: s.client.Name}
+		obj := backup.Object{ID: header.ID, Metadata: header.Metadata}
+		written, err := backup.Pipe(ctx, dst, obj, func(w io.Writer) error {
+			if _, err := io.Copy(w, data); err != nil {
+				return s.client.remoteError(ctx, err)
+			}
+			return nil
+		})
+		total += written
+		if err != nil {
+			return total, err
+		}
+		// Skip data the destination did not read
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return total, s.client.remoteError(ctx, err)
+		}
+		if err := stream.SendMsg(&Ack{Written: written}); err != nil {
+			return total, s.client.remoteError(ctx, err)
+		}
+	}
+}
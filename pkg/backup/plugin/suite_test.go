@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/plugin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// helperEnv lets the test binary serve the test registry as plugin
+const helperEnv = "BACKUP_PLUGIN_TEST_HELPER"
+
+func init() {
+	if os.Getenv(helperEnv) != "1" {
+		return
+	}
+	if err := plugin.Serve(newTestRegistry()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// tarPlugin is the binary of the example plugin built for the suite
+var tarPlugin string
+
+func TestPlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Plugin")
+}
+
+var _ = BeforeSuite(func() {
+	By("building the example plugin")
+	tarPlugin = filepath.Join(tempDir(), "tar-plugin")
+	out, err := exec.Command("go", "build", "-o", tarPlugin, "github.com/finleap-connect/backup-operator/examples/tar-plugin").CombinedOutput()
+	Expect(err).ToNot(HaveOccurred(), string(out))
+})
+
+var _ = AfterSuite(func() {
+	Expect(os.RemoveAll(filepath.Dir(tarPlugin))).To(Succeed())
+})
+
+type testObject struct {
+	ID       string            `json:"id"`
+	Data     string            `json:"data"`
+	Repeat   int               `json:"repeat"`
+	Metadata map[string]string `json:"metadata"`
+	// Fail after the data instead of ending the object
+	Fail string `json:"fail"`
+	// Stall after the data until the context is done
+	Stall bool `json:"stall"`
+}
+
+type testSourceConfig struct {
+	Objects []testObject `json:"objects"`
+}
+
+type testDirConfig struct {
+	Path string `json:"path"`
+}
+
+// newTestRegistry returns the types served by the test plugin
+func newTestRegistry() *backup.Registry {
+	reg := backup.NewRegistry()
+	reg.RegisterSource(backup.SourceType{
+		Name:      "objects",
+		NewConfig: func() interface{} { return &testSourceConfig{} },
+		New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+			return &testSource{conf: conf.(*testSourceConfig), opts: opts}, nil
+		},
+	})
+	reg.RegisterDestination(backup.DestinationType{
+		Name:      "dir",
+		NewConfig: func() interface{} { return &testDirConfig{} },
+		New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+			return fs.NewDirDestination(filepath.Join(conf.(*testDirConfig).Path, opts.Namespace, opts.Name))
+		},
+	})
+	return reg
+}
+
+type testSource struct {
+	conf *testSourceConfig
+	opts backup.SourceOptions
+}
+
+func (s *testSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	var total int64
+	for _, o := range s.conf.Objects {
+		id := o.ID
+		if id == "" {
+			id = backup.NewID(s.opts.Time, "")
+		}
+		metadata := map[string]string{"compressed": fmt.Sprint(s.opts.Compressed)}
+		for k, v := range o.Metadata {
+			metadata[k] = v
+		}
+		var data io.Reader = strings.NewReader(strings.Repeat(o.Data, o.Repeat+1))
+		switch {
+		case o.Fail != "":
+			data = io.MultiReader(data, &failingReader{errors.New(o.Fail)})
+		case o.Stall:
+			data = io.MultiReader(data, &stallingReader{ctx})
+		}
+		written, err := dst.Store(ctx, backup.Object{ID: id, Data: data, Metadata: metadata})
+		total += written
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+type stallingReader struct {
+	ctx context.Context
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+// recordingDestination keeps the objects stored and fails after reading
+// the given number of bytes if set
+type recordingDestination struct {
+	data     map[string][]byte
+	metadata map[string]map[string]string
+	failAt   int64
+}
+
+func newRecordingDestination() *recordingDestination {
+	return &recordingDestination{
+		data:     map[string][]byte{},
+		metadata: map[string]map[string]string{},
+	}
+}
+
+func (d *recordingDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	var buf bytes.Buffer
+	r := obj.Data
+	if d.failAt > 0 {
+		r = io.LimitReader(r, d.failAt)
+	}
+	written, err := io.Copy(&buf, r)
+	if err != nil {
+		return written, err
+	}
+	if d.failAt > 0 {
+		return written, errors.New("disk full")
+	}
+	d.data[obj.ID] = buf.Bytes()
+	d.metadata[obj.ID] = obj.Metadata
+	return written, nil
+}
+
+func tempDir() string {
+	dir, err := ioutil.TempDir("", "plugin")
+	Expect(err).ToNot(HaveOccurred())
+	return dir
+}
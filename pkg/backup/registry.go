@@ -0,0 +1,225 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknownType is returned for source and destination types, which are not
+// registered
+var ErrUnknownType = errors.New("unknown type")
+
+// ErrNotReadable is returned for destination types, which cannot read back
+// the backups stored in them
+var ErrNotReadable = errors.New("reading backups is not supported")
+
+// SourceOptions are passed to all source factories
+type SourceOptions struct {
+	Time       time.Time // Start of the run, e.g. to derive the ID of the backup
+	Compressed bool      // Whether the backup is compressed after the source
+}
+
+// SourceType describes how sources of a type are created from their typed
+// configuration
+type SourceType struct {
+	// Name of the type, e.g. mongodb, recorded in manifests and metrics
+	Name string
+	// Tools creating the backups and their versions, recorded in manifests
+	Tools map[string]string
+	// NewConfig returns a pointer to the configuration of the type, which
+	// is unmarshalled from JSON and passed to New
+	NewConfig func() interface{}
+	New       func(conf interface{}, opts SourceOptions) (Source, error)
+}
+
+// DestinationOptions are passed to all destination factories
+type DestinationOptions struct {
+	Namespace string            // Namespace of the plan
+	Name      string            // Name of the plan
+	Tags      map[string]string // Added to all objects if supported
+	Retention RetentionPolicy   // Effective retention of the destination
+}
+
+// DestinationType describes how destinations of a type are created from their
+// typed configuration
+type DestinationType struct {
+	// Name of the type, which is also the key of its configuration
+	Name      string
+	NewConfig func() interface{}
+	New       func(conf interface{}, opts DestinationOptions) (Destination, error)
+	// NewSource returns a source streaming the backup with the given ID as
+	// stored by destinations of the type. It is optional, backups of types
+	// without it cannot be verified or restored.
+	NewSource func(conf interface{}, opts DestinationOptions, id string) (Source, error)
+}
+
+// Registry holds the known source and destination types
+type Registry struct {
+	mu           sync.RWMutex
+	sources      map[string]SourceType
+	destinations map[string]DestinationType
+}
+
+// DefaultRegistry is used by the package level functions
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sources:      map[string]SourceType{},
+		destinations: map[string]DestinationType{},
+	}
+}
+
+// RegisterSource registers a source type. It panics if the type is
+// incomplete or registered already, as types are registered on start up.
+func (r *Registry) RegisterSource(t SourceType) {
+	if t.Name == "" || t.NewConfig == nil || t.New == nil {
+		panic(fmt.Sprintf("incomplete source type %q", t.Name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sources[t.Name]; ok {
+		panic(fmt.Sprintf("source type %q registered twice", t.Name))
+	}
+	r.sources[t.Name] = t
+}
+
+// RegisterDestination registers a destination type. It panics if the type is
+// incomplete or registered already.
+func (r *Registry) RegisterDestination(t DestinationType) {
+	if t.Name == "" || t.NewConfig == nil || t.New == nil {
+		panic(fmt.Sprintf("incomplete destination type %q", t.Name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.destinations[t.Name]; ok {
+		panic(fmt.Sprintf("destination type %q registered twice", t.Name))
+	}
+	r.destinations[t.Name] = t
+}
+
+// Source returns the source type with the given name
+func (r *Registry) Source(name string) (SourceType, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.sources[name]
+	if !ok {
+		return SourceType{}, fmt.Errorf("%w of source: %s", ErrUnknownType, name)
+	}
+	return t, nil
+}
+
+// Destination returns the destination type with the given name
+func (r *Registry) Destination(name string) (DestinationType, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.destinations[name]
+	if !ok {
+		return DestinationType{}, fmt.Errorf("%w of destination: %s", ErrUnknownType, name)
+	}
+	return t, nil
+}
+
+// Sources returns the names of all source types sorted
+func (r *Registry) Sources() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Destinations returns the names of all destination types sorted
+func (r *Registry) Destinations() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.destinations))
+	for name := range r.destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSource creates a source of the named type from its JSON configuration
+func (r *Registry) NewSource(name string, raw []byte, opts SourceOptions) (Source, error) {
+	t, err := r.Source(name)
+	if err != nil {
+		return nil, err
+	}
+	conf := t.NewConfig()
+	if err := json.Unmarshal(raw, conf); err != nil {
+		return nil, fmt.Errorf("invalid configuration of source %s: %w", name, err)
+	}
+	return t.New(conf, opts)
+}
+
+// NewDestination creates a destination of the named type from its JSON
+// configuration
+func (r *Registry) NewDestination(name string, raw []byte, opts DestinationOptions) (Destination, error) {
+	t, conf, err := r.destinationConfig(name, raw)
+	if err != nil {
+		return nil, err
+	}
+	return t.New(conf, opts)
+}
+
+// NewDestinationSource creates a source reading the backup with the given ID
+// from a destination of the named type
+func (r *Registry) NewDestinationSource(name string, raw []byte, opts DestinationOptions, id string) (Source, error) {
+	t, conf, err := r.destinationConfig(name, raw)
+	if err != nil {
+		return nil, err
+	}
+	if t.NewSource == nil {
+		return nil, fmt.Errorf("%w by destination: %s", ErrNotReadable, name)
+	}
+	return t.NewSource(conf, opts, id)
+}
+
+// destinationConfig returns the named destination type and its configuration
+// unmarshalled from JSON
+func (r *Registry) destinationConfig(name string, raw []byte) (DestinationType, interface{}, error) {
+	t, err := r.Destination(name)
+	if err != nil {
+		return DestinationType{}, nil, err
+	}
+	conf := t.NewConfig()
+	if err := json.Unmarshal(raw, conf); err != nil {
+		return DestinationType{}, nil, fmt.Errorf("invalid configuration of destination %s: %w", name, err)
+	}
+	return t, conf, nil
+}
+
+// RegisterSource registers a source type in the default registry
+func RegisterSource(t SourceType) {
+	DefaultRegistry.RegisterSource(t)
+}
+
+// RegisterDestination registers a destination type in the default registry
+func RegisterDestination(t DestinationType) {
+	DefaultRegistry.RegisterDestination(t)
+}
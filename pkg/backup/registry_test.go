@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type bufferSourceConfig struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+var _ = Describe("Registry", func() {
+	var registry *backup.Registry
+
+	BeforeEach(func() {
+		registry = backup.NewRegistry()
+		registry.RegisterSource(backup.SourceType{
+			Name:      "buffer",
+			NewConfig: func() interface{} { return &bufferSourceConfig{} },
+			New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+				c := conf.(*bufferSourceConfig)
+				return mem.NewBufferSource(backup.NewID(opts.Time, c.Name), []byte(c.Data))
+			},
+		})
+		registry.RegisterDestination(backup.DestinationType{
+			Name:      "buffer",
+			NewConfig: func() interface{} { return &struct{}{} },
+			New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+				return mem.NewBufferDestination()
+			},
+			NewSource: func(conf interface{}, opts backup.DestinationOptions, id string) (backup.Source, error) {
+				return mem.NewBufferSource(id, []byte("testcontent"))
+			},
+		})
+		registry.RegisterDestination(backup.DestinationType{
+			Name:      "discard",
+			NewConfig: func() interface{} { return &struct{}{} },
+			New: func(conf interface{}, opts backup.DestinationOptions) (backup.Destination, error) {
+				return mem.NewBufferDestination()
+			},
+		})
+	})
+
+	It("should create sources and destinations from their configuration", func() {
+		src, err := registry.NewSource("buffer", []byte(`{"name":".tgz","data":"testcontent"}`), backup.SourceOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		dst, err := registry.NewDestination("buffer", []byte(`{}`), backup.DestinationOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.(*mem.BufferDestination).Data).To(HaveKeyWithValue("backup-00010101000000.tgz", []byte("testcontent")))
+		Expect(registry.Sources()).To(Equal([]string{"buffer"}))
+		Expect(registry.Destinations()).To(Equal([]string{"buffer", "discard"}))
+	})
+	It("should create sources reading backups from destinations", func() {
+		src, err := registry.NewDestinationSource("buffer", []byte(`{}`), backup.DestinationOptions{}, "backup-20200101000000.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		dst, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.Data).To(HaveKeyWithValue("backup-20200101000000.tgz", []byte("testcontent")))
+		_, err = registry.NewDestinationSource("discard", []byte(`{}`), backup.DestinationOptions{}, "backup-20200101000000.tgz")
+		Expect(errors.Is(err, backup.ErrNotReadable)).To(BeTrue())
+		_, err = registry.NewDestinationSource("ftp", []byte(`{}`), backup.DestinationOptions{}, "backup-20200101000000.tgz")
+		Expect(errors.Is(err, backup.ErrUnknownType)).To(BeTrue())
+	})
+	It("should fail for unknown types and invalid configuration", func() {
+		_, err := registry.NewSource("mysql", []byte(`{}`), backup.SourceOptions{})
+		Expect(errors.Is(err, backup.ErrUnknownType)).To(BeTrue())
+		_, err = registry.NewDestination("ftp", []byte(`{}`), backup.DestinationOptions{})
+		Expect(errors.Is(err, backup.ErrUnknownType)).To(BeTrue())
+		_, err = registry.NewSource("buffer", []byte(`{"name":1}`), backup.SourceOptions{})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should refuse duplicate and incomplete types", func() {
+		Expect(func() {
+			registry.RegisterSource(backup.SourceType{
+				Name:      "buffer",
+				NewConfig: func() interface{} { return &bufferSourceConfig{} },
+				New: func(conf interface{}, opts backup.SourceOptions) (backup.Source, error) {
+					return nil, nil
+				},
+			})
+		}).To(Panic())
+		Expect(func() { registry.RegisterDestination(backup.DestinationType{Name: "incomplete"}) }).To(Panic())
+	})
+})
@@ -0,0 +1,259 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+// RetentionPolicy decides which backups are kept by a destination. Backups
+// are bucketed by their timestamps in UTC, the newest backup of every bucket
+// is kept for the given number of most recent buckets (grandfather, father,
+// son). A backup is kept if any of the rules keeps it.
+type RetentionPolicy struct {
+	KeepLast    int           // Number of newest backups to keep
+	KeepHourly  int           // Number of hours to keep the newest backup of
+	KeepDaily   int           // Number of days to keep the newest backup of
+	KeepWeekly  int           // Number of ISO weeks to keep the newest backup of
+	KeepMonthly int           // Number of months to keep the newest backup of
+	KeepYearly  int           // Number of years to keep the newest backup of
+	MinAge      time.Duration // Backups younger than this are always kept
+	MaxAge      time.Duration // Backups older than this are always removed
+	DryRun      bool          // Only log the backups, which would be removed
+	PruneLegacy bool          // Backups without manifest are considered too
+
+	// Only backups with matching names are considered, e.g. IDPattern. All
+	// backups are considered if unset.
+	Pattern *regexp.Regexp
+	// ID of the backup of the current run. Nothing is removed unless it is
+	// stored completely.
+	Require string
+}
+
+// IDPattern matches the IDs returned by NewID including the extensions added
+// by compression and encryption
+var IDPattern = regexp.MustCompile(`^backup-[0-9]{14}(\.|$)`)
+
+// ErrUnverifiedBackup is returned if the backup of the current run cannot be
+// verified before pruning
+var ErrUnverifiedBackup = errors.New("backup cannot be verified")
+
+// ErrLocked is returned by pruners for backups, which cannot be removed yet,
+// e.g. because of an object lock
+var ErrLocked = errors.New("backup is locked")
+
+// NewID returns the ID of a backup created at t
+func NewID(t time.Time, ext string) string {
+	return fmt.Sprintf("backup-%s%s", t.Format("20060102150405"), ext)
+}
+
+// KeepLast returns a policy, which keeps the newest n backups
+func KeepLast(n int) RetentionPolicy {
+	return RetentionPolicy{KeepLast: n}
+}
+
+// StoredBackup is a backup kept by a destination
+type StoredBackup struct {
+	ID        string
+	Timestamp time.Time
+	Size      int64
+	Manifest  bool // Whether a manifest is stored next to the backup
+}
+
+// Pruner is implemented by destinations, which can remove backups
+type Pruner interface {
+	// Backups returns all stored backups, newest first. Manifests are not
+	// included.
+	Backups(ctx context.Context) ([]StoredBackup, error)
+	// Manifest returns the manifest of the backup
+	Manifest(ctx context.Context, id string) (*Manifest, error)
+	// Remove removes the backup and its manifest if any
+	Remove(ctx context.Context, id string) error
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("last=%d hourly=%d daily=%d weekly=%d monthly=%d yearly=%d minAge=%s maxAge=%s",
+		p.KeepLast, p.KeepHourly, p.KeepDaily, p.KeepWeekly, p.KeepMonthly, p.KeepYearly, p.MinAge, p.MaxAge)
+}
+
+// Validate returns an error if the policy never removes a backup, as it has
+// neither a keep rule nor a maximum age
+func (p RetentionPolicy) Validate() error {
+	if !p.hasKeepRules() && p.MaxAge <= 0 {
+		return fmt.Errorf("retention policy keeps all backups, a keep rule or a maximum age is required")
+	}
+	return nil
+}
+
+// LockDuration returns how long backups taken in the interval of the finest
+// rule are kept at least, e.g. 7 days for a backup per day and KeepDaily 7.
+// Backups are always kept for MinAge if set. Zero is returned if the duration
+// cannot be derived as the policy only keeps a number of backups.
+func (p RetentionPolicy) LockDuration() time.Duration {
+	if p.MinAge > 0 {
+		return p.MinAge
+	}
+	day := 24 * time.Hour
+	switch {
+	case p.KeepHourly > 0:
+		return time.Duration(p.KeepHourly) * time.Hour
+	case p.KeepDaily > 0:
+		return time.Duration(p.KeepDaily) * day
+	case p.KeepWeekly > 0:
+		return time.Duration(p.KeepWeekly) * 7 * day
+	case p.KeepMonthly > 0:
+		return time.Duration(p.KeepMonthly) * 30 * day
+	case p.KeepYearly > 0:
+		return time.Duration(p.KeepYearly) * 365 * day
+	}
+	return 0
+}
+
+func (p RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepHourly > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0 || p.KeepYearly > 0
+}
+
+// Obsolete returns the backups to remove according to the policy, newest
+// first. If no keep rule is set all backups are kept, which are not older
+// than MaxAge.
+func (p RetentionPolicy) Obsolete(backups []StoredBackup, now time.Time) []StoredBackup {
+	sorted := append([]StoredBackup{}, backups...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.After(sorted[j].Timestamp)
+	})
+	keep := make([]bool, len(sorted))
+	if !p.hasKeepRules() {
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+	for i := 0; i < p.KeepLast && i < len(sorted); i++ {
+		keep[i] = true
+	}
+	buckets := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{p.KeepHourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{p.KeepDaily, func(t time.Time) string { return t.Format("20060102") }},
+		{p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{p.KeepMonthly, func(t time.Time) string { return t.Format("200601") }},
+		{p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, b := range buckets {
+		last, kept := "", 0
+		for i := 0; i < len(sorted) && kept < b.count; i++ {
+			if key := b.key(sorted[i].Timestamp.UTC()); key != last {
+				keep[i] = true
+				last = key
+				kept++
+			}
+		}
+	}
+	var obsolete []StoredBackup
+	for i, b := range sorted {
+		age := now.Sub(b.Timestamp)
+		if p.MinAge > 0 && age < p.MinAge {
+			continue
+		}
+		if keep[i] && (p.MaxAge <= 0 || age <= p.MaxAge) {
+			continue
+		}
+		obsolete = append(obsolete, b)
+	}
+	return obsolete
+}
+
+// ApplyRetention removes all backups of p, which are obsolete according to
+// the policy. Only backups with a manifest are considered, so partial backups
+// of failed runs never replace intact ones, unless PruneLegacy is set. Nothing is removed if the required
+// backup of the current run cannot be verified. Locked backups are skipped
+// and removed by a later run. In dry run mode the backups are only logged.
+func ApplyRetention(ctx context.Context, p Pruner, policy RetentionPolicy, log logger.Logger) error {
+	backups, err := p.Backups(ctx)
+	if err != nil {
+		return err
+	}
+	var candidates []StoredBackup
+	for _, b := range backups {
+		if policy.Pattern != nil && !policy.Pattern.MatchString(path.Base(b.ID)) {
+			continue
+		}
+		if !b.Manifest && !policy.PruneLegacy {
+			log.Info("ignoring backup without manifest", "id", b.ID)
+			continue
+		}
+		candidates = append(candidates, b)
+	}
+	if policy.Require != "" {
+		if err := verifyStored(ctx, p, candidates, policy.Require); err != nil {
+			return fmt.Errorf("refusing to apply retention: %w", err)
+		}
+	}
+	obsolete := policy.Obsolete(candidates, time.Now())
+	log.Info("applying retention policy", "policy", policy.String(), "backups", len(candidates), "obsolete", len(obsolete), "dryRun", policy.DryRun)
+	for _, b := range obsolete {
+		if b.ID == policy.Require {
+			continue
+		}
+		if policy.DryRun {
+			log.Info("would remove obsolete backup", "id", b.ID, "timestamp", b.Timestamp)
+			continue
+		}
+		log.Info("removing obsolete backup", "id", b.ID, "timestamp", b.Timestamp)
+		if err := p.Remove(ctx, b.ID); errors.Is(err, ErrLocked) {
+			log.Info("skipping locked backup", "id", b.ID, "reason", err.Error())
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyStored ensures the backup with the given ID is among the backups and
+// its size matches its manifest
+func verifyStored(ctx context.Context, p Pruner, backups []StoredBackup, id string) error {
+	for _, b := range backups {
+		if b.ID != id {
+			continue
+		}
+		if !b.Manifest {
+			break
+		}
+		manifest, err := p.Manifest(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrUnverifiedBackup, id, err)
+		}
+		// IDs may contain directories the manifest destination does not know of
+		if path.Base(manifest.Object) != path.Base(id) || manifest.Size != b.Size {
+			return fmt.Errorf("%w: %s: stored %d bytes, manifest of %s expects %d", ErrUnverifiedBackup, id, b.Size, manifest.Object, manifest.Size)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s has no manifest", ErrUnverifiedBackup, id)
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// pruner keeps backups in memory
+type pruner struct {
+	backups   []backup.StoredBackup
+	manifests map[string]*backup.Manifest
+	locked    map[string]bool
+	removed   []string
+}
+
+func (p *pruner) Backups(_ context.Context) ([]backup.StoredBackup, error) {
+	return p.backups, nil
+}
+
+func (p *pruner) Manifest(_ context.Context, id string) (*backup.Manifest, error) {
+	if m, ok := p.manifests[id]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("no manifest for %s", id)
+}
+
+func (p *pruner) Remove(_ context.Context, id string) error {
+	if p.locked[id] {
+		return fmt.Errorf("%w: %s", backup.ErrLocked, id)
+	}
+	p.removed = append(p.removed, id)
+	return nil
+}
+
+// hourlyBackups returns n backups with manifests taken every hour before now,
+// newest first
+func hourlyBackups(now time.Time, n int) []backup.StoredBackup {
+	backups := make([]backup.StoredBackup, n)
+	for i := range backups {
+		ts := now.Add(-time.Duration(i) * time.Hour)
+		backups[i] = backup.StoredBackup{ID: backup.NewID(ts, ".tgz"), Timestamp: ts, Size: 42, Manifest: true}
+	}
+	return backups
+}
+
+func ids(backups []backup.StoredBackup) []string {
+	ids := []string{}
+	for _, b := range backups {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+var _ = Describe("RetentionPolicy", func() {
+	// Sunday, so every day before starts a new ISO week
+	now := time.Date(2021, time.March, 7, 12, 30, 0, 0, time.UTC)
+	backups := hourlyBackups(now, 24*90)
+	kept := func(policy backup.RetentionPolicy) []string {
+		obsolete := map[string]bool{}
+		for _, b := range policy.Obsolete(backups, now) {
+			obsolete[b.ID] = true
+		}
+		kept := []string{}
+		for _, b := range backups {
+			if !obsolete[b.ID] {
+				kept = append(kept, b.Timestamp.Format("2006-01-02T15"))
+			}
+		}
+		return kept
+	}
+
+	DescribeTable("should keep backups",
+		func(policy backup.RetentionPolicy, expected []string) {
+			Expect(kept(policy)).To(Equal(expected))
+		},
+		Entry("newest", backup.KeepLast(3), []string{"2021-03-07T12", "2021-03-07T11", "2021-03-07T10"}),
+		Entry("hourly", backup.RetentionPolicy{KeepHourly: 2}, []string{"2021-03-07T12", "2021-03-07T11"}),
+		Entry("daily", backup.RetentionPolicy{KeepDaily: 3}, []string{"2021-03-07T12", "2021-03-06T23", "2021-03-05T23"}),
+		Entry("weekly", backup.RetentionPolicy{KeepWeekly: 3}, []string{"2021-03-07T12", "2021-02-28T23", "2021-02-21T23"}),
+		Entry("monthly", backup.RetentionPolicy{KeepMonthly: 5}, []string{"2021-03-07T12", "2021-02-28T23", "2021-01-31T23", "2020-12-31T23"}),
+		Entry("yearly", backup.RetentionPolicy{KeepYearly: 5}, []string{"2021-03-07T12", "2020-12-31T23"}),
+		Entry("combined", backup.RetentionPolicy{KeepLast: 2, KeepDaily: 2, KeepMonthly: 2}, []string{"2021-03-07T12", "2021-03-07T11", "2021-03-06T23", "2021-02-28T23"}),
+		Entry("younger than min age", backup.RetentionPolicy{KeepLast: 1, MinAge: 150 * time.Minute}, []string{"2021-03-07T12", "2021-03-07T11", "2021-03-07T10"}),
+		Entry("not older than max age", backup.RetentionPolicy{KeepDaily: 3, MaxAge: 36 * time.Hour}, []string{"2021-03-07T12", "2021-03-06T23"}),
+	)
+	It("should keep all backups without keep rules", func() {
+		Expect(backup.RetentionPolicy{}.Obsolete(backups, now)).To(BeEmpty())
+		Expect(kept(backup.RetentionPolicy{MaxAge: 2 * time.Hour})).To(Equal([]string{"2021-03-07T12", "2021-03-07T11", "2021-03-07T10"}))
+	})
+	It("should reject policies keeping all backups", func() {
+		Expect(backup.RetentionPolicy{}.Validate()).ToNot(Succeed())
+		Expect(backup.RetentionPolicy{MinAge: time.Hour, DryRun: true}.Validate()).ToNot(Succeed())
+		Expect(backup.KeepLast(1).Validate()).To(Succeed())
+		Expect(backup.RetentionPolicy{MaxAge: time.Hour}.Validate()).To(Succeed())
+	})
+	It("should sort backups by timestamp", func() {
+		shuffled := []backup.StoredBackup{backups[2], backups[0], backups[1]}
+		Expect(ids(backup.KeepLast(1).Obsolete(shuffled, now))).To(Equal(ids(backups[1:3])))
+	})
+	It("should only log obsolete backups in dry run mode", func() {
+		p := &pruner{backups: hourlyBackups(time.Now(), 5)}
+		log := logger.WithName("retention")
+		Expect(backup.ApplyRetention(context.Background(), p, backup.RetentionPolicy{KeepLast: 2, DryRun: true}, log)).To(Succeed())
+		Expect(p.removed).To(BeEmpty())
+		Expect(backup.ApplyRetention(context.Background(), p, backup.KeepLast(2), log)).To(Succeed())
+		Expect(p.removed).To(Equal(ids(p.backups[2:])))
+	})
+	It("should only consider matching backups with manifests", func() {
+		now := time.Now()
+		p := &pruner{backups: hourlyBackups(now, 4)}
+		// Failed runs newer than all intact backups
+		p.backups = append([]backup.StoredBackup{
+			{ID: backup.NewID(now.Add(time.Minute), ".tgz"), Timestamp: now.Add(time.Minute)},
+			{ID: "unrelated.txt", Timestamp: now.Add(time.Minute), Manifest: true},
+		}, p.backups...)
+		policy := backup.KeepLast(2)
+		policy.Pattern = backup.IDPattern
+		Expect(backup.ApplyRetention(context.Background(), p, policy, logger.WithName("retention"))).To(Succeed())
+		Expect(p.removed).To(Equal(ids(p.backups[4:])))
+	})
+	It("should prune legacy backups without manifest only if enabled", func() {
+		now := time.Now()
+		p := &pruner{backups: hourlyBackups(now, 4)}
+		for i := range p.backups[1:] {
+			p.backups[i+1].Manifest = false
+		}
+		policy := backup.KeepLast(2)
+		policy.Pattern = backup.IDPattern
+		log := logger.WithName("retention")
+		Expect(backup.ApplyRetention(context.Background(), p, policy, log)).To(Succeed())
+		Expect(p.removed).To(BeEmpty())
+		policy.PruneLegacy = true
+		Expect(backup.ApplyRetention(context.Background(), p, policy, log)).To(Succeed())
+		Expect(p.removed).To(Equal(ids(p.backups[2:])))
+
+		// The backup of the current run still requires a manifest
+		p = &pruner{backups: hourlyBackups(now, 4)}
+		p.backups[0].Manifest = false
+		policy.Require = p.backups[0].ID
+		err := backup.ApplyRetention(context.Background(), p, policy, log)
+		Expect(errors.Is(err, backup.ErrUnverifiedBackup)).To(BeTrue())
+		Expect(p.removed).To(BeEmpty())
+	})
+	It("should refuse to prune if the current backup cannot be verified", func() {
+		p := &pruner{backups: hourlyBackups(time.Now(), 4), manifests: map[string]*backup.Manifest{}}
+		current := p.backups[0].ID
+		policy := backup.KeepLast(1)
+		policy.Require = current
+		log := logger.WithName("retention")
+		err := backup.ApplyRetention(context.Background(), p, policy, log)
+		Expect(errors.Is(err, backup.ErrUnverifiedBackup)).To(BeTrue())
+		p.manifests[current] = &backup.Manifest{Object: current, Size: 41}
+		err = backup.ApplyRetention(context.Background(), p, policy, log)
+		Expect(errors.Is(err, backup.ErrUnverifiedBackup)).To(BeTrue())
+		p.backups[0].Manifest = false
+		p.manifests[current].Size = 42
+		err = backup.ApplyRetention(context.Background(), p, policy, log)
+		Expect(errors.Is(err, backup.ErrUnverifiedBackup)).To(BeTrue())
+		Expect(p.removed).To(BeEmpty())
+		p.backups[0].Manifest = true
+		Expect(backup.ApplyRetention(context.Background(), p, policy, log)).To(Succeed())
+		Expect(p.removed).To(Equal(ids(p.backups[1:])))
+	})
+	It("should skip locked backups", func() {
+		p := &pruner{backups: hourlyBackups(time.Now(), 4), locked: map[string]bool{}}
+		p.locked[p.backups[2].ID] = true
+		Expect(backup.ApplyRetention(context.Background(), p, backup.KeepLast(1), logger.WithName("retention"))).To(Succeed())
+		Expect(p.removed).To(Equal([]string{p.backups[1].ID, p.backups[3].ID}))
+	})
+	DescribeTable("should derive lock durations",
+		func(policy backup.RetentionPolicy, expected time.Duration) {
+			Expect(policy.LockDuration()).To(Equal(expected))
+		},
+		Entry("newest", backup.KeepLast(3), time.Duration(0)),
+		Entry("min age", backup.RetentionPolicy{KeepLast: 3, KeepDaily: 7, MinAge: 36 * time.Hour}, 36*time.Hour),
+		Entry("finest rule", backup.RetentionPolicy{KeepDaily: 7, KeepMonthly: 12}, 7*24*time.Hour),
+		Entry("weekly", backup.RetentionPolicy{KeepWeekly: 2}, 14*24*time.Hour),
+	)
+})
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultRegion is used if no region is configured
+const DefaultRegion = "us-east-1"
+
+// clientConf configures the connection and authentication shared by sources
+// and destinations
+type clientConf struct {
+	Endpoint           string
+	Region             string
+	AccessKey          string
+	SecretKey          string
+	CredentialChain    bool
+	RoleARN            string
+	ExternalID         string
+	DisableSSL         bool
+	InsecureSkipVerify bool
+	CABundle           string
+	ClientCertificate  string
+	ClientKey          string
+	ServerName         string
+	Retry              *RetryPolicy // Retries of every request, the default of the SDK if nil
+}
+
+// newClient creates a client authenticated with the static access key or the
+// default credential chain of the SDK, i.e. environment, web identity token,
+// shared config and EC2/ECS metadata. If a role is configured it is assumed
+// with these credentials.
+func newClient(conf clientConf) (*session.Session, *s3.S3, error) {
+	region := conf.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	opts := session.Options{
+		Config: aws.Config{Region: aws.String(region)},
+	}
+	if conf.CredentialChain {
+		opts.SharedConfigState = session.SharedConfigEnable
+	} else {
+		opts.Config.Credentials = credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, "")
+	}
+	newSession, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	// The endpoint only applies to S3, other services like STS use the
+	// endpoints of the region
+	cfg := aws.NewConfig().
+		WithHTTPClient(&http.Client{Transport: tr}).
+		WithDisableSSL(conf.DisableSSL).
+		WithS3ForcePathStyle(true)
+	if conf.Endpoint != "" {
+		cfg = cfg.WithEndpoint(conf.Endpoint)
+	}
+	if conf.Retry != nil {
+		cfg = request.WithRetryer(cfg, newRetryer(*conf.Retry))
+	}
+	if conf.RoleARN != "" {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(newSession, conf.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = fmt.Sprintf("backup-operator-%d", time.Now().Unix())
+			if conf.ExternalID != "" {
+				p.ExternalID = aws.String(conf.ExternalID)
+			}
+		}))
+	}
+	return newSession, s3.New(newSession, cfg), nil
+}
+
+// newTLSConfig returns the TLS configuration of the connection to the
+// endpoint. Certificates of the CA bundle are trusted in addition to the
+// system roots.
+func newTLSConfig(conf clientConf) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: conf.InsecureSkipVerify, // nolint:gosec
+		ServerName:         conf.ServerName,
+	}
+	if conf.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(conf.CABundle)) {
+			return nil, fmt.Errorf("CA bundle contains no PEM encoded certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.ClientCertificate != "" || conf.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(conf.ClientCertificate), []byte(conf.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// createBucket creates the bucket, if it does not exist yet
+func createBucket(client *s3.S3, input *s3.CreateBucketInput) error {
+	_, err := client.CreateBucket(input)
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == s3.ErrCodeBucketAlreadyExists || aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+			return nil
+		}
+	}
+	return err
+}
+
+// createBucketInput returns the input to create the bucket in the region
+func createBucketInput(bucket, region string) *s3.CreateBucketInput {
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(bucket),
+	}
+	// Buckets in the default region must not have a location constraint
+	if region != "" && region != DefaultRegion {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	return input
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newTestClientCertificate returns a self-signed PEM encoded client
+// certificate and its key
+func newTestClientCertificate() (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "backup-operator"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+}
+
+// serverCABundle returns the certificate of the test server PEM encoded
+func serverCABundle(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+func get(conf clientConf, url string) error {
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+var _ = Describe("TLS", func() {
+	var server *httptest.Server
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	AfterEach(func() {
+		server.Close()
+	})
+	It("should verify the endpoint with the CA bundle", func() {
+		server = httptest.NewTLSServer(handler)
+		Expect(get(clientConf{}, server.URL)).ToNot(Succeed())
+		Expect(get(clientConf{CABundle: serverCABundle(server)}, server.URL)).To(Succeed())
+	})
+	It("should verify the server name", func() {
+		server = httptest.NewTLSServer(handler)
+		// The certificate of the test server is valid for example.com
+		conf := clientConf{CABundle: serverCABundle(server), ServerName: "example.com"}
+		Expect(get(conf, server.URL)).To(Succeed())
+		conf.ServerName = "other.example.org"
+		Expect(get(conf, server.URL)).ToNot(Succeed())
+	})
+	It("should authenticate with a client certificate", func() {
+		cert, key := newTestClientCertificate()
+		clientCAs := x509.NewCertPool()
+		Expect(clientCAs.AppendCertsFromPEM([]byte(cert))).To(BeTrue())
+		server = httptest.NewUnstartedServer(handler)
+		server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		}
+		server.StartTLS()
+		conf := clientConf{CABundle: serverCABundle(server)}
+		Expect(get(conf, server.URL)).ToNot(Succeed())
+		conf.ClientCertificate, conf.ClientKey = cert, key
+		Expect(get(conf, server.URL)).To(Succeed())
+	})
+	It("should reject invalid certificates", func() {
+		server = httptest.NewTLSServer(handler)
+		_, err := newTLSConfig(clientConf{CABundle: "invalid"})
+		Expect(err).To(HaveOccurred())
+		cert, _ := newTestClientCertificate()
+		_, err = newTLSConfig(clientConf{ClientCertificate: cert})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,250 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// Layout defines where objects are stored below the prefix of a destination
+type Layout string
+
+const (
+	// LayoutV1 stores objects directly below the prefix
+	LayoutV1 Layout = "v1"
+	// LayoutV2 stores the objects of every run in a directory of their own,
+	// i.e. <prefix>/<timestamp>-<runid>/<id>
+	LayoutV2 Layout = "v2"
+)
+
+// DefaultPrefixTemplate is used if no prefix template is configured
+const DefaultPrefixTemplate = "{{ .Namespace }}/{{ .Name }}/"
+
+// PrefixData is passed to prefix templates
+type PrefixData struct {
+	Namespace string
+	Name      string
+}
+
+// RenderPrefix renders the prefix template. The prefix always ends with a
+// delimiter, so it never matches the objects of other plans sharing the
+// beginning of their name.
+func RenderPrefix(tmpl string, data PrefixData) (string, error) {
+	t, err := template.New("prefix").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid prefix template: %w", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid prefix template: %w", err)
+	}
+	return normalizePrefix(b.String()), nil
+}
+
+// runTimeFormat is the format of the time in UTC the names of run directories
+// start with
+const runTimeFormat = "20060102150405"
+
+// NewRunID returns the name of the directory of a run started at t
+func NewRunID(t time.Time) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", t.UTC().Format(runTimeFormat), hex.EncodeToString(b))
+}
+
+// migratedRunID returns the name of the directory objects stored at t are
+// migrated to
+func migratedRunID(t time.Time) string {
+	return fmt.Sprintf("%s-%s", t.UTC().Format(runTimeFormat), LayoutV1)
+}
+
+// runTime returns the time the name of the run directory starts with
+func runTime(run string) (time.Time, bool) {
+	if len(run) < len(runTimeFormat) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(runTimeFormat, run[:len(runTimeFormat)])
+	return t, err == nil
+}
+
+// timestamp returns the time the backup stored as obj below the prefix was
+// created. In LayoutV2 this is the time of its run directory, as the
+// modification time is reset by copies, e.g. when backups are migrated.
+func timestamp(obj *s3.Object, prefix string, layout Layout) time.Time {
+	if layout == LayoutV2 {
+		if t, ok := runTime(strings.TrimPrefix(*obj.Key, prefix)); ok {
+			return t
+		}
+	}
+	return aws.TimeValue(obj.LastModified)
+}
+
+// normalizePrefix removes leading and adds a trailing delimiter
+func normalizePrefix(prefix string) string {
+	prefix = strings.TrimLeft(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// Migrate moves all backups stored in LayoutV1 directly below from into a
+// directory of their own below the prefix of the destination, which is marked
+// as complete. Manifests are moved along with their backups. The IDs of the
+// migrated backups are returned, in dry run mode nothing is moved.
+func (s *S3Destination) Migrate(ctx context.Context, from string, dryRun bool) ([]string, error) {
+	if s.Layout != LayoutV2 {
+		return nil, fmt.Errorf("migration requires layout %s", LayoutV2)
+	}
+	objects, manifests, err := s.list(ctx, normalizePrefix(from), LayoutV1)
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	runs := map[string][]string{} // Objects migrated to each run directory
+	for _, obj := range objects {
+		run := migratedRunID(aws.TimeValue(obj.LastModified))
+		id := path.Join(run, path.Base(*obj.Key))
+		moves := [][2]string{{*obj.Key, s.Prefix + id}}
+		if manifests[backup.ManifestID(*obj.Key)] {
+			moves = append(moves, [2]string{backup.ManifestID(*obj.Key), backup.ManifestID(s.Prefix + id)})
+		}
+		if dryRun {
+			s.log.Info("would migrate backup", "bucket", s.Bucket, "key", *obj.Key, "id", id)
+			migrated = append(migrated, id)
+			continue
+		}
+		s.log.Info("migrating backup", "bucket", s.Bucket, "key", *obj.Key, "id", id)
+		// Copy everything first, so interrupted migrations can be repeated
+		for _, m := range moves {
+			if err := s.copyObject(ctx, m[0], m[1]); err != nil {
+				return migrated, fmt.Errorf("failed to migrate %s: %w", m[0], err)
+			}
+			runs[run] = append(runs[run], path.Base(m[1]))
+		}
+		if err := s.complete(ctx, run, runs[run]); err != nil {
+			return migrated, fmt.Errorf("failed to migrate %s: %w", *obj.Key, err)
+		}
+		for _, m := range moves {
+			_, err := s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: &s.Bucket,
+				Key:    aws.String(m[0]),
+			})
+			if err != nil {
+				return migrated, fmt.Errorf("failed to migrate %s: %w", m[0], err)
+			}
+		}
+		migrated = append(migrated, id)
+	}
+	return migrated, nil
+}
+
+// copyObject copies the object including its metadata and tags. Objects too
+// large for CopyObject are copied in parts.
+func (s *S3Destination) copyObject(ctx context.Context, from, to string) error {
+	head, err := s.Client.HeadObjectWithContext(ctx, s.headObjectInput(from))
+	if err != nil {
+		return err
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:     &s.Bucket,
+		Key:        &to,
+		CopySource: aws.String((&url.URL{Path: s.Bucket + "/" + from}).EscapedPath()),
+	}
+	s.copyOptions(input, head)
+	if aws.Int64Value(head.ContentLength) > maxCopyObjectSize {
+		return s.copyObjectParts(ctx, input, from, head)
+	}
+	_, err = s.Client.CopyObjectWithContext(ctx, input)
+	return err
+}
+
+// copyObjectParts copies the object as described by input with a multipart
+// upload. The metadata and tags of the source are not copied by multipart
+// uploads, so they are set on creation of the upload.
+func (s *S3Destination) copyObjectParts(ctx context.Context, input *s3.CopyObjectInput, from string, head *s3.HeadObjectOutput) error {
+	tagging, err := s.Client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: &s.Bucket,
+		Key:    &from,
+	})
+	if err != nil {
+		return err
+	}
+	tags := url.Values{}
+	for _, tag := range tagging.TagSet {
+		tags.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+	create := &s3.CreateMultipartUploadInput{}
+	awsutil.Copy(create, input)
+	create.Metadata = head.Metadata
+	if len(tags) > 0 {
+		create.Tagging = aws.String(tags.Encode())
+	}
+	upload, err := s.Client.CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	size := aws.Int64Value(head.ContentLength)
+	for offset := int64(0); offset < size; offset += copyPartSize {
+		last := offset + copyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+		res, err := s.Client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         input.Bucket,
+			Key:                            input.Key,
+			UploadId:                       upload.UploadId,
+			PartNumber:                     number,
+			CopySource:                     input.CopySource,
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+			SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+			SSECustomerKey:                 input.SSECustomerKey,
+			CopySourceSSECustomerAlgorithm: input.CopySourceSSECustomerAlgorithm,
+			CopySourceSSECustomerKey:       input.CopySourceSSECustomerKey,
+		})
+		if err != nil {
+			s.abortUpload(*input.Key, aws.StringValue(upload.UploadId))
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: number})
+	}
+	_, err = s.Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortUpload(*input.Key, aws.StringValue(upload.UploadId))
+	}
+	return err
+}
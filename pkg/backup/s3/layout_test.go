@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Layout", func() {
+	newDestination := func(bucket, prefix string, layout Layout) *S3Destination {
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+			Prefix:             prefix,
+			Layout:             layout,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return dst
+	}
+	store := func(dst backup.Destination, id string) {
+		_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString("testcontent")})
+		Expect(err).ToNot(HaveOccurred())
+	}
+	keys := func(dst *S3Destination) []string {
+		found := []string{}
+		Expect(dst.Client.ListObjectsPages(&s3.ListObjectsInput{Bucket: &dst.Bucket},
+			func(page *s3.ListObjectsOutput, lastPage bool) bool {
+				for _, obj := range page.Contents {
+					found = append(found, *obj.Key)
+				}
+				return true
+			})).To(Succeed())
+		sort.Strings(found)
+		return found
+	}
+
+	It("should render prefixes with a trailing delimiter", func() {
+		prefix, err := RenderPrefix(DefaultPrefixTemplate, PrefixData{Namespace: "prod", Name: "db"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prefix).To(Equal("prod/db/"))
+		prefix, err = RenderPrefix("/backups/{{ .Name }}", PrefixData{Namespace: "prod", Name: "db"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prefix).To(Equal("backups/db/"))
+		_, err = RenderPrefix("{{ .Unknown }}", PrefixData{})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should not list backups of plans sharing the beginning of their name", func() {
+		db := newDestination("bucketlayout1", "prod/db", LayoutV1)
+		archive := newDestination("bucketlayout1", "prod/db-archive", LayoutV1)
+		store(db, "backup-20210101000000.tgz")
+		store(archive, "backup-20210102000000.tgz")
+		ids, err := db.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"backup-20210101000000.tgz"}))
+		Expect(db.EnsureRetention(context.Background(), backup.KeepLast(1))).To(Succeed())
+		Expect(keys(archive)).To(ContainElement("prod/db-archive/backup-20210102000000.tgz"))
+	})
+	It("should store every run in a directory of its own", func() {
+		dst := newDestination("bucketlayout2", "prod/db", LayoutV2)
+		store(dst, "backup-20210101000000.tgz")
+		Expect(keys(dst)).To(Equal([]string{
+			"prod/db/" + dst.Run + "/" + backup.CompletionMarker,
+			"prod/db/" + dst.Run + "/backup-20210101000000.tgz",
+			"prod/db/" + dst.Run + "/backup-20210101000000.tgz" + backup.ManifestExtension,
+		}))
+		ids, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{dst.Run + "/backup-20210101000000.tgz"}))
+		policy := backup.KeepLast(1)
+		policy.Pattern = backup.IDPattern
+		policy.Require = "backup-20210101000000.tgz"
+		Expect(dst.EnsureRetention(context.Background(), policy)).To(Succeed())
+	})
+	It("should migrate backups from layout v1", func() {
+		v1 := newDestination("bucketlayout3", "prod/db", LayoutV1)
+		store(v1, "backup-20210101000000.tgz")
+		_, err := v1.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte("other")),
+			Bucket: &v1.Bucket,
+			Key:    aws.String("prod/db-archive/backup-20210101000000.tgz"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		v2 := newDestination("bucketlayout3", "prod/db", LayoutV2)
+		migrated, err := v2.Migrate(context.Background(), "prod/db", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(migrated).To(HaveLen(1))
+		Expect(keys(v2)).To(ContainElement("prod/db/backup-20210101000000.tgz"))
+		migrated, err = v2.Migrate(context.Background(), "prod/db", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(migrated).To(HaveLen(1))
+		Expect(keys(v2)).To(Equal([]string{
+			"prod/db-archive/backup-20210101000000.tgz",
+			"prod/db/" + path.Dir(migrated[0]) + "/" + backup.CompletionMarker,
+			"prod/db/" + migrated[0],
+			"prod/db/" + migrated[0] + backup.ManifestExtension,
+		}))
+		ids, err := v2.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal(migrated))
+	})
+	It("should keep the timestamps of migrated backups", func() {
+		v1 := newDestination("bucketlayout4", "prod/db", LayoutV1)
+		store(v1, "backup-20210101000000.tgz")
+		before, err := v1.Backups(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		time.Sleep(time.Second) // Copies are modified later
+		v2 := newDestination("bucketlayout4", "prod/db", LayoutV2)
+		_, err = v2.Migrate(context.Background(), "prod/db", false)
+		Expect(err).ToNot(HaveOccurred())
+		after, err := v2.Backups(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(after).To(HaveLen(1))
+		Expect(after[0].Timestamp).To(Equal(before[0].Timestamp.UTC().Truncate(time.Second)))
+	})
+	It("should order backups by their run directories", func() {
+		newer := newDestination("bucketlayout5", "prod/db", LayoutV2)
+		newer.Run = "20210102000000-aaaaaaaa"
+		older := newDestination("bucketlayout5", "prod/db", LayoutV2)
+		older.Run = "20210101000000-bbbbbbbb"
+		// Stored in reverse order, so their modification times are reversed
+		store(newer, "backup-20210102000000.tgz")
+		store(older, "backup-20210101000000.tgz")
+		backups, err := newer.Backups(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		Expect(backups[0].ID).To(Equal(newer.Run + "/backup-20210102000000.tgz"))
+		Expect(backups[0].Timestamp).To(Equal(time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)))
+		Expect(backups[1].Timestamp).To(Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(newer.EnsureRetention(context.Background(), backup.KeepLast(1))).To(Succeed())
+		Expect(keys(newer)).To(Equal([]string{
+			"prod/db/" + newer.Run + "/" + backup.CompletionMarker,
+			"prod/db/" + newer.Run + "/backup-20210102000000.tgz",
+			"prod/db/" + newer.Run + "/backup-20210102000000.tgz" + backup.ManifestExtension,
+		}))
+	})
+	It("should migrate backups too large for a single copy in parts", func() {
+		defer func(max, part int64) {
+			maxCopyObjectSize, copyPartSize = max, part
+		}(maxCopyObjectSize, copyPartSize)
+		maxCopyObjectSize, copyPartSize = 6<<20, server.MinPartSize
+
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             "bucketlayout6",
+			CreateBucket:       true,
+			Prefix:             "prod/db",
+			Layout:             LayoutV1,
+			EncryptionKey:      &encryptionKey,
+			Tags:               map[string]string{"team": "a"},
+			Metadata:           map[string]string{"owner": "team-a"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		data := bytes.Repeat([]byte("temporarycontent"), 12<<16) // 12MiB
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: "backup-20210101000000.tgz", Data: bytes.NewReader(data)})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, before, ok := server.Object("bucketlayout6", "prod/db/backup-20210101000000.tgz")
+		Expect(ok).To(BeTrue())
+
+		dst.Layout = LayoutV2
+		migrated, err := dst.Migrate(context.Background(), "prod/db", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(migrated).To(HaveLen(1))
+		obj, metadata, ok := server.Object("bucketlayout6", "prod/db/"+migrated[0])
+		Expect(ok).To(BeTrue())
+		Expect(obj).To(Equal(data))
+		Expect(metadata).To(Equal(before))
+		Expect(metadata).To(HaveKeyWithValue("owner", "team-a"))
+		tagging, err := dst.Client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: &dst.Bucket, Key: aws.String("prod/db/" + migrated[0])})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tagging.TagSet).To(HaveLen(1))
+		Expect(server.Uploads("bucketlayout6")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+	"github.com/ory/dockertest/v3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Runs the destination against MinIO if enabled by testutil.DockerEnv, the
+// certificates are created by make minio-selfsigned
+var _ = Describe("MinIO", func() {
+	var (
+		minioEndpoint string
+		caBundle      string
+	)
+	BeforeEach(func() {
+		testutil.SkipWithoutDocker()
+		if minioEndpoint != "" {
+			return
+		}
+		log := logger.WithName("s3setup")
+		wd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		ca, err := ioutil.ReadFile(filepath.Join(wd, "certs", "public.crt"))
+		Expect(err).ToNot(HaveOccurred(), "run make minio-selfsigned")
+		caBundle = string(ca)
+		pool, err := dockertest.NewPool("")
+		Expect(err).ToNot(HaveOccurred())
+		log.Info("spawn minio container")
+		resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+			Repository: "minio/minio",
+			Tag:        "latest",
+			Cmd:        []string{"server", "/data"},
+			Env: []string{
+				fmt.Sprintf("MINIO_ACCESS_KEY=%s", accessKeyID),
+				fmt.Sprintf("MINIO_SECRET_KEY=%s", secretAccessKey),
+			},
+			Mounts: []string{fmt.Sprintf("%s/certs:/root/.minio/certs", wd)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		teardown = append(teardown, func() error { return pool.Purge(resource) })
+		minioEndpoint = fmt.Sprintf("localhost:%s", resource.GetPort("9000/tcp"))
+		log.Info("check minio connection", "endpoint", minioEndpoint)
+		Expect(testutil.WaitForS3(pool, minioEndpoint, accessKeyID, secretAccessKey)).To(Succeed())
+		log.Info("minio ready")
+	})
+
+	buckets := 0
+	for _, layout := range []Layout{LayoutV1, LayoutV2} {
+		layout := layout
+		Context(fmt.Sprintf("with layout %s", layout), func() {
+			testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+				buckets++
+				bucket := fmt.Sprintf("conformance-%d", buckets)
+				const prefix = "namespace/plan/"
+				dst, err := NewS3Destination(&S3DestinationConf{
+					Endpoint:     minioEndpoint,
+					AccessKey:    accessKeyID,
+					SecretKey:    secretAccessKey,
+					CABundle:     caBundle,
+					Bucket:       bucket,
+					CreateBucket: true,
+					Prefix:       prefix,
+					Layout:       layout,
+				})
+				if err != nil {
+					return nil, err
+				}
+				return &testutil.ConformanceTarget{
+					Destination: dst,
+					Source: func(id string) (backup.Source, error) {
+						return NewS3Source(&S3SourceConf{
+							Endpoint:  minioEndpoint,
+							AccessKey: accessKeyID,
+							SecretKey: secretAccessKey,
+							CABundle:  caBundle,
+							Bucket:    bucket,
+							Key:       prefix + strings.TrimPrefix(path.Join(dst.Run, id), "/"),
+							// Conformance objects are stored without checksum
+							AllowUnverified: true,
+						})
+					},
+					Metadata:   true,
+					Resolution: time.Second,
+				}, nil
+			})
+		})
+	}
+
+	It("should store and read objects encrypted with customer keys", func() {
+		conf := &S3DestinationConf{
+			Endpoint:            minioEndpoint,
+			AccessKey:           accessKeyID,
+			SecretKey:           secretAccessKey,
+			CABundle:            caBundle,
+			EncryptionKey:       &encryptionKey,
+			EncryptionAlgorithm: encryptionAlgorithm,
+			Bucket:              "encrypted",
+			CreateBucket:        true,
+		}
+		dst, err := NewS3Destination(conf)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: bytes.NewBufferString("testcontent")})
+		Expect(err).ToNot(HaveOccurred())
+
+		srcConf := &S3SourceConf{
+			Endpoint:  minioEndpoint,
+			AccessKey: accessKeyID,
+			SecretKey: secretAccessKey,
+			CABundle:  caBundle,
+			Bucket:    "encrypted",
+			Key:       "backup.tgz",
+			// Only the encryption is checked here
+			AllowUnverified: true,
+		}
+		src, err := NewS3Source(srcConf)
+		Expect(err).ToNot(HaveOccurred())
+		out, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), out)
+		Expect(err).To(HaveOccurred())
+
+		srcConf.EncryptionKey, srcConf.EncryptionAlgorithm = conf.EncryptionKey, conf.EncryptionAlgorithm
+		src, err = NewS3Source(srcConf)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.Data).To(HaveKeyWithValue("backup.tgz", []byte("testcontent")))
+	})
+})
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// preflightKeyPrefix is the prefix of the objects written by the preflight
+// check below the prefix of the destination
+const preflightKeyPrefix = ".preflight-"
+
+// Preflight checks the bucket exists and objects can be written, listed and
+// deleted below the prefix. If object lock is configured, the bucket must
+// have versioning and object lock enabled.
+func (s *S3Destination) Preflight(ctx context.Context) error {
+	if _, err := s.Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &s.Bucket}); err != nil {
+		return fmt.Errorf("bucket %s is not accessible: %w", s.Bucket, err)
+	}
+	if s.ObjectLock != nil {
+		if err := s.preflightObjectLock(ctx); err != nil {
+			return err
+		}
+	}
+
+	key := s.Prefix + preflightKeyPrefix + NewRunID(time.Now())
+	// Buckets with object lock require the checksum of written objects
+	checksum := md5.Sum(nil)
+	input := &s3.PutObjectInput{
+		Bucket:     &s.Bucket,
+		Key:        &key,
+		Body:       bytes.NewReader(nil),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+	}
+	if s.EncryptionKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s.EncryptionAlgorithm)
+		if s.EncryptionAlgorithm == "" {
+			input.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
+		}
+		input.SSECustomerKey = s.EncryptionKey
+	}
+	if s.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+		if s.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+		}
+	}
+	if _, err := s.Client.PutObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("cannot write to bucket %s: %w", s.Bucket, err)
+	}
+	list, err := s.Client.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: &s.Bucket,
+		Prefix: &key,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list bucket %s: %w", s.Bucket, err)
+	}
+	if len(list.Contents) == 0 {
+		return fmt.Errorf("written object %s is not listed in bucket %s", key, s.Bucket)
+	}
+	if _, err := s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: &s.Bucket, Key: &key}); err != nil {
+		return fmt.Errorf("cannot delete from bucket %s: %w", s.Bucket, err)
+	}
+	s.log.Info("preflight successful", "bucket", s.Bucket, "prefix", s.Prefix)
+	return nil
+}
+
+func (s *S3Destination) preflightObjectLock(ctx context.Context) error {
+	versioning, err := s.Client.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{Bucket: &s.Bucket})
+	if err != nil {
+		return fmt.Errorf("cannot read versioning of bucket %s: %w", s.Bucket, err)
+	}
+	if aws.StringValue(versioning.Status) != s3.BucketVersioningStatusEnabled {
+		return fmt.Errorf("object lock requires versioning of bucket %s", s.Bucket)
+	}
+	lock, err := s.Client.GetObjectLockConfigurationWithContext(ctx, &s3.GetObjectLockConfigurationInput{Bucket: &s.Bucket})
+	if err != nil {
+		return fmt.Errorf("cannot read object lock configuration of bucket %s: %w", s.Bucket, err)
+	}
+	if lock.ObjectLockConfiguration == nil || aws.StringValue(lock.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return fmt.Errorf("object lock is not enabled for bucket %s", s.Bucket)
+	}
+	return nil
+}
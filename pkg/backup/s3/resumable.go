@@ -0,0 +1,202 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // nolint:gosec
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// uploadResumable uploads body from its current offset to its end and retries
+// failed uploads according to the retry policy of the destination. Multipart
+// uploads continue after the last part the bucket completed instead of
+// starting over. Failed multipart uploads are aborted.
+func (s *S3Destination) uploadResumable(ctx context.Context, params *s3manager.UploadInput, body io.ReadSeeker) error {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	uploader := *s.Uploader
+	withPartSize(end - start)(&uploader)
+	partSize := uploader.PartSize
+	if partSize <= 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+
+	if end-start <= partSize {
+		err = s.retry(ctx, *params.Key, func() error {
+			if _, err := body.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+			input := *params
+			input.Body = body
+			_, err := s.Uploader.UploadWithContext(ctx, &input)
+			return err
+		})
+	} else {
+		u := &resumableUpload{
+			dst:      s,
+			params:   params,
+			body:     body,
+			start:    start,
+			size:     end - start,
+			partSize: partSize,
+		}
+		err = s.retry(ctx, *params.Key, func() error {
+			return u.resume(ctx)
+		})
+		if err != nil && u.id != "" {
+			s.abortUpload(*params.Key, u.id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.log.Info("upload successful", "bucket", s.Bucket, "key", *params.Key)
+	return nil
+}
+
+// uploadSpooled writes data to a temporary file in the spool directory and
+// uploads the file, so failed uploads can be resumed. The file is removed
+// afterwards.
+func (s *S3Destination) uploadSpooled(ctx context.Context, params *s3manager.UploadInput, data io.Reader) error {
+	f, err := ioutil.TempFile(s.SpoolDir, "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	defer f.Close()
+	if _, err := io.Copy(f, backup.NewContextReader(ctx, data)); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.uploadResumable(ctx, params, f)
+}
+
+// resumableUpload is a multipart upload of data, which can be re-read
+type resumableUpload struct {
+	dst      *S3Destination
+	params   *s3manager.UploadInput
+	body     io.ReadSeeker
+	start    int64 // Offset of the data in body
+	size     int64
+	partSize int64
+	id       string
+	parts    []*s3.CompletedPart
+}
+
+// resume creates the upload or continues it after the last completed part and
+// completes it once all parts are uploaded
+func (u *resumableUpload) resume(ctx context.Context) error {
+	client := u.dst.Client
+	if u.id == "" {
+		input := &s3.CreateMultipartUploadInput{}
+		awsutil.Copy(input, u.params)
+		res, err := client.CreateMultipartUploadWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		u.id = aws.StringValue(res.UploadId)
+	} else {
+		if err := u.listParts(ctx); err != nil {
+			return err
+		}
+		u.dst.log.Info("resuming multipart upload", "bucket", u.dst.Bucket, "key", *u.params.Key, "completedParts", len(u.parts))
+	}
+
+	buf := make([]byte, u.partSize)
+	for offset := int64(len(u.parts)) * u.partSize; offset < u.size; offset += u.partSize {
+		part := buf
+		if remaining := u.size - offset; remaining < u.partSize {
+			part = buf[:remaining]
+		}
+		if _, err := u.body.Seek(u.start+offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(u.body, part); err != nil {
+			return err
+		}
+		sum := md5.Sum(part) // nolint:gosec
+		number := aws.Int64(int64(len(u.parts) + 1))
+		res, err := client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:               u.params.Bucket,
+			Key:                  u.params.Key,
+			UploadId:             &u.id,
+			PartNumber:           number,
+			Body:                 bytes.NewReader(part),
+			ContentMD5:           aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+			SSECustomerAlgorithm: u.params.SSECustomerAlgorithm,
+			SSECustomerKey:       u.params.SSECustomerKey,
+		})
+		if err != nil {
+			return err
+		}
+		u.parts = append(u.parts, &s3.CompletedPart{ETag: res.ETag, PartNumber: number})
+	}
+
+	_, err := client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          u.params.Bucket,
+		Key:             u.params.Key,
+		UploadId:        &u.id,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: u.parts},
+	})
+	return err
+}
+
+// listParts drops the parts, which the bucket has not completed, so the
+// upload continues after the last part it has
+func (u *resumableUpload) listParts(ctx context.Context) error {
+	completed := map[int64]string{}
+	err := u.dst.Client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   u.params.Bucket,
+		Key:      u.params.Key,
+		UploadId: &u.id,
+	}, func(page *s3.ListPartsOutput, last bool) bool {
+		for _, p := range page.Parts {
+			completed[aws.Int64Value(p.PartNumber)] = aws.StringValue(p.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for i, p := range u.parts {
+		if etag, ok := completed[aws.Int64Value(p.PartNumber)]; !ok || etag != aws.StringValue(p.ETag) {
+			u.parts = u.parts[:i]
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	DefaultRetries       = client.DefaultRetryerMaxNumRetries // Retries of requests by default of the SDK
+	DefaultRetryMinDelay = 100 * time.Millisecond
+	DefaultRetryMaxDelay = 30 * time.Second
+)
+
+// RetryPolicy retries failed attempts with exponential backoff. The delay
+// before a retry is doubled for every retry up to MaxDelay, a random jitter of
+// up to half of it spreads the retries of concurrent uploads.
+type RetryPolicy struct {
+	MaxRetries int           // Retries after the first attempt, none if 0
+	MinDelay   time.Duration // Delay before the first retry, DefaultRetryMinDelay if 0
+	MaxDelay   time.Duration // Upper bound of all delays, DefaultRetryMaxDelay if 0
+}
+
+// Delay returns the delay before the given retry, which starts at 0
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	min, max := p.MinDelay, p.MaxDelay
+	if min <= 0 {
+		min = DefaultRetryMinDelay
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxDelay
+	}
+	delay := max
+	if retry < 32 {
+		if d := min << uint(retry); d > 0 && d < max {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) // nolint:gosec
+}
+
+// retryer retries the requests of the SDK, e.g. the upload of a part,
+// according to the policy instead of the default backoff
+type retryer struct {
+	client.DefaultRetryer
+	policy RetryPolicy
+}
+
+func newRetryer(policy RetryPolicy) request.Retryer {
+	return retryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: policy.MaxRetries},
+		policy:         policy,
+	}
+}
+
+func (r retryer) RetryRules(req *request.Request) time.Duration {
+	return r.policy.Delay(req.RetryCount)
+}
+
+// retryable returns true for errors of requests, which may succeed if they are
+// repeated, i.e. network errors, throttling and server errors. Other errors,
+// e.g. of reading the data, are permanent.
+func retryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= http.StatusInternalServerError && rf.StatusCode() != http.StatusNotImplemented {
+		return true
+	}
+	return request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr)
+}
+
+// retry calls f until it succeeds, fails permanently, the retries of the
+// policy of the destination are exhausted or ctx is done
+func (s *S3Destination) retry(ctx context.Context, key string, f func() error) error {
+	var policy RetryPolicy
+	if s.Retry != nil {
+		policy = *s.Retry
+	}
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil || retry >= policy.MaxRetries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := policy.Delay(retry)
+		s.log.Error(err, "upload failed, retrying", "bucket", s.Bucket, "key", key, "retry", retry+1, "delay", delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
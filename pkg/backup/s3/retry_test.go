@@ -0,0 +1,188 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// partFailures fails the uploads of parts as often as given per part number
+// and counts the uploads of every part
+type partFailures struct {
+	mu       sync.Mutex
+	failures map[string]int
+	uploads  map[string]int
+}
+
+func (p *partFailures) fail(r *http.Request) bool {
+	part := r.URL.Query().Get("partNumber")
+	if r.Method != http.MethodPut || part == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uploads[part]++
+	if p.failures[part] > 0 {
+		p.failures[part]--
+		return true
+	}
+	return false
+}
+
+var _ = Describe("Retry", func() {
+	data := bytes.Repeat([]byte("temporarycontent"), 12<<16) // 12MiB, 3 parts
+	fastRetry := &RetryPolicy{MaxRetries: 3, MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	noRetry := &RetryPolicy{}
+
+	var failures *partFailures
+	BeforeEach(func() {
+		failures = &partFailures{failures: map[string]int{}, uploads: map[string]int{}}
+		server.Fail = failures.fail
+	})
+	AfterEach(func() {
+		server.Fail = nil
+	})
+
+	newDestination := func(bucket string, partRetry, retry *RetryPolicy, spoolDir string) *S3Destination {
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+			PartSize:           server.MinPartSize,
+			EncryptionKey:      &encryptionKey,
+			PartRetry:          partRetry,
+			Retry:              retry,
+			SpoolDir:           spoolDir,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return dst
+	}
+	stored := func(bucket, key string) []byte {
+		obj, _, ok := server.Object(bucket, key)
+		Expect(ok).To(BeTrue())
+		return obj
+	}
+
+	It("should back off exponentially with jitter", func() {
+		policy := RetryPolicy{MinDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+		Expect(policy.Delay(0)).To(BeNumerically("~", 75*time.Millisecond, 25*time.Millisecond))
+		Expect(policy.Delay(2)).To(BeNumerically("~", 300*time.Millisecond, 100*time.Millisecond))
+		Expect(policy.Delay(100)).To(BeNumerically("~", 750*time.Millisecond, 250*time.Millisecond))
+		Expect(RetryPolicy{}.Delay(0)).To(BeNumerically("<=", DefaultRetryMinDelay))
+	})
+	It("should only retry errors of requests, which may succeed", func() {
+		Expect(retryable(awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), http.StatusServiceUnavailable, ""))).To(BeTrue())
+		Expect(retryable(awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, ""))).To(BeTrue())
+		Expect(retryable(awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), http.StatusForbidden, ""))).To(BeFalse())
+		Expect(retryable(errors.New("read failed"))).To(BeFalse())
+	})
+	It("should retry failed parts", func() {
+		dst := newDestination("retry-parts", fastRetry, nil, "")
+		failures.failures["2"] = 2
+		// Data, which cannot be re-read, relies on the retries of the parts
+		_, err := dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: io.MultiReader(bytes.NewReader(data))})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored("retry-parts", "backup.tgz")).To(Equal(data))
+		Expect(failures.uploads["2"]).To(Equal(3))
+	})
+	It("should fail uploads of data, which cannot be re-read, once the retries of a part are exhausted", func() {
+		dst := newDestination("retry-exhausted", noRetry, fastRetry, "")
+		failures.failures["2"] = 1
+		_, err := dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: io.MultiReader(bytes.NewReader(data))})
+		Expect(err).To(HaveOccurred())
+		Expect(server.Keys("retry-exhausted")).To(BeEmpty())
+		Expect(server.Uploads("retry-exhausted")).To(BeEmpty())
+	})
+	It("should resume failed uploads after the last completed part", func() {
+		dst := newDestination("retry-resume", noRetry, fastRetry, "")
+		failures.failures["2"] = 2
+		_, err := dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: bytes.NewReader(data)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored("retry-resume", "backup.tgz")).To(Equal(data))
+		Expect(failures.uploads).To(Equal(map[string]int{"1": 1, "2": 3, "3": 1}))
+		Expect(server.Uploads("retry-resume")).To(BeEmpty())
+	})
+	It("should abort resumable uploads once the retries are exhausted", func() {
+		dst := newDestination("retry-abort", noRetry, fastRetry, "")
+		failures.failures["3"] = 4
+		_, err := dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: bytes.NewReader(data)})
+		Expect(err).To(HaveOccurred())
+		Expect(failures.uploads).To(Equal(map[string]int{"1": 1, "2": 1, "3": 4}))
+		Expect(server.Keys("retry-abort")).To(BeEmpty())
+		Expect(server.Uploads("retry-abort")).To(BeEmpty())
+	})
+	It("should resume uploads of files", func() {
+		dir, err := ioutil.TempDir("", "retry")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		fp := dir + "/backup.tgz"
+		Expect(ioutil.WriteFile(fp, data, 0600)).To(Succeed())
+		file, err := os.Open(fp)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		dst := newDestination("retry-file", noRetry, fastRetry, "")
+		failures.failures["3"] = 1
+		_, err = dst.Store(context.Background(), backup.Object{ID: "backup.tgz", Data: backup.NewContextReader(context.Background(), file)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored("retry-file", "backup.tgz")).To(Equal(data))
+		Expect(failures.uploads).To(Equal(map[string]int{"1": 1, "2": 1, "3": 2}))
+	})
+	It("should spool data, which cannot be re-read, to resume its uploads", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		dst := newDestination("retry-spool", noRetry, fastRetry, dir)
+		failures.failures["2"] = 1
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: "backup.tgz", Data: io.MultiReader(bytes.NewReader(data))})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored("retry-spool", "backup.tgz")).To(Equal(data))
+		Expect(stored("retry-spool", backup.ManifestID("backup.tgz"))).ToNot(BeEmpty())
+		Expect(failures.uploads).To(Equal(map[string]int{"1": 1, "2": 2, "3": 1}))
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+	It("should not retry cancelled uploads", func() {
+		dst := newDestination("retry-cancel", noRetry, &RetryPolicy{MaxRetries: 3, MinDelay: time.Hour, MaxDelay: time.Hour}, "")
+		failures.failures["2"] = 1
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := dst.Store(ctx, backup.Object{ID: "backup.tgz", Data: bytes.NewReader(data)})
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+		Expect(server.Uploads("retry-cancel")).To(BeEmpty())
+	})
+})
@@ -17,3 +17,11 @@ limitations under the License.
 package s3
 
 const DefaultEncryptionAlgorithm = "AES256"
+
+var (
+	// Objects larger than this can not be copied with a single CopyObject
+	// request
+	maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+	// Size of the parts larger objects are copied in
+	copyPartSize int64 = 1024 * 1024 * 1024
+)
@@ -17,66 +17,115 @@ limitations under the License.
 package s3
 
 import (
-	"crypto/tls"
-	"net/http"
-	"path/filepath"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/finleap-connect/backup-operator/pkg/util"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type S3DestinationConf struct {
-	Endpoint            string
-	AccessKey           string
-	SecretKey           string
-	EncryptionKey       *string
-	EncryptionAlgorithm string
-	DisableSSL          bool
-	InsecureSkipVerify  bool
-	Bucket              string
-	Prefix              string
-	PartSize            int64
+	Endpoint             string
+	AccessKey            string
+	SecretKey            string
+	EncryptionKey        *string
+	EncryptionAlgorithm  string
+	DisableSSL           bool
+	InsecureSkipVerify   bool
+	CABundle             string // PEM encoded certificates trusted in addition to the system roots
+	ClientCertificate    string // PEM encoded client certificate for mutual TLS
+	ClientKey            string // PEM encoded key of the client certificate
+	ServerName           string // Verified against the certificate of the endpoint, defaults to its host
+	Region               string // Defaults to DefaultRegion
+	CredentialChain      bool   // Use the default credential chain instead of the access key
+	RoleARN              string // Role assumed with the credentials, if set
+	ExternalID           string // External ID passed when assuming the role
+	Bucket               string
+	CreateBucket         bool // Create the bucket if it does not exist
+	Prefix               string
+	PartSize             int64
+	Layout               Layout // Defaults to LayoutV1
+	Run                  string // Directory of this run in LayoutV2, generated if empty
+	ObjectLock           *ObjectLockConf
+	StorageClass         string            // Storage class of stored objects, e.g. STANDARD_IA
+	Tags                 map[string]string // Tags of stored objects
+	Metadata             map[string]string // User metadata of stored objects
+	ServerSideEncryption string            // AES256 for SSE-S3 or aws:kms for SSE-KMS
+	SSEKMSKeyID          string            // Key used for SSE-KMS, the AWS managed key if empty
+	PartRetry            *RetryPolicy      // Retries of every request, e.g. the upload of a part, the default of the SDK if nil
+	// Retries of whole uploads of data, which can be re-read, e.g. files.
+	// Multipart uploads are resumed after the last completed part.
+	Retry *RetryPolicy
+	// Data, which cannot be re-read, is spooled to a temporary file in this
+	// directory first, so its uploads are retried as well. Disabled if empty.
+	SpoolDir string
+}
+
+// ObjectLockConf configures object lock of all stored objects. The bucket
+// must have object lock enabled.
+type ObjectLockConf struct {
+	Mode      string        // GOVERNANCE or COMPLIANCE, no retention if empty
+	Duration  time.Duration // Objects are retained this long after they are stored
+	LegalHold bool          // Place a legal hold on the objects
 }
 
 func NewS3Destination(conf *S3DestinationConf) (*S3Destination, error) {
-	newSession, err := session.NewSession(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
-		Endpoint:         aws.String(conf.Endpoint),
-		Region:           aws.String("us-east-1"),
-		DisableSSL:       aws.Bool(conf.DisableSSL),
-		S3ForcePathStyle: aws.Bool(true),
+	newSession, client, err := newClient(clientConf{
+		Endpoint:           conf.Endpoint,
+		Region:             conf.Region,
+		AccessKey:          conf.AccessKey,
+		SecretKey:          conf.SecretKey,
+		CredentialChain:    conf.CredentialChain,
+		RoleARN:            conf.RoleARN,
+		ExternalID:         conf.ExternalID,
+		DisableSSL:         conf.DisableSSL,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+		CABundle:           conf.CABundle,
+		ClientCertificate:  conf.ClientCertificate,
+		ClientKey:          conf.ClientKey,
+		ServerName:         conf.ServerName,
+		Retry:              conf.PartRetry,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify},
+	if conf.ServerSideEncryption != "" && conf.EncryptionKey != nil {
+		return nil, fmt.Errorf("server side encryption %s cannot be combined with an encryption key", conf.ServerSideEncryption)
+	}
+	if conf.SSEKMSKeyID != "" && conf.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return nil, fmt.Errorf("KMS key requires server side encryption %s", s3.ServerSideEncryptionAwsKms)
+	}
+	if lock := conf.ObjectLock; lock != nil && lock.Mode != "" && lock.Duration <= 0 {
+		return nil, fmt.Errorf("object lock mode %s requires a duration", lock.Mode)
 	}
-	cl := &http.Client{Transport: tr}
-	client := s3.New(newSession, aws.NewConfig().WithHTTPClient(cl))
 
-	// Create bucket, if not exists
-	_, err = client.CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(conf.Bucket),
-	})
-	if err != nil { // If bucket already exists ignore error
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() != s3.ErrCodeBucketAlreadyExists && aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
-				return nil, err
-			}
-		} else {
+	if conf.CreateBucket {
+		input := createBucketInput(conf.Bucket, conf.Region)
+		if conf.ObjectLock != nil {
+			input.ObjectLockEnabledForBucket = aws.Bool(true)
+		}
+		if err := createBucket(client, input); err != nil {
 			return nil, err
 		}
 	}
+	run := conf.Run
+	if conf.Layout == LayoutV2 && run == "" {
+		run = NewRunID(time.Now())
+	}
 	return &S3Destination{
 		Session:             newSession,
 		Client:              client,
@@ -85,29 +134,77 @@ func NewS3Destination(conf *S3DestinationConf) (*S3Destination, error) {
 		Uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
 			u.PartSize = conf.PartSize
 		}),
-		Bucket: conf.Bucket,
-		Prefix: conf.Prefix,
-		log:    logger.WithName("s3dst"),
+		Bucket:               conf.Bucket,
+		Prefix:               normalizePrefix(conf.Prefix),
+		Layout:               conf.Layout,
+		Run:                  run,
+		ObjectLock:           conf.ObjectLock,
+		StorageClass:         conf.StorageClass,
+		Tags:                 conf.Tags,
+		Metadata:             conf.Metadata,
+		ServerSideEncryption: conf.ServerSideEncryption,
+		SSEKMSKeyID:          conf.SSEKMSKeyID,
+		Retry:                conf.Retry,
+		SpoolDir:             conf.SpoolDir,
+		log:                  logger.WithName("s3dst"),
 	}, nil
 }
 
 type S3Destination struct {
-	Session             *session.Session
-	Client              *s3.S3
-	EncryptionKey       *string
-	EncryptionAlgorithm string
-	Uploader            *s3manager.Uploader
-	Bucket              string
-	Prefix              string
-	log                 logger.Logger
-}
-
-func (s *S3Destination) Store(obj backup.Object) (int64, error) {
-	key := filepath.Join(s.Prefix, obj.ID)
+	Session              *session.Session
+	Client               *s3.S3
+	EncryptionKey        *string
+	EncryptionAlgorithm  string
+	Uploader             *s3manager.Uploader
+	Bucket               string
+	Prefix               string // Always ends with a delimiter if not empty
+	Layout               Layout
+	Run                  string
+	ObjectLock           *ObjectLockConf
+	StorageClass         string
+	Tags                 map[string]string
+	Metadata             map[string]string
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	Retry                *RetryPolicy
+	SpoolDir             string
+	stored               []string // Objects stored in the run outside of sessions
+	log                  logger.Logger
+}
+
+// Store stores obj below the prefix. In LayoutV2 the directory of the run is
+// marked as complete afterwards, as if obj was committed by a session.
+func (s *S3Destination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	written, err := s.store(ctx, s.storeKey(obj.ID), obj)
+	if err != nil || s.Layout != LayoutV2 {
+		return written, err
+	}
+	s.stored = append(s.stored, obj.ID)
+	return written, s.complete(ctx, s.Run, s.stored)
+}
+
+// store uploads obj to key
+func (s *S3Destination) store(ctx context.Context, key string, obj backup.Object) (int64, error) {
 	params := &s3manager.UploadInput{
 		Bucket: &s.Bucket,
 		Key:    &key,
-		Body:   obj.Data,
+	}
+	if metadata := s.metadata(obj.Metadata); len(metadata) > 0 {
+		params.Metadata = aws.StringMap(metadata)
+	}
+	info := obj.Info()
+	if info.ContentType != "" && info.Compression == "" && info.Encryption == "" {
+		params.ContentType = aws.String(info.ContentType)
+	}
+	if len(s.Tags) > 0 {
+		params.Tagging = aws.String(s.tagging())
+	}
+	if s.StorageClass != "" {
+		params.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.ServerSideEncryption != "" {
+		params.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+		params.SSEKMSKeyId = util.NilIfEmpty(s.SSEKMSKeyID)
 	}
 
 	if s.EncryptionKey != nil {
@@ -118,82 +215,315 @@ func (s *S3Destination) Store(obj backup.Object) (int64, error) {
 		}
 		params.SSECustomerKey = s.EncryptionKey
 	}
+	if lock := s.ObjectLock; lock != nil {
+		if lock.Mode != "" {
+			params.ObjectLockMode = aws.String(lock.Mode)
+			params.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(lock.Duration))
+		}
+		if lock.LegalHold {
+			params.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+		}
+	}
 
 	s.log.Info("upload starting", "bucket", s.Bucket, "key", key)
-	res, err := s.Uploader.Upload(params)
+	if err := s.upload(ctx, params, obj.Data, info.Size); err != nil {
+		return 0, err
+	}
+
+	head, err := s.Client.HeadObjectWithContext(ctx, s.headObjectInput(key))
 	if err != nil {
 		return 0, err
 	}
+	return *head.ContentLength, nil
+}
+
+// upload uploads data as described by params. Only uploads of data, which can
+// be re-read, are retried.
+func (s *S3Destination) upload(ctx context.Context, params *s3manager.UploadInput, data io.Reader, size int64) error {
+	if s.Retry != nil && s.Retry.MaxRetries > 0 {
+		if body, ok := data.(io.ReadSeeker); ok {
+			return s.uploadResumable(ctx, params, body)
+		}
+		if s.SpoolDir != "" {
+			return s.uploadSpooled(ctx, params, data)
+		}
+	}
+	params.Body = data
+	res, err := s.Uploader.UploadWithContext(ctx, params, withPartSize(size))
+	if err != nil {
+		// The uploader aborts failed multipart uploads with ctx, which fails
+		// once it is cancelled and leaves the uploaded parts behind
+		var failure s3manager.MultiUploadFailure
+		if ctx.Err() != nil && errors.As(err, &failure) {
+			s.abortUpload(*params.Key, failure.UploadID())
+		}
+		return err
+	}
 	s.log.Info("upload successful", "result", res)
+	return nil
+}
 
-	headObjectInput := &s3.HeadObjectInput{
-		Bucket: &s.Bucket,
-		Key:    &key,
+// withPartSize increases the part size of multipart uploads if required to
+// upload size bytes. The uploader cannot determine the size of streams itself.
+func withPartSize(size int64) func(*s3manager.Uploader) {
+	return func(u *s3manager.Uploader) {
+		if size <= 0 || u.MaxUploadParts <= 0 {
+			return
+		}
+		partSize := u.PartSize
+		if partSize == 0 {
+			partSize = s3manager.DefaultUploadPartSize
+		}
+		if minPartSize := size/int64(u.MaxUploadParts) + 1; minPartSize > partSize {
+			u.PartSize = minPartSize
+		}
+	}
+}
+
+// abortUpload aborts the multipart upload independent of the context of the
+// upload
+func (s *S3Destination) abortUpload(key, uploadID string) {
+	_, err := s.Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.Bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	if err != nil {
+		s.log.Error(err, "failed to abort multipart upload", "bucket", s.Bucket, "key", key)
+		return
 	}
+	s.log.Info("aborted multipart upload", "bucket", s.Bucket, "key", key)
+}
 
+func (s *S3Destination) EnsureRetention(ctx context.Context, policy backup.RetentionPolicy) error {
+	if s.Layout == LayoutV2 && policy.Require != "" {
+		policy.Require = path.Join(s.Run, policy.Require)
+	}
+	return backup.ApplyRetention(ctx, s, policy, s.log)
+}
+
+func (s *S3Destination) Backups(ctx context.Context) ([]backup.StoredBackup, error) {
+	objects, manifests, err := s.objects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]backup.StoredBackup, len(objects))
+	for i, obj := range objects {
+		backups[i] = backup.StoredBackup{
+			ID:        s.id(*obj.Key),
+			Timestamp: timestamp(obj, s.Prefix, s.Layout),
+			Size:      aws.Int64Value(obj.Size),
+			Manifest:  manifests[backup.ManifestID(*obj.Key)],
+		}
+	}
+	return backups, nil
+}
+
+func (s *S3Destination) Manifest(ctx context.Context, id string) (*backup.Manifest, error) {
+	params := &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(backup.ManifestID(s.Prefix + id)),
+	}
 	if s.EncryptionKey != nil {
 		if s.EncryptionAlgorithm == "" {
-			headObjectInput.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
+			params.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
 		} else {
-			headObjectInput.SSECustomerAlgorithm = &s.EncryptionAlgorithm
+			params.SSECustomerAlgorithm = &s.EncryptionAlgorithm
 		}
-		headObjectInput.SSECustomerKey = s.EncryptionKey
+		params.SSECustomerKey = s.EncryptionKey
 	}
+	res, err := s.Client.GetObjectWithContext(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return backup.ParseManifest(res.Body)
+}
 
-	head, err := s.Client.HeadObject(headObjectInput)
+// Remove removes the backup and its manifest. Backups, which are still locked,
+// are not removed, as on versioned buckets only a delete marker hiding them
+// would be created.
+func (s *S3Destination) Remove(ctx context.Context, id string) error {
+	key := s.Prefix + id
+	head, err := s.Client.HeadObjectWithContext(ctx, s.headObjectInput(key))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return *head.ContentLength, nil
+	if aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		return fmt.Errorf("%w: %s is under legal hold", backup.ErrLocked, id)
+	}
+	if until := aws.TimeValue(head.ObjectLockRetainUntilDate); until.After(time.Now()) {
+		return fmt.Errorf("%w: %s is retained until %s", backup.ErrLocked, id, until.Format(time.RFC3339))
+	}
+	_, err = s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	// Deleting a missing key is no error
+	_, err = s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(backup.ManifestID(key)),
+	})
+	if err != nil {
+		return err
+	}
+	if s.Layout == LayoutV2 {
+		return s.removeRun(ctx, path.Dir(key)+"/")
+	}
+	return nil
+}
+
+func (s *S3Destination) List(ctx context.Context) ([]string, error) {
+	objects, _, err := s.objects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(objects))
+	for i, obj := range objects {
+		ids[i] = s.id(*obj.Key)
+	}
+	return ids, nil
 }
 
-func (s *S3Destination) EnsureRetention(max int) error {
+// id returns the ID of the backup stored at key. In LayoutV2 IDs contain the
+// directory of the run.
+func (s *S3Destination) id(key string) string {
+	return strings.TrimPrefix(key, s.Prefix)
+}
+
+// storeKey returns the key objects of this run are stored at
+func (s *S3Destination) storeKey(id string) string {
+	if s.Layout == LayoutV2 {
+		return s.Prefix + path.Join(s.Run, id)
+	}
+	return s.Prefix + id
+}
+
+// objects returns all backups below the prefix, newest first, and the keys of
+// all manifests
+func (s *S3Destination) objects(ctx context.Context) ([]*s3.Object, map[string]bool, error) {
+	return s.list(ctx, s.Prefix, s.Layout)
+}
+
+// list returns all backups stored in the layout below the prefix, newest
+// first, and the keys of all manifests. Objects in other directories, e.g. of
+// plans with names starting with the same name, are never included. In
+// LayoutV2 only objects of runs with a completion marker are included.
+func (s *S3Destination) list(ctx context.Context, prefix string, layout Layout) ([]*s3.Object, map[string]bool, error) {
 	// NOTE: using V1 list method is intentional as V2 malfunctioned on older ceph s3 installations
 	input := &s3.ListObjectsInput{
 		Bucket: &s.Bucket,
-		Prefix: &s.Prefix,
+		Prefix: &prefix,
+	}
+	depth := 1
+	if layout == LayoutV2 {
+		depth = 2
+	} else {
+		input.Delimiter = aws.String("/")
 	}
-	objects := sortableObjectSlice{}
-	err := s.Client.ListObjectsPages(input,
+	var objects []*s3.Object
+	manifests := map[string]bool{}
+	completed := map[string]bool{}
+	err := s.Client.ListObjectsPagesWithContext(ctx, input,
 		func(page *s3.ListObjectsOutput, lastPage bool) bool {
-			objects = append(objects, page.Contents...)
+			for _, obj := range page.Contents {
+				if len(strings.Split(strings.TrimPrefix(*obj.Key, prefix), "/")) != depth {
+					continue
+				}
+				if path.Base(*obj.Key) == backup.CompletionMarker {
+					completed[path.Dir(*obj.Key)] = true
+					continue
+				}
+				// Manifests are removed together with their backups
+				if backup.IsManifest(*obj.Key) {
+					manifests[*obj.Key] = true
+				} else {
+					objects = append(objects, obj)
+				}
+			}
 			return true
 		})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if len(objects) > max {
-		sort.Sort(objects)
-		obsolete := objects[max:]
-		if len(objects) > 0 {
-			for _, obj := range obsolete {
-				input := &s3.DeleteObjectInput{
-					Bucket: &s.Bucket,
-					Key:    obj.Key,
-				}
-				_, err := s.Client.DeleteObject(input)
-				if err != nil {
-					return err
-				}
+	if layout == LayoutV2 {
+		// Runs are only complete once they are committed
+		n := 0
+		for _, obj := range objects {
+			if completed[path.Dir(*obj.Key)] {
+				objects[n] = obj
+				n++
 			}
 		}
+		objects = objects[:n]
 	}
-	return nil
+	sort.SliceStable(objects, func(i, j int) bool {
+		ti, tj := timestamp(objects[i], prefix, layout), timestamp(objects[j], prefix, layout)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		// Objects of the same run are ordered as they were stored
+		mi, mj := aws.TimeValue(objects[i].LastModified), aws.TimeValue(objects[j].LastModified)
+		if !mi.Equal(mj) {
+			return mi.After(mj)
+		}
+		return *objects[i].Key < *objects[j].Key
+	})
+	return objects, manifests, nil
 }
 
-type sortableObjectSlice []*s3.Object
+// copyOptions sets the options, which are not copied from the source object
+// by CopyObject
+func (s *S3Destination) copyOptions(input *s3.CopyObjectInput, head *s3.HeadObjectOutput) {
+	if s.EncryptionKey != nil {
+		input.SSECustomerAlgorithm = head.SSECustomerAlgorithm
+		input.SSECustomerKey = s.EncryptionKey
+		input.CopySourceSSECustomerAlgorithm = head.SSECustomerAlgorithm
+		input.CopySourceSSECustomerKey = s.EncryptionKey
+	}
+	input.StorageClass = head.StorageClass
+	input.ContentType = head.ContentType
+	input.ServerSideEncryption = head.ServerSideEncryption
+	input.SSEKMSKeyId = head.SSEKMSKeyId
+}
 
-func (s sortableObjectSlice) Len() int {
-	return len(s)
+// metadata returns the configured user metadata extended by the metadata of
+// an object
+func (s *S3Destination) metadata(metadata map[string]string) map[string]string {
+	merged := make(map[string]string, len(s.Metadata)+len(metadata))
+	for k, v := range s.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	return merged
 }
 
-func (s sortableObjectSlice) Less(i, j int) bool {
-	if s[i].LastModified == s[j].LastModified {
-		return *s[i].Key < *s[j].Key
+// tagging returns the configured tags URL encoded as expected by S3
+func (s *S3Destination) tagging() string {
+	tags := url.Values{}
+	for k, v := range s.Tags {
+		tags.Set(k, v)
 	}
-	return s[i].LastModified.After(*s[j].LastModified)
+	return tags.Encode()
 }
 
-func (s sortableObjectSlice) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+func (s *S3Destination) headObjectInput(key string) *s3.HeadObjectInput {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	}
+	if s.EncryptionKey != nil {
+		if s.EncryptionAlgorithm == "" {
+			headObjectInput.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
+		} else {
+			headObjectInput.SSECustomerAlgorithm = &s.EncryptionAlgorithm
+		}
+		headObjectInput.SSECustomerKey = s.EncryptionKey
+	}
+	return headObjectInput
 }
@@ -18,15 +18,18 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
-	"github.com/finleap-connect/backup-operator/pkg/backup/mongodb"
-	"github.com/finleap-connect/backup-operator/pkg/testutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -46,12 +49,13 @@ var _ = Describe("S3Destination", func() {
 			SecretKey:          secretAccessKey,
 			InsecureSkipVerify: true,
 			Bucket:             bucket,
+			CreateBucket:       true,
 		}
 
 		dst, err := NewS3Destination(conf)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(dst).ToNot(BeNil())
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		input := s3.GetObjectInput{
@@ -78,26 +82,231 @@ var _ = Describe("S3Destination", func() {
 			EncryptionKey:       &encryptionKey,
 			EncryptionAlgorithm: encryptionAlgorithm,
 			Bucket:              bucket,
+			CreateBucket:        true,
 		}
 
 		dst, err := NewS3Destination(conf)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(dst).ToNot(BeNil())
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		input := s3.GetObjectInput{
-			Bucket:               &bucket,
-			Key:                  &key,
-			SSECustomerKey:       conf.EncryptionKey,
-			SSECustomerAlgorithm: &conf.EncryptionAlgorithm,
+			Bucket: &bucket,
+			Key:    &key,
 		}
 		buf := aws.NewWriteAtBuffer([]byte{})
 		downloader := s3manager.NewDownloaderWithClient(dst.Client)
+		// The key is required to read the object
+		_, err = downloader.Download(buf, &input)
+		Expect(err).To(HaveOccurred())
+		input.SSECustomerKey = conf.EncryptionKey
+		input.SSECustomerAlgorithm = &conf.EncryptionAlgorithm
 		_, err = downloader.Download(buf, &input)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(buf.Bytes()).Should(Equal(data))
 	})
+	It("should lock objects and skip locked objects in retention", func() {
+		bucket := "bucketlock"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+			ObjectLock:         &ObjectLockConf{Mode: s3.ObjectLockModeGovernance, Duration: time.Hour},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		ids := []string{"backup-20210101000000.tgz", "backup-20210102000000.tgz"}
+		for _, id := range ids {
+			_, err := backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString("testcontent")})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		head, err := dst.Client.HeadObject(dst.headObjectInput(ids[0]))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(head.ObjectLockMode)).To(Equal(s3.ObjectLockModeGovernance))
+		Expect(aws.TimeValue(head.ObjectLockRetainUntilDate)).To(BeTemporally(">", time.Now()))
+		Expect(errors.Is(dst.Remove(context.Background(), ids[0]), backup.ErrLocked)).To(BeTrue())
+		Expect(dst.EnsureRetention(context.Background(), backup.KeepLast(1))).To(Succeed())
+		found, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(HaveLen(2))
+	})
+	It("should not create buckets unless configured", func() {
+		conf := &S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             "bucketpreflight",
+			Prefix:             "ns/plan",
+		}
+		dst, err := NewS3Destination(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.Preflight(context.Background())).ToNot(Succeed())
+		conf.CreateBucket = true
+		dst, err = NewS3Destination(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.Preflight(context.Background())).To(Succeed())
+		// The probe object is removed again
+		found, err := dst.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &conf.Bucket})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found.Contents).To(BeEmpty())
+		// Object lock requires a bucket with object lock enabled
+		conf.ObjectLock = &ObjectLockConf{Mode: s3.ObjectLockModeGovernance, Duration: time.Hour}
+		dst, err = NewS3Destination(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.Preflight(context.Background())).ToNot(Succeed())
+	})
+	It("should store objects with storage class, tags and metadata", func() {
+		bucket := "buckettags"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+			StorageClass:       s3.StorageClassReducedRedundancy,
+			Tags:               map[string]string{"backup.finleap.cloud/plan": "db", "team": "a b"},
+			Metadata:           map[string]string{"owner": "team-a"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		id := "backup-20210101000000.tgz"
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString("testcontent")})
+		Expect(err).ToNot(HaveOccurred())
+		head, err := dst.Client.HeadObject(dst.headObjectInput(id))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(head.StorageClass)).To(Equal(s3.StorageClassReducedRedundancy))
+		metadata := map[string]string{}
+		for k, v := range head.Metadata {
+			metadata[strings.ToLower(k)] = aws.StringValue(v)
+		}
+		Expect(metadata).To(HaveKeyWithValue("owner", "team-a"))
+		Expect(metadata).ToNot(HaveKey("backup-sha256"))
+		tagging, err := dst.Client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: &bucket, Key: &id})
+		Expect(err).ToNot(HaveOccurred())
+		tags := map[string]string{}
+		for _, t := range tagging.TagSet {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		Expect(tags).To(Equal(map[string]string{"backup.finleap.cloud/plan": "db", "team": "a b"}))
+	})
+	It("should persist object info and read it back", func() {
+		bucket := "bucketinfo"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		id := "backup-20210101000000.tgz"
+		created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{
+			ID:   id,
+			Data: bytes.NewBufferString("testcontent"),
+			Metadata: backup.ObjectInfo{
+				Size:          11,
+				ContentType:   "application/gzip",
+				Created:       created,
+				SourceType:    "mongodb",
+				SourceVersion: "4.4.0",
+				Labels:        map[string]string{"team": "platform"},
+			}.Metadata(),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		head, err := dst.Client.HeadObject(dst.headObjectInput(id))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(head.ContentType)).To(Equal("application/gzip"))
+
+		src, err := NewS3Source(&S3SourceConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			Key:                id,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		info, err := src.Info(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size).To(BeEquivalentTo(11))
+		Expect(info.ContentType).To(Equal("application/gzip"))
+		Expect(info.Created).To(Equal(created))
+		Expect(info.SourceType).To(Equal("mongodb"))
+		Expect(info.SourceVersion).To(Equal("4.4.0"))
+		Expect(info.Labels).To(Equal(map[string]string{"team": "platform"}))
+	})
+	It("should store sessions in run directories", func() {
+		bucket := "bucketsession"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+			Prefix:             "ns/name/",
+			Layout:             LayoutV2,
+			Run:                "20210101000000-1a2b3c4d",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		src, _ := mem.NewBufferSource("backup-20210101000000.tgz", []byte("testcontent"))
+		_, err = backup.StreamSession(context.Background(), src, dst, dst.Run)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Client.HeadObject(dst.headObjectInput("ns/name/20210101000000-1a2b3c4d/" + backup.CompletionMarker))
+		Expect(err).ToNot(HaveOccurred())
+		// The marker is no backup
+		ids, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"20210101000000-1a2b3c4d/backup-20210101000000.tgz"}))
+
+		session, err := dst.Begin(context.Background(), "20210102000000-1a2b3c4d")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), session)
+		Expect(err).ToNot(HaveOccurred())
+		// Runs are not listed before they are committed
+		ids, err = dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"20210101000000-1a2b3c4d/backup-20210101000000.tgz"}))
+		backups, err := dst.Backups(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		Expect(session.Abort(context.Background())).To(Succeed())
+		ids, err = dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(HaveLen(1))
+
+		// Removing the last backup of a run removes its marker
+		Expect(dst.Remove(context.Background(), ids[0])).To(Succeed())
+		Expect(server.Keys(bucket)).To(BeEmpty())
+	})
+	It("should not support sessions in layout v1", func() {
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             "bucketsessionv1",
+			CreateBucket:       true,
+			Prefix:             "ns/name/",
+			Layout:             LayoutV1,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Begin(context.Background(), "20210101000000-1a2b3c4d")
+		Expect(errors.Is(err, backup.ErrNoSessions)).To(BeTrue())
+	})
+	It("should increase the part size to fit the size hint", func() {
+		u := &s3manager.Uploader{PartSize: s3manager.MinUploadPartSize, MaxUploadParts: s3manager.MaxUploadParts}
+		withPartSize(0)(u)
+		Expect(u.PartSize).To(Equal(s3manager.MinUploadPartSize))
+		withPartSize(s3manager.MinUploadPartSize * s3manager.MaxUploadParts * 2)(u)
+		Expect(u.PartSize).To(BeNumerically(">", 2*s3manager.MinUploadPartSize))
+	})
 	DescribeTable("ensure retention for values",
 		func(retention int, count int) {
 			data := []byte("testcontent")
@@ -109,36 +318,49 @@ var _ = Describe("S3Destination", func() {
 				SecretKey:          secretAccessKey,
 				InsecureSkipVerify: true,
 				Bucket:             bucket,
+				CreateBucket:       true,
 			}
 
 			dst, err := NewS3Destination(conf)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(dst).ToNot(BeNil())
 			for i := 0; i < count; i++ {
+				key := fmt.Sprintf("key%d-%d-%d", retention, count, i)
 				_, err := dst.Client.PutObject(&s3.PutObjectInput{
 					Body:   bytes.NewReader(data),
 					Bucket: &bucket,
-					Key:    aws.String(fmt.Sprintf("key%d-%d-%d", retention, count, i)),
+					Key:    &key,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				// Only backups with manifests are considered
+				_, err = dst.Client.PutObject(&s3.PutObjectInput{
+					Body:   bytes.NewReader([]byte(`{"sha256":"00"}`)),
+					Bucket: &bucket,
+					Key:    aws.String(backup.ManifestID(key)),
 				})
 				Expect(err).ToNot(HaveOccurred())
 			}
 			input := &s3.ListObjectsInput{
 				Bucket: &bucket,
 			}
-			objects := sortableObjectSlice{}
+			var objects []*s3.Object
 			Expect(dst.Client.ListObjectsPages(input,
 				func(page *s3.ListObjectsOutput, lastPage bool) bool {
 					for _, obj := range page.Contents {
-						objects = append(objects, obj)
+						if !backup.IsManifest(*obj.Key) {
+							objects = append(objects, obj)
+						}
 					}
 					return true
 				})).To(Succeed())
-			sort.Sort(objects)
+			sort.Slice(objects, func(i, j int) bool {
+				return objects[i].LastModified.After(*objects[j].LastModified)
+			})
 			expected := []string{}
 			for _, obj := range objects[:retention] {
-				expected = append(expected, *obj.Key)
+				expected = append(expected, *obj.Key, backup.ManifestID(*obj.Key))
 			}
-			err = dst.EnsureRetention(retention)
+			err = dst.EnsureRetention(context.Background(), backup.KeepLast(retention))
 			Expect(err).ToNot(HaveOccurred())
 			found := []string{}
 			err = dst.Client.ListObjectsPages(input,
@@ -157,101 +379,42 @@ var _ = Describe("S3Destination", func() {
 		Entry("4 out of 5", 4, 5),
 		Entry("5 out of 12", 5, 12),
 	)
-	It("should stream from MongoDBSource to S3Destination and back", func() {
-		name := "backup.tgz"
-		src, err := mongodb.NewMongoDBSource(srcURI, "", name)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(src).ToNot(BeNil())
-		bucket := "bucketc"
-
-		conf := &S3DestinationConf{
+	It("should abort requests once the context is cancelled", func() {
+		dst, err := NewS3Destination(&S3DestinationConf{
 			Endpoint:           endpoint,
 			AccessKey:          accessKeyID,
 			SecretKey:          secretAccessKey,
 			InsecureSkipVerify: true,
-			Bucket:             bucket,
-			Prefix:             "",
-		}
-
-		dst, err := NewS3Destination(conf)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(dst).ToNot(BeNil())
-		written, err := src.Stream(dst)
-		Expect(written).To(BeNumerically(">", 0))
+			Bucket:             "bucketcontext",
+			CreateBucket:       true,
+			Prefix:             "ns/name/",
+		})
 		Expect(err).ToNot(HaveOccurred())
-		input := s3.GetObjectInput{
-			Bucket: &bucket,
-			Key:    &name,
-		}
-		buf := aws.NewWriteAtBuffer([]byte{})
-		downloader := s3manager.NewDownloaderWithClient(dst.Client)
-		_, err = downloader.Download(buf, &input)
+		id := "backup-20210101000000.tgz"
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: id, Data: bytes.NewBufferString("testcontent")})
 		Expect(err).ToNot(HaveOccurred())
-		Expect(len(buf.Bytes())).Should(BeNumerically(">", 100))
 
-		confSrc := &S3SourceConf{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = dst.Backups(ctx)
+		Expect(err).To(HaveOccurred())
+		_, err = dst.Manifest(ctx, id)
+		Expect(err).To(HaveOccurred())
+		Expect(dst.Remove(ctx, id)).ToNot(Succeed())
+		src, err := NewS3Source(&S3SourceConf{
 			Endpoint:           endpoint,
 			AccessKey:          accessKeyID,
 			SecretKey:          secretAccessKey,
 			InsecureSkipVerify: true,
-			Bucket:             bucket,
-			Key:                name,
-		}
-		src, err = NewS3Source(confSrc)
+			Bucket:             "bucketcontext",
+			Key:                "ns/name/" + id,
+		})
 		Expect(err).ToNot(HaveOccurred())
-		Expect(src).ToNot(BeNil())
-		mdst, err := mongodb.NewMongoDBDestination(dstURI)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(mdst).ToNot(BeNil())
-		_, err = src.Stream(mdst)
-		Expect(err).ToNot(HaveOccurred())
-		err = testutil.FindTestData(dstURI)
-		Expect(err).ToNot(HaveOccurred())
-	})
+		_, err = src.Info(ctx)
+		Expect(err).To(HaveOccurred())
 
-	It("should stream from MongoDBSource to encrypted S3Destination and back", func() {
-		name := "backup.tgz"
-		src, err := mongodb.NewMongoDBSource(srcURI, "", name)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(src).ToNot(BeNil())
-		bucket := "buckete"
-
-		conf := &S3DestinationConf{
-			Endpoint:            endpoint,
-			AccessKey:           accessKeyID,
-			SecretKey:           secretAccessKey,
-			EncryptionKey:       &encryptionKey,
-			EncryptionAlgorithm: encryptionAlgorithm,
-			InsecureSkipVerify:  true,
-			Bucket:              bucket,
-		}
-
-		dst, err := NewS3Destination(conf)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(dst).ToNot(BeNil())
-		written, err := src.Stream(dst)
-		Expect(written).To(BeNumerically(">", 0))
-		Expect(err).ToNot(HaveOccurred())
-
-		confSrc := &S3SourceConf{
-			Endpoint:            endpoint,
-			AccessKey:           accessKeyID,
-			SecretKey:           secretAccessKey,
-			EncryptionKey:       &encryptionKey,
-			EncryptionAlgorithm: encryptionAlgorithm,
-			InsecureSkipVerify:  true,
-			Bucket:              bucket,
-			Key:                 name,
-		}
-		src, err = NewS3Source(confSrc)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(src).ToNot(BeNil())
-		mdst, err := mongodb.NewMongoDBDestination(dstURI)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(mdst).ToNot(BeNil())
-		_, err = src.Stream(mdst)
-		Expect(err).ToNot(HaveOccurred())
-		err = testutil.FindTestData(dstURI)
+		ids, err := dst.List(context.Background())
 		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{id}))
 	})
 })
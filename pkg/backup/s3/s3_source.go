@@ -17,18 +17,17 @@ limitations under the License.
 package s3
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/logger"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -42,42 +41,41 @@ type S3SourceConf struct {
 	EncryptionAlgorithm string
 	DisableSSL          bool
 	InsecureSkipVerify  bool
+	CABundle            string // PEM encoded certificates trusted in addition to the system roots
+	ClientCertificate   string // PEM encoded client certificate for mutual TLS
+	ClientKey           string // PEM encoded key of the client certificate
+	ServerName          string // Verified against the certificate of the endpoint, defaults to its host
+	Region              string // Defaults to DefaultRegion
+	CredentialChain     bool   // Use the default credential chain instead of the access key
+	RoleARN             string // Role assumed with the credentials, if set
+	ExternalID          string // External ID passed when assuming the role
 	Bucket              string
 	Key                 string
+	DecryptionKeys      []backup.EncryptionKey // Used to decrypt client-side encrypted backups
+	Raw                 bool                   // Stream objects as stored without decryption and decompression
+	AllowUnverified     bool                   // Stream objects without checksum, which cannot be verified
 }
 
 func NewS3Source(conf *S3SourceConf) (*S3Source, error) {
-	newSession, err := session.NewSession(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
-		Endpoint:         aws.String(conf.Endpoint),
-		Region:           aws.String("us-east-1"),
-		DisableSSL:       aws.Bool(conf.DisableSSL),
-		S3ForcePathStyle: aws.Bool(true),
+	newSession, client, err := newClient(clientConf{
+		Endpoint:           conf.Endpoint,
+		Region:             conf.Region,
+		AccessKey:          conf.AccessKey,
+		SecretKey:          conf.SecretKey,
+		CredentialChain:    conf.CredentialChain,
+		RoleARN:            conf.RoleARN,
+		ExternalID:         conf.ExternalID,
+		DisableSSL:         conf.DisableSSL,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+		CABundle:           conf.CABundle,
+		ClientCertificate:  conf.ClientCertificate,
+		ClientKey:          conf.ClientKey,
+		ServerName:         conf.ServerName,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify},
-	}
-	cl := &http.Client{Transport: tr}
-	client := s3.New(newSession, aws.NewConfig().WithHTTPClient(cl))
-
-	// Create bucket, if not exists
-	_, err = client.CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(conf.Bucket),
-	})
-	if err != nil { // If bucket already exists ignore error
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() != s3.ErrCodeBucketAlreadyExists && aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
-	}
-
 	return &S3Source{
 		Session:             newSession,
 		Client:              client,
@@ -86,6 +84,9 @@ func NewS3Source(conf *S3SourceConf) (*S3Source, error) {
 		Downloader:          s3manager.NewDownloaderWithClient(client),
 		Bucket:              conf.Bucket,
 		Key:                 conf.Key,
+		DecryptionKeys:      conf.DecryptionKeys,
+		Raw:                 conf.Raw,
+		AllowUnverified:     conf.AllowUnverified,
 		log:                 logger.WithName("s3src"),
 	}, nil
 }
@@ -98,10 +99,13 @@ type S3Source struct {
 	Key                 string
 	EncryptionKey       *string
 	EncryptionAlgorithm string
+	DecryptionKeys      []backup.EncryptionKey
+	Raw                 bool
+	AllowUnverified     bool
 	log                 logger.Logger
 }
 
-func (s *S3Source) Stream(dst backup.Destination) (int64, error) {
+func (s *S3Source) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
 	log := s.log
 	// Use sequential writes to be able tu use stub implementation
 	s.Downloader.Concurrency = 1
@@ -119,28 +123,113 @@ func (s *S3Source) Stream(dst backup.Destination) (int64, error) {
 		params.SSECustomerKey = s.EncryptionKey
 	}
 
-	pr, pw := io.Pipe()
-	errc := make(chan error, 1)
-	defer close(errc)
-	go func() {
-		defer pw.Close()
-		log.Info("download starting", "bucket", s.Bucket, "key", s.Key)
-		numBytes, err := s.Downloader.Download(writerAtStub{pw}, params)
-		if err != nil {
-			errc <- err
+	metadata, err := s.metadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !s.Raw {
+		if metadata[backup.MetadataEncryption] != "" && len(s.DecryptionKeys) == 0 {
+			return 0, fmt.Errorf("object %s is encrypted with key %s, but no decryption keys are provided", s.Key, metadata[backup.MetadataEncryptionKeyID])
+		}
+		// Decompress after decryption as compression is applied first on backup
+		dst = backup.NewDecompressingDestination(dst)
+		if len(s.DecryptionKeys) > 0 {
+			dst = backup.NewDecryptingDestination(dst, s.DecryptionKeys...)
+		}
+	}
+
+	checksum, err := s.checksum(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if checksum != "" {
+		dst = backup.NewVerifyingDestination(dst, checksum)
+	} else if !backup.IsManifest(s.Key) {
+		if !s.AllowUnverified {
+			return 0, fmt.Errorf("%w: %s has neither a checksum nor a manifest", backup.ErrNoChecksum, s.Key)
 		}
+		log.Info("no checksum available, skipping verification", "bucket", s.Bucket, "key", s.Key)
+	}
+	return backup.Pipe(ctx, dst, backup.Object{ID: s.Key, Metadata: metadata}, func(w io.Writer) error {
+		log.Info("download starting", "bucket", s.Bucket, "key", s.Key)
+		numBytes, err := s.Downloader.DownloadWithContext(ctx, writerAtStub{w}, params)
 		log.Info("finished download", "numBytes", numBytes)
-	}()
-	written, dsterr := dst.Store(backup.Object{
-		ID:   s.Key,
-		Data: pr,
+		return err
 	})
-	select {
-	case srcerr := <-errc: // return src error if possible as well
-		return written, fmt.Errorf("dst error: %v; src error: %v", dsterr, srcerr)
-	case <-time.After(1 * time.Second):
-		return written, dsterr
+}
+
+// Info returns the metadata of the object as stored by a S3 destination
+func (s *S3Source) Info(ctx context.Context) (backup.ObjectInfo, error) {
+	metadata, err := s.metadata(ctx)
+	if err != nil {
+		return backup.ObjectInfo{}, err
 	}
+	return backup.ParseObjectInfo(metadata), nil
+}
+
+// metadata returns the user metadata of the object with lower case keys and
+// its size
+func (s *S3Source) metadata(ctx context.Context) (map[string]string, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &s.Key,
+	}
+	if s.EncryptionKey != nil {
+		if s.EncryptionAlgorithm == "" {
+			params.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
+		} else {
+			params.SSECustomerAlgorithm = &s.EncryptionAlgorithm
+		}
+		params.SSECustomerKey = s.EncryptionKey
+	}
+	head, err := s.Client.HeadObjectWithContext(ctx, params)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", backup.ErrNotFound, s.Key)
+	} else if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(head.Metadata)+1)
+	for k, v := range head.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	metadata[backup.MetadataSize] = strconv.FormatInt(aws.Int64Value(head.ContentLength), 10)
+	return metadata, nil
+}
+
+// checksum returns the SHA-256 of the object from its manifest. The metadata
+// is not trusted, as it may be modified without the manifest. An empty
+// checksum is returned only for objects without manifest, all other errors
+// reading the manifest are returned.
+func (s *S3Source) checksum(ctx context.Context) (string, error) {
+	if backup.IsManifest(s.Key) {
+		return "", nil
+	}
+	params := &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(backup.ManifestID(s.Key)),
+	}
+	if s.EncryptionKey != nil {
+		if s.EncryptionAlgorithm == "" {
+			params.SSECustomerAlgorithm = aws.String(DefaultEncryptionAlgorithm)
+		} else {
+			params.SSECustomerAlgorithm = &s.EncryptionAlgorithm
+		}
+		params.SSECustomerKey = s.EncryptionKey
+	}
+	res, err := s.Client.GetObjectWithContext(ctx, params)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer res.Body.Close()
+	manifest, err := backup.ParseManifest(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return manifest.SHA256, nil
 }
 
 type writerAtStub struct {
@@ -150,3 +239,10 @@ type writerAtStub struct {
 func (fw writerAtStub) WriteAt(p []byte, offset int64) (n int, err error) {
 	return fw.w.Write(p) // ignore 'offset' because we forced sequential downloads
 }
+
+// isNotFound returns true if err reports a missing object. Responses to HEAD
+// requests have no body, so their code is derived from the status.
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
@@ -18,8 +18,17 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
 	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
 
 	. "github.com/onsi/ginkgo"
@@ -44,6 +53,7 @@ var _ = Describe("S3Source", func() {
 		src, err := NewS3Source(confSrc)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(src).ToNot(BeNil())
+		Expect(createBucket(src.Client, createBucketInput(bucket, ""))).To(Succeed())
 		_, err = src.Client.PutObject(&s3.PutObjectInput{
 			Body:   bytes.NewReader(data),
 			Bucket: &bucket,
@@ -51,7 +61,13 @@ var _ = Describe("S3Source", func() {
 		})
 		Expect(err).ToNot(HaveOccurred())
 		dst, _ := mem.NewBufferDestination()
-		written, err := src.Stream(dst)
+		_, err = src.Stream(context.Background(), dst)
+		Expect(errors.Is(err, backup.ErrNoChecksum)).To(BeTrue())
+
+		confSrc.AllowUnverified = true
+		src, err = NewS3Source(confSrc)
+		Expect(err).ToNot(HaveOccurred())
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(dst.Data[key]).Should(Equal(data))
@@ -70,11 +86,13 @@ var _ = Describe("S3Source", func() {
 			InsecureSkipVerify:  true,
 			Bucket:              bucket,
 			Key:                 key,
+			AllowUnverified:     true,
 		}
 
 		src, err := NewS3Source(confSrc)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(src).ToNot(BeNil())
+		Expect(createBucket(src.Client, createBucketInput(bucket, ""))).To(Succeed())
 		_, err = src.Client.PutObject(&s3.PutObjectInput{
 			Body:                 bytes.NewReader(data),
 			Bucket:               &confSrc.Bucket,
@@ -84,9 +102,140 @@ var _ = Describe("S3Source", func() {
 		})
 		Expect(err).ToNot(HaveOccurred())
 		dst, _ := mem.NewBufferDestination()
-		written, err := src.Stream(dst)
+		written, err := src.Stream(context.Background(), dst)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(written).To(BeNumerically(">", 0))
 		Expect(dst.Data[key]).Should(Equal(data))
 	})
+	It("should decrypt client-side encrypted backups", func() {
+		data := []byte("temporarycontent")
+		bucket := "bucketa"
+		key, err := backup.ParseEncryptionKey("key-1", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+		Expect(err).ToNot(HaveOccurred())
+
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backup.NewEncryptingDestination(dst, key).Store(context.Background(), backup.Object{ID: "keyb", Data: bytes.NewReader(data)})
+		Expect(err).ToNot(HaveOccurred())
+
+		confSrc := &S3SourceConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			Key:                "keyb" + backup.EncryptionExtension,
+			AllowUnverified:    true,
+		}
+		src, err := NewS3Source(confSrc)
+		Expect(err).ToNot(HaveOccurred())
+		buf, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), buf)
+		Expect(err).To(HaveOccurred())
+
+		confSrc.DecryptionKeys = []backup.EncryptionKey{key}
+		src, err = NewS3Source(confSrc)
+		Expect(err).ToNot(HaveOccurred())
+		buf, _ = mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.Data["keyb"]).Should(Equal(data))
+	})
+	It("should verify checksums of backups with manifest", func() {
+		data := []byte("temporarycontent")
+		bucket := "bucketa"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backup.NewManifestDestination(dst, backup.ManifestInfo{}).Store(context.Background(), backup.Object{ID: "keyc", Data: bytes.NewReader(data)})
+		Expect(err).ToNot(HaveOccurred())
+
+		src, err := NewS3Source(&S3SourceConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			Key:                "keyc",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		buf, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.Data["keyc"]).Should(Equal(data))
+
+		// Replace the backup, a checksum in its metadata is not trusted
+		corrupted := []byte("corruptedcontent")
+		sum := sha256.Sum256(corrupted)
+		_, err = src.Client.PutObject(&s3.PutObjectInput{
+			Body:     bytes.NewReader(corrupted),
+			Bucket:   &bucket,
+			Key:      aws.String("keyc"),
+			Metadata: aws.StringMap(map[string]string{"backup-sha256": hex.EncodeToString(sum[:])}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), buf)
+		Expect(errors.Is(err, backup.ErrChecksumMismatch)).To(BeTrue())
+	})
+	It("should fail if the manifest cannot be read", func() {
+		bucket := "bucketa"
+		dst, err := NewS3Destination(&S3DestinationConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			CreateBucket:       true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = dst.Store(context.Background(), backup.Object{ID: "keyd", Data: bytes.NewReader([]byte("temporarycontent"))})
+		Expect(err).ToNot(HaveOccurred())
+		server.Fail = func(r *http.Request) bool {
+			return strings.HasSuffix(r.URL.Path, backup.ManifestID("keyd"))
+		}
+		defer func() { server.Fail = nil }()
+
+		src, err := NewS3Source(&S3SourceConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             bucket,
+			Key:                "keyd",
+			AllowUnverified:    true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		buf, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), buf)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, backup.ErrNoChecksum)).To(BeFalse())
+		Expect(buf.Data).To(BeEmpty())
+	})
+	It("should report missing objects", func() {
+		src, err := NewS3Source(&S3SourceConf{
+			Endpoint:           endpoint,
+			AccessKey:          accessKeyID,
+			SecretKey:          secretAccessKey,
+			InsecureSkipVerify: true,
+			Bucket:             "bucketa",
+			Key:                "missing",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		buf, _ := mem.NewBufferDestination()
+		_, err = src.Stream(context.Background(), buf)
+		Expect(backup.IsNotFound(err)).To(BeTrue())
+	})
 })
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+)
+
+// Begin starts a session storing objects below <prefix>/<run>/, which becomes
+// the Run of the destination, so the backups of the session are subject to the
+// retention. Sessions require LayoutV2, as LayoutV1 has no run directories.
+func (s *S3Destination) Begin(ctx context.Context, run string) (backup.Session, error) {
+	if s.Layout != LayoutV2 {
+		return nil, fmt.Errorf("%w in layout %s", backup.ErrNoSessions, LayoutV1)
+	}
+	if err := backup.ValidateRun(run); err != nil {
+		return nil, err
+	}
+	s.Run = run
+	return &s3Session{
+		dst: s,
+		run: run,
+		dir: s.Prefix + run + "/",
+	}, nil
+}
+
+type s3Session struct {
+	dst     *S3Destination
+	run     string
+	dir     string
+	objects []string
+}
+
+func (s *s3Session) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	written, err := s.dst.store(ctx, s.dir+obj.ID, obj)
+	if err != nil {
+		return written, err
+	}
+	s.objects = append(s.objects, obj.ID)
+	return written, nil
+}
+
+func (s *s3Session) Commit(ctx context.Context) error {
+	return s.dst.complete(ctx, s.run, s.objects)
+}
+
+// complete stores the completion marker listing objects in the directory of
+// run, which lists the objects of the run from now on
+func (s *S3Destination) complete(ctx context.Context, run string, objects []string) error {
+	marker, err := backup.NewCompletion(run, objects)
+	if err != nil {
+		return err
+	}
+	_, err = s.store(ctx, s.Prefix+run+"/"+backup.CompletionMarker, backup.Object{
+		ID:   backup.CompletionMarker,
+		Data: bytes.NewReader(marker),
+	})
+	return err
+}
+
+// Abort removes all objects below the run directory, including those stored
+// by other sessions of the same run
+func (s *s3Session) Abort(ctx context.Context) error {
+	s.dst.log.Info("aborting session", "bucket", s.dst.Bucket, "prefix", s.dir)
+	var keys []string
+	err := s.dst.Client.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: &s.dst.Bucket,
+		Prefix: &s.dir,
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, key := range keys {
+		_, err := s.dst.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: &s.dst.Bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove objects: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// removeRun removes the completion marker of the run directory once no other
+// objects are left in it
+func (s *S3Destination) removeRun(ctx context.Context, dir string) error {
+	list, err := s.Client.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:  &s.Bucket,
+		Prefix:  &dir,
+		MaxKeys: aws.Int64(2),
+	})
+	if err != nil {
+		return err
+	}
+	marker := dir + backup.CompletionMarker
+	if len(list.Contents) != 1 || aws.StringValue(list.Contents[0].Key) != marker {
+		return nil
+	}
+	_, err = s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &marker,
+	})
+	return err
+}
@@ -18,28 +18,21 @@ package s3
 
 import (
 	"crypto/rand"
-	"fmt"
-	"os"
 	"testing"
 
-	"github.com/finleap-connect/backup-operator/pkg/logger"
 	"github.com/finleap-connect/backup-operator/pkg/testutil"
-	"github.com/ory/dockertest/v3"
-	dc "github.com/ory/dockertest/v3/docker"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var (
-	pool          *dockertest.Pool
-	srcResource   *dockertest.Resource
-	dstResource   *dockertest.Resource
-	srcURI        string
-	dstURI        string
-	s3Resource    *dockertest.Resource
+	server        *testutil.S3Server
 	endpoint      string
 	encryptionKey string
+	// teardown is run after the suite, e.g. to remove containers started by
+	// specs
+	teardown []func() error
 )
 
 const (
@@ -53,66 +46,24 @@ func TestS3(t *testing.T) {
 	RunSpecs(t, "S3")
 }
 
-var _ = BeforeSuite(func(done Done) {
+var _ = BeforeSuite(func() {
 	var err error
-	log := logger.WithName("s3setup")
-	path, err := os.Getwd()
-	Expect(err).ToNot(HaveOccurred())
 	key := make([]byte, 32)
 	_, err = rand.Read(key)
 	Expect(err).ToNot(HaveOccurred())
 	encryptionKey = string(key)
-	By("bootstrapping both mongodbs")
-	pool, err = dockertest.NewPool("")
-	Expect(err).ToNot(HaveOccurred())
-	log.Info("spawn src mongo container")
-	srcResource, err = pool.Run("mongo", "4.2", nil)
-	Expect(err).ToNot(HaveOccurred())
-	srcURI = fmt.Sprintf("mongodb://localhost:%s", srcResource.GetPort("27017/tcp"))
-	log.Info("spawn dst mongo container")
-	dstResource, err = pool.Run("mongo", "4.2", nil)
-	Expect(err).ToNot(HaveOccurred())
-	dstURI = fmt.Sprintf("mongodb://localhost:%s", dstResource.GetPort("27017/tcp"))
-	log.Info("spawn minio container")
-	options := &dockertest.RunOptions{
-		Repository: "minio/minio",
-		Tag:        "latest",
-		Cmd:        []string{"server", "/data"},
-		PortBindings: map[dc.Port][]dc.PortBinding{
-			"9000": {{HostPort: "9000"}},
-		},
-		Env: []string{
-			fmt.Sprintf("MINIO_ACCESS_KEY=%s", accessKeyID),
-			fmt.Sprintf("MINIO_SECRET_KEY=%s", secretAccessKey),
-		},
-		Mounts: []string{fmt.Sprintf("%s/certs:/root/.minio/certs", path)},
-	}
-	s3Resource, err = pool.RunWithOptions(options)
-	Expect(err).ToNot(HaveOccurred())
-	endpoint = fmt.Sprintf("localhost:%s", s3Resource.GetPort("9000/tcp"))
-	log.Info("check src mongo connection", "uri", srcURI)
-	err = testutil.WaitForMongoDB(pool, srcURI)
+	By("starting s3")
+	// SSE-C requires TLS
+	server, err = testutil.NewS3TLSServer()
 	Expect(err).ToNot(HaveOccurred())
-	log.Info("insert test data", "uri", srcURI)
-	err = testutil.InsertTestData(srcURI)
-	Expect(err).ToNot(HaveOccurred())
-	log.Info("check dst mongo connection", "uri", dstURI)
-	err = testutil.WaitForMongoDB(pool, dstURI)
-	Expect(err).ToNot(HaveOccurred())
-	log.Info("mongo databases ready")
-	log.Info("check minio connection", "endpoint", endpoint)
-	err = testutil.WaitForS3(pool, endpoint, accessKeyID, secretAccessKey)
-	Expect(err).ToNot(HaveOccurred())
-	log.Info("minio ready")
-	close(done)
-}, 60)
+	server.AccessKeyID, server.SecretAccessKey = accessKeyID, secretAccessKey
+	endpoint = server.Endpoint
+})
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
-	err1 := pool.Purge(srcResource)
-	err2 := pool.Purge(dstResource)
-	err3 := pool.Purge(s3Resource)
-	Expect(err1).ToNot(HaveOccurred())
-	Expect(err2).ToNot(HaveOccurred())
-	Expect(err3).ToNot(HaveOccurred())
+	Expect(server.Close()).To(Succeed())
+	for _, f := range teardown {
+		Expect(f()).To(Succeed())
+	}
 })
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompletionMarker is the ID of the marker a committed session stores in its
+// run directory. Runs without it are incomplete.
+const CompletionMarker = ".complete"
+
+// ErrNoSessions is returned if a destination does not support sessions
+var ErrNoSessions = errors.New("destination does not support sessions")
+
+// Session groups the objects of a single backup run, e.g. the dumps of
+// several databases. Objects are stored in the directory of the run, which is
+// only marked as complete on Commit. Either Commit or Abort must be called.
+type Session interface {
+	Destination
+	// Commit stores the completion marker listing all objects of the run
+	Commit(ctx context.Context) error
+	// Abort removes all objects stored in the run directory
+	Abort(ctx context.Context) error
+}
+
+// SessionDestination is implemented by destinations supporting sessions
+type SessionDestination interface {
+	// Begin starts a session storing objects in the directory run
+	Begin(ctx context.Context, run string) (Session, error)
+}
+
+// Completion is the content of a completion marker
+type Completion struct {
+	Run       string    `json:"run"`
+	Objects   []string  `json:"objects"`
+	Committed time.Time `json:"committed"`
+}
+
+// NewCompletion returns the marshalled completion marker of a run
+func NewCompletion(run string, objects []string) ([]byte, error) {
+	return json.MarshalIndent(&Completion{
+		Run:       run,
+		Objects:   objects,
+		Committed: time.Now().UTC(),
+	}, "", "  ")
+}
+
+// ValidateRun returns an error if run cannot be used as run directory. It is
+// called by all implementations of Begin.
+func ValidateRun(run string) error {
+	if run == "" || run == "." || run == ".." || strings.ContainsAny(run, `/\`) {
+		return fmt.Errorf("invalid run directory %q", run)
+	}
+	return nil
+}
+
+// Begin starts a session of dst in the directory run
+func Begin(ctx context.Context, dst Destination, run string) (Session, error) {
+	sd, ok := dst.(SessionDestination)
+	if !ok {
+		return nil, ErrNoSessions
+	}
+	return sd.Begin(ctx, run)
+}
+
+// beginStage starts a session of dst in the directory run, which applies the
+// stage returned by wrap to all objects stored in it
+func beginStage(ctx context.Context, dst Destination, run string, wrap func(Destination) Destination) (Session, error) {
+	session, err := Begin(ctx, dst, run)
+	if err != nil {
+		return nil, err
+	}
+	return &stageSession{Destination: wrap(session), session: session}, nil
+}
+
+// stageSession stores objects through a stage into a session
+type stageSession struct {
+	Destination
+	session Session
+}
+
+func (s *stageSession) Commit(ctx context.Context) error {
+	return s.session.Commit(ctx)
+}
+
+func (s *stageSession) Abort(ctx context.Context) error {
+	return s.session.Abort(ctx)
+}
+
+// StreamSession streams src into a session of dst in the directory run. The
+// session is committed if src succeeds and aborted otherwise. Aborting does
+// not use ctx, as it is usually done already.
+func StreamSession(ctx context.Context, src Source, dst Destination, run string) (int64, error) {
+	session, err := Begin(ctx, dst, run)
+	if err != nil {
+		return 0, err
+	}
+	written, err := src.Stream(ctx, session)
+	if err != nil {
+		if aerr := session.Abort(context.Background()); aerr != nil {
+			return written, fmt.Errorf("%w; failed to abort session: %v", err, aerr)
+		}
+		return written, err
+	}
+	return written, session.Commit(ctx)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// multiSource stores several objects and fails afterwards if err is set
+type multiSource struct {
+	ids []string
+	err error
+}
+
+func (m *multiSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	var written int64
+	for _, id := range m.ids {
+		n, err := dst.Store(ctx, backup.Object{ID: id, Data: bytes.NewBufferString("testcontent")})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, m.err
+}
+
+var _ = Describe("Session", func() {
+	It("should mark committed runs as complete", func() {
+		dst, _ := mem.NewBufferDestination()
+		src := &multiSource{ids: []string{"admin.archive", "app.archive"}}
+		written, err := backup.StreamSession(context.Background(), src, dst, "20200101000000-1a2b3c4d")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeEquivalentTo(2 * len("testcontent")))
+		Expect(dst.Data).To(HaveKey("20200101000000-1a2b3c4d/admin.archive"))
+		Expect(dst.Data).To(HaveKey("20200101000000-1a2b3c4d/app.archive"))
+		completion := &backup.Completion{}
+		Expect(json.Unmarshal(dst.Data["20200101000000-1a2b3c4d/"+backup.CompletionMarker], completion)).To(Succeed())
+		Expect(completion.Run).To(Equal("20200101000000-1a2b3c4d"))
+		Expect(completion.Objects).To(Equal([]string{"admin.archive", "app.archive"}))
+		Expect(completion.Committed).ToNot(BeZero())
+	})
+	It("should remove everything of aborted runs", func() {
+		dst, _ := mem.NewBufferDestination()
+		srcerr := errors.New("oplog failed")
+		src := &multiSource{ids: []string{"admin.archive"}, err: srcerr}
+		_, err := backup.StreamSession(context.Background(), src, dst, "run")
+		Expect(err).To(MatchError(srcerr))
+		Expect(dst.Data).To(BeEmpty())
+	})
+	It("should reject destinations without sessions and invalid runs", func() {
+		_, err := backup.Begin(context.Background(), discard{}, "run")
+		Expect(errors.Is(err, backup.ErrNoSessions)).To(BeTrue())
+		dst, _ := mem.NewBufferDestination()
+		for _, run := range []string{"", ".", "..", "a/b"} {
+			_, err := backup.Begin(context.Background(), dst, run)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+	It("should only commit the sessions of successful targets", func() {
+		a, _ := mem.NewBufferDestination()
+		b, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: &failingSessionDestination{b}, Optional: true},
+		)
+		src := &multiSource{ids: []string{"admin.archive", "app.archive"}}
+		_, err := backup.StreamSession(context.Background(), src, dst, "run")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Data).To(HaveKey("run/" + backup.CompletionMarker))
+		Expect(b.Data).To(BeEmpty())
+		results := dst.Results()
+		Expect(results[0].Err).ToNot(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+	})
+	It("should require all targets of a fan out to support sessions", func() {
+		a, _ := mem.NewBufferDestination()
+		dst := backup.NewFanOutDestination(
+			backup.FanOutTarget{Name: "a", Destination: a},
+			backup.FanOutTarget{Name: "b", Destination: discard{}},
+		)
+		_, err := dst.Begin(context.Background(), "run")
+		Expect(errors.Is(err, backup.ErrNoSessions)).To(BeTrue())
+	})
+	It("should pass sessions through all stages", func() {
+		mdst, _ := mem.NewBufferDestination()
+		key := backup.EncryptionKey{ID: "key1", Key: bytes.Repeat([]byte{1}, 32)}
+		dst, err := backup.NewCompressingDestination(
+			backup.NewEncryptingDestination(backup.NewManifestDestination(mdst, backup.ManifestInfo{}), key),
+			backup.CompressionConf{Codec: backup.CompressionGzip},
+		)
+		Expect(err).ToNot(HaveOccurred())
+		src := &multiSource{ids: []string{"admin.archive"}}
+		_, err = backup.StreamSession(context.Background(), src, dst, "run")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mdst.Data).To(HaveKey("run/admin.archive.gz.enc"))
+		Expect(mdst.Data).To(HaveKey("run/" + backup.ManifestID("admin.archive.gz.enc")))
+		completion := &backup.Completion{}
+		Expect(json.Unmarshal(mdst.Data["run/"+backup.CompletionMarker], completion)).To(Succeed())
+		Expect(completion.Objects).To(ConsistOf("admin.archive.gz.enc", backup.ManifestID("admin.archive.gz.enc")))
+
+		_, err = backup.Begin(context.Background(), backup.NewManifestDestination(discard{}, backup.ManifestInfo{}), "run")
+		Expect(errors.Is(err, backup.ErrNoSessions)).To(BeTrue())
+	})
+})
+
+// failingSessionDestination fails to store the second object of a session
+type failingSessionDestination struct {
+	*mem.BufferDestination
+}
+
+func (f *failingSessionDestination) Begin(ctx context.Context, run string) (backup.Session, error) {
+	s, err := f.BufferDestination.Begin(ctx, run)
+	return &failingSession{Session: s}, err
+}
+
+type failingSession struct {
+	backup.Session
+	stored int
+}
+
+func (f *failingSession) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	if f.stored++; f.stored > 1 {
+		return 0, errors.New("disk full")
+	}
+	return f.Session.Store(ctx, obj)
+}
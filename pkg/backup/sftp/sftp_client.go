@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialTimeout limits how long connecting to and authenticating with the server
+// may take
+var DialTimeout = 30 * time.Second
+
+// CancelGrace is how long requests may take once the context is done before
+// the connection is closed, e.g. to remove partial uploads
+var CancelGrace = time.Second
+
+type SFTPConf struct {
+	Host       string // host:port of the server
+	User       string
+	PrivateKey string // PEM encoded private key used for authentication
+	HostKey    string // Pinned host key(s) in authorized_keys format
+	Directory  string // Remote base directory
+}
+
+func newClient(conf *SFTPConf) (*ssh.Client, *sftp.Client, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(conf.PrivateKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	hostKeyCallback, err := pinnedHostKeyCallback(conf.HostKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.DialTimeout("tcp", conf.Host, DialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The dial timeout of ssh only covers the TCP connection, a server never
+	// completing the handshake would block forever
+	if err := conn.SetDeadline(time.Now().Add(DialTimeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, conf.Host, &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, nil, err
+	}
+	return sshClient, client, nil
+}
+
+// closeOnDone closes conn once ctx is done and CancelGrace passed so that
+// requests blocked on the network return. The returned function stops
+// watching ctx.
+func closeOnDone(ctx context.Context, conn io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		grace := time.NewTimer(CancelGrace)
+		defer grace.Stop()
+		select {
+		case <-grace.C:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// pinnedHostKeyCallback only accepts the host keys listed in authorized_keys
+// format. Multiple keys can be specified one per line to allow rotation.
+func pinnedHostKeyCallback(hostKeys string) (ssh.HostKeyCallback, error) {
+	var pinned []ssh.PublicKey
+	rest := []byte(hostKeys)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key: %w", err)
+		}
+		pinned = append(pinned, key)
+		rest = next
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("host key required to connect to sftp server")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, p := range pinned {
+			if bytes.Equal(p.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key of %s does not match pinned host keys", hostname)
+	}, nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type SFTPDestinationConf struct {
+	SFTPConf
+	Prefix string
+}
+
+func NewSFTPDestination(conf *SFTPDestinationConf) (*SFTPDestination, error) {
+	sshClient, client, err := newClient(&conf.SFTPConf)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join(conf.Directory, conf.Prefix)
+	log := logger.WithName("sftpdst")
+	return &SFTPDestination{
+		SSHClient: sshClient,
+		Client:    client,
+		Dir:       dir,
+		store:     &backup.DirStore{FS: sftpFS{client}, Dir: dir, Log: log},
+		log:       log,
+	}, nil
+}
+
+type SFTPDestination struct {
+	SSHClient *ssh.Client
+	Client    *sftp.Client
+	Dir       string
+	store     *backup.DirStore
+	log       logger.Logger
+}
+
+func (s *SFTPDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	defer closeOnDone(ctx, s.SSHClient)()
+	fp := path.Join(s.Dir, obj.ID)
+	s.log.Info("upload starting", "path", fp)
+	written, err := s.store.Store(ctx, obj)
+	if err != nil {
+		return written, err
+	}
+	s.log.Info("upload successful", "path", fp, "written", written)
+	return written, nil
+}
+
+// Preflight checks files can be written, listed and removed in the remote
+// directory
+func (s *SFTPDestination) Preflight(ctx context.Context) error {
+	defer closeOnDone(ctx, s.SSHClient)()
+	if err := s.Client.MkdirAll(s.Dir); err != nil {
+		return err
+	}
+	fp := path.Join(s.Dir, ".preflight")
+	file, err := s.Client.Create(fp)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if _, err := s.Client.ReadDir(s.Dir); err != nil {
+		return err
+	}
+	return s.Client.Remove(fp)
+}
+
+// Begin starts a session storing objects in the remote sub directory run
+func (s *SFTPDestination) Begin(ctx context.Context, run string) (backup.Session, error) {
+	session, err := s.store.Begin(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpSession{Session: session, conn: s.SSHClient}, nil
+}
+
+// sftpSession closes the connection on cancellation like the destination
+type sftpSession struct {
+	backup.Session
+	conn io.Closer
+}
+
+func (s *sftpSession) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	defer closeOnDone(ctx, s.conn)()
+	return s.Session.Store(ctx, obj)
+}
+
+func (s *sftpSession) Commit(ctx context.Context) error {
+	defer closeOnDone(ctx, s.conn)()
+	return s.Session.Commit(ctx)
+}
+
+// Abort removes the run directory including partial uploads
+func (s *sftpSession) Abort(ctx context.Context) error {
+	defer closeOnDone(ctx, s.conn)()
+	return s.Session.Abort(ctx)
+}
+
+func (s *SFTPDestination) EnsureRetention(ctx context.Context, policy backup.RetentionPolicy) error {
+	// The backup of this run is stored in the directory of its session
+	return backup.ApplyRetention(ctx, s, s.store.Retention(policy), s.log)
+}
+
+func (s *SFTPDestination) Backups(ctx context.Context) ([]backup.StoredBackup, error) {
+	defer closeOnDone(ctx, s.SSHClient)()
+	return s.store.Backups(ctx)
+}
+
+func (s *SFTPDestination) Manifest(ctx context.Context, id string) (*backup.Manifest, error) {
+	defer closeOnDone(ctx, s.SSHClient)()
+	file, err := s.Client.Open(backup.ManifestID(path.Join(s.Dir, id)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return backup.ParseManifest(file)
+}
+
+func (s *SFTPDestination) Remove(ctx context.Context, id string) error {
+	defer closeOnDone(ctx, s.SSHClient)()
+	return s.store.Remove(ctx, id)
+}
+
+func (s *SFTPDestination) Close() error {
+	s.Client.Close()
+	return s.SSHClient.Close()
+}
+
+func (s *SFTPDestination) List(ctx context.Context) ([]string, error) {
+	defer closeOnDone(ctx, s.SSHClient)()
+	return s.store.List(ctx)
+}
+
+// sftpFS is the remote file system
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (f sftpFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return f.client.ReadDir(dir)
+}
+
+func (f sftpFS) Create(name string) (io.WriteCloser, error) {
+	return f.client.Create(name)
+}
+
+func (f sftpFS) Remove(name string) error {
+	return f.client.Remove(name)
+}
+
+func (f sftpFS) Rename(oldname, newname string) error {
+	return f.client.PosixRename(oldname, newname)
+}
+
+func (f sftpFS) MkdirAll(dir string) error {
+	return f.client.MkdirAll(dir)
+}
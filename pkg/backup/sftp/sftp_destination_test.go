@@ -0,0 +1,230 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SFTPDestination", func() {
+	It("should write buffer to remote directory", func() {
+		data := []byte("temporarycontent")
+		src, _ := mem.NewBufferSource("backup.tgz", data)
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   "ns/plana",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		written, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(Equal(int64(len(data))))
+		res, err := ioutil.ReadFile(filepath.Join(dir, "ns", "plana", "backup.tgz"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).Should(Equal(data))
+	})
+	It("should refuse unknown host keys", func() {
+		conf := newTestConf()
+		other, err := testutil.NewSFTPServer()
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		conf.HostKey = other.HostKey
+		_, err = NewSFTPDestination(&SFTPDestinationConf{SFTPConf: conf})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should require a host key", func() {
+		conf := newTestConf()
+		conf.HostKey = ""
+		_, err := NewSFTPDestination(&SFTPDestinationConf{SFTPConf: conf})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should give up connecting to unresponsive servers", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer l.Close()
+		timeout := DialTimeout
+		DialTimeout = 100 * time.Millisecond
+		defer func() { DialTimeout = timeout }()
+		conf := newTestConf()
+		conf.Host = l.Addr().String()
+		_, err = NewSFTPDestination(&SFTPDestinationConf{SFTPConf: conf})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should close the connection once the context is cancelled", func() {
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   "ns/cancel",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer closeOnDone(ctx, dst.SSHClient)()
+		_, err = dst.Client.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		cancel()
+		Eventually(func() error {
+			_, err := dst.Client.Getwd()
+			return err
+		}, 5*CancelGrace).Should(HaveOccurred())
+	})
+	It("should pass preflight checks", func() {
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   "ns/preflight",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		Expect(dst.Preflight(context.Background())).To(Succeed())
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "ns", "preflight"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+	It("should store sessions in run directories", func() {
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   "ns/session",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		src, _ := mem.NewBufferSource("backup.tgz", []byte("testcontent"))
+		_, err = backup.StreamSession(context.Background(), src, dst, "run-a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "ns", "session", "run-a", "backup.tgz")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "ns", "session", "run-a", backup.CompletionMarker)).To(BeAnExistingFile())
+
+		session, err := dst.Begin(context.Background(), "run-b")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = src.Stream(context.Background(), session)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Abort(context.Background())).To(Succeed())
+		Expect(filepath.Join(dir, "ns", "session", "run-b")).ToNot(BeADirectory())
+		ids, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"run-a/backup.tgz"}))
+	})
+	It("should apply the retention to the backups of runs", func() {
+		prefix := "ns/sessionretention"
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   prefix,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		now := time.Now()
+		var ids []string
+		for i, run := range []string{"run-a", "run-b"} {
+			id := backup.NewID(now.Add(time.Duration(i)*time.Hour), ".tgz")
+			ids = append(ids, id)
+			src, _ := mem.NewBufferSource(id, []byte("testcontent"))
+			_, err := backup.StreamSession(context.Background(), src, backup.NewManifestDestination(dst, backup.ManifestInfo{}), run)
+			Expect(err).ToNot(HaveOccurred())
+			mtime := now.Add(time.Duration(i) * time.Hour)
+			Expect(os.Chtimes(filepath.Join(dir, prefix, run, id), mtime, mtime)).To(Succeed())
+		}
+		policy := backup.KeepLast(1)
+		policy.Pattern = backup.IDPattern
+		policy.Require = ids[1]
+		Expect(dst.EnsureRetention(context.Background(), policy)).To(Succeed())
+		Expect(filepath.Join(dir, prefix, "run-a")).ToNot(BeADirectory())
+		stored, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(Equal([]string{"run-b/" + ids[1]}))
+	})
+	It("should list backups newest first", func() {
+		prefix := "ns/list"
+		dst, err := NewSFTPDestination(&SFTPDestinationConf{
+			SFTPConf: newTestConf(),
+			Prefix:   prefix,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		now := time.Now()
+		for i, name := range []string{"backup-a.tgz", "backup-b.tgz", backup.ManifestID("backup-b.tgz")} {
+			src, _ := mem.NewBufferSource(name, []byte("testcontent"))
+			_, err := src.Stream(context.Background(), dst)
+			Expect(err).ToNot(HaveOccurred())
+			mtime := now.Add(time.Duration(i) * time.Minute)
+			Expect(os.Chtimes(filepath.Join(dir, prefix, name), mtime, mtime)).To(Succeed())
+		}
+		ids, err := dst.List(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"backup-b.tgz", "backup-a.tgz"}))
+	})
+	DescribeTable("ensure retention for values",
+		func(retention int, count int) {
+			prefix := fmt.Sprintf("ns/retention%d-%d", retention, count)
+			dst, err := NewSFTPDestination(&SFTPDestinationConf{
+				SFTPConf: newTestConf(),
+				Prefix:   prefix,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer dst.Close()
+			expected := []string{}
+			now := time.Now()
+			for i := 0; i < count; i++ {
+				name := fmt.Sprintf("backup-%d.tgz", i)
+				src, _ := mem.NewBufferSource(name, []byte("testcontent"))
+				_, err := src.Stream(context.Background(), dst)
+				Expect(err).ToNot(HaveOccurred())
+				mtime := now.Add(time.Duration(i) * time.Minute)
+				Expect(os.Chtimes(filepath.Join(dir, prefix, name), mtime, mtime)).To(Succeed())
+				// Every other backup has no manifest and is never removed
+				manifest := backup.ManifestID(name)
+				if i%2 == 0 {
+					Expect(ioutil.WriteFile(filepath.Join(dir, prefix, manifest), []byte("{}"), 0644)).To(Succeed())
+					Expect(os.Chtimes(filepath.Join(dir, prefix, manifest), mtime, mtime)).To(Succeed())
+				}
+				if i%2 == 1 {
+					expected = append(expected, name)
+				} else if i >= count-2*retention {
+					expected = append(expected, name, manifest)
+				}
+			}
+			// Leftovers of failed uploads must be ignored
+			Expect(ioutil.WriteFile(filepath.Join(dir, prefix, ".backup-x.tgz.part"), []byte{}, 0644)).To(Succeed())
+			Expect(dst.EnsureRetention(context.Background(), backup.KeepLast(retention))).To(Succeed())
+			entries, err := ioutil.ReadDir(filepath.Join(dir, prefix))
+			Expect(err).ToNot(HaveOccurred())
+			found := []string{}
+			for _, fi := range entries {
+				found = append(found, fi.Name())
+			}
+			expected = append(expected, ".backup-x.tgz.part")
+			sort.Strings(expected)
+			sort.Strings(found)
+			Expect(found).To(Equal(expected))
+		},
+		Entry("3 out of 5", 3, 5),
+		Entry("4 out of 5", 4, 5),
+		Entry("5 out of 12", 5, 12),
+	)
+})
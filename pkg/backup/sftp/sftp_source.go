@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"context"
+	"path"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type SFTPSourceConf struct {
+	SFTPConf
+	Key string // Path of the backup relative to the directory
+}
+
+func NewSFTPSource(conf *SFTPSourceConf) (*SFTPSource, error) {
+	sshClient, client, err := newClient(&conf.SFTPConf)
+	if err != nil {
+		return nil, err
+	}
+	return &SFTPSource{
+		SSHClient: sshClient,
+		Client:    client,
+		Dir:       conf.Directory,
+		Key:       conf.Key,
+		log:       logger.WithName("sftpsrc"),
+	}, nil
+}
+
+type SFTPSource struct {
+	SSHClient *ssh.Client
+	Client    *sftp.Client
+	Dir       string
+	Key       string
+	log       logger.Logger
+}
+
+func (s *SFTPSource) Stream(ctx context.Context, dst backup.Destination) (int64, error) {
+	defer closeOnDone(ctx, s.SSHClient)()
+	fp := path.Join(s.Dir, s.Key)
+	s.log.Info("download starting", "path", fp)
+	file, err := s.Client.Open(fp)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return dst.Store(ctx, backup.Object{
+		ID:       s.Key,
+		Data:     backup.NewContextReader(ctx, file),
+		Metadata: backup.ObjectInfo{Size: info.Size()}.Metadata(),
+	})
+}
+
+func (s *SFTPSource) Close() error {
+	s.Client.Close()
+	return s.SSHClient.Close()
+}
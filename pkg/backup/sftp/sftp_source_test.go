@@ -0,0 +1,49 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SFTPSource", func() {
+	It("should read remote file to buffer", func() {
+		data := []byte("temporarycontent")
+		key := "ns/planb/backup.tgz"
+		Expect(os.MkdirAll(filepath.Join(dir, "ns", "planb"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, key), data, 0644)).To(Succeed())
+		src, err := NewSFTPSource(&SFTPSourceConf{
+			SFTPConf: newTestConf(),
+			Key:      key,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer src.Close()
+		dst, _ := mem.NewBufferDestination()
+		written, err := src.Stream(context.Background(), dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeNumerically(">", 0))
+		Expect(dst.Data[key]).Should(Equal(data))
+	})
+})
@@ -0,0 +1,63 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	server *testutil.SFTPServer
+	dir    string
+)
+
+func TestSFTP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SFTP")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	By("starting in-process sftp server")
+	server, err = testutil.NewSFTPServer()
+	Expect(err).ToNot(HaveOccurred())
+	dir, err = ioutil.TempDir("", "sftp")
+	Expect(err).ToNot(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	By("tearing down the test environment")
+	Expect(server.Close()).To(Succeed())
+	Expect(os.RemoveAll(dir)).To(Succeed())
+})
+
+func newTestConf() SFTPConf {
+	return SFTPConf{
+		Host:       server.Addr,
+		User:       server.User,
+		PrivateKey: server.PrivateKey,
+		HostKey:    server.HostKey,
+		Directory:  dir,
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrDestinationClosed is returned to a producer writing to a pipe, after the
+// destination stopped reading from it
+var ErrDestinationClosed = errors.New("destination stopped reading")
+
+// StreamError reports which side of a stream failed
+type StreamError struct {
+	Source      error
+	Destination error
+}
+
+func (e *StreamError) Error() string {
+	switch {
+	case e.Source != nil && e.Destination != nil:
+		return fmt.Sprintf("source failed: %v; destination failed: %v", e.Source, e.Destination)
+	case e.Source != nil:
+		return fmt.Sprintf("source failed: %v", e.Source)
+	default:
+		return fmt.Sprintf("destination failed: %v", e.Destination)
+	}
+}
+
+// Unwrap returns the source error if present, as it is usually the cause of
+// the destination error
+func (e *StreamError) Unwrap() error {
+	if e.Source != nil {
+		return e.Source
+	}
+	return e.Destination
+}
+
+// Pipe stores everything produce writes as obj in dst. produce runs in a
+// separate goroutine, its error closes the pipe, so the destination never
+// mistakes a failed source for a complete one. On cancellation of ctx both
+// sides are unblocked. Pipe waits for both sides to finish and returns a
+// *StreamError naming the side, which failed. Data the destination does not
+// read is discarded.
+func Pipe(ctx context.Context, dst Destination, obj Object, produce func(w io.Writer) error) (int64, error) {
+	pr, pw := io.Pipe()
+	stop := OnCancel(ctx, func() {
+		pw.CloseWithError(ctx.Err())
+	})
+	defer stop()
+
+	srcerrc := make(chan error, 1)
+	go func() {
+		err := produce(pw)
+		pw.CloseWithError(err)
+		srcerrc <- err
+	}()
+
+	obj.Data = pr
+	written, dsterr := dst.Store(ctx, obj)
+	// Unblock the producer, if the destination returned early
+	pr.CloseWithError(ErrDestinationClosed)
+	srcerr := <-srcerrc
+	if errors.Is(srcerr, ErrDestinationClosed) {
+		// Caused by the destination, not the source itself
+		srcerr = nil
+	}
+	if srcerr == nil && dsterr == nil {
+		return written, nil
+	}
+	return written, &StreamError{Source: srcerr, Destination: dsterr}
+}
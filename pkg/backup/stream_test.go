@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipe", func() {
+	It("should store everything produced", func() {
+		dst, _ := mem.NewBufferDestination()
+		written, err := backup.Pipe(context.Background(), dst, backup.Object{ID: "backup.tgz"}, func(w io.Writer) error {
+			_, err := w.Write([]byte("testcontent"))
+			return err
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeEquivalentTo(len("testcontent")))
+		Expect(string(dst.Data["backup.tgz"])).To(Equal("testcontent"))
+	})
+	It("should report source failures", func() {
+		srcerr := errors.New("dump failed")
+		dst, _ := mem.NewBufferDestination()
+		_, err := backup.Pipe(context.Background(), dst, backup.Object{ID: "backup.tgz"}, func(w io.Writer) error {
+			_, _ = w.Write([]byte("test"))
+			return srcerr
+		})
+		Expect(err).To(HaveOccurred())
+		var serr *backup.StreamError
+		Expect(errors.As(err, &serr)).To(BeTrue())
+		Expect(serr.Source).To(Equal(srcerr))
+		// The destination must not treat the truncated data as complete
+		Expect(serr.Destination).To(MatchError(srcerr))
+		Expect(errors.Is(err, srcerr)).To(BeTrue())
+	})
+	It("should report destination failures and unblock the source", func() {
+		dsterr := errors.New("upload failed")
+		_, err := backup.Pipe(context.Background(), failing{dsterr}, backup.Object{ID: "backup.tgz"}, func(w io.Writer) error {
+			for {
+				if _, err := w.Write([]byte("testcontent")); err != nil {
+					return err
+				}
+			}
+		})
+		var serr *backup.StreamError
+		Expect(errors.As(err, &serr)).To(BeTrue())
+		Expect(serr.Source).ToNot(HaveOccurred())
+		Expect(serr.Destination).To(Equal(dsterr))
+		Expect(err.Error()).To(Equal("destination failed: upload failed"))
+	})
+	It("should unblock both sides on cancellation", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			defer GinkgoRecover()
+			_, err := backup.Pipe(ctx, stalling{}, backup.Object{ID: "backup.tgz"}, func(w io.Writer) error {
+				for {
+					if _, err := w.Write([]byte("testcontent")); err != nil {
+						return err
+					}
+				}
+			})
+			done <- err
+		}()
+		cancel()
+		var err error
+		Eventually(done, time.Second).Should(Receive(&err))
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	})
+})
+
+type failing struct {
+	err error
+}
+
+func (f failing) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	buf := make([]byte, 4)
+	_, _ = obj.Data.Read(buf)
+	return 0, f.err
+}
+
+// stalling reads nothing until the context is done
+type stalling struct{}
+
+func (stalling) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
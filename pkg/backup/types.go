@@ -17,18 +17,63 @@ limitations under the License.
 package backup
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
 )
 
+// ErrNotFound is returned by sources if the object to stream does not exist
+var ErrNotFound = errors.New("object not found")
+
+// IsNotFound returns true if err reports that an object does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist)
+}
+
 type Object struct {
-	ID   string // Used to determine filenames
-	Data io.Reader
+	ID       string // Used to determine filenames
+	Data     io.Reader
+	Metadata map[string]string // Persisted alongside the data if supported by the destination
+}
+
+// WithMetadata returns a copy of the metadata of obj extended by the given key
+// value pairs
+func (obj Object) WithMetadata(keyValues ...string) map[string]string {
+	metadata := make(map[string]string, len(obj.Metadata)+len(keyValues)/2)
+	for k, v := range obj.Metadata {
+		metadata[k] = v
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		metadata[keyValues[i]] = keyValues[i+1]
+	}
+	return metadata
 }
 
 type Destination interface {
-	Store(obj Object) (int64, error) // Can be invoked multiple times
+	Store(ctx context.Context, obj Object) (int64, error) // Can be invoked multiple times
+}
+
+type RetentionDestination interface {
+	Destination
+	EnsureRetention(ctx context.Context, policy RetentionPolicy) error // Removes all backups obsolete according to the policy
+}
+
+// Lister is implemented by destinations, which can list the backups they store
+type Lister interface {
+	// List returns the IDs of all stored backups, newest first. Manifests are
+	// not included.
+	List(ctx context.Context) ([]string, error)
+}
+
+// PreflightChecker is implemented by destinations, which can check in advance
+// whether backups can be stored
+type PreflightChecker interface {
+	// Preflight checks the destination is reachable and backups can be
+	// stored, listed and removed
+	Preflight(ctx context.Context) error
 }
 
 type Source interface {
-	Stream(dst Destination) (int64, error)
+	Stream(ctx context.Context, dst Destination) (int64, error)
 }
@@ -34,6 +34,8 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // BackupPlanReconciler reconciles BackupPlan objects
@@ -51,9 +53,13 @@ type BackupPlanReconciler struct {
 // +kubebuilder:rbac:groups=backup.finleap.cloud,resources=mongodbbackupplans/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=backup.finleap.cloud,resources=consulbackupplans,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=backup.finleap.cloud,resources=consulbackupplans/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=backup.finleap.cloud,resources=pluginbackupplans,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=backup.finleap.cloud,resources=pluginbackupplans/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
 
 func (r *BackupPlanReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues(r.Type.GetKind(), req.NamespacedName)
@@ -113,6 +119,13 @@ func (r *BackupPlanReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 					status.CronJob = nil
 				}
 			}
+			if status.Verification != nil {
+				if err := r.deleteVerificationCronJob(ctx, status.Verification); err != nil {
+					log.Error(err, "failed to remove owned verification CronJob")
+					r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", "Failed to remove owned verification CronJob")
+					return ctrl.Result{}, err
+				}
+			}
 			// Finally remove the finalizer
 			objectMeta.Finalizers = util.RemoveString(objectMeta.Finalizers, finalizerName)
 			if err := r.Update(ctx, plan); err != nil {
@@ -213,17 +226,25 @@ func (r *BackupPlanReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	// Properly construct the spec
 	spec := plan.GetSpec()
+	dstVolumes, dstVolumeMounts := DestinationVolumes(spec.GetDestinations())
+	volumes := func() []corev1.Volume {
+		return append(append([]corev1.Volume{}, spec.Volumes...), dstVolumes...)
+	}
+	volumeMounts := func() []corev1.VolumeMount {
+		return append(append([]corev1.VolumeMount{}, spec.VolumeMounts...), dstVolumeMounts...)
+	}
 	err = UpdateCronJobSpec(&cronJob, secretRef,
 		spec.Schedule,
 		spec.ActiveDeadlineSeconds,
 		r.WorkerImage,
 		spec.Env,
 		plan.GetCmd(),
-		spec.Volumes,
-		spec.VolumeMounts) // TODO: const?
+		volumes(),
+		volumeMounts()) // TODO: const?
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName = spec.ServiceAccountName
 
 	// Finally create or update the cronjob
 	if status.CronJob != nil {
@@ -248,6 +269,20 @@ func (r *BackupPlanReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	status.CronJob = cronJobRef
 
+	// Check the destinations whenever the configuration of the worker changes
+	if err := r.reconcilePreflight(ctx, plan, secretRef, raw, volumes(), volumeMounts()); err != nil {
+		log.Error(err, "failed to reconcile preflight")
+		r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Failed to reconcile preflight: %v", err))
+		return ctrl.Result{}, err
+	}
+
+	// Restore tests run with the same volumes as the backup
+	if err := r.reconcileVerification(ctx, plan, secretRef, &cronJob, volumes(), volumeMounts()); err != nil {
+		log.Error(err, "failed to reconcile verification")
+		r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Failed to reconcile verification: %v", err))
+		return ctrl.Result{}, err
+	}
+
 	if err := r.Update(ctx, plan); err != nil {
 		log.Error(err, "status update failed")
 		r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Failed to update BackupPlan: %v", err))
@@ -262,6 +297,7 @@ func (r *BackupPlanReconciler) SetupWithManager(mgr ctrl.Manager, name string) e
 		For(r.Type).
 		Owns(&corev1.Secret{}).
 		Owns(&batchv1.CronJob{}).
+		Watches(&source.Kind{Type: &batchv1.Job{}}, handler.EnqueueRequestsFromMapFunc(r.jobToPlan)).
 		Named(name).
 		Complete(r)
 }
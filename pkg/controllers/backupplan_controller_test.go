@@ -23,7 +23,10 @@ import (
 	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -38,9 +41,10 @@ const (
 )
 
 // Add api types to test here
-var planTypes = [2]backupv1alpha1.BackupPlan{
+var planTypes = [3]backupv1alpha1.BackupPlan{
 	&backupv1alpha1.ConsulBackupPlan{},
 	&backupv1alpha1.MongoDBBackupPlan{},
+	&backupv1alpha1.PluginBackupPlan{},
 }
 
 type CreateNewBackupPlanFunc = func(namespace string) backupv1alpha1.BackupPlan
@@ -53,10 +57,14 @@ var createTypeFuncs = map[string]CreateNewBackupPlanFunc{
 	backupv1alpha1.MongoDBBackupPlanKind: func(namespace string) backupv1alpha1.BackupPlan {
 		return newMongoDBBackupPlan(namespace)
 	},
+	backupv1alpha1.PluginBackupPlanKind: func(namespace string) backupv1alpha1.BackupPlan {
+		return newPluginBackupPlan(namespace)
+	},
 }
 
 type UpdateMongoDBBackupPlanFunc = func(spec *backupv1alpha1.MongoDBBackupPlan)
 type UpdateConsulBackupPlanFunc = func(spec *backupv1alpha1.ConsulBackupPlan)
+type UpdatePluginBackupPlanFunc = func(spec *backupv1alpha1.PluginBackupPlan)
 
 func newObjectMeta(namespace string) metav1.ObjectMeta {
 	return metav1.ObjectMeta{
@@ -112,6 +120,23 @@ func newMongoDBBackupPlan(namespace string, updates ...UpdateMongoDBBackupPlanFu
 	return plan
 }
 
+func newPluginBackupPlan(namespace string, updates ...UpdatePluginBackupPlanFunc) backupv1alpha1.BackupPlan {
+	plan := &backupv1alpha1.PluginBackupPlan{
+		ObjectMeta: newObjectMeta(namespace),
+		Spec: backupv1alpha1.PluginBackupPlanSpec{
+			BackupPlanSpec: newBackupPlanSpec(namespace),
+			Plugin: backupv1alpha1.Plugin{
+				Name:   "tar-plugin",
+				Config: &runtime.RawExtension{Raw: []byte(`{"path":"/data"}`)},
+			},
+		},
+	}
+	for _, f := range updates {
+		f(plan)
+	}
+	return plan
+}
+
 func mustCreateNewBackupPlan(planType backupv1alpha1.BackupPlan, namespace string) backupv1alpha1.BackupPlan {
 	f := createTypeFuncs[planType.GetKind()]
 	plan := f(namespace)
@@ -223,4 +248,252 @@ var _ = Describe("BackupPlanReconciler", func() {
 			}, &cronJob)).Should(Succeed())
 		}
 	})
+	It("runs the CronJob with the service account of the plan", func() {
+		for _, planType := range planTypes {
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			plan.GetSpec().ServiceAccountName = "backup"
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			res := mustReconcile(ctx, plan)
+			Expect(res.Requeue).To(Equal(false))
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().CronJob.Namespace,
+				Name:      plan.GetStatus().CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			Expect(cronJob.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName).To(Equal("backup"))
+		}
+	})
+	It("mounts volumes of destinations into CronJob", func() {
+		for _, planType := range planTypes {
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			plan.GetSpec().Destinations = []backupv1alpha1.Destination{
+				{Volume: &backupv1alpha1.Volume{ClaimName: "backups"}},
+				{Volume: &backupv1alpha1.Volume{ClaimName: "backups", SubPath: "copy"}},
+			}
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			res := mustReconcile(ctx, plan)
+			Expect(res.Requeue).To(Equal(false))
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().CronJob.Namespace,
+				Name:      plan.GetStatus().CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+			Expect(podSpec.Volumes).To(ContainElement(WithTransform(func(v corev1.Volume) *corev1.PersistentVolumeClaimVolumeSource {
+				return v.PersistentVolumeClaim
+			}, Equal(&corev1.PersistentVolumeClaimVolumeSource{ClaimName: "backups"}))))
+			Expect(podSpec.Volumes).To(HaveLen(2)) // config and a single claim
+			Expect(podSpec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name:      WorkerBackupVolumeName + "-0",
+				MountPath: backupv1alpha1.VolumeDestinationMountPath + "/backups",
+			}))
+		}
+	})
+	It("mounts TLS secrets and config maps of S3 destinations into CronJob", func() {
+		for _, planType := range planTypes {
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			plan.GetSpec().Destination.S3.CABundleRef = &backupv1alpha1.KeyRef{ConfigMapName: "ca", Key: "ca.crt"}
+			plan.GetSpec().Destination.S3.ClientCertificateSecret = "client"
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			res := mustReconcile(ctx, plan)
+			Expect(res.Requeue).To(Equal(false))
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().CronJob.Namespace,
+				Name:      plan.GetStatus().CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+			Expect(podSpec.Volumes).To(HaveLen(3)) // config, CA bundle and client certificate
+			Expect(podSpec.Containers[0].VolumeMounts).To(ContainElements(
+				corev1.VolumeMount{
+					Name:      WorkerTLSVolumeName + "-0",
+					MountPath: backupv1alpha1.TLSMountPath + "/configmap/ca",
+					ReadOnly:  true,
+				},
+				corev1.VolumeMount{
+					Name:      WorkerTLSVolumeName + "-1",
+					MountPath: backupv1alpha1.SecretMountPath("client"),
+					ReadOnly:  true,
+				},
+			))
+		}
+	})
+	It("mounts a spool volume for S3 destinations with upload retries into CronJob", func() {
+		for _, planType := range planTypes {
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			limit := resource.MustParse("10Gi")
+			plan.GetSpec().Destination.S3.Retry = &backupv1alpha1.S3Retry{UploadRetries: 3, SpoolSizeLimit: &limit}
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			res := mustReconcile(ctx, plan)
+			Expect(res.Requeue).To(Equal(false))
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().CronJob.Namespace,
+				Name:      plan.GetStatus().CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+			Expect(podSpec.Volumes).To(ContainElement(WithTransform(func(v corev1.Volume) *corev1.EmptyDirVolumeSource {
+				return v.EmptyDir
+			}, Equal(&corev1.EmptyDirVolumeSource{SizeLimit: &limit}))))
+			Expect(podSpec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name:      WorkerSpoolVolumeName,
+				MountPath: backupv1alpha1.SpoolMountPath,
+			}))
+		}
+	})
+})
+
+var _ = Describe("BackupPlanReconciler verification", func() {
+	ctx := context.Background()
+
+	It("creates verification CronJob with scratch instance", func() {
+		for _, planType := range planTypes {
+			if _, ok := DefaultScratchCommands[planType.GetCmd()]; !ok {
+				// Backups of plugins cannot be restored by the worker
+				continue
+			}
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			plan.GetSpec().Verification = &backupv1alpha1.Verification{
+				Schedule: "0 * * * *",
+				Image:    "scratch:latest",
+			}
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			res := mustReconcile(ctx, plan)
+			Expect(res.Requeue).To(Equal(false))
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			Expect(plan.GetStatus().Verification).ToNot(BeNil())
+			Expect(plan.GetStatus().Verification.CronJob).ToNot(BeNil())
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().Verification.CronJob.Namespace,
+				Name:      plan.GetStatus().Verification.CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			Expect(cronJob.Spec.Schedule).To(Equal("0 * * * *"))
+			Expect(cronJob.Spec.JobTemplate.Labels).To(HaveKeyWithValue(planLabel, plan.GetName()))
+			containers := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers
+			Expect(containers).To(HaveLen(2))
+			Expect(containers[0].Args).To(ContainElement("restore-test"))
+			Expect(containers[1].Image).To(Equal("scratch:latest"))
+
+			// Removing the verification removes the CronJob
+			plan.GetSpec().Verification = nil
+			Expect(k8sClient.Update(ctx, plan)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			Expect(plan.GetStatus().Verification).To(BeNil())
+			Expect(client.IgnoreNotFound(k8sClient.Get(ctx, namespacedName(&cronJob), &cronJob))).Should(Succeed())
+		}
+	})
+	It("launches verification Job after successful backup", func() {
+		for _, planType := range planTypes {
+			plan := createTypeFuncs[planType.GetKind()](testNamespace)
+			plan.GetSpec().Verification = &backupv1alpha1.Verification{
+				Image: "scratch:latest",
+			}
+			Expect(k8sClient.Create(ctx, plan)).Should(Succeed())
+			defer mustRemoveFinalizers(ctx, plan)
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			labels := client.MatchingLabels{planLabel: plan.GetName(), planKindLabel: plan.GetKind(), verificationLabel: "true"}
+			var jobs batchv1.JobList
+			Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), labels)).Should(Succeed())
+			Expect(jobs.Items).To(BeEmpty())
+
+			// Mark the backup as successful
+			var cronJob batchv1.CronJob
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().CronJob.Namespace,
+				Name:      plan.GetStatus().CronJob.Name,
+			}, &cronJob)).Should(Succeed())
+			now := metav1.Now()
+			cronJob.Status.LastSuccessfulTime = &now
+			Expect(k8sClient.Status().Update(ctx, &cronJob)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), labels)).Should(Succeed())
+			Expect(jobs.Items).To(HaveLen(1))
+
+			// Reconciling again must not launch another Job
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), labels)).Should(Succeed())
+			Expect(jobs.Items).To(HaveLen(1))
+
+			// Record the result
+			job := jobs.Items[0]
+			job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+				Type:               batchv1.JobFailed,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.Now(),
+			})
+			Expect(k8sClient.Status().Update(ctx, &job)).Should(Succeed())
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			Expect(plan.GetStatus().Verification.Job.Name).To(Equal(job.Name))
+			Expect(plan.GetStatus().Verification.LastResult).To(Equal(backupv1alpha1.VerificationFailed))
+		}
+	})
+})
+
+var _ = Describe("BackupPlanReconciler preflight", func() {
+	ctx := context.Background()
+
+	It("checks the destinations whenever the configuration changes", func() {
+		for _, planType := range planTypes {
+			plan := mustCreateNewBackupPlan(planType, testNamespace)
+			defer mustRemoveFinalizers(ctx, plan)
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			Expect(plan.GetStatus().Preflight).ToNot(BeNil())
+			condition := meta.FindStatusCondition(plan.GetStatus().Conditions, backupv1alpha1.DestinationReadyCondition)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionUnknown))
+			var job batchv1.Job
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Namespace: plan.GetStatus().Preflight.Job.Namespace,
+				Name:      plan.GetStatus().Preflight.Job.Name,
+			}, &job)).Should(Succeed())
+
+			// Reconciling again must not launch another Job
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			var jobs batchv1.JobList
+			Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels(preflightLabels(plan)))).Should(Succeed())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(job.Labels).To(HaveKeyWithValue(preflightLabel, "true"))
+			Expect(job.Spec.Template.Spec.Containers[0].Args).To(ContainElement("preflight"))
+
+			// Record the result
+			job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+				Type:               batchv1.JobFailed,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.Now(),
+				Message:            "BackoffLimitExceeded",
+			})
+			Expect(k8sClient.Status().Update(ctx, &job)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			condition = meta.FindStatusCondition(plan.GetStatus().Conditions, backupv1alpha1.DestinationReadyCondition)
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(backupv1alpha1.PreflightFailedReason))
+
+			// A new configuration is checked again
+			plan.GetSpec().Schedule = "0 * * * *"
+			Expect(k8sClient.Update(ctx, plan)).Should(Succeed())
+			mustReconcile(ctx, plan)
+			Expect(k8sClient.Get(ctx, namespacedName(plan), plan)).Should(Succeed())
+			Expect(plan.GetStatus().Preflight.Job.Name).ToNot(Equal(job.Name))
+			condition = meta.FindStatusCondition(plan.GetStatus().Conditions, backupv1alpha1.DestinationReadyCondition)
+			Expect(condition.Status).To(Equal(metav1.ConditionUnknown))
+		}
+	})
 })
@@ -19,4 +19,9 @@ package controllers
 const (
 	finalizerName   = "backup.finleap.cloud"
 	secretFieldName = "plan.json"
+
+	planLabel         = "backup.finleap.cloud/plan"
+	planKindLabel     = "backup.finleap.cloud/kind"
+	verificationLabel = "backup.finleap.cloud/verification"
+	preflightLabel    = "backup.finleap.cloud/preflight"
 )
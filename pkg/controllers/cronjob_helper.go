@@ -17,8 +17,10 @@ limitations under the License.
 package controllers
 
 import (
+	"fmt"
 	"path/filepath"
 
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -27,6 +29,9 @@ const (
 	WorkerContainerName    = "worker"
 	WorkerConfigVolumeName = "config"
 	WorkerConfigMountPath  = "/etc/worker"
+	WorkerBackupVolumeName = "backup"
+	WorkerTLSVolumeName    = "tls"
+	WorkerSpoolVolumeName  = "spool"
 )
 
 var (
@@ -70,3 +75,115 @@ func UpdateCronJobSpec(cronJob *batchv1.CronJob, secretRef *corev1.ObjectReferen
 	podSpec.RestartPolicy = corev1.RestartPolicyOnFailure
 	return nil
 }
+
+// DestinationVolumes returns the volumes and mounts the worker requires to
+// access the destinations
+func DestinationVolumes(dsts []backupv1alpha1.Destination) ([]corev1.Volume, []corev1.VolumeMount) {
+	var (
+		volumes      []corev1.Volume
+		volumeMounts []corev1.VolumeMount
+		claims       = map[string]bool{}
+		mounts       = map[string]bool{}
+		tlsVolumes   int
+	)
+	for _, dst := range dsts {
+		if dst.Volume == nil || claims[dst.Volume.ClaimName] {
+			continue
+		}
+		claims[dst.Volume.ClaimName] = true
+		name := fmt.Sprintf("%s-%d", WorkerBackupVolumeName, len(volumes))
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dst.Volume.ClaimName,
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: dst.Volume.MountPath(),
+		})
+	}
+	// Secrets and ConfigMaps referenced by the TLS options of S3 destinations
+	addTLSVolume := func(mountPath string, source corev1.VolumeSource) {
+		if mounts[mountPath] {
+			return
+		}
+		mounts[mountPath] = true
+		name := fmt.Sprintf("%s-%d", WorkerTLSVolumeName, tlsVolumes)
+		tlsVolumes++
+		volumes = append(volumes, corev1.Volume{Name: name, VolumeSource: source})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		})
+	}
+	for _, dst := range dsts {
+		if dst.S3 == nil {
+			continue
+		}
+		if ref := dst.S3.CABundleRef; ref != nil {
+			if ref.SecretName != "" {
+				addTLSVolume(ref.MountPath(), corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: ref.SecretName},
+				})
+			} else {
+				addTLSVolume(ref.MountPath(), corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: ref.ConfigMapName},
+					},
+				})
+			}
+		}
+		if name := dst.S3.ClientCertificateSecret; name != "" {
+			addTLSVolume(backupv1alpha1.SecretMountPath(name), corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: name},
+			})
+		}
+	}
+	if spool, ok := spoolVolume(dsts); ok {
+		volumes = append(volumes, corev1.Volume{
+			Name:         WorkerSpoolVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: spool},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      WorkerSpoolVolumeName,
+			MountPath: backupv1alpha1.SpoolMountPath,
+		})
+	}
+	return volumes, volumeMounts
+}
+
+// spoolVolume returns the emptyDir uploads of S3 destinations with upload
+// retries are spooled to. Its size limit is the largest limit of these
+// destinations, it is unlimited if any of them has no limit.
+func spoolVolume(dsts []backupv1alpha1.Destination) (*corev1.EmptyDirVolumeSource, bool) {
+	var (
+		spool *corev1.EmptyDirVolumeSource
+		limit = true
+	)
+	for _, dst := range dsts {
+		if dst.S3 == nil || dst.S3.Retry == nil || dst.S3.Retry.UploadRetries <= 0 {
+			continue
+		}
+		if spool == nil {
+			spool = &corev1.EmptyDirVolumeSource{}
+		}
+		size := dst.S3.Retry.SpoolSizeLimit
+		switch {
+		case size == nil:
+			limit = false
+		case spool.SizeLimit == nil || size.Cmp(*spool.SizeLimit) > 0:
+			spool.SizeLimit = size
+		}
+	}
+	if spool == nil {
+		return nil, false
+	}
+	if !limit {
+		spool.SizeLimit = nil
+	}
+	return spool, true
+}
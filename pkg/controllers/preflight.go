@@ -0,0 +1,150 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ref "k8s.io/client-go/tools/reference"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcilePreflight checks the destinations whenever the configuration of
+// the worker changes with a preflight Job and reports the result in the
+// DestinationReady condition
+func (r *BackupPlanReconciler) reconcilePreflight(ctx context.Context, plan backupv1alpha1.BackupPlan, secretRef *corev1.ObjectReference, config []byte, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount) error {
+	spec := plan.GetSpec()
+	status := plan.GetStatus()
+	// The generation cannot be used, as it changes with the status as well
+	sum := sha256.Sum256(config)
+	hash := hex.EncodeToString(sum[:])[:10]
+	if status.Preflight == nil || status.Preflight.ConfigHash != hash {
+		status.Preflight = &backupv1alpha1.PreflightStatus{ConfigHash: hash}
+	} else if c := meta.FindStatusCondition(status.Conditions, backupv1alpha1.DestinationReadyCondition); c != nil && c.Status != metav1.ConditionUnknown {
+		// Finished Jobs are removed after a while, their result is kept
+		return nil
+	}
+
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-preflight-%s", plan.GetName(), hash),
+			Namespace: plan.GetNamespace(),
+			Labels:    preflightLabels(plan),
+		},
+	}
+	err := r.Get(ctx, types.NamespacedName{Namespace: job.Namespace, Name: job.Name}, &job)
+	if apierrors.IsNotFound(err) {
+		if err := controllerutil.SetControllerReference(plan, &job, r.Scheme); err != nil {
+			return err
+		}
+		UpdatePreflightJobSpec(&job.Spec, secretRef,
+			spec.ActiveDeadlineSeconds,
+			r.WorkerImage,
+			spec.Env,
+			volumes,
+			volumeMounts)
+		job.Spec.Template.Spec.ServiceAccountName = spec.ServiceAccountName
+		r.Recorder.Event(plan, corev1.EventTypeNormal, "Info", "Creating preflight Job")
+		if err := r.Create(ctx, &job); err != nil && !apierrors.IsAlreadyExists(err) {
+			r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Creation of preflight Job failed with: %v", err))
+			return err
+		}
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               backupv1alpha1.DestinationReadyCondition,
+			Status:             metav1.ConditionUnknown,
+			ObservedGeneration: plan.GetGeneration(),
+			Reason:             backupv1alpha1.PreflightPendingReason,
+			Message:            fmt.Sprintf("Preflight Job %s is checking the destinations", job.Name),
+		})
+	} else if err != nil {
+		return err
+	}
+	if status.Preflight.Job, err = ref.GetReference(r.Scheme, &job); err != nil {
+		return err
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               backupv1alpha1.DestinationReadyCondition,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: plan.GetGeneration(),
+				Reason:             backupv1alpha1.PreflightSucceededReason,
+				Message:            "All destinations are ready",
+			})
+			r.Recorder.Event(plan, corev1.EventTypeNormal, "DestinationReady", "Preflight check of the destinations succeeded")
+		case batchv1.JobFailed:
+			message, err := r.terminationMessage(ctx, &job)
+			if err != nil {
+				return err
+			}
+			if message == "" {
+				message = c.Message
+			}
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               backupv1alpha1.DestinationReadyCondition,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: plan.GetGeneration(),
+				Reason:             backupv1alpha1.PreflightFailedReason,
+				Message:            message,
+			})
+			r.Recorder.Event(plan, corev1.EventTypeWarning, "DestinationNotReady", fmt.Sprintf("Preflight check of the destinations failed: %s", message))
+		}
+	}
+	return nil
+}
+
+// terminationMessage returns the termination message of the worker of the
+// Job, which contains the failures of the preflight check
+func (r *BackupPlanReconciler) terminationMessage(ctx context.Context, job *batchv1.Job) (string, error) {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name == WorkerContainerName && cs.State.Terminated != nil && cs.State.Terminated.Message != "" {
+				return cs.State.Terminated.Message, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func preflightLabels(plan backupv1alpha1.BackupPlan) map[string]string {
+	return map[string]string{
+		planLabel:      plan.GetName(),
+		planKindLabel:  plan.GetKind(),
+		preflightLabel: "true",
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PreflightTTLSecondsAfterFinished is the time finished preflight Jobs are
+// kept, their result is recorded in the status of the plan
+const PreflightTTLSecondsAfterFinished = int32(3600)
+
+// UpdatePreflightJobSpec sets up a Job checking all destinations of the plan
+// are ready to store backups. Failures are reported in the termination message
+// of the worker.
+func UpdatePreflightJobSpec(jobSpec *batchv1.JobSpec, secretRef *corev1.ObjectReference, activeDeadlineSeconds int64, image string, env []corev1.EnvVar,
+	volumes []corev1.Volume,
+	volumeMounts []corev1.VolumeMount) {
+	backoffLimit := int32(0) // A failed check is a result
+	ttl := PreflightTTLSecondsAfterFinished
+	jobSpec.ActiveDeadlineSeconds = &activeDeadlineSeconds
+	jobSpec.BackoffLimit = &backoffLimit
+	jobSpec.TTLSecondsAfterFinished = &ttl
+	podSpec := &jobSpec.Template.Spec
+
+	podSpec.Volumes = append(volumes, corev1.Volume{
+		Name: WorkerConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretRef.Name,
+			},
+		},
+	})
+
+	podSpec.Containers = []corev1.Container{
+		{
+			Name:            WorkerContainerName,
+			Image:           image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Env:             env,
+			Command:         []string{"/worker"},
+			Args:            []string{"preflight", "--message-file=" + corev1.TerminationMessagePathDefault, WorkerConfigFilePath},
+			VolumeMounts: append(volumeMounts,
+				corev1.VolumeMount{
+					Name:      WorkerConfigVolumeName,
+					MountPath: WorkerConfigMountPath,
+					ReadOnly:  true,
+				}),
+		},
+	}
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+}
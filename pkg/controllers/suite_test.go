@@ -117,6 +117,14 @@ var _ = BeforeSuite(func(done Done) {
 			WorkerImage: workerImage,
 			Type:        &backupv1alpha1.ConsulBackupPlan{},
 		},
+		backupv1alpha1.PluginBackupPlanKind: &BackupPlanReconciler{
+			Client:      k8sClient,
+			Log:         logf.Log.WithName("controllers").WithName("PluginBackupPlan"),
+			Recorder:    &record.FakeRecorder{},
+			Scheme:      scheme.Scheme,
+			WorkerImage: workerImage,
+			Type:        &backupv1alpha1.PluginBackupPlan{},
+		},
 	}
 
 	close(done)
@@ -160,6 +168,8 @@ func mustReconcile(ctx context.Context, obj runtime.Object) ctrl.Result {
 		reconciler = reconcilers[backupv1alpha1.MongoDBBackupPlanKind]
 	} else if _, ok := obj.(*backupv1alpha1.ConsulBackupPlan); ok {
 		reconciler = reconcilers[backupv1alpha1.ConsulBackupPlanKind]
+	} else if _, ok := obj.(*backupv1alpha1.PluginBackupPlan); ok {
+		reconciler = reconcilers[backupv1alpha1.PluginBackupPlanKind]
 	} else {
 		panic("deadcode, otherwise reconciler was not properly registered for test")
 	}
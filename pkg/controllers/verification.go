@@ -0,0 +1,236 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ref "k8s.io/client-go/tools/reference"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reconcileVerification launches restore tests of the plan, either on their
+// own schedule via a CronJob or after every successful backup, and records the
+// result of the latest one in the status
+func (r *BackupPlanReconciler) reconcileVerification(ctx context.Context, plan backupv1alpha1.BackupPlan, secretRef *corev1.ObjectReference, cronJob *batchv1.CronJob, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount) error {
+	spec := plan.GetSpec()
+	status := plan.GetStatus()
+	verification := spec.Verification
+	if verification == nil {
+		if status.Verification != nil {
+			if err := r.deleteVerificationCronJob(ctx, status.Verification); err != nil {
+				return err
+			}
+		}
+		status.Verification = nil
+		return nil
+	}
+	if status.Verification == nil {
+		status.Verification = &backupv1alpha1.VerificationStatus{}
+	}
+	vs := status.Verification
+	labels := verificationLabels(plan)
+
+	if verification.Schedule != "" {
+		var verificationCronJob batchv1.CronJob
+		if vs.CronJob != nil {
+			err := r.Get(ctx, types.NamespacedName{
+				Namespace: vs.CronJob.Namespace,
+				Name:      vs.CronJob.Name,
+			}, &verificationCronJob)
+			if client.IgnoreNotFound(err) != nil {
+				r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Checking owned verification CronJob failed with: %v", err))
+				return err
+			} else if err != nil {
+				vs.CronJob = nil
+			}
+		}
+		if vs.CronJob == nil {
+			verificationCronJob.ObjectMeta.Name = fmt.Sprintf("%s-verification", plan.GetName())
+			verificationCronJob.ObjectMeta.Namespace = plan.GetNamespace()
+			if err := controllerutil.SetControllerReference(plan, &verificationCronJob, r.Scheme); err != nil {
+				return err
+			}
+		}
+		verificationCronJob.Spec.Schedule = verification.Schedule
+		verificationCronJob.Spec.JobTemplate.ObjectMeta.Labels = labels
+		err := UpdateVerificationJobSpec(&verificationCronJob.Spec.JobTemplate.Spec, secretRef, verification,
+			spec.ActiveDeadlineSeconds,
+			r.WorkerImage,
+			spec.Env,
+			plan.GetCmd(),
+			volumes,
+			volumeMounts)
+		if err != nil {
+			return err
+		}
+		verificationCronJob.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName = spec.ServiceAccountName
+		if vs.CronJob != nil {
+			err = r.Update(ctx, &verificationCronJob)
+		} else {
+			r.Recorder.Event(plan, corev1.EventTypeNormal, "Info", "Creating verification CronJob")
+			err = r.Create(ctx, &verificationCronJob)
+		}
+		if err != nil {
+			r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Update or creation of verification CronJob failed with: %v", err))
+			return err
+		}
+		if vs.CronJob, err = ref.GetReference(r.Scheme, &verificationCronJob); err != nil {
+			return err
+		}
+	} else {
+		if err := r.deleteVerificationCronJob(ctx, vs); err != nil {
+			return err
+		}
+		// Verify the backup once after every successful run
+		lastSuccessfulTime := cronJob.Status.LastSuccessfulTime
+		if lastSuccessfulTime != nil && (vs.LastScheduleTime == nil || vs.LastScheduleTime.Before(lastSuccessfulTime)) {
+			job := batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("%s-verification-%d", plan.GetName(), lastSuccessfulTime.Unix()),
+					Namespace: plan.GetNamespace(),
+					Labels:    labels,
+				},
+			}
+			if err := controllerutil.SetControllerReference(plan, &job, r.Scheme); err != nil {
+				return err
+			}
+			err := UpdateVerificationJobSpec(&job.Spec, secretRef, verification,
+				spec.ActiveDeadlineSeconds,
+				r.WorkerImage,
+				spec.Env,
+				plan.GetCmd(),
+				volumes,
+				volumeMounts)
+			if err != nil {
+				return err
+			}
+			job.Spec.Template.Spec.ServiceAccountName = spec.ServiceAccountName
+			r.Recorder.Event(plan, corev1.EventTypeNormal, "Info", "Creating verification Job")
+			if err := r.Create(ctx, &job); err != nil && !apierrors.IsAlreadyExists(err) {
+				r.Recorder.Event(plan, corev1.EventTypeWarning, "Problem", fmt.Sprintf("Creation of verification Job failed with: %v", err))
+				return err
+			}
+			now := metav1.Now()
+			vs.LastScheduleTime = &now
+		}
+	}
+
+	return r.updateVerificationStatus(ctx, plan, labels)
+}
+
+// updateVerificationStatus records the result of the latest verification Job
+func (r *BackupPlanReconciler) updateVerificationStatus(ctx context.Context, plan backupv1alpha1.BackupPlan, labels map[string]string) error {
+	vs := plan.GetStatus().Verification
+	var jobs batchv1.JobList
+	if err := r.List(ctx, &jobs, client.InNamespace(plan.GetNamespace()), client.MatchingLabels(labels)); err != nil {
+		return err
+	}
+	var latest *batchv1.Job
+	for i := range jobs.Items {
+		if latest == nil || latest.CreationTimestamp.Before(&jobs.Items[i].CreationTimestamp) {
+			latest = &jobs.Items[i]
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	jobRef, err := ref.GetReference(r.Scheme, latest)
+	if err != nil {
+		return err
+	}
+	vs.Job = jobRef
+	if vs.LastScheduleTime == nil || vs.LastScheduleTime.Before(&latest.CreationTimestamp) {
+		vs.LastScheduleTime = latest.CreationTimestamp.DeepCopy()
+	}
+	for _, c := range latest.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		result := ""
+		switch c.Type {
+		case batchv1.JobComplete:
+			result = backupv1alpha1.VerificationSucceeded
+		case batchv1.JobFailed:
+			result = backupv1alpha1.VerificationFailed
+		default:
+			continue
+		}
+		completionTime := c.LastTransitionTime
+		if vs.LastCompletionTime != nil && !vs.LastCompletionTime.Before(&completionTime) {
+			break // Already recorded
+		}
+		vs.LastCompletionTime = &completionTime
+		vs.LastResult = result
+		if result == backupv1alpha1.VerificationSucceeded {
+			vs.LastSuccessfulTime = &completionTime
+			r.Recorder.Event(plan, corev1.EventTypeNormal, "Verified", fmt.Sprintf("Restore test %s succeeded", latest.Name))
+		} else {
+			r.Recorder.Event(plan, corev1.EventTypeWarning, "VerificationFailed", fmt.Sprintf("Restore test %s failed: %s", latest.Name, c.Message))
+		}
+	}
+	return nil
+}
+
+func (r *BackupPlanReconciler) deleteVerificationCronJob(ctx context.Context, vs *backupv1alpha1.VerificationStatus) error {
+	if vs.CronJob == nil {
+		return nil
+	}
+	if err := r.Delete(ctx, &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: vs.CronJob.Namespace,
+			Name:      vs.CronJob.Name,
+		},
+	}); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	vs.CronJob = nil
+	return nil
+}
+
+// jobToPlan maps verification and preflight Jobs to the plan they check
+func (r *BackupPlanReconciler) jobToPlan(obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if labels[verificationLabel] != "true" && labels[preflightLabel] != "true" {
+		return nil
+	}
+	if labels[planKindLabel] != r.Type.GetKind() {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: obj.GetNamespace(),
+		Name:      labels[planLabel],
+	}}}
+}
+
+func verificationLabels(plan backupv1alpha1.BackupPlan) map[string]string {
+	return map[string]string{
+		planLabel:         plan.GetName(),
+		planKindLabel:     plan.GetKind(),
+		verificationLabel: "true",
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+
+	backupv1alpha1 "github.com/finleap-connect/backup-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	ScratchContainerName   = "scratch"
+	VerificationVolumeName = "verification"
+	VerificationMountPath  = "/verification"
+)
+
+var (
+	VerificationDoneFilePath = filepath.Join(VerificationMountPath, "done")
+
+	// DefaultScratchCommands start scratch instances listening on localhost
+	DefaultScratchCommands = map[string]string{
+		backupv1alpha1.MongoDBBackupPlanWorkerCommand: "mongod --bind_ip 127.0.0.1",
+		backupv1alpha1.ConsulBackupPlanWorkerCommand:  "consul agent -dev -client 127.0.0.1",
+	}
+)
+
+// UpdateVerificationJobSpec sets up a Job restoring the latest backup into a
+// scratch instance, which runs as sidecar of the worker. The scratch instance
+// is stopped as soon as the worker signals completion via a shared volume.
+func UpdateVerificationJobSpec(jobSpec *batchv1.JobSpec, secretRef *corev1.ObjectReference, verification *backupv1alpha1.Verification, activeDeadlineSeconds int64, image string, env []corev1.EnvVar, subcmd string,
+	volumes []corev1.Volume,
+	volumeMounts []corev1.VolumeMount) error {
+	scratchCommand := verification.Command
+	if scratchCommand == "" {
+		scratchCommand = DefaultScratchCommands[subcmd]
+	}
+	if scratchCommand == "" {
+		return fmt.Errorf("no scratch command for %s", subcmd)
+	}
+	if verification.ActiveDeadlineSeconds > 0 {
+		activeDeadlineSeconds = verification.ActiveDeadlineSeconds
+	}
+	backoffLimit := int32(0) // A failed restore test is a result
+	jobSpec.ActiveDeadlineSeconds = &activeDeadlineSeconds
+	jobSpec.BackoffLimit = &backoffLimit
+	podSpec := &jobSpec.Template.Spec
+
+	podSpec.Volumes = append(volumes,
+		corev1.Volume{
+			Name: WorkerConfigVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: secretRef.Name,
+				},
+			},
+		},
+		corev1.Volume{
+			Name: VerificationVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	)
+
+	verificationMount := corev1.VolumeMount{
+		Name:      VerificationVolumeName,
+		MountPath: VerificationMountPath,
+	}
+	podSpec.Containers = []corev1.Container{
+		{
+			Name:            WorkerContainerName,
+			Image:           image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Env:             env,
+			Command:         []string{"/worker"},
+			Args:            []string{"restore-test", "--done-file=" + VerificationDoneFilePath, subcmd, WorkerConfigFilePath},
+			VolumeMounts: append(volumeMounts,
+				corev1.VolumeMount{
+					Name:      WorkerConfigVolumeName,
+					MountPath: WorkerConfigMountPath,
+					ReadOnly:  true,
+				},
+				verificationMount),
+		},
+		{
+			Name:  ScratchContainerName,
+			Image: verification.Image,
+			Command: []string{"sh", "-c", fmt.Sprintf(
+				"%s & pid=$!; while [ ! -e %s ]; do sleep 1; done; kill $pid; exit 0",
+				scratchCommand, VerificationDoneFilePath)},
+			VolumeMounts: []corev1.VolumeMount{verificationMount},
+		},
+	}
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+	return nil
+}
@@ -32,6 +32,8 @@ type MetricsPublisher interface {
 	StopTimer()
 	SetSuccessfulRun()
 	SetBackupSizeInBytes(sizeInBytes int64)
+	SetDestinationResult(destination string, sizeInBytes int64, successful bool)
+	SetVerificationResult(check string, count int64, successful bool)
 	PublishMetrics()
 }
 
@@ -112,11 +114,27 @@ func NewMetricsPublisher(c *MetricsPublisherConfig) MetricsPublisher {
 			Name: "backup_size_in_bytes",
 			Help: "The size in bytes of the last backup.",
 		}),
+		destinationSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "backup_destination_last_run_successful",
+			Help: "Whether the last backup was stored successfully in the destination.",
+		}, []string{"destination"}),
+		destinationSizeInBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "backup_destination_size_in_bytes",
+			Help: "The size in bytes of the last backup stored in the destination.",
+		}, []string{"destination"}),
+		verificationSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "backup_verification_check_successful",
+			Help: "Whether the check of the last restore test was successful.",
+		}, []string{"check"}),
+		verificationCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "backup_verification_check_count",
+			Help: "The number of documents or keys counted by the check of the last restore test.",
+		}, []string{"check"}),
 		log: logger.WithName("metrics"),
 	}
 
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(p.completionTime, p.duration, p.sizeInBytes, collectors.NewGoCollector())
+	registry.MustRegister(p.completionTime, p.duration, p.sizeInBytes, p.destinationSuccess, p.destinationSizeInBytes, p.verificationSuccess, p.verificationCount, collectors.NewGoCollector())
 
 	pusher := push.New(c.URL, c.Job).Gatherer(registry)
 
@@ -148,6 +166,12 @@ type metricsPublisher struct {
 	duration       prometheus.Gauge
 	sizeInBytes    prometheus.Gauge
 	start          time.Time
+
+	destinationSuccess     *prometheus.GaugeVec
+	destinationSizeInBytes *prometheus.GaugeVec
+
+	verificationSuccess *prometheus.GaugeVec
+	verificationCount   *prometheus.GaugeVec
 }
 
 func (m *metricsPublisher) StartTimer() {
@@ -168,6 +192,24 @@ func (m *metricsPublisher) SetBackupSizeInBytes(sizeInBytes int64) {
 	m.sizeInBytes.Set(float64(sizeInBytes))
 }
 
+func (m *metricsPublisher) SetDestinationResult(destination string, sizeInBytes int64, successful bool) {
+	success := 0.0
+	if successful {
+		success = 1.0
+	}
+	m.destinationSuccess.WithLabelValues(destination).Set(success)
+	m.destinationSizeInBytes.WithLabelValues(destination).Set(float64(sizeInBytes))
+}
+
+func (m *metricsPublisher) SetVerificationResult(check string, count int64, successful bool) {
+	success := 0.0
+	if successful {
+		success = 1.0
+	}
+	m.verificationSuccess.WithLabelValues(check).Set(success)
+	m.verificationCount.WithLabelValues(check).Set(float64(count))
+}
+
 func (m *metricsPublisher) PublishMetrics() {
 	err := m.pusher.Add()
 	if err != nil { // TODO: should we error for real?
@@ -192,5 +234,11 @@ func (n nopMetricsPublisher) SetSuccessfulRun() {
 func (n nopMetricsPublisher) SetBackupSizeInBytes(_ int64) {
 }
 
+func (n nopMetricsPublisher) SetDestinationResult(_ string, _ int64, _ bool) {
+}
+
+func (n nopMetricsPublisher) SetVerificationResult(_ string, _ int64, _ bool) {
+}
+
 func (n nopMetricsPublisher) PublishMetrics() {
 }
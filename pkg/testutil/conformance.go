@@ -0,0 +1,313 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	conformanceLargeSize = 12*1024*1024 + 123 // Spans several parts of multipart uploads
+	conformanceTimeout   = time.Minute
+)
+
+// ConformanceTarget is a destination checked by DestinationConformance
+// together with a way to read back what it stored
+type ConformanceTarget struct {
+	Destination backup.Destination
+	// Source returns a source streaming the object stored with the given ID.
+	// It may fail or return a failing source for missing objects.
+	Source func(id string) (backup.Source, error)
+	// Leftovers returns incomplete uploads, temporary files and the like left
+	// behind by the destination, if set
+	Leftovers func() []string
+	// Metadata is set if the destination persists the metadata of objects
+	Metadata bool
+	// Resolution of the timestamps of stored backups, defaults to 10ms
+	Resolution time.Duration
+	// Close releases the target, if set
+	Close func()
+}
+
+// DestinationConformance declares the specs every destination and source
+// pair must pass. newTarget is called before every spec and returns an empty
+// destination. Specs for optional features the destination does not
+// implement are skipped.
+func DestinationConformance(newTarget func() (*ConformanceTarget, error)) {
+	var (
+		target *ConformanceTarget
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	BeforeEach(func() {
+		var err error
+		target, err = newTarget()
+		Expect(err).ToNot(HaveOccurred())
+		if target.Resolution == 0 {
+			target.Resolution = 10 * time.Millisecond
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), conformanceTimeout)
+	})
+	AfterEach(func() {
+		cancel()
+		if target.Close != nil {
+			target.Close()
+		}
+	})
+
+	store := func(id string, data io.Reader, metadata map[string]string) (int64, error) {
+		return target.Destination.Store(ctx, backup.Object{ID: id, Data: data, Metadata: metadata})
+	}
+	expectStored := func(id string, seed int64, size int) *readBack {
+		res, err := readBackObject(ctx, target, id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.size).To(Equal(int64(size)))
+		Expect(res.sha256).To(Equal(conformanceChecksum(seed, size)), "data of %s differs", id)
+		return res
+	}
+	expectMissing := func(id string) {
+		_, err := readBackObject(ctx, target, id)
+		Expect(err).To(HaveOccurred(), "%s must not be stored", id)
+		if lister, ok := target.Destination.(backup.Lister); ok {
+			ids, err := lister.List(ctx)
+			if err == nil {
+				for _, stored := range ids {
+					Expect(stored).ToNot(HaveSuffix(id))
+				}
+			}
+		}
+		if target.Leftovers != nil {
+			Expect(target.Leftovers()).To(BeEmpty())
+		}
+	}
+
+	It("stores large streams", func() {
+		written, err := store("large", conformanceData(1, conformanceLargeSize), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(Equal(int64(conformanceLargeSize)))
+		expectStored("large", 1, conformanceLargeSize)
+	})
+	It("stores empty streams", func() {
+		written, err := store("empty", conformanceData(2, 0), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeZero())
+		expectStored("empty", 2, 0)
+	})
+	It("overwrites objects stored with the same ID", func() {
+		_, err := store("object", conformanceData(3, 1024), nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = store("object", conformanceData(4, 2048), nil)
+		Expect(err).ToNot(HaveOccurred())
+		expectStored("object", 4, 2048)
+	})
+	for _, failAt := range []int{1024, conformanceLargeSize / 2} {
+		failAt := failAt
+		It(fmt.Sprintf("stores nothing if the reader fails after %d bytes", failAt), func() {
+			failure := errors.New("reader failed")
+			data := io.MultiReader(conformanceData(5, failAt), &failingReader{err: failure})
+			_, err := store("failed", data, nil)
+			Expect(err).To(HaveOccurred())
+			expectMissing("failed")
+		})
+	}
+	It("stores concurrently", func() {
+		const n, size = 8, 256 * 1024
+		var wg sync.WaitGroup
+		errs := make([]error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				_, errs[i] = store(fmt.Sprintf("concurrent-%d", i), conformanceData(int64(10+i), size), nil)
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < n; i++ {
+			Expect(errs[i]).ToNot(HaveOccurred())
+			expectStored(fmt.Sprintf("concurrent-%d", i), int64(10+i), size)
+		}
+	})
+	It("removes the oldest backups on retention", func() {
+		retention, ok := target.Destination.(backup.RetentionDestination)
+		lister, isLister := target.Destination.(backup.Lister)
+		if !ok || !isLister {
+			Skip("destination does not support retention")
+		}
+		// Not matching the pattern, so never removed
+		_, err := store("other", conformanceData(20, 16), nil)
+		Expect(err).ToNot(HaveOccurred())
+		manifests := backup.NewManifestDestination(target.Destination, backup.ManifestInfo{})
+		ids := make([]string, 4)
+		for i := range ids {
+			time.Sleep(target.Resolution)
+			ids[i] = backup.NewID(time.Date(2020, 1, 1, i, 0, 0, 0, time.UTC), "")
+			_, err := manifests.Store(ctx, backup.Object{ID: ids[i], Data: conformanceData(int64(21+i), 1024)})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		policy := backup.KeepLast(2)
+		policy.Pattern = backup.IDPattern
+		policy.Require = ids[3]
+		Expect(retention.EnsureRetention(ctx, policy)).To(Succeed())
+
+		stored, err := lister.List(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(HaveLen(3))
+		for i, id := range []string{ids[3], ids[2], "other"} {
+			Expect(stored[i]).To(HaveSuffix(id))
+		}
+		expectStored(ids[2], 23, 1024)
+		for _, id := range ids[:2] {
+			expectMissing(id)
+			expectMissing(backup.ManifestID(id))
+		}
+	})
+	It("lists only objects of committed sessions", func() {
+		lister, ok := target.Destination.(backup.Lister)
+		if !ok {
+			Skip("destination does not list backups")
+		}
+		committed, err := backup.Begin(ctx, target.Destination, "20200101000000-committed")
+		if errors.Is(err, backup.ErrNoSessions) {
+			Skip("destination does not support sessions")
+		}
+		Expect(err).ToNot(HaveOccurred())
+		_, err = committed.Store(ctx, backup.Object{ID: "kept", Data: conformanceData(50, 64)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(committed.Commit(ctx)).To(Succeed())
+		pending, err := backup.Begin(ctx, target.Destination, "20200102000000-pending")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = pending.Store(ctx, backup.Object{ID: "pending", Data: conformanceData(51, 64)})
+		Expect(err).ToNot(HaveOccurred())
+
+		ids, err := lister.List(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(ConsistOf(HaveSuffix("kept")))
+		Expect(pending.Abort(ctx)).To(Succeed())
+		ids, err = lister.List(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(ConsistOf(HaveSuffix("kept")))
+	})
+	It("keeps the metadata of objects", func() {
+		if !target.Metadata {
+			Skip("destination does not persist metadata")
+		}
+		info := backup.ObjectInfo{
+			ContentType: "application/x-conformance",
+			SourceType:  "conformance",
+			Labels:      map[string]string{"team": "backup"},
+		}
+		_, err := store("metadata", conformanceData(30, 64), info.Metadata())
+		Expect(err).ToNot(HaveOccurred())
+		res := expectStored("metadata", 30, 64)
+		for k, v := range info.Metadata() {
+			Expect(res.metadata).To(HaveKeyWithValue(k, v))
+		}
+	})
+	It("stops storing on cancellation", func() {
+		storeCtx, storeCancel := context.WithCancel(ctx)
+		defer storeCancel()
+		errc := make(chan error, 1)
+		go func() {
+			// Like a source, which stalls after producing some data
+			_, err := backup.Pipe(storeCtx, target.Destination, backup.Object{ID: "cancelled"}, func(w io.Writer) error {
+				if _, err := io.Copy(w, conformanceData(40, 1024)); err != nil {
+					return err
+				}
+				<-storeCtx.Done()
+				return storeCtx.Err()
+			})
+			errc <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		storeCancel()
+		Eventually(errc, 10*time.Second).Should(Receive(HaveOccurred()))
+		expectMissing("cancelled")
+	})
+}
+
+// conformanceData returns size bytes of pseudo random data determined by seed
+func conformanceData(seed int64, size int) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), int64(size))
+}
+
+func conformanceChecksum(seed int64, size int) [sha256.Size]byte {
+	h := sha256.New()
+	_, _ = io.Copy(h, conformanceData(seed, size))
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+// readBack is an object as streamed by the source of a target
+type readBack struct {
+	size     int64
+	sha256   [sha256.Size]byte
+	metadata map[string]string
+}
+
+func readBackObject(ctx context.Context, target *ConformanceTarget, id string) (*readBack, error) {
+	src, err := target.Source(id)
+	if err != nil {
+		return nil, err
+	}
+	dst := &readBackDestination{}
+	if _, err := src.Stream(ctx, dst); err != nil {
+		return nil, err
+	}
+	if dst.res == nil {
+		return nil, fmt.Errorf("source streamed no object for %s", id)
+	}
+	return dst.res, nil
+}
+
+// readBackDestination records the checksum and metadata of the object it
+// stores
+type readBackDestination struct {
+	res *readBack
+}
+
+func (r *readBackDestination) Store(ctx context.Context, obj backup.Object) (int64, error) {
+	h := sha256.New()
+	written, err := io.Copy(h, obj.Data)
+	if err != nil {
+		return written, err
+	}
+	r.res = &readBack{size: written, metadata: obj.Metadata}
+	copy(r.res.sha256[:], h.Sum(nil))
+	return written, nil
+}
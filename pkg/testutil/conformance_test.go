@@ -0,0 +1,179 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/backup"
+	"github.com/finleap-connect/backup-operator/pkg/backup/fs"
+	"github.com/finleap-connect/backup-operator/pkg/backup/mem"
+	"github.com/finleap-connect/backup-operator/pkg/backup/s3"
+	"github.com/finleap-connect/backup-operator/pkg/backup/sftp"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Destination conformance", func() {
+	Context("mem", func() {
+		testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+			dst, err := mem.NewBufferDestination()
+			if err != nil {
+				return nil, err
+			}
+			return &testutil.ConformanceTarget{
+				Destination: dst,
+				Source: func(id string) (backup.Source, error) {
+					data, ok := dst.Data[id]
+					if !ok {
+						return nil, fmt.Errorf("%s not found", id)
+					}
+					return mem.NewBufferSource(id, data)
+				},
+			}, nil
+		})
+	})
+	Context("fs", func() {
+		testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+			dir, err := ioutil.TempDir("", "conformance")
+			if err != nil {
+				return nil, err
+			}
+			dst, err := fs.NewDirDestination(dir)
+			if err != nil {
+				return nil, err
+			}
+			return &testutil.ConformanceTarget{
+				Destination: dst,
+				Source: func(id string) (backup.Source, error) {
+					return fs.NewFileSource(filepath.Join(dir, id))
+				},
+				Leftovers: func() []string {
+					hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+					return hidden
+				},
+				Close: func() {
+					_ = os.RemoveAll(dir)
+				},
+			}, nil
+		})
+	})
+	Context("sftp", func() {
+		testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+			server, err := testutil.NewSFTPServer()
+			if err != nil {
+				return nil, err
+			}
+			dir, err := ioutil.TempDir("", "conformance")
+			if err != nil {
+				return nil, err
+			}
+			const prefix = "namespace/plan"
+			conf := sftp.SFTPConf{
+				Host:       server.Addr,
+				User:       server.User,
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+				Directory:  dir,
+			}
+			dst, err := sftp.NewSFTPDestination(&sftp.SFTPDestinationConf{SFTPConf: conf, Prefix: prefix})
+			if err != nil {
+				return nil, err
+			}
+			var sources []*sftp.SFTPSource
+			return &testutil.ConformanceTarget{
+				Destination: dst,
+				Source: func(id string) (backup.Source, error) {
+					src, err := sftp.NewSFTPSource(&sftp.SFTPSourceConf{SFTPConf: conf, Key: path.Join(prefix, id)})
+					if err == nil {
+						sources = append(sources, src)
+					}
+					return src, err
+				},
+				Leftovers: func() []string {
+					parts, _ := filepath.Glob(filepath.Join(dir, prefix, ".*.part"))
+					runParts, _ := filepath.Glob(filepath.Join(dir, prefix, "*", ".*.part"))
+					return append(parts, runParts...)
+				},
+				Resolution: time.Second,
+				Close: func() {
+					for _, src := range sources {
+						_ = src.Close()
+					}
+					_ = dst.Close()
+					_ = server.Close()
+					_ = os.RemoveAll(dir)
+				},
+			}, nil
+		})
+	})
+	for _, layout := range []s3.Layout{s3.LayoutV1, s3.LayoutV2} {
+		layout := layout
+		Context(fmt.Sprintf("s3 with layout %s", layout), func() {
+			testutil.DestinationConformance(func() (*testutil.ConformanceTarget, error) {
+				server, err := testutil.NewS3Server()
+				if err != nil {
+					return nil, err
+				}
+				const bucket, prefix = "backups", "namespace/plan/"
+				dst, err := s3.NewS3Destination(&s3.S3DestinationConf{
+					Endpoint:     server.Endpoint,
+					AccessKey:    server.AccessKeyID,
+					SecretKey:    server.SecretAccessKey,
+					DisableSSL:   true,
+					Bucket:       bucket,
+					CreateBucket: true,
+					Prefix:       prefix,
+					PartSize:     server.MinPartSize,
+					Layout:       layout,
+				})
+				if err != nil {
+					return nil, err
+				}
+				return &testutil.ConformanceTarget{
+					Destination: dst,
+					Source: func(id string) (backup.Source, error) {
+						return s3.NewS3Source(&s3.S3SourceConf{
+							Endpoint:   server.Endpoint,
+							AccessKey:  server.AccessKeyID,
+							SecretKey:  server.SecretAccessKey,
+							DisableSSL: true,
+							Bucket:     bucket,
+							Key:        prefix + strings.TrimPrefix(path.Join(dst.Run, id), "/"),
+							// Conformance objects are stored without checksum
+							AllowUnverified: true,
+						})
+					},
+					Leftovers: func() []string {
+						return server.Uploads(bucket)
+					},
+					Metadata: true,
+					Close: func() {
+						_ = server.Close()
+					},
+				}, nil
+			})
+		})
+	}
+})
@@ -0,0 +1,305 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+// ConsulServer is an in-process HTTP server implementing the snapshot, key
+// value, agent and status endpoints of the Consul API used by the consul
+// source and destination. Snapshots are gzipped tar archives with a manifest
+// and checksums like the ones of Consul, but contain the key value store only.
+type ConsulServer struct {
+	Address  string // host:port
+	Version  string // Reported by the agent
+	Username string // Requests must use basic auth if set
+	Password string
+
+	server *httptest.Server
+	mu     sync.Mutex
+	kv     map[string][]byte
+	index  uint64
+	log    logger.Logger
+}
+
+// consulSnapshotMeta is stored as meta.json in snapshots
+type consulSnapshotMeta struct {
+	ID      string
+	Index   uint64
+	Term    uint64
+	Version int
+}
+
+type consulKVPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+}
+
+func NewConsulServer() (*ConsulServer, error) {
+	s := &ConsulServer{
+		Version: "1.7.0",
+		kv:      map[string][]byte{},
+		index:   1,
+		log:     logger.WithName("consulserver"),
+	}
+	s.server = httptest.NewServer(s)
+	s.Address = strings.TrimPrefix(s.server.URL, "http://")
+	return s, nil
+}
+
+func (s *ConsulServer) Close() error {
+	s.server.Close()
+	return nil
+}
+
+// Put stores the value at key
+func (s *ConsulServer) Put(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[key] = append([]byte{}, value...)
+	s.index++
+}
+
+// Get returns the value stored at key
+func (s *ConsulServer) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.kv[key]
+	return append([]byte{}, value...), ok
+}
+
+// Keys returns all keys in lexical order
+func (s *ConsulServer) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys("")
+}
+
+func (s *ConsulServer) keys(prefix string) []string {
+	keys := []string{}
+	for k := range s.kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *ConsulServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Username != "" {
+		if user, password, ok := r.BasicAuth(); !ok || user != s.Username || password != s.Password {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+
+	var err error
+	status := http.StatusInternalServerError
+	switch path := r.URL.Path; {
+	case path == "/v1/snapshot" && r.Method == http.MethodGet:
+		err = s.save(w)
+	case path == "/v1/snapshot" && r.Method == http.MethodPut:
+		err = s.restore(r.Body)
+	case path == "/v1/agent/self" && r.Method == http.MethodGet:
+		err = writeJSON(w, map[string]map[string]interface{}{
+			"Config": {"Version": s.Version, "Datacenter": "dc1"},
+			"Member": {"Name": "consul"},
+		})
+	case path == "/v1/status/leader" && r.Method == http.MethodGet:
+		err = writeJSON(w, "127.0.0.1:8300")
+	case strings.HasPrefix(path, "/v1/kv/"):
+		status, err = s.serveKV(w, r, strings.TrimPrefix(path, "/v1/kv/"))
+	default:
+		status, err = http.StatusNotFound, fmt.Errorf("unsupported request %s %s", r.Method, path)
+	}
+	if err != nil {
+		s.log.Info("request failed", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (s *ConsulServer) serveKV(w http.ResponseWriter, r *http.Request, key string) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		keys := []string{key}
+		if _, ok := r.URL.Query()["recurse"]; ok {
+			keys = s.keys(key)
+		}
+		pairs := []consulKVPair{}
+		for _, k := range keys {
+			if value, ok := s.kv[k]; ok {
+				pairs = append(pairs, consulKVPair{Key: k, Value: value, CreateIndex: s.index, ModifyIndex: s.index})
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return 0, nil
+		}
+		return 0, writeJSON(w, pairs)
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		s.kv[key] = value
+		s.index++
+		return 0, writeJSON(w, true)
+	case http.MethodDelete:
+		delete(s.kv, key)
+		s.index++
+		return 0, writeJSON(w, true)
+	}
+	return http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method)
+}
+
+// save writes a snapshot of the key value store
+func (s *ConsulServer) save(w http.ResponseWriter) error {
+	meta, err := json.Marshal(consulSnapshotMeta{
+		ID:      fmt.Sprintf("1-%d-%d", s.index, time.Now().UnixNano()/int64(time.Millisecond)),
+		Index:   s.index,
+		Term:    1,
+		Version: 1,
+	})
+	if err != nil {
+		return err
+	}
+	pairs := []consulKVPair{}
+	for _, k := range s.keys("") {
+		pairs = append(pairs, consulKVPair{Key: k, Value: s.kv[k], CreateIndex: s.index, ModifyIndex: s.index})
+	}
+	state, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	sums := fmt.Sprintf("%s  meta.json\n%s  state.bin\n", sha256Hex(meta), sha256Hex(state))
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"meta.json", meta}, {"state.bin", state}, {"SHA256SUMS", []byte(sums)}} {
+		if err := archive.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: time.Now()}); err != nil {
+			return err
+		}
+		if _, err := archive.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// restore replaces the key value store with the one of the snapshot after
+// verifying its checksums
+func (s *ConsulServer) restore(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	archive := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		if files[header.Name], err = ioutil.ReadAll(archive); err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+	}
+	sums, ok := files["SHA256SUMS"]
+	if !ok {
+		return fmt.Errorf("failed to read snapshot: missing SHA256SUMS")
+	}
+	verified := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		data, ok := files[fields[1]]
+		if !ok || sha256Hex(data) != fields[0] {
+			return fmt.Errorf("failed to read snapshot: checksum of %s does not match", fields[1])
+		}
+		verified[fields[1]] = true
+	}
+	if !verified["meta.json"] || !verified["state.bin"] {
+		return fmt.Errorf("failed to read snapshot: missing meta.json or state.bin")
+	}
+	var pairs []consulKVPair
+	if err := json.Unmarshal(files["state.bin"], &pairs); err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	s.kv = map[string][]byte{}
+	for _, p := range pairs {
+		s.kv[p.Key] = p.Value
+	}
+	s.index++
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// DockerEnv has to be set to 1 to run tests against containers, e.g. of MinIO
+// and Consul, which are replaced by in-process servers otherwise
+const DockerEnv = "BACKUP_TEST_DOCKER"
+
+// SkipWithoutDocker skips the current spec unless DockerEnv is set
+func SkipWithoutDocker() {
+	if os.Getenv(DockerEnv) != "1" {
+		Skip(fmt.Sprintf("set %s=1 to run tests against containers", DockerEnv))
+	}
+}
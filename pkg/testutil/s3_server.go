@@ -0,0 +1,1104 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// S3Server is an in-process HTTP server implementing the subset of the S3 API
+// used by the S3 source and destination with path style requests: buckets,
+// objects with user metadata, tags, storage classes, server side encryption
+// including SSE-C, object lock, ranged reads, copies, listings and multipart
+// uploads. Signatures are not verified, only the access key they are made
+// with. Buckets with object lock have versioning enabled, but only keep the
+// latest version of every object, deleting objects hides them like a delete
+// marker does.
+type S3Server struct {
+	Endpoint        string // host:port, use with DisableSSL unless started with TLS
+	AccessKeyID     string
+	SecretAccessKey string
+	MinPartSize     int64  // Minimum size of all but the last part of multipart uploads
+	CABundle        string // PEM encoded certificate of servers started with TLS
+	// Requests fail with 500 InternalError without being served, if it returns
+	// true. Called concurrently.
+	Fail func(r *http.Request) bool
+
+	server       *httptest.Server
+	mu           sync.Mutex
+	buckets      map[string]*s3Bucket
+	uploads      map[string]*s3Upload
+	lastModified time.Time
+	log          logger.Logger
+}
+
+type s3Bucket struct {
+	created    time.Time
+	objectLock bool
+	objects    map[string]*s3Object
+}
+
+type s3Object struct {
+	data           []byte
+	etag           string
+	contentType    string
+	metadata       map[string]string // Lower case keys without the x-amz-meta- prefix
+	tagging        url.Values
+	storageClass   string
+	sse            string
+	kmsKeyID       string
+	customerKeyMD5 string // Base64 encoded MD5 of the SSE-C key
+	lockMode       string
+	retainUntil    time.Time
+	legalHold      string
+	lastModified   time.Time
+}
+
+type s3Upload struct {
+	bucket    string
+	key       string
+	object    *s3Object // Headers given on initiation
+	parts     map[int]*s3Object
+	initiated time.Time
+}
+
+// s3Error is an error response of the API
+type s3Error struct {
+	status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newS3Error(status int, code, format string, args ...interface{}) *s3Error {
+	return &s3Error{status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// NewS3Server starts a server accepting plain HTTP. Requests with SSE-C keys
+// are rejected like S3 does.
+func NewS3Server() (*S3Server, error) {
+	s := newS3Server()
+	s.server = httptest.NewServer(s)
+	s.Endpoint = strings.TrimPrefix(s.server.URL, "http://")
+	return s, nil
+}
+
+// NewS3TLSServer starts a server accepting HTTPS with a self-signed
+// certificate
+func NewS3TLSServer() (*S3Server, error) {
+	s := newS3Server()
+	s.server = httptest.NewTLSServer(s)
+	s.Endpoint = strings.TrimPrefix(s.server.URL, "https://")
+	s.CABundle = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw}))
+	return s, nil
+}
+
+func newS3Server() *S3Server {
+	return &S3Server{
+		AccessKeyID:     "backup",
+		SecretAccessKey: "backup-secret",
+		MinPartSize:     5 * 1024 * 1024,
+		buckets:         map[string]*s3Bucket{},
+		uploads:         map[string]*s3Upload{},
+		log:             logger.WithName("s3server"),
+	}
+}
+
+func (s *S3Server) Close() error {
+	s.server.Close()
+	return nil
+}
+
+// URL returns the endpoint including its scheme
+func (s *S3Server) URL() string {
+	return s.server.URL
+}
+
+// CreateBucket creates the bucket unless it exists
+func (s *S3Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[name] == nil {
+		s.buckets[name] = &s3Bucket{created: s.now(), objects: map[string]*s3Object{}}
+	}
+}
+
+// Keys returns the keys of all objects in the bucket in lexical order
+func (s *S3Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	if b == nil {
+		return nil
+	}
+	return b.keys()
+}
+
+// Object returns the data and user metadata of an object
+func (s *S3Server) Object(bucket, key string) ([]byte, map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	if b == nil || b.objects[key] == nil {
+		return nil, nil, false
+	}
+	obj := b.objects[key]
+	metadata := make(map[string]string, len(obj.metadata))
+	for k, v := range obj.metadata {
+		metadata[k] = v
+	}
+	return append([]byte{}, obj.data...), metadata, true
+}
+
+// Uploads returns the keys of all multipart uploads in the bucket, which have
+// been neither completed nor aborted
+func (s *S3Server) Uploads(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for _, u := range s.uploads {
+		if u.bucket == bucket {
+			keys = append(keys, u.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *s3Bucket) keys() []string {
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// now returns a strictly increasing time with the millisecond resolution of
+// listings, so objects can be ordered by their modification time
+func (s *S3Server) now() time.Time {
+	t := time.Now().UTC().Truncate(time.Millisecond)
+	if !t.After(s.lastModified) {
+		t = s.lastModified.Add(time.Millisecond)
+	}
+	s.lastModified = t
+	return t
+}
+
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := newS3Error(http.StatusInternalServerError, "InternalError", "injected failure")
+	if s.Fail == nil || !s.Fail(r) {
+		err = s.serve(w, r)
+	}
+	if err != nil {
+		s.log.Info("request failed", "method", r.Method, "path", r.URL.Path, "code", err.Code)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(err.status)
+		if r.Method != http.MethodHead {
+			_ = xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name `xml:"Error"`
+				*s3Error
+			}{s3Error: err})
+		}
+	}
+}
+
+func (s *S3Server) serve(w http.ResponseWriter, r *http.Request) *s3Error {
+	if err := s.authenticate(r); err != nil {
+		return err
+	}
+	bucket, key := r.URL.Path, ""
+	bucket = strings.TrimPrefix(bucket, "/")
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		return s.listBuckets(w)
+	case bucket == "":
+		return newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed", r.Method)
+	case key == "":
+		return s.serveBucket(w, r, bucket)
+	}
+	b := s.buckets[bucket]
+	if b == nil {
+		return newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", bucket)
+	}
+	return s.serveObject(w, r, b, bucket, key)
+}
+
+// authenticate checks the access key of the signature in the header or the
+// query of presigned requests
+func (s *S3Server) authenticate(r *http.Request) *s3Error {
+	credential := r.URL.Query().Get("X-Amz-Credential")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if i := strings.Index(auth, "Credential="); i >= 0 {
+			credential = auth[i+len("Credential="):]
+		}
+	}
+	if credential == "" {
+		return newS3Error(http.StatusForbidden, "AccessDenied", "anonymous access is not allowed")
+	}
+	if accessKeyID := strings.SplitN(credential, "/", 2)[0]; accessKeyID != s.AccessKeyID {
+		return newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "access key %s does not exist", accessKeyID)
+	}
+	return nil
+}
+
+func (s *S3Server) serveBucket(w http.ResponseWriter, r *http.Request, name string) *s3Error {
+	b := s.buckets[name]
+	if r.Method == http.MethodPut {
+		if b != nil {
+			return newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "bucket %s already exists", name)
+		}
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		s.buckets[name] = &s3Bucket{
+			created:    s.now(),
+			objectLock: r.Header.Get("X-Amz-Bucket-Object-Lock-Enabled") == "true",
+			objects:    map[string]*s3Object{},
+		}
+		w.Header().Set("Location", "/"+name)
+		return nil
+	}
+	if b == nil {
+		return newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", name)
+	}
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodHead:
+		return nil
+	case http.MethodDelete:
+		if len(b.objects) > 0 {
+			return newS3Error(http.StatusConflict, "BucketNotEmpty", "bucket %s is not empty", name)
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodGet:
+		if _, ok := query["uploads"]; ok {
+			return s.listUploads(w, name)
+		}
+		if _, ok := query["versioning"]; ok {
+			status := ""
+			if b.objectLock {
+				status = "Enabled"
+			}
+			return writeXML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"VersioningConfiguration"`
+				Xmlns   string   `xml:"xmlns,attr"`
+				Status  string   `xml:"Status,omitempty"`
+			}{Xmlns: s3Namespace, Status: status})
+		}
+		if _, ok := query["object-lock"]; ok {
+			if !b.objectLock {
+				return newS3Error(http.StatusNotFound, "ObjectLockConfigurationNotFoundError", "object lock configuration does not exist for bucket %s", name)
+			}
+			return writeXML(w, http.StatusOK, struct {
+				XMLName           xml.Name `xml:"ObjectLockConfiguration"`
+				Xmlns             string   `xml:"xmlns,attr"`
+				ObjectLockEnabled string   `xml:"ObjectLockEnabled"`
+			}{Xmlns: s3Namespace, ObjectLockEnabled: "Enabled"})
+		}
+		if _, ok := query["location"]; ok {
+			return writeXML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		}
+		for sub := range query {
+			if !listParameters[sub] {
+				return newS3Error(http.StatusNotImplemented, "NotImplemented", "%s is not implemented", sub)
+			}
+		}
+		return s.listObjects(w, query, name, b)
+	}
+	return newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed", r.Method)
+}
+
+var listParameters = map[string]bool{
+	"prefix": true, "delimiter": true, "marker": true, "max-keys": true, "encoding-type": true,
+	"list-type": true, "continuation-token": true, "start-after": true, "fetch-owner": true,
+}
+
+func (s *S3Server) serveObject(w http.ResponseWriter, r *http.Request, b *s3Bucket, bucket, key string) *s3Error {
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch r.Method {
+	case http.MethodPut:
+		if uploadID != "" && r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.uploadPartCopy(w, r, uploadID, query.Get("partNumber"))
+		}
+		if uploadID != "" {
+			return s.uploadPart(w, r, uploadID, query.Get("partNumber"))
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r, b, key)
+		}
+		obj, err := objectHeaders(r, b)
+		if err != nil {
+			return err
+		}
+		if err := readBody(r, obj); err != nil {
+			return err
+		}
+		obj.lastModified = s.now()
+		b.objects[key] = obj
+		writeEncryption(w, obj)
+		w.Header().Set("ETag", obj.etag)
+		return nil
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" && r.Method == http.MethodGet {
+			return s.listParts(w, bucket, key, uploadID)
+		}
+		obj := b.objects[key]
+		if obj == nil {
+			return newS3Error(http.StatusNotFound, "NoSuchKey", "key %s does not exist", key)
+		}
+		if _, ok := query["tagging"]; ok {
+			return writeTagging(w, obj)
+		}
+		keyMD5, err := customerKey(r, "X-Amz-Server-Side-Encryption-Customer")
+		if err != nil {
+			return err
+		}
+		if err := checkCustomerKey(obj, keyMD5); err != nil {
+			return err
+		}
+		return writeObject(w, r, obj)
+	case http.MethodDelete:
+		if uploadID != "" {
+			if u := s.uploads[uploadID]; u == nil || u.bucket != bucket || u.key != key {
+				return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+			}
+			delete(s.uploads, uploadID)
+		} else {
+			delete(b.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPost:
+		if _, ok := query["uploads"]; ok {
+			return s.initiateUpload(w, r, b, bucket, key)
+		}
+		if uploadID != "" {
+			return s.completeUpload(w, r, b, uploadID)
+		}
+	}
+	return newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed", r.Method)
+}
+
+// readBody reads the body of a request storing data into obj
+func readBody(r *http.Request, obj *s3Object) *s3Error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return newS3Error(http.StatusBadRequest, "IncompleteBody", "failed to read body: %v", err)
+	}
+	if r.ContentLength >= 0 && int64(len(data)) != r.ContentLength {
+		return newS3Error(http.StatusBadRequest, "IncompleteBody", "expected %d bytes, got %d", r.ContentLength, len(data))
+	}
+	sum := md5.Sum(data)
+	if expected := r.Header.Get("Content-MD5"); expected != "" && expected != base64.StdEncoding.EncodeToString(sum[:]) {
+		return newS3Error(http.StatusBadRequest, "BadDigest", "Content-MD5 does not match the body")
+	}
+	if expected := r.Header.Get("X-Amz-Content-Sha256"); len(expected) == sha256.Size*2 {
+		if digest := sha256.Sum256(data); expected != hex.EncodeToString(digest[:]) {
+			return newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "x-amz-content-sha256 does not match the body")
+		}
+	}
+	obj.data = data
+	obj.etag = `"` + hex.EncodeToString(sum[:]) + `"`
+	return nil
+}
+
+// objectHeaders returns an object with the properties given in the headers
+// of a request storing it in b
+func objectHeaders(r *http.Request, b *s3Bucket) (*s3Object, *s3Error) {
+	header := r.Header
+	obj := &s3Object{
+		contentType:  header.Get("Content-Type"),
+		metadata:     map[string]string{},
+		storageClass: header.Get("X-Amz-Storage-Class"),
+		sse:          header.Get("X-Amz-Server-Side-Encryption"),
+		kmsKeyID:     header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+		lockMode:     header.Get("X-Amz-Object-Lock-Mode"),
+		legalHold:    header.Get("X-Amz-Object-Lock-Legal-Hold"),
+	}
+	for k, v := range header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-meta-") && len(v) > 0 {
+			obj.metadata[strings.TrimPrefix(name, "x-amz-meta-")] = v[0]
+		}
+	}
+	var err error
+	if obj.tagging, err = url.ParseQuery(header.Get("X-Amz-Tagging")); err != nil {
+		return nil, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid tagging: %v", err)
+	}
+	switch obj.storageClass {
+	case "":
+		obj.storageClass = "STANDARD"
+	case "STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER", "DEEP_ARCHIVE", "GLACIER_IR":
+	default:
+		return nil, newS3Error(http.StatusBadRequest, "InvalidStorageClass", "invalid storage class %s", obj.storageClass)
+	}
+	if serr := objectEncryption(r, obj); serr != nil {
+		return nil, serr
+	}
+	if serr := objectLock(header, b, obj); serr != nil {
+		return nil, serr
+	}
+	return obj, nil
+}
+
+// objectEncryption validates and sets the server side encryption of obj
+func objectEncryption(r *http.Request, obj *s3Object) *s3Error {
+	switch obj.sse {
+	case "", "AES256":
+		if obj.kmsKeyID != "" {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "a KMS key requires server side encryption aws:kms")
+		}
+	case "aws:kms":
+	default:
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid server side encryption %s", obj.sse)
+	}
+	keyMD5, err := customerKey(r, "X-Amz-Server-Side-Encryption-Customer")
+	if err != nil {
+		return err
+	}
+	if keyMD5 != "" && obj.sse != "" {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "server side encryption %s cannot be combined with a customer provided key", obj.sse)
+	}
+	obj.customerKeyMD5 = keyMD5
+	return nil
+}
+
+// customerKey returns the MD5 of the SSE-C key given in the headers with the
+// prefix, or an empty string if none is given
+func customerKey(r *http.Request, prefix string) (string, *s3Error) {
+	algorithm := r.Header.Get(prefix + "-Algorithm")
+	key := r.Header.Get(prefix + "-Key")
+	keyMD5 := r.Header.Get(prefix + "-Key-Md5")
+	if algorithm == "" && key == "" && keyMD5 == "" {
+		return "", nil
+	}
+	if r.TLS == nil {
+		return "", newS3Error(http.StatusBadRequest, "InvalidRequest", "requests specifying server side encryption with customer provided keys must be made over a secure connection")
+	}
+	if algorithm != "AES256" {
+		return "", newS3Error(http.StatusBadRequest, "InvalidEncryptionAlgorithmError", "invalid encryption algorithm %s", algorithm)
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return "", newS3Error(http.StatusBadRequest, "InvalidArgument", "the secret key is invalid for the specified algorithm")
+	}
+	sum := md5.Sum(raw)
+	if encoded := base64.StdEncoding.EncodeToString(sum[:]); keyMD5 != encoded {
+		return "", newS3Error(http.StatusBadRequest, "InvalidArgument", "the MD5 of the key does not match the provided one")
+	}
+	return keyMD5, nil
+}
+
+// checkCustomerKey checks the SSE-C key with the given MD5 is the one obj is
+// encrypted with
+func checkCustomerKey(obj *s3Object, keyMD5 string) *s3Error {
+	switch {
+	case obj.customerKeyMD5 == "" && keyMD5 != "":
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "the object is not encrypted with a customer provided key")
+	case obj.customerKeyMD5 != "" && keyMD5 == "":
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "the object is encrypted with a customer provided key, which must be provided")
+	case obj.customerKeyMD5 != keyMD5:
+		return newS3Error(http.StatusForbidden, "AccessDenied", "the provided key does not match the key of the object")
+	}
+	return nil
+}
+
+// objectLock validates the object lock of obj, which requires a bucket with
+// object lock enabled
+func objectLock(header http.Header, b *s3Bucket, obj *s3Object) *s3Error {
+	until := header.Get("X-Amz-Object-Lock-Retain-Until-Date")
+	if obj.lockMode == "" && until == "" && obj.legalHold == "" {
+		return nil
+	}
+	if !b.objectLock {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "bucket is missing object lock configuration")
+	}
+	if (obj.lockMode == "") != (until == "") {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "object lock mode and retain until date must be given together")
+	}
+	if obj.lockMode != "" {
+		if obj.lockMode != "GOVERNANCE" && obj.lockMode != "COMPLIANCE" {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid object lock mode %s", obj.lockMode)
+		}
+		var err error
+		if obj.retainUntil, err = time.Parse(time.RFC3339, until); err != nil || !obj.retainUntil.After(time.Now()) {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "the retain until date must be in the future")
+		}
+	}
+	if obj.legalHold != "" && obj.legalHold != "ON" && obj.legalHold != "OFF" {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid legal hold status %s", obj.legalHold)
+	}
+	return nil
+}
+
+// writeEncryption writes the headers describing the encryption of obj
+func writeEncryption(w http.ResponseWriter, obj *s3Object) {
+	header := w.Header()
+	if obj.sse != "" {
+		header.Set("X-Amz-Server-Side-Encryption", obj.sse)
+	}
+	if obj.kmsKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", obj.kmsKeyID)
+	}
+	if obj.customerKeyMD5 != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		header.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", obj.customerKeyMD5)
+	}
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+func writeTagging(w http.ResponseWriter, obj *s3Object) *s3Error {
+	var tags []s3Tag
+	for k, v := range obj.tagging {
+		tags = append(tags, s3Tag{Key: k, Value: v[0]})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"Tagging"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Tags    []s3Tag  `xml:"TagSet>Tag"`
+	}{Xmlns: s3Namespace, Tags: tags})
+}
+
+// writeObject writes the object or the requested range of it
+func writeObject(w http.ResponseWriter, r *http.Request, obj *s3Object) *s3Error {
+	header := w.Header()
+	header.Set("ETag", obj.etag)
+	header.Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if obj.contentType != "" {
+		header.Set("Content-Type", obj.contentType)
+	} else {
+		header.Set("Content-Type", "binary/octet-stream")
+	}
+	for k, v := range obj.metadata {
+		header.Set("X-Amz-Meta-"+k, v)
+	}
+	if obj.storageClass != "STANDARD" {
+		header.Set("X-Amz-Storage-Class", obj.storageClass)
+	}
+	if obj.lockMode != "" {
+		header.Set("X-Amz-Object-Lock-Mode", obj.lockMode)
+		header.Set("X-Amz-Object-Lock-Retain-Until-Date", obj.retainUntil.UTC().Format(time.RFC3339))
+	}
+	if obj.legalHold != "" {
+		header.Set("X-Amz-Object-Lock-Legal-Hold", obj.legalHold)
+	}
+	if len(obj.tagging) > 0 {
+		header.Set("X-Amz-Tagging-Count", strconv.Itoa(len(obj.tagging)))
+	}
+	writeEncryption(w, obj)
+	data, status := obj.data, http.StatusOK
+	// Ranges of empty objects are ignored like S3 does
+	if rng := r.Header.Get("Range"); rng != "" && len(obj.data) > 0 {
+		start, end, err := parseRange(rng, int64(len(obj.data)))
+		if err != nil {
+			return err
+		}
+		data, status = obj.data[start:end+1], http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+	return nil
+}
+
+// parseRange parses a single byte range of an object of the given size
+func parseRange(rng string, size int64) (int64, int64, *s3Error) {
+	invalid := newS3Error(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "range %s cannot be satisfied", rng)
+	spec := strings.TrimPrefix(rng, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if spec == rng || len(parts) != 2 {
+		return 0, 0, invalid
+	}
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, invalid
+	}
+	end := size - 1
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < start {
+			return 0, 0, invalid
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+// copySource returns the bucket, key and object of the source of a copy
+func (s *S3Server) copySource(r *http.Request) (*s3Bucket, string, *s3Object, *s3Error) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, "", nil, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid copy source: %v", err)
+	}
+	source = strings.TrimPrefix(source, "/")
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 {
+		return nil, "", nil, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid copy source %s", source)
+	}
+	sb := s.buckets[parts[0]]
+	if sb == nil {
+		return nil, "", nil, newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", parts[0])
+	}
+	src := sb.objects[parts[1]]
+	if src == nil {
+		return nil, "", nil, newS3Error(http.StatusNotFound, "NoSuchKey", "key %s does not exist", parts[1])
+	}
+	sourceKeyMD5, serr := customerKey(r, "X-Amz-Copy-Source-Server-Side-Encryption-Customer")
+	if serr != nil {
+		return nil, "", nil, serr
+	}
+	if serr := checkCustomerKey(src, sourceKeyMD5); serr != nil {
+		return nil, "", nil, serr
+	}
+	return sb, parts[1], src, nil
+}
+
+func (s *S3Server) copyObject(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) *s3Error {
+	sb, sourceKey, src, serr := s.copySource(r)
+	if serr != nil {
+		return serr
+	}
+	obj, serr := objectHeaders(r, b)
+	if serr != nil {
+		return serr
+	}
+	if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		if sb == b && sourceKey == key {
+			return newS3Error(http.StatusBadRequest, "InvalidRequest", "copying an object onto itself requires replacing its metadata")
+		}
+		obj.contentType, obj.metadata = src.contentType, src.metadata
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+		obj.tagging = src.tagging
+	}
+	obj.data, obj.etag, obj.lastModified = src.data, src.etag, s.now()
+	b.objects[key] = obj
+	writeEncryption(w, obj)
+	return writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: obj.etag, LastModified: formatS3Time(obj.lastModified)})
+}
+
+func (s *S3Server) initiateUpload(w http.ResponseWriter, r *http.Request, b *s3Bucket, bucket, key string) *s3Error {
+	obj, err := objectHeaders(r, b)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+	s.uploads[uploadID] = &s3Upload{
+		bucket:    bucket,
+		key:       key,
+		object:    obj,
+		parts:     map[int]*s3Object{},
+		initiated: s.now(),
+	}
+	writeEncryption(w, obj)
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadID, partNumber string) *s3Error {
+	u := s.uploads[uploadID]
+	if u == nil {
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid part number %s", partNumber)
+	}
+	keyMD5, serr := customerKey(r, "X-Amz-Server-Side-Encryption-Customer")
+	if serr != nil {
+		return serr
+	}
+	if keyMD5 != u.object.customerKeyMD5 {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "parts must be encrypted with the key given on initiation of the upload")
+	}
+	// The body is read without holding the lock, so parts are uploaded
+	// concurrently
+	part := &s3Object{}
+	s.mu.Unlock()
+	rerr := readBody(r, part)
+	s.mu.Lock()
+	if rerr != nil {
+		return rerr
+	}
+	if s.uploads[uploadID] != u {
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+	}
+	u.parts[n] = part
+	writeEncryption(w, u.object)
+	w.Header().Set("ETag", part.etag)
+	return nil
+}
+
+// uploadPartCopy copies the range of the source object given in the
+// X-Amz-Copy-Source-Range header into a part
+func (s *S3Server) uploadPartCopy(w http.ResponseWriter, r *http.Request, uploadID, partNumber string) *s3Error {
+	u := s.uploads[uploadID]
+	if u == nil {
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid part number %s", partNumber)
+	}
+	keyMD5, serr := customerKey(r, "X-Amz-Server-Side-Encryption-Customer")
+	if serr != nil {
+		return serr
+	}
+	if keyMD5 != u.object.customerKeyMD5 {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "parts must be encrypted with the key given on initiation of the upload")
+	}
+	_, _, src, serr := s.copySource(r)
+	if serr != nil {
+		return serr
+	}
+	data := src.data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last || last >= len(data) {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid copy source range %s", rng)
+		}
+		data = data[first : last+1]
+	}
+	sum := md5.Sum(data)
+	part := &s3Object{data: append([]byte{}, data...), etag: `"` + hex.EncodeToString(sum[:]) + `"`, lastModified: s.now()}
+	u.parts[n] = part
+	writeEncryption(w, u.object)
+	return writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: part.etag, LastModified: formatS3Time(part.lastModified)})
+}
+
+func (s *S3Server) completeUpload(w http.ResponseWriter, r *http.Request, b *s3Bucket, uploadID string) *s3Error {
+	u := s.uploads[uploadID]
+	if u == nil {
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+	}
+	var body struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+		return newS3Error(http.StatusBadRequest, "MalformedXML", "%v", err)
+	}
+	if len(body.Parts) == 0 {
+		return newS3Error(http.StatusBadRequest, "MalformedXML", "no parts given")
+	}
+	var data bytes.Buffer
+	digests := md5.New()
+	for i, p := range body.Parts {
+		part := u.parts[p.PartNumber]
+		if part == nil || part.etag != p.ETag {
+			return newS3Error(http.StatusBadRequest, "InvalidPart", "part %d has not been uploaded", p.PartNumber)
+		}
+		if i > 0 && p.PartNumber <= body.Parts[i-1].PartNumber {
+			return newS3Error(http.StatusBadRequest, "InvalidPartOrder", "parts are not in ascending order")
+		}
+		if i < len(body.Parts)-1 && int64(len(part.data)) < s.MinPartSize {
+			return newS3Error(http.StatusBadRequest, "EntityTooSmall", "part %d is smaller than %d bytes", p.PartNumber, s.MinPartSize)
+		}
+		data.Write(part.data)
+		sum, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		digests.Write(sum)
+	}
+	obj := u.object
+	obj.data = data.Bytes()
+	obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(digests.Sum(nil)), len(body.Parts))
+	obj.lastModified = s.now()
+	b.objects[u.key] = obj
+	delete(s.uploads, uploadID)
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Xmlns: s3Namespace, Bucket: u.bucket, Key: u.key, ETag: obj.etag})
+}
+
+type s3ListPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int    `xml:"Size"`
+}
+
+// listParts lists all parts of the upload at once
+func (s *S3Server) listParts(w http.ResponseWriter, bucket, key, uploadID string) *s3Error {
+	u := s.uploads[uploadID]
+	if u == nil || u.bucket != bucket || u.key != key {
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", uploadID)
+	}
+	parts := make([]s3ListPart, 0, len(u.parts))
+	for n, part := range u.parts {
+		parts = append(parts, s3ListPart{PartNumber: n, ETag: part.etag, Size: len(part.data)})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name     `xml:"ListPartsResult"`
+		Xmlns    string       `xml:"xmlns,attr"`
+		Bucket   string       `xml:"Bucket"`
+		Key      string       `xml:"Key"`
+		UploadID string       `xml:"UploadId"`
+		Parts    []s3ListPart `xml:"Part"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: uploadID, Parts: parts})
+}
+
+type s3ListUpload struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+func (s *S3Server) listUploads(w http.ResponseWriter, bucket string) *s3Error {
+	var uploads []s3ListUpload
+	for id, u := range s.uploads {
+		if u.bucket == bucket {
+			uploads = append(uploads, s3ListUpload{Key: u.key, UploadID: id, Initiated: formatS3Time(u.initiated)})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Key < uploads[j].Key
+	})
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name       `xml:"ListMultipartUploadsResult"`
+		Xmlns   string         `xml:"xmlns,attr"`
+		Bucket  string         `xml:"Bucket"`
+		Uploads []s3ListUpload `xml:"Upload"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Uploads: uploads})
+}
+
+type s3ListBucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (s *S3Server) listBuckets(w http.ResponseWriter) *s3Error {
+	var buckets []s3ListBucket
+	for name, b := range s.buckets {
+		buckets = append(buckets, s3ListBucket{Name: name, CreationDate: formatS3Time(b.created)})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+		Xmlns   string         `xml:"xmlns,attr"`
+		Buckets []s3ListBucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Buckets: buckets})
+}
+
+type s3ListObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	Contents              []s3ListObject   `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects implements both versions of ListObjects
+func (s *S3Server) listObjects(w http.ResponseWriter, query url.Values, name string, b *s3Bucket) *s3Error {
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %s", v)
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	res := s3ListResult{
+		Xmlns:     s3Namespace,
+		Name:      name,
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		res.StartAfter = query.Get("start-after")
+		after = res.StartAfter
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+			}
+			res.ContinuationToken, after = token, string(decoded)
+		}
+	} else {
+		res.Marker = &after
+	}
+
+	last, count := "", 0
+	seen := map[string]bool{}
+	for _, key := range b.keys() {
+		if !strings.HasPrefix(key, res.Prefix) || key <= after {
+			continue
+		}
+		entry := key
+		if res.Delimiter != "" {
+			if i := strings.Index(key[len(res.Prefix):], res.Delimiter); i >= 0 {
+				entry = key[:len(res.Prefix)+i+len(res.Delimiter)]
+			}
+		}
+		if seen[entry] || (entry != key && entry <= after) {
+			continue
+		}
+		if count == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		if entry != key {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: entry})
+		} else {
+			obj := b.objects[key]
+			res.Contents = append(res.Contents, s3ListObject{
+				Key:          key,
+				LastModified: formatS3Time(obj.lastModified),
+				ETag:         obj.etag,
+				Size:         len(obj.data),
+				StorageClass: obj.storageClass,
+			})
+		}
+		last = entry
+		count++
+	}
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		} else if res.Delimiter != "" {
+			res.NextMarker = last
+		}
+	}
+	if v2 {
+		res.KeyCount = &count
+	}
+	return writeXML(w, http.StatusOK, res)
+}
+
+func formatS3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) *s3Error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return newS3Error(http.StatusInternalServerError, "InternalError", "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+	return nil
+}
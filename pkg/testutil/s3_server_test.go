@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil_test
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/finleap-connect/backup-operator/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("S3Server", func() {
+	var (
+		server *testutil.S3Server
+		client *s3.S3
+	)
+	newClient := func(accessKeyID string) *s3.S3 {
+		sess, err := session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials(accessKeyID, server.SecretAccessKey, ""),
+			Endpoint:         aws.String(server.URL()),
+			Region:           aws.String("us-east-1"),
+			S3ForcePathStyle: aws.Bool(true),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return s3.New(sess)
+	}
+	put := func(key string) {
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(key)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	}
+	BeforeEach(func() {
+		var err error
+		server, err = testutil.NewS3Server()
+		Expect(err).ToNot(HaveOccurred())
+		server.CreateBucket("bucket")
+		client = newClient(server.AccessKeyID)
+	})
+	AfterEach(func() {
+		Expect(server.Close()).To(Succeed())
+	})
+
+	It("should reject unknown access keys", func() {
+		_, err := newClient("unknown").ListBuckets(&s3.ListBucketsInput{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("InvalidAccessKeyId"))
+	})
+	It("should list in pages", func() {
+		for i := 0; i < 5; i++ {
+			put(fmt.Sprintf("a/%d", i))
+			put(fmt.Sprintf("b/%d/c", i))
+		}
+		var keys, prefixes []string
+		Expect(client.ListObjectsPages(&s3.ListObjectsInput{
+			Bucket:    aws.String("bucket"),
+			Prefix:    aws.String("b/"),
+			Delimiter: aws.String("/"),
+			MaxKeys:   aws.Int64(2),
+		}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, p := range page.CommonPrefixes {
+				prefixes = append(prefixes, *p.Prefix)
+			}
+			return true
+		})).To(Succeed())
+		Expect(prefixes).To(Equal([]string{"b/0/", "b/1/", "b/2/", "b/3/", "b/4/"}))
+		Expect(client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket:  aws.String("bucket"),
+			Prefix:  aws.String("a/"),
+			MaxKeys: aws.Int64(2),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+			return true
+		})).To(Succeed())
+		Expect(keys).To(Equal([]string{"a/0", "a/1", "a/2", "a/3", "a/4"}))
+	})
+	It("should reject customer provided keys without TLS", func() {
+		_, err := client.PutObject(&s3.PutObjectInput{
+			Bucket:               aws.String("bucket"),
+			Key:                  aws.String("key"),
+			Body:                 bytes.NewReader(nil),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String(string(bytes.Repeat([]byte{1}, 32))),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(server.Keys("bucket")).To(BeEmpty())
+	})
+	It("should reject incomplete multipart uploads", func() {
+		upload, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String("key"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		parts := []*s3.CompletedPart{}
+		for i := int64(1); i <= 2; i++ {
+			part, err := client.UploadPart(&s3.UploadPartInput{
+				Bucket:     aws.String("bucket"),
+				Key:        aws.String("key"),
+				UploadId:   upload.UploadId,
+				PartNumber: aws.Int64(i),
+				Body:       bytes.NewReader([]byte("small")),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			parts = append(parts, &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(i)})
+		}
+		Expect(server.Uploads("bucket")).To(Equal([]string{"key"}))
+		// All but the last part must have the minimum size
+		_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String("bucket"),
+			Key:             aws.String("key"),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("EntityTooSmall"))
+		_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String("bucket"),
+			Key:      aws.String("key"),
+			UploadId: upload.UploadId,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.Uploads("bucket")).To(BeEmpty())
+		Expect(server.Keys("bucket")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,141 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+
+	"github.com/finleap-connect/backup-operator/pkg/logger"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPServer is an in-process SSH server only offering the sftp subsystem
+type SFTPServer struct {
+	Addr       string
+	User       string
+	HostKey    string // authorized_keys format
+	PrivateKey string // PEM encoded client key
+	listener   net.Listener
+	log        logger.Logger
+}
+
+func NewSFTPServer() (*SFTPServer, error) {
+	hostSigner, _, err := newECDSAKey()
+	if err != nil {
+		return nil, err
+	}
+	clientSigner, clientPEM, err := newECDSAKey()
+	if err != nil {
+		return nil, err
+	}
+	user := "backup"
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == user && string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SFTPServer{
+		Addr:       listener.Addr().String(),
+		User:       user,
+		HostKey:    string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+		PrivateKey: string(clientPEM),
+		listener:   listener,
+		log:        logger.WithName("sftpserver"),
+	}
+	go s.serve(config)
+	return s, nil
+}
+
+func (s *SFTPServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *SFTPServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn, config)
+	}
+}
+
+func (s *SFTPServer) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		s.log.Error(err, "handshake failed")
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			s.log.Error(err, "failed to accept channel")
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+			}
+		}(requests)
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				s.log.Error(err, "failed to start sftp server")
+				return
+			}
+			_ = server.Serve()
+		}()
+	}
+}
+
+func newECDSAKey() (ssh.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2020 Backup Operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ModuleVersion", func() {
+	It("returns version of dependencies", func() {
+		Expect(ModuleVersion("github.com/onsi/gomega")).Should(Equal("v1.20.1"))
+	})
+	It("returns unknown for missing modules", func() {
+		Expect(ModuleVersion("example.com/missing")).Should(Equal(UnknownVersion))
+	})
+})